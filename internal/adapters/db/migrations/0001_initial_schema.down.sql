@@ -0,0 +1,5 @@
+DROP VIEW IF EXISTS order_summary_view;
+DROP TABLE IF EXISTS order_items;
+DROP TABLE IF EXISTS orders;
+DROP TABLE IF EXISTS products;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS stock_transfers;
+DROP TABLE IF EXISTS warehouse_stocks;
+ALTER TABLE products DROP COLUMN IF EXISTS warehouse_id;
+DROP TABLE IF EXISTS warehouses;
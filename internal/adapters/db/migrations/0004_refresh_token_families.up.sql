@@ -0,0 +1,16 @@
+-- One-time-use refresh tokens grouped into families. Tokens are stored as
+-- SHA-256 hashes; existing plaintext tokens are hashed in place and each of
+-- them starts its own family.
+
+ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash;
+UPDATE refresh_tokens SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex');
+
+ALTER TABLE refresh_tokens ADD COLUMN family_id VARCHAR(64);
+UPDATE refresh_tokens SET family_id = 'legacy-' || id;
+ALTER TABLE refresh_tokens ALTER COLUMN family_id SET NOT NULL;
+
+ALTER TABLE refresh_tokens ADD COLUMN used_at TIMESTAMP;
+ALTER TABLE refresh_tokens ADD COLUMN revoked_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_expires_at ON refresh_tokens(expires_at);
@@ -0,0 +1,12 @@
+-- Access tokens carry the token_version of their user and are rejected once
+-- it has been incremented, e.g. after a role change. Single tokens are
+-- revoked through the denylist until they expire.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token_version INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS revoked_access_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_revoked_access_tokens_expires_at ON revoked_access_tokens(expires_at);
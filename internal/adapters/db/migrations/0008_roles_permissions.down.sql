@@ -0,0 +1,11 @@
+ALTER TABLE invitations DROP CONSTRAINT IF EXISTS invitations_role_fkey;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_fkey;
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'user';
+
+-- Only the roles known before this migration survive the rollback
+UPDATE users SET role = 'user' WHERE role <> 'admin';
+UPDATE invitations SET role = 'user' WHERE role <> 'admin';
+
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS permissions;
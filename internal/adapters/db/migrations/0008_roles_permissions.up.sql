@@ -0,0 +1,91 @@
+-- Permission-based access control. Roles map to named permissions; the
+-- permissions of a role are embedded in access tokens and checked per route.
+-- The former "user" role becomes "customer", and roles that were never
+-- assignable through the API fall back to it.
+
+CREATE TABLE IF NOT EXISTS permissions (
+    name VARCHAR(100) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(50) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role VARCHAR(50) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+    permission VARCHAR(100) NOT NULL REFERENCES permissions(name) ON DELETE CASCADE,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO permissions (name, description) VALUES
+    ('orders:create', 'Place, confirm, cancel and delete own orders'),
+    ('orders:read', 'Read own orders'),
+    ('orders:read_all', 'Read the orders of every user'),
+    ('products:write', 'Create, update and delete products'),
+    ('warehouses:read', 'Read warehouses'),
+    ('warehouses:write', 'Create, update and delete warehouses'),
+    ('stock:read', 'Read warehouse stock'),
+    ('stock:adjust', 'Set and add warehouse stock'),
+    ('transfers:create', 'Request stock transfers'),
+    ('transfers:read', 'Read stock transfers'),
+    ('transfers:process', 'Change the status of and process stock transfers'),
+    ('users:read', 'Read users and their sessions'),
+    ('users:manage', 'Change roles, revoke sessions and invite users'),
+    ('roles:manage', 'Create roles and edit their permissions')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO roles (name, description) VALUES
+    ('admin', 'Full access'),
+    ('warehouse_manager', 'Runs the warehouses: stock, transfers and products'),
+    ('warehouse_clerk', 'Checks stock and requests transfers'),
+    ('customer_support', 'Looks up customers and their orders'),
+    ('customer', 'Places orders')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'orders:create'),
+    ('admin', 'orders:read'),
+    ('admin', 'orders:read_all'),
+    ('admin', 'products:write'),
+    ('admin', 'warehouses:read'),
+    ('admin', 'warehouses:write'),
+    ('admin', 'stock:read'),
+    ('admin', 'stock:adjust'),
+    ('admin', 'transfers:create'),
+    ('admin', 'transfers:read'),
+    ('admin', 'transfers:process'),
+    ('admin', 'users:read'),
+    ('admin', 'users:manage'),
+    ('admin', 'roles:manage'),
+    ('warehouse_manager', 'orders:read'),
+    ('warehouse_manager', 'orders:read_all'),
+    ('warehouse_manager', 'products:write'),
+    ('warehouse_manager', 'warehouses:read'),
+    ('warehouse_manager', 'stock:read'),
+    ('warehouse_manager', 'stock:adjust'),
+    ('warehouse_manager', 'transfers:create'),
+    ('warehouse_manager', 'transfers:read'),
+    ('warehouse_manager', 'transfers:process'),
+    ('warehouse_clerk', 'warehouses:read'),
+    ('warehouse_clerk', 'stock:read'),
+    ('warehouse_clerk', 'transfers:create'),
+    ('warehouse_clerk', 'transfers:read'),
+    ('customer_support', 'orders:read'),
+    ('customer_support', 'orders:read_all'),
+    ('customer_support', 'users:read'),
+    ('customer', 'orders:create'),
+    ('customer', 'orders:read')
+ON CONFLICT DO NOTHING;
+
+UPDATE users SET role = 'customer' WHERE role NOT IN (SELECT name FROM roles);
+UPDATE invitations SET role = 'customer' WHERE role NOT IN (SELECT name FROM roles);
+
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'customer';
+ALTER TABLE users ADD CONSTRAINT users_role_fkey FOREIGN KEY (role) REFERENCES roles(name);
+ALTER TABLE invitations ADD CONSTRAINT invitations_role_fkey FOREIGN KEY (role) REFERENCES roles(name) ON DELETE CASCADE;
+
+-- Tokens issued before permissions existed carry none
+UPDATE users SET token_version = token_version + 1;
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE name = 'warehouses:all';
+DROP TABLE IF EXISTS user_warehouses;
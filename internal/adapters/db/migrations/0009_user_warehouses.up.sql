@@ -0,0 +1,23 @@
+-- Warehouse-scoped access. Stock and transfer endpoints only act on the
+-- warehouses a user is assigned to, unless the user's role grants
+-- warehouses:all, which the admin role does.
+
+CREATE TABLE IF NOT EXISTS user_warehouses (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    warehouse_id INTEGER NOT NULL REFERENCES warehouses(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, warehouse_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_warehouses_warehouse_id ON user_warehouses(warehouse_id);
+
+INSERT INTO permissions (name, description) VALUES
+    ('warehouses:all', 'Act on every warehouse, not only the assigned ones')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'warehouses:all')
+ON CONFLICT DO NOTHING;
+
+-- Admin tokens issued so far lack the new permission
+UPDATE users SET token_version = token_version + 1 WHERE role = 'admin';
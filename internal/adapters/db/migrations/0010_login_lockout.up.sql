@@ -0,0 +1,39 @@
+-- Brute-force protection on login. Failed attempts are counted per account
+-- and per source address; crossing the threshold locks the subject for a
+-- delay that doubles with every further failure. Lockouts and unlocks are
+-- written to a general audit log.
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+    scope VARCHAR(20) NOT NULL, -- 'account' or 'ip'
+    subject VARCHAR(255) NOT NULL, -- username or address
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP,
+    PRIMARY KEY (scope, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_last_failure_at ON login_attempts(last_failure_at);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id SERIAL PRIMARY KEY,
+    event VARCHAR(100) NOT NULL,
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    subject VARCHAR(255) NOT NULL DEFAULT '',
+    ip VARCHAR(100) NOT NULL DEFAULT '',
+    details TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);
+
+INSERT INTO permissions (name, description) VALUES
+    ('audit:read', 'Read the audit log')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'audit:read')
+ON CONFLICT DO NOTHING;
+
+-- Admin tokens issued so far lack the new permission
+UPDATE users SET token_version = token_version + 1 WHERE role = 'admin';
@@ -0,0 +1,19 @@
+-- TOTP two-factor authentication. A secret is stored when enrollment starts
+-- and enabled once the user has confirmed a first code. Recovery codes are
+-- single-use and stored as hashes.
+
+CREATE TABLE IF NOT EXISTS user_mfa (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL, -- base32, needed in clear to compute codes
+    enabled_at TIMESTAMP, -- NULL while enrollment is pending
+    last_used_step BIGINT NOT NULL DEFAULT 0, -- codes of this or earlier time steps are rejected
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    UNIQUE (user_id, code_hash)
+);
@@ -0,0 +1,19 @@
+-- Admin user management. Deleting a user only marks the row, so their
+-- orders and the audit trail keep pointing at it. Support staff may act as
+-- another user through short-lived impersonation tokens.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(created_at);
+
+INSERT INTO permissions (name, description) VALUES
+    ('users:impersonate', 'Act as another user through an impersonation token')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'users:impersonate'),
+    ('customer_support', 'users:impersonate')
+ON CONFLICT DO NOTHING;
+
+-- Tokens issued so far lack the new permission
+UPDATE users SET token_version = token_version + 1 WHERE role IN ('admin', 'customer_support');
@@ -0,0 +1,68 @@
+-- Order state machine. Orders move pending → confirmed → picking → packed →
+-- shipped → delivered and may end cancelled or refunded instead. Every status
+-- change is kept in order_status_history together with who made it.
+
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    from_status VARCHAR(50),
+    to_status VARCHAR(50) NOT NULL,
+    changed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history(order_id);
+
+-- The history of existing orders starts with their current status
+UPDATE orders SET status = 'pending' WHERE status IS NULL;
+INSERT INTO order_status_history (order_id, to_status, created_at)
+SELECT o.id, o.status, o.created_at FROM orders o
+WHERE NOT EXISTS (SELECT 1 FROM order_status_history h WHERE h.order_id = o.id);
+
+-- Statuses used to be free-form. Spelling variants are mapped onto the state
+-- machine and anything else is cancelled, which moves no stock; the history
+-- keeps the old status.
+CREATE TEMPORARY TABLE legacy_order_statuses ON COMMIT DROP AS
+SELECT id, status AS from_status,
+    CASE
+        WHEN lower(trim(status)) IN (
+            'pending', 'confirmed', 'picking', 'packed', 'shipped', 'delivered', 'cancelled', 'refunded'
+        ) THEN lower(trim(status))
+        WHEN lower(trim(status)) = 'canceled' THEN 'cancelled'
+        WHEN lower(trim(status)) IN ('completed', 'complete') THEN 'delivered'
+        WHEN lower(trim(status)) IN ('processing', 'approved') THEN 'confirmed'
+        ELSE 'cancelled'
+    END AS to_status
+FROM orders
+WHERE status NOT IN (
+    'pending', 'confirmed', 'picking', 'packed', 'shipped', 'delivered', 'cancelled', 'refunded'
+);
+
+UPDATE orders o SET status = l.to_status
+FROM legacy_order_statuses l WHERE o.id = l.id;
+
+INSERT INTO order_status_history (order_id, from_status, to_status)
+SELECT id, from_status, to_status FROM legacy_order_statuses;
+
+ALTER TABLE orders ALTER COLUMN status SET NOT NULL;
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_status_check;
+ALTER TABLE orders ADD CONSTRAINT orders_status_check CHECK (status IN (
+    'pending', 'confirmed', 'picking', 'packed', 'shipped', 'delivered', 'cancelled', 'refunded'
+));
+
+INSERT INTO permissions (name, description) VALUES
+    ('orders:fulfil', 'Move any order through picking, packing and shipping, or cancel it'),
+    ('orders:refund', 'Refund shipped and delivered orders')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'orders:fulfil'),
+    ('admin', 'orders:refund'),
+    ('warehouse_manager', 'orders:fulfil'),
+    ('warehouse_clerk', 'orders:fulfil'),
+    ('customer_support', 'orders:refund')
+ON CONFLICT DO NOTHING;
+
+-- Tokens issued so far lack the new permissions
+UPDATE users SET token_version = token_version + 1
+WHERE role IN ('admin', 'warehouse_manager', 'warehouse_clerk', 'customer_support');
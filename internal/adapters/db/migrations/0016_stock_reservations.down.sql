@@ -0,0 +1,6 @@
+ALTER TABLE warehouse_stocks DROP CONSTRAINT IF EXISTS chk_warehouse_stocks_in_stock;
+DROP INDEX IF EXISTS idx_orders_status_created_at;
+ALTER TABLE order_items DROP COLUMN IF EXISTS warehouse_id;
+
+-- Nothing releases reservations without the column
+UPDATE warehouse_stocks SET reserved_quantity = 0;
@@ -0,0 +1,16 @@
+-- Stock reservations. Placing an order reserves its items in a warehouse by
+-- raising warehouse_stocks.reserved_quantity; confirming turns the
+-- reservation into a deduction and cancelling releases it. Items of orders
+-- placed before this migration have no warehouse and are taken from stock
+-- when confirmed, as before.
+
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS warehouse_id INTEGER REFERENCES warehouses(id);
+
+-- Finds pending orders whose reservation has expired
+CREATE INDEX IF NOT EXISTS idx_orders_status_created_at ON orders(status, created_at);
+
+-- Stock may never drop below what is reserved. Moving products between
+-- warehouses could leave negative stock behind, which is cleared first.
+UPDATE warehouse_stocks SET quantity = reserved_quantity WHERE quantity < reserved_quantity;
+ALTER TABLE warehouse_stocks DROP CONSTRAINT IF EXISTS chk_warehouse_stocks_in_stock;
+ALTER TABLE warehouse_stocks ADD CONSTRAINT chk_warehouse_stocks_in_stock CHECK (quantity >= reserved_quantity);
@@ -0,0 +1,14 @@
+ALTER TABLE warehouses DROP COLUMN IF EXISTS longitude;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS latitude;
+
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS warehouse_id INTEGER REFERENCES warehouses(id);
+
+-- Items split across warehouses keep the warehouse holding most of them
+UPDATE order_items oi SET warehouse_id = (
+    SELECT a.warehouse_id FROM order_item_allocations a
+    WHERE a.order_item_id = oi.id
+    ORDER BY a.quantity DESC, a.warehouse_id
+    LIMIT 1
+);
+
+DROP TABLE IF EXISTS order_item_allocations;
@@ -0,0 +1,20 @@
+-- Order items may be split across warehouses. Each row takes part of an item
+-- from one warehouse; the allocations of an item add up to its quantity.
+-- Warehouses get an optional location for the closest allocation strategy.
+
+CREATE TABLE IF NOT EXISTS order_item_allocations (
+    id SERIAL PRIMARY KEY,
+    order_item_id INTEGER NOT NULL REFERENCES order_items(id) ON DELETE CASCADE,
+    warehouse_id INTEGER NOT NULL REFERENCES warehouses(id),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    UNIQUE (order_item_id, warehouse_id)
+);
+
+INSERT INTO order_item_allocations (order_item_id, warehouse_id, quantity)
+SELECT id, warehouse_id, quantity FROM order_items WHERE warehouse_id IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE order_items DROP COLUMN IF EXISTS warehouse_id;
+
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS latitude DOUBLE PRECISION;
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS longitude DOUBLE PRECISION;
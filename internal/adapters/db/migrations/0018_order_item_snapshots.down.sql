@@ -0,0 +1,17 @@
+DROP VIEW IF EXISTS order_summary_view;
+ALTER TABLE orders ALTER COLUMN total_amount TYPE DECIMAL(10,2);
+CREATE VIEW order_summary_view AS
+SELECT
+    o.id AS order_id,
+    o.user_id,
+    o.total_amount,
+    o.status,
+    o.created_at,
+    u.username
+FROM orders o
+JOIN users u ON o.user_id = u.id;
+
+ALTER TABLE order_items DROP COLUMN IF EXISTS line_total;
+ALTER TABLE order_items DROP COLUMN IF EXISTS product_description;
+ALTER TABLE order_items DROP COLUMN IF EXISTS product_name;
+ALTER TABLE order_items DROP COLUMN IF EXISTS unit_price;
@@ -0,0 +1,40 @@
+-- Order items keep what the customer was charged: the unit price, the product
+-- name and description, and the line total as they were when the order was
+-- placed. Later product edits no longer change historical orders.
+
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS unit_price DECIMAL(10,2);
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS product_name VARCHAR(255);
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS product_description TEXT;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS line_total DECIMAL(12,2);
+
+-- Earlier items never stored a price; the current product is the best record
+-- left. Their order totals were computed when they were placed and are kept.
+-- Databases created from the old README schema allow NULL descriptions.
+UPDATE order_items oi
+SET unit_price = p.price,
+    product_name = p.name,
+    product_description = COALESCE(p.description, ''),
+    line_total = p.price * oi.quantity
+FROM products p
+WHERE p.id = oi.product_id AND oi.unit_price IS NULL;
+
+ALTER TABLE order_items ALTER COLUMN unit_price SET NOT NULL;
+ALTER TABLE order_items ALTER COLUMN product_name SET NOT NULL;
+ALTER TABLE order_items ALTER COLUMN product_description SET NOT NULL;
+ALTER TABLE order_items ALTER COLUMN product_description SET DEFAULT '';
+ALTER TABLE order_items ALTER COLUMN line_total SET NOT NULL;
+
+-- An order total is the sum of its line totals and must hold as much as one.
+-- The summary view depends on the column and is recreated around the change.
+DROP VIEW IF EXISTS order_summary_view;
+ALTER TABLE orders ALTER COLUMN total_amount TYPE DECIMAL(12,2);
+CREATE VIEW order_summary_view AS
+SELECT
+    o.id AS order_id,
+    o.user_id,
+    o.total_amount,
+    o.status,
+    o.created_at,
+    u.username
+FROM orders o
+JOIN users u ON o.user_id = u.id;
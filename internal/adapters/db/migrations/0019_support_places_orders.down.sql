@@ -0,0 +1 @@
+DELETE FROM role_permissions WHERE role = 'customer_support' AND permission = 'orders:create';
@@ -0,0 +1,10 @@
+-- Impersonation is limited to users whose permissions the impersonator holds
+-- all of. Support staff place orders for customers while acting as them, so
+-- they need the customer's orders:create as well.
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('customer_support', 'orders:create')
+ON CONFLICT DO NOTHING;
+
+-- Tokens issued so far lack the new permission
+UPDATE users SET token_version = token_version + 1 WHERE role = 'customer_support';
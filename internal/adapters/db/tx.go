@@ -0,0 +1,24 @@
+package db
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// InTx runs fn in a transaction begun on q and commits it if fn succeeds,
+// otherwise everything fn wrote is rolled back. Repositories created on tx
+// take part in the same unit of work. When q is itself a transaction, pgx
+// begins a savepoint instead, so the work joins the caller's transaction.
+func InTx(ctx context.Context, q Querier, fn func(tx pgx.Tx) error) error {
+	tx, err := q.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
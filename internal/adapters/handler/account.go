@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/service"
+)
+
+// AccountHandler serves password changes and resets and the activation of
+// accounts
+type AccountHandler struct {
+	accounts *service.AccountService
+}
+
+func NewAccountHandler(accounts *service.AccountService) *AccountHandler {
+	return &AccountHandler{accounts: accounts}
+}
+
+// accountError maps an error of the account service to the client error
+func accountError(c *fiber.Ctx, err error) error {
+	var locked *service.LoginLockedError
+	switch {
+	case errors.As(err, &locked):
+		return tooManyAttempts(c, locked)
+	case errors.Is(err, service.ErrWrongPassword):
+		return apperr.BadRequest(apperr.CodeWrongPassword, "Wrong password")
+	case errors.Is(err, service.ErrWeakPassword):
+		return apperr.BadRequest(apperr.CodeWeakPassword, service.ErrWeakPassword.Error())
+	case errors.Is(err, service.ErrInvalidResetToken):
+		return apperr.BadRequest(apperr.CodeTokenInvalid, "Invalid, used or expired reset token")
+	case errors.Is(err, service.ErrUserNotFound):
+		return apperr.NotFound("User not found")
+	case errors.Is(err, service.ErrLastAdmin):
+		return apperr.Conflict(apperr.CodeLastAdmin, "The last active admin cannot be deactivated")
+	case errors.Is(err, service.ErrUserDeleted):
+		return apperr.Conflict(apperr.CodeAccountInactive, "User is deleted")
+	}
+	return err
+}
+
+// ChangePassword godoc
+// @Summary Change password
+// @Description Set a new password after checking the current one. Every other session is signed out and all access tokens are revoked; refresh the current session for a new access token. Wrong passwords count as failed logins.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body models.ChangePasswordRequest true "Current and new password"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 429 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/password [put]
+func (h *AccountHandler) ChangePassword(c *fiber.Ctx) error {
+	var req models.ChangePasswordRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+	userID := c.Locals("user_id").(int)
+	sessionID, _ := c.Locals("session_id").(string)
+
+	if err := h.accounts.ChangePassword(userID, sessionID, req.CurrentPassword, req.NewPassword, c.IP()); err != nil {
+		return accountError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Password changed, other sessions signed out"})
+}
+
+// ForgotPassword godoc
+// @Summary Request a password reset
+// @Description Send a single-use reset token to the user through the configured notifier. The answer is the same whether or not the user exists.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body models.ForgotPasswordRequest true "Username"
+// @Success 202 {object} map[string]string
+// @Failure 400 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/password/forgot [post]
+func (h *AccountHandler) ForgotPassword(c *fiber.Ctx) error {
+	var req models.ForgotPasswordRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	if err := h.accounts.RequestReset(req.Username); err != nil {
+		return err
+	}
+
+	return c.Status(202).JSON(fiber.Map{"message": "If the account exists, a reset token has been sent"})
+}
+
+// ResetPassword godoc
+// @Summary Reset password
+// @Description Set a new password with a reset token. The token works once, every session of the user is signed out and a login lockout is lifted.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body models.ResetPasswordRequest true "Reset token and new password"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/password/reset [post]
+func (h *AccountHandler) ResetPassword(c *fiber.Ctx) error {
+	var req models.ResetPasswordRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	if err := h.accounts.ResetPassword(req.Token, req.NewPassword, c.IP()); err != nil {
+		return accountError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Password reset, please log in"})
+}
+
+// DeactivateAccount godoc
+// @Summary Deactivate own account
+// @Description Deactivate the account of the current user after checking their password and sign out every session. Only an admin can activate it again.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body models.DeactivateAccountRequest true "Password"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 429 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/deactivate [post]
+func (h *AccountHandler) DeactivateAccount(c *fiber.Ctx) error {
+	var req models.DeactivateAccountRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+	userID := c.Locals("user_id").(int)
+
+	if err := h.accounts.Deactivate(userID, req.Password, c.IP()); err != nil {
+		return accountError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Account deactivated"})
+}
+
+// ActivateUser godoc
+// @Summary Activate a user
+// @Description Allow a deactivated user to log in again. Requires the users:manage permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/users/{id}/activate [post]
+func (h *AccountHandler) ActivateUser(c *fiber.Ctx) error {
+	return h.setActive(c, true)
+}
+
+// DeactivateUser godoc
+// @Summary Deactivate a user
+// @Description Stop a user from logging in, sign out every session and revoke their access tokens. The last active admin cannot be deactivated. Requires the users:manage permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/users/{id}/deactivate [post]
+func (h *AccountHandler) DeactivateUser(c *fiber.Ctx) error {
+	return h.setActive(c, false)
+}
+
+func (h *AccountHandler) setActive(c *fiber.Ctx, active bool) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid user ID")
+	}
+	adminID := c.Locals("user_id").(int)
+
+	if err := h.accounts.SetActive(userID, active, adminID, c.IP()); err != nil {
+		return accountError(c, err)
+	}
+
+	if active {
+		return c.JSON(fiber.Map{"message": "User activated"})
+	}
+	return c.JSON(fiber.Map{"message": "User deactivated"})
+}
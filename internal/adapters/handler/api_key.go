@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+	"github.com/slmbngl/OrderAplication/internal/service"
+)
+
+// APIKeyHandler lets admins manage the API keys of integrations
+type APIKeyHandler struct {
+	apiKeys *service.APIKeyService
+}
+
+func NewAPIKeyHandler(apiKeys *service.APIKeyService) *APIKeyHandler {
+	return &APIKeyHandler{apiKeys: apiKeys}
+}
+
+// CreateAPIKey godoc
+// @Summary Create an API key (Admin only)
+// @Description Create a key that calls the warehouse, stock and transfer endpoints as the given user, sent in the X-API-Key header. It is limited to its scopes, which must be granted by the user's role. The key is only returned by this call. Requires the api_keys:manage permission.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param key body models.CreateAPIKeyRequest true "API key data"
+// @Success 201 {object} models.CreateAPIKeyResponse
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/api-keys [post]
+func (h *APIKeyHandler) CreateAPIKey(c *fiber.Ctx) error {
+	var req models.CreateAPIKeyRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			return apperr.InvalidInput("expires_in must be a duration such as 2160h")
+		}
+		ttl = d
+	}
+
+	adminID := c.Locals("user_id").(int)
+	key, secret, err := h.apiKeys.Create(req.UserID, req.Name, req.Scopes, ttl, adminID, c.IP())
+	switch {
+	case errors.Is(err, service.ErrInvalidAPIKeyName):
+		return apperr.InvalidInput("name must be 1 to 100 characters")
+	case errors.Is(err, service.ErrInvalidAPIKeyTTL):
+		return apperr.InvalidInput("expires_in must be positive and at most 8760h")
+	case errors.Is(err, service.ErrNoScopes):
+		return apperr.InvalidInput("At least one scope is required")
+	case errors.Is(err, service.ErrUnknownPermission):
+		return apperr.InvalidInput("Unknown scope")
+	case errors.Is(err, service.ErrScopeNotGranted):
+		return apperr.InvalidInput("Scopes must be granted by the user's role")
+	case errors.Is(err, service.ErrUserNotFound):
+		return apperr.NotFound("User not found")
+	case err != nil:
+		return err
+	}
+
+	return c.Status(201).JSON(models.CreateAPIKeyResponse{APIKey: *key, Key: secret})
+}
+
+// ListAPIKeys godoc
+// @Summary List API keys (Admin only)
+// @Description List every API key including revoked and expired ones, newest first. Keys are not included, only their prefixes. Requires the api_keys:manage permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.APIKey
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/api-keys [get]
+func (h *APIKeyHandler) ListAPIKeys(c *fiber.Ctx) error {
+	keys, err := h.apiKeys.List()
+	if err != nil {
+		return err
+	}
+	return c.JSON(keys)
+}
+
+// RevokeAPIKey godoc
+// @Summary Revoke an API key (Admin only)
+// @Description Stop an API key from working at once. Requires the api_keys:manage permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "API key ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/api-keys/{id} [delete]
+func (h *APIKeyHandler) RevokeAPIKey(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid API key ID")
+	}
+
+	adminID := c.Locals("user_id").(int)
+	err = h.apiKeys.Revoke(id, adminID, c.IP())
+	var notFound *repository.APIKeyNotFoundError
+	if errors.As(err, &notFound) {
+		return apperr.NotFound("API key not found or already revoked")
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"message": "API key revoked successfully"})
+}
@@ -1,45 +1,108 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/config"
 	"github.com/slmbngl/OrderAplication/internal/models"
 	"github.com/slmbngl/OrderAplication/internal/repository"
 	"github.com/slmbngl/OrderAplication/internal/service"
 )
 
+// AuthHandler serves the authentication and user administration endpoints
+type AuthHandler struct {
+	users         repository.UserRepository
+	tokens        *service.TokenService
+	refreshTokens *service.RefreshTokenService
+	revocations   *service.RevocationService
+	roles         *service.RoleService
+	lockout       *service.LockoutService
+	mfa           *service.MFAService
+	accounts      *service.AccountService
+	passwords     service.PasswordHasher
+	// dummyHash is verified against when there is no usable account, so
+	// failed logins take as long whether or not the username exists
+	dummyHash string
+}
+
+func NewAuthHandler(users repository.UserRepository, tokens *service.TokenService,
+	refreshTokens *service.RefreshTokenService, revocations *service.RevocationService,
+	roles *service.RoleService, lockout *service.LockoutService, mfa *service.MFAService,
+	accounts *service.AccountService, passwords service.PasswordHasher) *AuthHandler {
+	dummyHash, err := passwords.Hash("login-timing-dummy-password")
+	if err != nil {
+		slog.Warn("could not create the dummy password hash", "error", err)
+	}
+	return &AuthHandler{
+		users:         users,
+		tokens:        tokens,
+		refreshTokens: refreshTokens,
+		revocations:   revocations,
+		roles:         roles,
+		lockout:       lockout,
+		mfa:           mfa,
+		accounts:      accounts,
+		passwords:     passwords,
+		dummyHash:     dummyHash,
+	}
+}
+
+// issueAccessToken creates an access token carrying the current permissions
+// of the user's role
+func (h *AuthHandler) issueAccessToken(user *models.User, sessionID string) (string, error) {
+	permissions, err := h.roles.Permissions(user.Role)
+	if err != nil {
+		return "", err
+	}
+	return h.tokens.GenerateAccessToken(user.ID, user.Role, permissions, user.TokenVersion, sessionID)
+}
+
 // Register godoc
 // @Summary Register a new user
-// @Description Create a new user account
+// @Description Create a new user account with the "customer" role. Other roles are granted through invitations.
 // @Tags auth
 // @Accept json
 // @Produce json
-// @Param user body models.UserRegisterResponseReq true "User registration data"
-// @Success 200 {object} models.User
-// @Failure 400 {string} string "Invalid input"
-// @Failure 500 {string} string "Internal server error"
+// @Param user body models.RegisterRequest true "User registration data"
+// @Success 201 {object} models.User
+// @Failure 400 {object} apperr.Problem "Invalid input"
+// @Failure 409 {object} apperr.Problem "Username already taken"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/auth/register [post]
-func Register(c *fiber.Ctx) error {
-	var req models.UserRegisterResponseReq
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Geçersiz giriş"})
+func (h *AuthHandler) Register(c *fiber.Ctx) error {
+	var req models.RegisterRequest
+	if err := bind(c, &req); err != nil {
+		return err
 	}
 
-	hashedPassword := service.HashPassword(req.Password)
+	hashedPassword, err := h.passwords.Hash(req.Password)
+	if err != nil {
+		return err
+	}
 
+	if _, err := h.users.GetByUsername(req.Username); err == nil {
+		return apperr.Conflict(apperr.CodeAlreadyExists, "Username already taken")
+	}
+
+	// Self-registration never grants more than the default role
 	user := &models.User{
 		Username:     req.Username,
 		PasswordHash: hashedPassword,
 		IsActive:     true,
-		Role:         req.Role,
+		Role:         models.RoleCustomer,
 	}
 
-	userRepo := repository.NewUserRepository()
-	createdUser, err := userRepo.Create(user)
+	createdUser, err := h.users.Create(user)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Registration failed: " + err.Error()})
+		return err
 	}
 
 	createdUser.PasswordHash = ""
@@ -49,89 +112,145 @@ func Register(c *fiber.Ctx) error {
 
 // Login godoc
 // @Summary Login user
-// @Description Authenticate user and return JWT token
+// @Description Authenticate user and return JWT token. Users with two-factor authentication, or whose role requires it, get an MFA challenge token instead, to be completed at /api/auth/mfa/verify or, if MFA is not set up yet, through enrollment. Repeated failures lock the account and the source address out for a delay that doubles with every further failure.
 // @Tags auth
 // @Accept json
 // @Produce json
 // @Param user body models.UserLoginResponseReq true "User login credentials"
-// @Success 200 {object} map[string]string
-// @Failure 400 {string} string "Invalid input"
-// @Failure 401 {string} string "Invalid username or password"
-// @Failure 500 {string} string "Token could not be created"
+// @Success 200 {object} map[string]interface{} "Access and refresh token, or an MFA challenge"
+// @Failure 400 {object} apperr.Problem "Invalid input"
+// @Failure 401 {object} apperr.Problem "Invalid username or password"
+// @Failure 429 {object} apperr.Problem "Too many failed attempts, see the Retry-After header"
+// @Failure 500 {object} apperr.Problem "Token could not be created"
 // @Router /api/auth/login [post]
-func Login(c *fiber.Ctx) error {
+func (h *AuthHandler) Login(c *fiber.Ctx) error {
 	var req models.UserLoginResponseReq
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	if err := bind(c, &req); err != nil {
+		return err
 	}
 
-	userRepo := repository.NewUserRepository()
-	dbUser, err := userRepo.GetByUsername(req.Username)
+	// Locked accounts and addresses are refused before the password is checked
+	if err := h.lockout.Check(req.Username, c.IP()); err != nil {
+		var locked *service.LoginLockedError
+		if errors.As(err, &locked) {
+			return tooManyAttempts(c, locked)
+		}
+		return err
+	}
+
+	dbUser, err := h.users.GetByUsername(req.Username)
 	if err != nil || !dbUser.IsActive {
-		return c.Status(401).JSON(fiber.Map{"error": "Invalid username or password"})
+		// Spend the time a password check takes, so the response does not
+		// tell which usernames exist
+		h.passwords.Verify(req.Password, h.dummyHash)
+		return h.loginFailed(c, req.Username, nil)
 	}
 
-	if service.HashPassword(req.Password) != dbUser.PasswordHash {
-		return c.Status(401).JSON(fiber.Map{"error": "Invalid username or password"})
+	ok, err := h.passwords.Verify(req.Password, dbUser.PasswordHash)
+	if err != nil || !ok {
+		return h.loginFailed(c, req.Username, &dbUser.ID)
+	}
+
+	// Upgrade hashes from older algorithms or parameters while the plain
+	// password is at hand; a failure here must not block the login
+	if h.passwords.NeedsRehash(dbUser.PasswordHash) {
+		if newHash, err := h.passwords.Hash(req.Password); err == nil {
+			if err := h.users.UpdatePasswordHash(dbUser.ID, newHash); err != nil {
+				slog.Warn("password rehash failed", "user_id", dbUser.ID, "error", err)
+			}
+		}
 	}
 
-	// create Access Token (15 minutes)
-	accessToken, err := service.GenerateAccessToken(dbUser.ID, dbUser.Role)
+	// The password alone is not enough once MFA is enabled or required
+	mfaEnabled, err := h.mfa.Enabled(dbUser.ID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Access token could not be created"})
+		return err
+	}
+	if mfaEnabled || h.mfa.Required(dbUser.Role) {
+		challenge, err := h.mfa.Challenge(dbUser, req.DeviceLabel)
+		if err != nil {
+			return err
+		}
+		return c.JSON(fiber.Map{
+			"mfa_required":            true,
+			"mfa_enrollment_required": !mfaEnabled,
+			"mfa_token":               challenge,
+			"expires_in":              int(h.mfa.ChallengeDuration().Seconds()),
+		})
 	}
 
-	// create Refresh token (7 days)
-	refreshToken, err := service.GenerateRefreshToken()
+	return h.completeLogin(c, dbUser, req.DeviceLabel, nil)
+}
+
+// completeLogin starts a session for an authenticated user and answers with
+// its tokens plus the fields of extra
+func (h *AuthHandler) completeLogin(c *fiber.Ctx, user *models.User, deviceLabel string, extra fiber.Map) error {
+	if err := h.lockout.RecordSuccess(user.Username); err != nil {
+		slog.Warn("failed login attempts could not be reset", "user_id", user.ID, "error", err)
+	}
+
+	// create Refresh token, starting a new session for this login
+	grant, err := h.refreshTokens.Issue(user.ID, clientInfo(c, deviceLabel))
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Refresh token could not be created"})
+		return err
 	}
 
-	// save refresh token to database
-	expiresAt := time.Now().Add(service.RefreshTokenDuration)
-	err = userRepo.SaveRefreshToken(dbUser.ID, refreshToken, expiresAt)
+	// create Access Token
+	accessToken, err := h.issueAccessToken(user, grant.SessionID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Refresh token could not be saved"})
+		return err
 	}
 
-	return c.JSON(fiber.Map{
+	response := fiber.Map{
 		"access_token":  accessToken,
-		"refresh_token": refreshToken,
+		"refresh_token": grant.Token,
 		"token_type":    "Bearer",
-		"expires_in":    int(service.AccessTokenDuration.Seconds()), // 900 seconds (15 minutes)
+		"expires_in":    int(h.tokens.AccessTokenDuration().Seconds()),
 		"user": fiber.Map{
-			"id":       dbUser.ID,
-			"username": dbUser.Username,
-			"role":     dbUser.Role,
+			"id":       user.ID,
+			"username": user.Username,
+			"role":     user.Role,
 		},
-	})
+	}
+	for key, value := range extra {
+		response[key] = value
+	}
+	return c.JSON(response)
 }
 
-// GetAllUsers godoc
-// @Summary Get all users (Admin only)
-// @Description Get list of all users
-// @Tags admin
-// @Accept json
-// @Produce json
-// @Security BearerAuth
-// @Success 200 {array} models.User
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 403 {string} string "Forbidden"
-// @Failure 500 {string} string "Internal server error"
-// @Router /api/admin/users [get]
-func GetAllUsers(c *fiber.Ctx) error {
-	userRepo := repository.NewUserRepository()
-	users, err := userRepo.GetAllUsers()
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+// loginFailed counts a failed login and answers it
+func (h *AuthHandler) loginFailed(c *fiber.Ctx, username string, userID *int) error {
+	if err := h.lockout.RecordFailure(username, c.IP(), userID); err != nil {
+		slog.Error("failed login could not be recorded", "username", username, "error", err)
 	}
+	return apperr.Unauthorized(apperr.CodeInvalidCredentials, "Invalid username or password")
+}
 
-	return c.JSON(users)
+func tooManyAttempts(c *fiber.Ctx, locked *service.LoginLockedError) error {
+	retryAfter := int(math.Ceil(time.Until(locked.Until).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	return apperr.New(fiber.StatusTooManyRequests, apperr.CodeLoginLocked, "Too many failed login attempts, try again later").
+		With("retry_after", retryAfter)
+}
+
+// JWKS godoc
+// @Summary JSON Web Key Set
+// @Description Public keys for verifying access tokens, identified by the kid header. Empty when tokens are signed with HS256.
+// @Tags auth
+// @Produce json
+// @Success 200 {object} service.JWKS
+// @Router /.well-known/jwks.json [get]
+func (h *AuthHandler) JWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int(config.JWKSMaxAge.Seconds())))
+	return c.JSON(h.tokens.Keys().JWKS())
 }
 
 // UpdateUserRole godoc
 // @Summary Update user role (Admin only)
-// @Description Update a user's role
+// @Description Update a user's role to one whose permissions the caller all holds
 // @Tags admin
 // @Accept json
 // @Produce json
@@ -139,48 +258,46 @@ func GetAllUsers(c *fiber.Ctx) error {
 // @Param id path int true "User ID"
 // @Param role body models.UpdateUserRoleRequest true "Role data"
 // @Success 200 {object} map[string]string
-// @Failure 400 {string} string "Bad request"
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 403 {string} string "Forbidden"
-// @Failure 404 {string} string "User not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apperr.Problem "Bad request"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 403 {object} apperr.Problem "Forbidden, or the role grants permissions the caller lacks"
+// @Failure 404 {object} apperr.Problem "User not found"
+// @Failure 409 {object} apperr.Problem "The last active admin cannot lose the admin role"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/admin/users/{id}/role [put]
-func UpdateUserRole(c *fiber.Ctx) error {
+func (h *AuthHandler) UpdateUserRole(c *fiber.Ctx) error {
 	userIDStr := c.Params("id")
 	userID, err := strconv.Atoi(userIDStr)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid user ID"})
+		return apperr.InvalidInput("Invalid user ID")
 	}
 
-	var roleReq map[string]string
-	if err := c.BodyParser(&roleReq); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid data"})
+	var roleReq models.UpdateUserRoleRequest
+	if err := bind(c, &roleReq); err != nil {
+		return err
 	}
+	role := roleReq.Role
 
-	role, exists := roleReq["role"]
-	if !exists {
-		return c.Status(400).JSON(fiber.Map{"error": "Role is required"})
+	known, err := h.roles.Exists(role)
+	if err != nil {
+		return err
 	}
-
-	validRoles := map[string]bool{
-		"user":  true,
-		"admin": true,
+	if !known {
+		return apperr.InvalidInput("Invalid role")
 	}
 
-	if !validRoles[role] {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid role"})
-	}
-
-	userRepo := repository.NewUserRepository()
-
-	_, err = userRepo.GetByID(userID)
-	if err != nil {
-		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
-	}
-
-	err = userRepo.UpdateUserRole(userID, role)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	err = h.accounts.ChangeRole(userID, role, granted(c))
+	switch {
+	case errors.Is(err, service.ErrUserNotFound):
+		return apperr.NotFound("User not found")
+	case errors.Is(err, service.ErrRoleNotFound):
+		return apperr.InvalidInput("Invalid role")
+	case errors.Is(err, service.ErrGrantBroader):
+		return apperr.Forbidden(apperr.CodeGrantNotAllowed, "You cannot grant a role with permissions you do not have")
+	case errors.Is(err, service.ErrLastAdmin):
+		return apperr.Conflict(apperr.CodeLastAdmin, "The last active admin cannot lose the admin role")
+	case err != nil:
+		return err
 	}
 
 	return c.JSON(fiber.Map{"message": "User role updated successfully"})
@@ -194,10 +311,10 @@ func UpdateUserRole(c *fiber.Ctx) error {
 // @Produce json
 // @Security BearerAuth
 // @Success 200 {object} models.User
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 404 {string} string "User not found"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 404 {object} apperr.Problem "User not found"
 // @Router /api/auth/profile [get]
-func GetMe(c *fiber.Ctx) error {
+func (h *AuthHandler) GetMe(c *fiber.Ctx) error {
 	// Assuming user ID is stored in locals by JWT middleware as "user_id"
 	userIDVal := c.Locals("user_id")
 	userID, ok := userIDVal.(int)
@@ -205,19 +322,18 @@ func GetMe(c *fiber.Ctx) error {
 		// Try to convert from string if middleware stores as string
 		userIDStr, ok := userIDVal.(string)
 		if !ok {
-			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+			return apperr.Unauthorized(apperr.CodeUnauthorized, "Unauthorized")
 		}
 		id, err := strconv.Atoi(userIDStr)
 		if err != nil {
-			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+			return apperr.Unauthorized(apperr.CodeUnauthorized, "Unauthorized")
 		}
 		userID = id
 	}
 
-	userRepo := repository.NewUserRepository()
-	user, err := userRepo.GetByID(userID)
+	user, err := h.users.GetByID(userID)
 	if err != nil {
-		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+		return apperr.NotFound("User not found")
 	}
 
 	return c.JSON(user)
@@ -225,119 +341,118 @@ func GetMe(c *fiber.Ctx) error {
 
 // RefreshToken godoc
 // @Summary Refresh access token
-// @Description Generate a new access token using refresh token
+// @Description Exchange a refresh token for a new access token and a new refresh token. Every refresh token can be used once; presenting a used token again revokes all tokens of that login.
 // @Tags auth
 // @Accept json
 // @Produce json
 // @Param refresh_token body models.RefreshTokenRequest true "Refresh token data"
-// @Success 200 {object} map[string]interface{} "New access token"
-// @Failure 400 {string} string "Invalid input"
-// @Failure 401 {string} string "Invalid or expired refresh token"
-// @Failure 500 {string} string "Access token could not be created"
+// @Success 200 {object} map[string]interface{} "New access and refresh token"
+// @Failure 400 {object} apperr.Problem "Invalid input"
+// @Failure 401 {object} apperr.Problem "Invalid, expired or reused refresh token"
+// @Failure 500 {object} apperr.Problem "Access token could not be created"
 // @Router /api/auth/refresh [post]
-func RefreshToken(c *fiber.Ctx) error {
-	var req map[string]string
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
-	}
-
-	refreshToken, exists := req["refresh_token"]
-	if !exists {
-		return c.Status(400).JSON(fiber.Map{"error": "Refresh token is required"})
+func (h *AuthHandler) RefreshToken(c *fiber.Ctx) error {
+	var req models.RefreshTokenRequest
+	if err := bind(c, &req); err != nil {
+		return err
 	}
 
-	userRepo := repository.NewUserRepository()
-
-	// Get the refresh token from the database
-	storedToken, err := userRepo.GetRefreshToken(refreshToken)
-	if err != nil {
-		return c.Status(401).JSON(fiber.Map{"error": "Invalid refresh token"})
-	}
-
-	// Check token expiration
-	if time.Now().After(storedToken.ExpiresAt) {
-		// Delete expired token
-		userRepo.DeleteRefreshToken(refreshToken)
-		return c.Status(401).JSON(fiber.Map{"error": "Refresh token expired"})
+	// Consume the refresh token and get its successor
+	grant, err := h.refreshTokens.Rotate(req.RefreshToken, clientInfo(c, ""))
+	switch {
+	case errors.Is(err, service.ErrRefreshTokenExpired):
+		return apperr.Unauthorized(apperr.CodeTokenInvalid, "Refresh token expired")
+	case errors.Is(err, service.ErrRefreshTokenReused):
+		return apperr.Unauthorized(apperr.CodeTokenRevoked, "Refresh token was already used, please log in again")
+	case errors.Is(err, service.ErrInvalidRefreshToken):
+		return apperr.Unauthorized(apperr.CodeTokenInvalid, "Invalid refresh token")
+	case err != nil:
+		return err
 	}
 
 	// Get user information
-	user, err := userRepo.GetByID(storedToken.UserID)
+	user, err := h.users.GetByID(grant.UserID)
 	if err != nil {
-		return c.Status(401).JSON(fiber.Map{"error": "User not found"})
+		return apperr.Unauthorized(apperr.CodeTokenInvalid, "User not found")
 	}
 
 	// Get detailed user information (for role)
-	dbUser, err := userRepo.GetByUsername(user.Username)
+	dbUser, err := h.users.GetByUsername(user.Username)
 	if err != nil {
-		return c.Status(401).JSON(fiber.Map{"error": "User not found"})
+		return apperr.Unauthorized(apperr.CodeTokenInvalid, "User not found")
 	}
 
 	// Create new access token
-	newAccessToken, err := service.GenerateAccessToken(dbUser.ID, dbUser.Role)
+	newAccessToken, err := h.issueAccessToken(dbUser, grant.SessionID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Access token could not be created"})
+		return err
 	}
 
 	return c.JSON(fiber.Map{
-		"access_token": newAccessToken,
-		"token_type":   "Bearer",
-		"expires_in":   int(service.AccessTokenDuration.Seconds()),
+		"access_token":  newAccessToken,
+		"refresh_token": grant.Token,
+		"token_type":    "Bearer",
+		"expires_in":    int(h.tokens.AccessTokenDuration().Seconds()),
 	})
 }
 
 // Logout godoc
 // @Summary Logout user
-// @Description Logout user by invalidating refresh token
+// @Description Logout user by invalidating refresh token. The access token sent in the Authorization header, if any, is revoked as well.
 // @Tags auth
 // @Accept json
 // @Produce json
 // @Param refresh_token body models.LogoutRequest true "Refresh token data"
 // @Success 200 {object} map[string]string "Success message"
-// @Failure 400 {string} string "Invalid input"
+// @Failure 400 {object} apperr.Problem "Invalid input"
 // @Router /api/auth/logout [post]
-func Logout(c *fiber.Ctx) error {
-	var req map[string]string
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+func (h *AuthHandler) Logout(c *fiber.Ctx) error {
+	var req models.LogoutRequest
+	if err := bind(c, &req); err != nil {
+		return err
 	}
 
-	refreshToken, exists := req["refresh_token"]
-	if !exists {
-		return c.Status(400).JSON(fiber.Map{"error": "Refresh token is required"})
-	}
-
-	userRepo := repository.NewUserRepository()
-
-	// Delete refresh token
-	err := userRepo.DeleteRefreshToken(refreshToken)
+	// Revoke every refresh token of this login
+	err := h.refreshTokens.Revoke(req.RefreshToken)
 	if err != nil {
 		// Even if there's an error, we return success (token may already be gone)
 	}
 
+	// Revoke the access token too, so it cannot be used until it expires
+	if bearer := c.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+		if claims, err := h.tokens.ParseAccessToken(strings.TrimPrefix(bearer, "Bearer ")); err == nil {
+			if err := h.revocations.Revoke(claims); err != nil {
+				return err
+			}
+		}
+	}
+
 	return c.JSON(fiber.Map{"message": "Successfully logged out"})
 }
 
 // LogoutAllDevices godoc
 // @Summary Logout from all devices
-// @Description Logout user from all devices by invalidating all refresh tokens
+// @Description Logout user from all devices by invalidating all refresh tokens and access tokens
 // @Tags auth
 // @Accept json
 // @Produce json
 // @Security BearerAuth
 // @Success 200 {object} models.LogoutRequest "Success message"
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 500 {string} string "Logout failed"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 500 {object} apperr.Problem "Logout failed"
 // @Router /api/auth/logout-all [post]
-func LogoutAllDevices(c *fiber.Ctx) error {
+func (h *AuthHandler) LogoutAllDevices(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(int)
 
-	userRepo := repository.NewUserRepository()
-
 	// Delete all refresh tokens for the user
-	err := userRepo.DeleteUserRefreshTokens(userID)
+	err := h.refreshTokens.RevokeAll(userID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Logout failed"})
+		return err
+	}
+
+	// and invalidate the access tokens still in circulation
+	if err := h.revocations.RevokeUser(userID); err != nil {
+		return err
 	}
 
 	return c.JSON(fiber.Map{"message": "Successfully logged out from all devices"})
@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/validation"
+)
+
+// bind parses the request body into req, a pointer to a request struct, and
+// checks its validate tags. Invalid fields are listed in the errors member
+// of the problem.
+func bind(c *fiber.Ctx, req any) error {
+	if err := c.BodyParser(req); err != nil {
+		return apperr.InvalidInput("Malformed request body")
+	}
+
+	err := validation.Struct(req)
+	var invalid validation.Errors
+	if errors.As(err, &invalid) {
+		return apperr.InvalidInput("Request validation failed").With("errors", invalid)
+	}
+	return err
+}
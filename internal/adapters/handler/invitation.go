@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+	"github.com/slmbngl/OrderAplication/internal/service"
+)
+
+// InvitationHandler lets admins invite users with a role and serves the
+// sign-up with an invite code
+type InvitationHandler struct {
+	invitations *service.InvitationService
+}
+
+func NewInvitationHandler(invitations *service.InvitationService) *InvitationHandler {
+	return &InvitationHandler{invitations: invitations}
+}
+
+// CreateInvitation godoc
+// @Summary Create an invitation (Admin only)
+// @Description Create a single-use invite code that signs up a user with the given role, whose permissions the caller must all hold. The code is only returned by this call.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param invitation body models.CreateInvitationRequest true "Invitation data"
+// @Success 201 {object} models.CreateInvitationResponse
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/invitations [post]
+func (h *InvitationHandler) CreateInvitation(c *fiber.Ctx) error {
+	var req models.CreateInvitationRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			return apperr.InvalidInput("expires_in must be a duration such as 72h")
+		}
+		ttl = d
+	}
+
+	adminID := c.Locals("user_id").(int)
+	invitation, code, err := h.invitations.Create(req.Role, adminID, granted(c), ttl)
+	switch {
+	case errors.Is(err, service.ErrInvalidRole):
+		return apperr.InvalidInput("Invalid role")
+	case errors.Is(err, service.ErrGrantBroader):
+		return apperr.Forbidden(apperr.CodeGrantNotAllowed, "You cannot invite to a role with permissions you do not have")
+	case errors.Is(err, service.ErrInvalidTTL):
+		return apperr.InvalidInput("expires_in must be positive and at most 720h")
+	case err != nil:
+		return err
+	}
+
+	return c.Status(201).JSON(models.CreateInvitationResponse{Invitation: *invitation, Code: code})
+}
+
+// ListInvitations godoc
+// @Summary List invitations (Admin only)
+// @Description List every invitation, newest first. Codes are not included.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.Invitation
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/invitations [get]
+func (h *InvitationHandler) ListInvitations(c *fiber.Ctx) error {
+	invitations, err := h.invitations.List()
+	if err != nil {
+		return err
+	}
+	return c.JSON(invitations)
+}
+
+// RevokeInvitation godoc
+// @Summary Revoke an invitation (Admin only)
+// @Description Delete an invitation so its code can no longer be used
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Invitation ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/invitations/{id} [delete]
+func (h *InvitationHandler) RevokeInvitation(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid invitation ID")
+	}
+
+	err = h.invitations.Revoke(id)
+	var notFound *repository.InvitationNotFoundError
+	if errors.As(err, &notFound) {
+		return apperr.NotFound("Invitation not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"message": "Invitation revoked successfully"})
+}
+
+// AcceptInvitation godoc
+// @Summary Sign up with an invite code
+// @Description Create an account with the role of the invitation. Each code can be used once.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param invitation body models.AcceptInvitationRequest true "Invite code and account data"
+// @Success 201 {object} models.User
+// @Failure 400 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/invitations/accept [post]
+func (h *InvitationHandler) AcceptInvitation(c *fiber.Ctx) error {
+	var req models.AcceptInvitationRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	user, err := h.invitations.Accept(req.Code, req.Username, req.Password)
+	switch {
+	case errors.Is(err, service.ErrInvalidInvitation):
+		return apperr.BadRequest(apperr.CodeTokenInvalid, "Invalid, used or expired invitation")
+	case errors.Is(err, service.ErrUsernameTaken):
+		return apperr.Conflict(apperr.CodeAlreadyExists, "Username already taken")
+	case err != nil:
+		return err
+	}
+
+	return c.Status(201).JSON(user)
+}
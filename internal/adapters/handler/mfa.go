@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/service"
+)
+
+// loadUser returns the full user record, including role and token version
+func (h *AuthHandler) loadUser(userID int) (*models.User, error) {
+	user, err := h.users.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return h.users.GetByUsername(user.Username)
+}
+
+// mfaError maps an error of the MFA service to the client error
+func mfaError(c *fiber.Ctx, err error) error {
+	var locked *service.LoginLockedError
+	switch {
+	case errors.As(err, &locked):
+		return tooManyAttempts(c, locked)
+	case errors.Is(err, service.ErrInvalidMFACode):
+		return apperr.BadRequest(apperr.CodeMFAInvalidCode, "Invalid two-factor code")
+	case errors.Is(err, service.ErrMFARequired):
+		return apperr.Forbidden(apperr.CodeMFARequired, "Two-factor authentication is required for your role")
+	case errors.Is(err, service.ErrMFANotEnabled):
+		return apperr.Conflict(apperr.CodeMFAState, "Two-factor authentication is not enabled")
+	case errors.Is(err, service.ErrMFAAlreadyEnabled):
+		return apperr.Conflict(apperr.CodeMFAState, "Two-factor authentication is already enabled")
+	case errors.Is(err, service.ErrMFANotEnrolling):
+		return apperr.Conflict(apperr.CodeMFAState, "Start the enrollment first")
+	}
+	return err
+}
+
+// MFAStatus godoc
+// @Summary Two-factor authentication status
+// @Description Whether TOTP two-factor authentication is enabled for the current user, whether their role requires it and how many recovery codes are left
+// @Tags mfa
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} models.MFAStatus
+// @Failure 401 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/mfa [get]
+func (h *AuthHandler) MFAStatus(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(int)
+	role := c.Locals("role").(string)
+
+	status, err := h.mfa.Status(userID, role)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(status)
+}
+
+// EnrollMFA godoc
+// @Summary Start two-factor enrollment
+// @Description Create a new TOTP secret for the current user. Enter it into an authenticator app, e.g. by scanning the otpauth URL as a QR code, then confirm with a first code. Users whose role requires MFA and who have not enrolled yet authenticate with the mfa_token returned by login.
+// @Tags mfa
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} models.MFAEnrollment
+// @Failure 401 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/mfa/enroll [post]
+func (h *AuthHandler) EnrollMFA(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(int)
+
+	user, err := h.users.GetByID(userID)
+	if err != nil {
+		return apperr.Unauthorized(apperr.CodeTokenInvalid, "User not found")
+	}
+
+	enrollment, err := h.mfa.Enroll(user.ID, user.Username)
+	if err != nil {
+		return mfaError(c, err)
+	}
+
+	return c.JSON(enrollment)
+}
+
+// ConfirmMFA godoc
+// @Summary Confirm two-factor enrollment
+// @Description Enable two-factor authentication with a first code from the authenticator app and receive the recovery codes, which are shown only once. When authenticated with an mfa_token from login, the login is completed and access and refresh tokens are returned as well.
+// @Tags mfa
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param code body models.MFACodeRequest true "Code from the authenticator app"
+// @Success 200 {object} models.MFARecoveryCodes
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/mfa/enroll/confirm [post]
+func (h *AuthHandler) ConfirmMFA(c *fiber.Ctx) error {
+	var req models.MFACodeRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+	userID := c.Locals("user_id").(int)
+
+	codes, err := h.mfa.ConfirmEnrollment(userID, req.Code, c.IP())
+	if err != nil {
+		return mfaError(c, err)
+	}
+
+	// Enrolling during login completes that login
+	if challenge, ok := c.Locals("mfa_challenge").(*service.MFAClaims); ok {
+		user, err := h.loadUser(challenge.UserID)
+		if err != nil || !user.IsActive {
+			return apperr.Unauthorized(apperr.CodeTokenInvalid, "User not found")
+		}
+		return h.completeLogin(c, user, challenge.DeviceLabel, fiber.Map{"recovery_codes": codes})
+	}
+
+	return c.JSON(models.MFARecoveryCodes{RecoveryCodes: codes})
+}
+
+// VerifyMFA godoc
+// @Summary Complete a two-factor login
+// @Description Exchange the mfa_token returned by login and a code from the authenticator app, or an unused recovery code, for access and refresh tokens. Wrong codes count as failed logins.
+// @Tags mfa
+// @Accept json
+// @Produce json
+// @Param request body models.MFAVerifyRequest true "Challenge and code"
+// @Success 200 {object} map[string]interface{} "Access and refresh token"
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 429 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/mfa/verify [post]
+func (h *AuthHandler) VerifyMFA(c *fiber.Ctx) error {
+	var req models.MFAVerifyRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	challenge, err := h.mfa.ParseChallenge(req.MFAToken)
+	if errors.Is(err, service.ErrInvalidMFAChallenge) {
+		return apperr.Unauthorized(apperr.CodeTokenInvalid, "Invalid or expired MFA challenge, please log in again")
+	}
+	if err != nil {
+		return err
+	}
+
+	user, err := h.loadUser(challenge.UserID)
+	if err != nil || !user.IsActive {
+		return apperr.Unauthorized(apperr.CodeTokenInvalid, "Invalid or expired MFA challenge, please log in again")
+	}
+
+	err = h.mfa.Verify(user.ID, req.Code, req.RecoveryCode, c.IP())
+	switch {
+	case errors.Is(err, service.ErrInvalidMFACode):
+		return apperr.Unauthorized(apperr.CodeMFAInvalidCode, "Invalid two-factor code")
+	case errors.Is(err, service.ErrMFANotEnabled):
+		return apperr.Forbidden(apperr.CodeMFARequired, "Two-factor authentication must be set up first")
+	case err != nil:
+		return mfaError(c, err)
+	}
+
+	return h.completeLogin(c, user, challenge.DeviceLabel, nil)
+}
+
+// RegenerateRecoveryCodes godoc
+// @Summary Replace recovery codes
+// @Description Invalidate every recovery code of the current user and return new ones, after checking a code from the authenticator app
+// @Tags mfa
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param code body models.MFACodeRequest true "Code from the authenticator app"
+// @Success 200 {object} models.MFARecoveryCodes
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 429 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/mfa/recovery-codes [post]
+func (h *AuthHandler) RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	var req models.MFACodeRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+	userID := c.Locals("user_id").(int)
+
+	codes, err := h.mfa.RegenerateRecoveryCodes(userID, req.Code, c.IP())
+	if err != nil {
+		return mfaError(c, err)
+	}
+
+	return c.JSON(models.MFARecoveryCodes{RecoveryCodes: codes})
+}
+
+// DisableMFA godoc
+// @Summary Disable two-factor authentication
+// @Description Turn two-factor authentication off for the current user after checking a code from the authenticator app. Not possible for roles that require MFA.
+// @Tags mfa
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param code body models.MFACodeRequest true "Code from the authenticator app"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 429 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/mfa [delete]
+func (h *AuthHandler) DisableMFA(c *fiber.Ctx) error {
+	var req models.MFACodeRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+	userID := c.Locals("user_id").(int)
+	role := c.Locals("role").(string)
+
+	if err := h.mfa.Disable(userID, role, req.Code, c.IP()); err != nil {
+		return mfaError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Two-factor authentication disabled"})
+}
@@ -1,14 +1,52 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
 	"github.com/slmbngl/OrderAplication/internal/models"
 	"github.com/slmbngl/OrderAplication/internal/repository"
+	"github.com/slmbngl/OrderAplication/internal/service"
 )
 
+// OrderHandler serves the order endpoints of the authenticated user
+type OrderHandler struct {
+	orders    repository.OrderRepository
+	lifecycle *service.OrderService
+}
+
+func NewOrderHandler(orders repository.OrderRepository, lifecycle *service.OrderService) *OrderHandler {
+	return &OrderHandler{orders: orders, lifecycle: lifecycle}
+}
+
+// orderActor describes the caller to the order service
+func orderActor(c *fiber.Ctx) service.OrderActor {
+	permissions, _ := c.Locals("permissions").([]string)
+	return service.OrderActor{UserID: c.Locals("user_id").(int), Permissions: permissions}
+}
+
+// orderError maps an error of the order service to the client error
+func orderError(err error) error {
+	var illegal *service.IllegalTransitionError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return apperr.NotFound("Order not found")
+	case errors.As(err, &illegal):
+		return apperr.Conflict(apperr.CodeIllegalTransition,
+			fmt.Sprintf("An order cannot move from %s to %s", illegal.From, illegal.To)).
+			With("from", illegal.From).
+			With("to", illegal.To).
+			With("allowed", illegal.Allowed)
+	case errors.Is(err, service.ErrTransitionNotPermitted):
+		return apperr.Forbidden(apperr.CodeForbidden, "You are not allowed to make this status change")
+	}
+	return err
+}
+
 // GetOrders godoc
 // @Summary Get user's orders
 // @Description Get all orders for authenticated user
@@ -17,15 +55,36 @@ import (
 // @Produce json
 // @Security BearerAuth
 // @Success 200 {array} models.Order
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/orders [get]
-func GetOrders(c *fiber.Ctx) error {
+func (h *OrderHandler) GetOrders(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(int)
 
-	orders, err := repository.GetOrdersByUserID(userID)
+	orders, err := h.orders.GetOrdersByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(orders)
+}
+
+// GetAllOrders godoc
+// @Summary Get all orders
+// @Description Get the orders of every user, newest first. Requires the orders:read_all permission.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.OrderWithItems
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 403 {object} apperr.Problem "Forbidden"
+// @Failure 500 {object} apperr.Problem "Internal server error"
+// @Router /api/admin/orders [get]
+func (h *OrderHandler) GetAllOrders(c *fiber.Ctx) error {
+	orders, err := h.orders.GetAllOrders()
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
 
 	return c.JSON(orders)
@@ -33,40 +92,43 @@ func GetOrders(c *fiber.Ctx) error {
 
 // GetOrderByID godoc
 // @Summary Get order by ID
-// @Description Get a specific order for authenticated user with items
+// @Description Get a specific order for authenticated user with items and the warehouses each item is allocated to. Users with the orders:read_all permission can get any order.
 // @Tags orders
 // @Accept json
 // @Produce json
 // @Security BearerAuth
 // @Param id path int true "Order ID"
 // @Success 200 {object} models.OrderWithItems
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 404 {string} string "Order not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 404 {object} apperr.Problem "Order not found"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/orders/{id} [get]
-func GetOrderByID(c *fiber.Ctx) error {
+func (h *OrderHandler) GetOrderByID(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(int)
 	orderIDStr := c.Params("id")
 
 	orderID, err := strconv.Atoi(orderIDStr)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid order ID"})
+		return apperr.InvalidInput("Invalid order ID")
 	}
 
-	orderRepo := repository.NewOrderRepository()
-
-	order, err := orderRepo.GetOrderByID(orderID, userID)
+	var order *models.Order
+	if hasPermission(c, models.PermOrdersReadAll) {
+		order, err = h.orders.GetOrder(orderID)
+	} else {
+		order, err = h.orders.GetOrderByID(orderID, userID)
+	}
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(404).JSON(fiber.Map{"error": "Order not found"})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.NotFound("Order not found")
 		}
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
 
 	// Get order items
-	items, err := orderRepo.GetOrderItems(order.ID)
+	items, err := h.orders.GetOrderItems(order.ID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
 
 	orderWithItems := models.OrderWithItems{
@@ -79,36 +141,32 @@ func GetOrderByID(c *fiber.Ctx) error {
 
 // CreateOrder godoc
 // @Summary Create a new order
-// @Description Create a new order for authenticated user
+// @Description Create a new order for authenticated user. The items are reserved in the warehouses chosen by the configured allocation strategy, which may split an item across warehouses, until the order is confirmed, cancelled or left pending for longer than the reservation TTL. The closest strategy ships from the warehouses nearest to ship_to. The allocations of every item are returned with it.
 // @Tags orders
 // @Accept json
 // @Produce json
 // @Security BearerAuth
 // @Param order body models.CreateOrderRequest true "Order data"
 // @Success 201 {object} models.OrderWithItems
-// @Failure 400 {string} string "Bad request"
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apperr.Problem "Bad request"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 409 {object} apperr.Problem "Insufficient stock"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/orders [post]
-func CreateOrder(c *fiber.Ctx) error {
+func (h *OrderHandler) CreateOrder(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(int)
 
 	var orderReq models.CreateOrderRequest
-	if err := c.BodyParser(&orderReq); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid data"})
+	if err := bind(c, &orderReq); err != nil {
+		return err
 	}
 
-	if len(orderReq.Items) == 0 {
-		return c.Status(400).JSON(fiber.Map{"error": "Order must contain at least one item"})
-	}
-
-	orderRepo := repository.NewOrderRepository()
-	orderWithItems, err := orderRepo.CreateOrder(userID, orderReq.Items)
+	orderWithItems, err := h.lifecycle.Place(userID, orderReq)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(400).JSON(fiber.Map{"error": "Product not found"})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.InvalidInput("Product not found")
 		}
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
 
 	return c.Status(201).JSON(orderWithItems)
@@ -116,33 +174,33 @@ func CreateOrder(c *fiber.Ctx) error {
 
 // DeleteOrder godoc
 // @Summary Delete order
-// @Description Delete an order for authenticated user
+// @Description Delete a pending or cancelled order of the authenticated user. Deleting a pending order releases its reserved stock; orders past pending must be cancelled through their status first.
 // @Tags orders
 // @Accept json
 // @Produce json
 // @Security BearerAuth
 // @Param id path int true "Order ID"
 // @Success 200 {object} map[string]string
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 404 {string} string "Not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 404 {object} apperr.Problem "Not found"
+// @Failure 409 {object} apperr.Problem "Order is neither pending nor cancelled"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/orders/{id} [delete]
-func DeleteOrder(c *fiber.Ctx) error {
+func (h *OrderHandler) DeleteOrder(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(int)
 	orderIDStr := c.Params("id")
 
 	orderID, err := strconv.Atoi(orderIDStr)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid order ID"})
+		return apperr.InvalidInput("Invalid order ID")
 	}
 
-	orderRepo := repository.NewOrderRepository()
-	err = orderRepo.DeleteOrder(orderID, userID)
+	err = h.orders.DeleteOrder(orderID, userID)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(404).JSON(fiber.Map{"error": "Order not found or you don't have permission to delete it"})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.NotFound("Order not found or you don't have permission to delete it")
 		}
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
 
 	return c.JSON(fiber.Map{"message": "Order successfully deleted"})
@@ -150,7 +208,7 @@ func DeleteOrder(c *fiber.Ctx) error {
 
 // UpdateOrderStatus godoc
 // @Summary Update order status
-// @Description Update the status of an order, you can choose from "pending", "confirmed" or "cancelled"
+// @Description Move an order through its state machine: pending → confirmed → picking → packed → shipped → delivered, or to cancelled before it ships and refunded after. Customers may confirm their own pending orders and cancel them until picking starts; the other changes require orders:fulfil, refunds orders:refund. Confirming takes the items from warehouse stock and cancelling puts them back.
 // @Tags orders
 // @Accept json
 // @Produce json
@@ -158,48 +216,54 @@ func DeleteOrder(c *fiber.Ctx) error {
 // @Param id path int true "Order ID"
 // @Param status body models.UpdateOrderStatusRequest true "Status data"
 // @Success 200 {object} map[string]string
-// @Failure 400 {string} string "Bad request"
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 404 {string} string "Not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apperr.Problem "Bad request"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 403 {object} apperr.Problem "Status change not permitted"
+// @Failure 404 {object} apperr.Problem "Not found"
+// @Failure 409 {object} apperr.Problem "Illegal transition or insufficient stock"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/orders/{id}/status [put]
-func UpdateOrderStatus(c *fiber.Ctx) error {
-	userID := c.Locals("user_id").(int)
-	orderIDStr := c.Params("id")
-
-	orderID, err := strconv.Atoi(orderIDStr)
+func (h *OrderHandler) UpdateOrderStatus(c *fiber.Ctx) error {
+	orderID, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid order ID"})
+		return apperr.InvalidInput("Invalid order ID")
 	}
 
-	var statusReq map[string]string
-	if err := c.BodyParser(&statusReq); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid data"})
+	var statusReq models.UpdateOrderStatusRequest
+	if err := bind(c, &statusReq); err != nil {
+		return err
 	}
 
-	status, exists := statusReq["status"]
-	if !exists {
-		return c.Status(400).JSON(fiber.Map{"error": "Status is required"})
+	if err := h.lifecycle.ChangeStatus(orderID, statusReq.Status, orderActor(c)); err != nil {
+		return orderError(err)
 	}
 
-	validStatuses := map[string]bool{
-		"pending":   true,
-		"confirmed": true,
-		"cancelled": true,
-	}
+	return c.JSON(fiber.Map{"message": "Order status successfully updated"})
+}
 
-	if !validStatuses[status] {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid status"})
+// GetOrderHistory godoc
+// @Summary Get order status history
+// @Description List the status changes of an order, oldest first, with who made them. Customers see their own orders; users with orders:read_all, orders:fulfil or orders:refund see every order.
+// @Tags orders
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Order ID"
+// @Success 200 {array} models.OrderStatusChange
+// @Failure 400 {object} apperr.Problem "Bad request"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 404 {object} apperr.Problem "Order not found"
+// @Failure 500 {object} apperr.Problem "Internal server error"
+// @Router /api/orders/{id}/history [get]
+func (h *OrderHandler) GetOrderHistory(c *fiber.Ctx) error {
+	orderID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid order ID")
 	}
 
-	orderRepo := repository.NewOrderRepository()
-	err = orderRepo.UpdateOrderStatus(orderID, userID, status)
+	history, err := h.lifecycle.History(orderID, orderActor(c))
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(404).JSON(fiber.Map{"error": "Order not found or you don't have permission to update it"})
-		}
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return orderError(err)
 	}
 
-	return c.JSON(fiber.Map{"message": "Order status successfully updated"})
+	return c.JSON(history)
 }
@@ -1,14 +1,28 @@
 package handler
 
 import (
+	"errors"
 	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
 	"github.com/slmbngl/OrderAplication/internal/models"
 	"github.com/slmbngl/OrderAplication/internal/repository"
 )
 
+// ProductHandler serves the product catalogue endpoints. Creating and
+// updating a product stocks it in a warehouse, which callers may only do in
+// the warehouses they are assigned to.
+type ProductHandler struct {
+	products   repository.ProductRepository
+	warehouses repository.WarehouseRepository
+}
+
+func NewProductHandler(products repository.ProductRepository, warehouses repository.WarehouseRepository) *ProductHandler {
+	return &ProductHandler{products: products, warehouses: warehouses}
+}
+
 // GetProducts godoc
 // @Summary Get all products
 // @Description Get all available products
@@ -16,13 +30,12 @@ import (
 // @Accept json
 // @Produce json
 // @Success 200 {array} models.Product
-// @Failure 500 {string} string "Internal server error"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/products [get]
-func GetProducts(c *fiber.Ctx) error {
-	productRepo := repository.NewProductRepository()
-	products, err := productRepo.GetAllProducts()
+func (h *ProductHandler) GetProducts(c *fiber.Ctx) error {
+	products, err := h.products.GetAllProducts()
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
 
 	return c.JSON(products)
@@ -36,23 +49,22 @@ func GetProducts(c *fiber.Ctx) error {
 // @Produce json
 // @Param id path int true "Product ID"
 // @Success 200 {object} models.Product
-// @Failure 404 {string} string "Product not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 404 {object} apperr.Problem "Product not found"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/products/{id} [get]
-func GetProductByID(c *fiber.Ctx) error {
+func (h *ProductHandler) GetProductByID(c *fiber.Ctx) error {
 	idStr := c.Params("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid product ID"})
+		return apperr.InvalidInput("Invalid product ID")
 	}
 
-	productRepo := repository.NewProductRepository()
-	product, err := productRepo.GetProductByID(id)
+	product, err := h.products.GetProductByID(id)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.NotFound("Product not found")
 		}
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
 
 	return c.JSON(product)
@@ -66,20 +78,28 @@ func GetProductByID(c *fiber.Ctx) error {
 // @Security BearerAuth
 // @Param product body models.ProductRequest true "Product data"
 // @Success 201 {object} models.Product
-// @Failure 400 {string} string "Bad request"
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apperr.Problem "Bad request"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 403 {object} apperr.Problem "Warehouse not assigned to the caller"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/products [post]
-func CreateProduct(c *fiber.Ctx) error {
+func (h *ProductHandler) CreateProduct(c *fiber.Ctx) error {
 	var productReq models.ProductRequest
-	if err := c.BodyParser(&productReq); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid data"})
+	if err := bind(c, &productReq); err != nil {
+		return err
+	}
+
+	scope, err := scopeOf(c, h.warehouses)
+	if err != nil {
+		return err
+	}
+	if !scope.allows(productReq.WarehouseID) {
+		return forbiddenWarehouse()
 	}
 
-	productRepo := repository.NewProductRepository()
-	product, err := productRepo.CreateProduct(&productReq)
+	product, err := h.products.CreateProduct(&productReq)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
 
 	return c.Status(201).JSON(product)
@@ -94,28 +114,45 @@ func CreateProduct(c *fiber.Ctx) error {
 // @Param id path int true "Product ID"
 // @Param product body models.ProductRequest true "Product data"
 // @Success 200 {object} map[string]string
-// @Failure 400 {string} string "Bad request"
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 404 {string} string "Not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apperr.Problem "Bad request"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 403 {object} apperr.Problem "Warehouse not assigned to the caller"
+// @Failure 404 {object} apperr.Problem "Not found"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/products/{id} [put]
-func UpdateProduct(c *fiber.Ctx) error {
+func (h *ProductHandler) UpdateProduct(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid product ID"})
+		return apperr.InvalidInput("Invalid product ID")
 	}
 
 	var productReq models.ProductRequest
-	if err := c.BodyParser(&productReq); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid data"})
+	if err := bind(c, &productReq); err != nil {
+		return err
 	}
-	productRepo := repository.NewProductRepository()
-	err = productRepo.UpdateProduct(id, &productReq)
+
+	// The stock leaves the product's current warehouse as well
+	current, err := h.products.GetProductByID(id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return apperr.NotFound("Product not found")
+	}
+	if err != nil {
+		return err
+	}
+	scope, err := scopeOf(c, h.warehouses)
+	if err != nil {
+		return err
+	}
+	if !scope.allows(current.WarehouseID, productReq.WarehouseID) {
+		return forbiddenWarehouse()
+	}
+
+	err = h.products.UpdateProduct(id, &productReq)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.NotFound("Product not found")
 		}
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
 
 	return c.JSON(fiber.Map{"message": "Product updated successfully"})
@@ -123,31 +160,31 @@ func UpdateProduct(c *fiber.Ctx) error {
 
 // DeleteProduct godoc
 // @Summary Delete a product
-// @Description Delete a product (Admin only)
+// @Description Delete a product and its stock. Products that are part of any order are kept for the order history.
 // @Tags products
 // @Accept json
 // @Produce json
 // @Security BearerAuth
 // @Param id path int true "Product ID"
 // @Success 200 {object} map[string]string
-// @Failure 401 {string} string "Unauthorized"
-// @Failure 404 {string} string "Not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 401 {object} apperr.Problem "Unauthorized"
+// @Failure 404 {object} apperr.Problem "Not found"
+// @Failure 409 {object} apperr.Problem "Product is part of orders"
+// @Failure 500 {object} apperr.Problem "Internal server error"
 // @Router /api/products/{id} [delete]
-func DeleteProduct(c *fiber.Ctx) error {
+func (h *ProductHandler) DeleteProduct(c *fiber.Ctx) error {
 	idStr := c.Params("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid product ID"})
+		return apperr.InvalidInput("Invalid product ID")
 	}
 
-	productRepo := repository.NewProductRepository()
-	err = productRepo.DeleteProduct(id)
+	err = h.products.DeleteProduct(id)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.NotFound("Product not found")
 		}
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
 
 	return c.JSON(fiber.Map{"message": "Product successfully deleted"})
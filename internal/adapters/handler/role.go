@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/service"
+)
+
+// RoleHandler lets admins manage roles and the permissions they grant
+type RoleHandler struct {
+	roles *service.RoleService
+}
+
+func NewRoleHandler(roles *service.RoleService) *RoleHandler {
+	return &RoleHandler{roles: roles}
+}
+
+// granted returns the permissions of the access token of the request
+func granted(c *fiber.Ctx) []string {
+	permissions, _ := c.Locals("permissions").([]string)
+	return permissions
+}
+
+// hasPermission reports whether the access token of the request grants a
+// permission
+func hasPermission(c *fiber.Ctx, permission string) bool {
+	return slices.Contains(granted(c), permission)
+}
+
+// ListPermissions godoc
+// @Summary List permissions
+// @Description List every permission a role can grant. Requires the roles:manage permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.Permission
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/permissions [get]
+func (h *RoleHandler) ListPermissions(c *fiber.Ctx) error {
+	permissions, err := h.roles.Catalogue()
+	if err != nil {
+		return err
+	}
+	return c.JSON(permissions)
+}
+
+// ListRoles godoc
+// @Summary List roles
+// @Description List every role with its permissions. Requires the roles:manage permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.Role
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/roles [get]
+func (h *RoleHandler) ListRoles(c *fiber.Ctx) error {
+	roles, err := h.roles.List()
+	if err != nil {
+		return err
+	}
+	return c.JSON(roles)
+}
+
+// CreateRole godoc
+// @Summary Create a role
+// @Description Create a role granting the given permissions, all of which the caller must hold. Names are lowercase letters, digits and underscores. Requires the roles:manage permission.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param role body models.CreateRoleRequest true "Role data"
+// @Success 201 {object} models.Role
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/roles [post]
+func (h *RoleHandler) CreateRole(c *fiber.Ctx) error {
+	var req models.CreateRoleRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	role, err := h.roles.Create(models.Role{
+		Name:        req.Name,
+		Description: req.Description,
+		Permissions: req.Permissions,
+	}, granted(c))
+	switch {
+	case errors.Is(err, service.ErrInvalidRoleName):
+		return apperr.InvalidInput("Role name must be 2-50 lowercase letters, digits or underscores")
+	case errors.Is(err, service.ErrUnknownPermission):
+		return apperr.InvalidInput("Unknown permission")
+	case errors.Is(err, service.ErrGrantBroader):
+		return apperr.Forbidden(apperr.CodeGrantNotAllowed, "You cannot grant permissions you do not have")
+	case errors.Is(err, service.ErrRoleExists):
+		return apperr.Conflict(apperr.CodeAlreadyExists, "Role already exists")
+	case err != nil:
+		return err
+	}
+
+	return c.Status(201).JSON(role)
+}
+
+// UpdateRolePermissions godoc
+// @Summary Replace the permissions of a role
+// @Description Replace the permissions of a role with ones the caller holds. Access tokens of users with the role are revoked so the change applies immediately. The admin role cannot be changed. Requires the roles:manage permission.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param name path string true "Role name"
+// @Param permissions body models.UpdateRolePermissionsRequest true "Permissions"
+// @Success 200 {object} models.Role
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/roles/{name}/permissions [put]
+func (h *RoleHandler) UpdateRolePermissions(c *fiber.Ctx) error {
+	var req models.UpdateRolePermissionsRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	role, err := h.roles.SetPermissions(c.Params("name"), req.Permissions, granted(c))
+	switch {
+	case errors.Is(err, service.ErrImmutableRole):
+		return apperr.InvalidInput("The admin role cannot be changed")
+	case errors.Is(err, service.ErrUnknownPermission):
+		return apperr.InvalidInput("Unknown permission")
+	case errors.Is(err, service.ErrGrantBroader):
+		return apperr.Forbidden(apperr.CodeGrantNotAllowed, "You cannot grant permissions you do not have")
+	case errors.Is(err, service.ErrRoleNotFound):
+		return apperr.NotFound("Role not found")
+	case err != nil:
+		return err
+	}
+
+	return c.JSON(role)
+}
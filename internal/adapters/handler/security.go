@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+	"github.com/slmbngl/OrderAplication/internal/service"
+)
+
+// SecurityHandler serves the admin endpoints for login lockouts, two-factor
+// resets and the audit log
+type SecurityHandler struct {
+	users   repository.UserRepository
+	lockout *service.LockoutService
+	mfa     *service.MFAService
+	audit   repository.AuditRepository
+}
+
+func NewSecurityHandler(users repository.UserRepository, lockout *service.LockoutService,
+	mfa *service.MFAService, audit repository.AuditRepository) *SecurityHandler {
+	return &SecurityHandler{users: users, lockout: lockout, mfa: mfa, audit: audit}
+}
+
+// UnlockUser godoc
+// @Summary Unlock a user account
+// @Description Lift the login lockout of an account and forget its failed attempts. Lockouts of source addresses expire on their own. Requires the users:manage permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/users/{id}/unlock [post]
+func (h *SecurityHandler) UnlockUser(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid user ID")
+	}
+
+	user, err := h.users.GetByID(userID)
+	if err != nil {
+		return apperr.NotFound("User not found")
+	}
+
+	adminID := c.Locals("user_id").(int)
+	if err := h.lockout.Unlock(user.ID, user.Username, adminID, c.IP()); err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"message": "Account unlocked"})
+}
+
+// ResetUserMFA godoc
+// @Summary Reset two-factor authentication of a user
+// @Description Remove the TOTP enrollment and recovery codes of a user who lost their device. Users whose role requires MFA enroll again at their next login. Requires the users:manage permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/users/{id}/mfa [delete]
+func (h *SecurityHandler) ResetUserMFA(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid user ID")
+	}
+
+	user, err := h.users.GetByID(userID)
+	if err != nil {
+		return apperr.NotFound("User not found")
+	}
+
+	adminID := c.Locals("user_id").(int)
+	err = h.mfa.Reset(user.ID, user.Username, adminID, c.IP())
+	if errors.Is(err, service.ErrMFANotEnabled) {
+		return apperr.NotFound("User has no two-factor enrollment")
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"message": "Two-factor authentication reset"})
+}
+
+// ListAuditLog godoc
+// @Summary List the audit log
+// @Description List audit events such as lockouts, unlocks and two-factor changes, newest first. Requires the audit:read permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param limit query int false "Maximum number of events (1-500, default 100)"
+// @Success 200 {array} models.AuditEvent
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/audit-log [get]
+func (h *SecurityHandler) ListAuditLog(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 100)
+	if limit < 1 || limit > 500 {
+		return apperr.InvalidInput("limit must be between 1 and 500")
+	}
+
+	events, err := h.audit.GetEvents(limit)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(events)
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/service"
+)
+
+// SessionHandler lets users see and end the logins of their devices
+type SessionHandler struct {
+	refreshTokens *service.RefreshTokenService
+}
+
+func NewSessionHandler(refreshTokens *service.RefreshTokenService) *SessionHandler {
+	return &SessionHandler{refreshTokens: refreshTokens}
+}
+
+// clientInfo describes the device making the request
+func clientInfo(c *fiber.Ctx, deviceLabel string) service.ClientInfo {
+	return service.ClientInfo{
+		UserAgent:   c.Get(fiber.HeaderUserAgent),
+		IPAddress:   c.IP(),
+		DeviceLabel: deviceLabel,
+	}
+}
+
+// ListSessions godoc
+// @Summary List my sessions
+// @Description List the active sessions (logged in devices) of the current user, most recently used first
+// @Tags sessions
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.Session
+// @Failure 401 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/sessions [get]
+func (h *SessionHandler) ListSessions(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(int)
+	return h.listSessions(c, userID)
+}
+
+// RevokeSession godoc
+// @Summary Revoke one of my sessions
+// @Description Log out a single device by revoking its refresh and access tokens
+// @Tags sessions
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "Session ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/auth/sessions/{id} [delete]
+func (h *SessionHandler) RevokeSession(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(int)
+	return h.revokeSession(c, userID, c.Params("id"))
+}
+
+// ListUserSessions godoc
+// @Summary List sessions of a user (Admin only)
+// @Description List the active sessions of any user
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {array} models.Session
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/users/{id}/sessions [get]
+func (h *SessionHandler) ListUserSessions(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid user ID")
+	}
+	return h.listSessions(c, userID)
+}
+
+// RevokeUserSession godoc
+// @Summary Revoke a session of a user (Admin only)
+// @Description Log out one device of any user
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param sessionId path string true "Session ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/users/{id}/sessions/{sessionId} [delete]
+func (h *SessionHandler) RevokeUserSession(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid user ID")
+	}
+	return h.revokeSession(c, userID, c.Params("sessionId"))
+}
+
+func (h *SessionHandler) listSessions(c *fiber.Ctx, userID int) error {
+	sessions, err := h.refreshTokens.Sessions(userID)
+	if err != nil {
+		return err
+	}
+
+	current, _ := c.Locals("session_id").(string)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+
+	return c.JSON(sessions)
+}
+
+func (h *SessionHandler) revokeSession(c *fiber.Ctx, userID int, sessionID string) error {
+	err := h.refreshTokens.RevokeSession(userID, sessionID)
+	if errors.Is(err, service.ErrSessionNotFound) {
+		return apperr.NotFound("Session not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"message": "Session revoked successfully"})
+}
@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/service"
+)
+
+// Page sizes of the user list
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 200
+)
+
+// UserHandler serves the admin user management
+type UserHandler struct {
+	users    *service.UserService
+	accounts *service.AccountService
+}
+
+func NewUserHandler(users *service.UserService, accounts *service.AccountService) *UserHandler {
+	return &UserHandler{users: users, accounts: accounts}
+}
+
+// ListUsers godoc
+// @Summary Search users (Admin only)
+// @Description List users, newest first, optionally filtered. Deleted users are left out unless include_deleted is set. The total number of matches is returned in the X-Total-Count header. Requires the users:read permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param username query string false "Part of the username, case-insensitive"
+// @Param role query string false "Role"
+// @Param active query bool false "Active state"
+// @Param created_from query string false "Created at or after, RFC 3339 or YYYY-MM-DD"
+// @Param created_to query string false "Created before, RFC 3339 or YYYY-MM-DD"
+// @Param include_deleted query bool false "Include deleted users"
+// @Param limit query int false "Page size, 1 to 200" default(50)
+// @Param offset query int false "Users to skip" default(0)
+// @Success 200 {array} models.User
+// @Header 200 {integer} X-Total-Count "Number of matching users"
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/users [get]
+func (h *UserHandler) ListUsers(c *fiber.Ctx) error {
+	filter := models.UserFilter{
+		Username: c.Query("username"),
+		Role:     c.Query("role"),
+		Limit:    c.QueryInt("limit", defaultUserPageSize),
+		Offset:   c.QueryInt("offset", 0),
+	}
+	if filter.Limit < 1 || filter.Limit > maxUserPageSize || filter.Offset < 0 {
+		return apperr.InvalidInput("limit must be between 1 and 200 and offset not negative")
+	}
+
+	if active := c.Query("active"); active != "" {
+		v, err := strconv.ParseBool(active)
+		if err != nil {
+			return apperr.InvalidInput("active must be true or false")
+		}
+		filter.IsActive = &v
+	}
+	if deleted := c.Query("include_deleted"); deleted != "" {
+		v, err := strconv.ParseBool(deleted)
+		if err != nil {
+			return apperr.InvalidInput("include_deleted must be true or false")
+		}
+		filter.IncludeDeleted = v
+	}
+	for param, target := range map[string]**time.Time{
+		"created_from": &filter.CreatedFrom,
+		"created_to":   &filter.CreatedTo,
+	} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := parseDate(value)
+		if err != nil {
+			return apperr.InvalidInput(param + " must be a date (YYYY-MM-DD) or RFC 3339 time")
+		}
+		*target = &t
+	}
+
+	users, total, err := h.users.Search(filter)
+	if err != nil {
+		return err
+	}
+
+	c.Set("X-Total-Count", strconv.Itoa(total))
+	return c.JSON(users)
+}
+
+// parseDate accepts a calendar date, taken as midnight UTC, or an RFC 3339 time
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// GetUser godoc
+// @Summary Get a user (Admin only)
+// @Description Get a user, deleted ones included, with their orders and active sessions. Requires the users:read and orders:read_all permissions.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} models.UserDetail
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/users/{id} [get]
+func (h *UserHandler) GetUser(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid user ID")
+	}
+
+	detail, err := h.users.Detail(userID)
+	if errors.Is(err, service.ErrUserNotFound) {
+		return apperr.NotFound("User not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(detail)
+}
+
+// CreateUser godoc
+// @Summary Create a user (Admin only)
+// @Description Open an account on behalf of a customer, with the customer role unless another is given, whose permissions the caller must all hold. Without a password the account gets a random one and the user a password reset token through the configured notifier. Requires the users:manage permission.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param user body models.CreateUserRequest true "User data"
+// @Success 201 {object} map[string]interface{} "The user and whether a reset token was sent"
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/users [post]
+func (h *UserHandler) CreateUser(c *fiber.Ctx) error {
+	var req models.CreateUserRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	adminID := c.Locals("user_id").(int)
+	user, resetSent, err := h.users.Create(req.Username, req.Password, req.Role, granted(c), adminID, c.IP())
+	switch {
+	case errors.Is(err, service.ErrInvalidUsername):
+		return apperr.InvalidInput("username must be 1 to 50 characters")
+	case errors.Is(err, service.ErrInvalidRole):
+		return apperr.InvalidInput("Invalid role")
+	case errors.Is(err, service.ErrGrantBroader):
+		return apperr.Forbidden(apperr.CodeGrantNotAllowed, "You cannot create a user with permissions you do not have")
+	case errors.Is(err, service.ErrWeakPassword):
+		return apperr.BadRequest(apperr.CodeWeakPassword, service.ErrWeakPassword.Error())
+	case errors.Is(err, service.ErrUsernameTaken):
+		return apperr.Conflict(apperr.CodeAlreadyExists, "Username already taken")
+	case err != nil:
+		return err
+	}
+
+	return c.Status(201).JSON(fiber.Map{"user": user, "password_reset_sent": resetSent})
+}
+
+// DeleteUser godoc
+// @Summary Delete a user (Admin only)
+// @Description Soft-delete a user: they can no longer log in, every session ends and they disappear from the user list, while their orders are kept. Admins cannot delete themselves or the last active admin. Requires the users:manage permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/users/{id} [delete]
+func (h *UserHandler) DeleteUser(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid user ID")
+	}
+
+	adminID := c.Locals("user_id").(int)
+	err = h.accounts.Delete(userID, adminID, c.IP())
+	if errors.Is(err, service.ErrDeleteSelf) {
+		return apperr.Conflict(apperr.CodeConflict, "You cannot delete your own account")
+	}
+	if err != nil {
+		return accountError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"message": "User deleted"})
+}
+
+// ImpersonateUser godoc
+// @Summary Impersonate a user
+// @Description Get a short-lived access token acting as a user, to reproduce what they see. The token carries the impersonator in its "imp" claim, cannot be refreshed and cannot change the user's password, two-factor settings or account state. Every impersonation is written to the audit log. Admins and inactive users cannot be impersonated. Requires the users:impersonate permission.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} models.ImpersonationResponse
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 500 {object} apperr.Problem
+// @Router /api/admin/users/{id}/impersonate [post]
+func (h *UserHandler) ImpersonateUser(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid user ID")
+	}
+
+	staffID := c.Locals("user_id").(int)
+	resp, err := h.users.Impersonate(userID, staffID, c.IP())
+	switch {
+	case errors.Is(err, service.ErrUserNotFound):
+		return apperr.NotFound("User not found")
+	case errors.Is(err, service.ErrImpersonateSelf):
+		return apperr.InvalidInput("You cannot impersonate yourself")
+	case errors.Is(err, service.ErrImpersonateAdmin):
+		return apperr.Forbidden(apperr.CodeForbidden, "Admins cannot be impersonated")
+	case errors.Is(err, service.ErrImpersonateBroader):
+		return apperr.Forbidden(apperr.CodeImpersonating, "You cannot impersonate a user with permissions you do not have")
+	case errors.Is(err, service.ErrImpersonateInactive):
+		return apperr.Conflict(apperr.CodeAccountInactive, "Inactive users cannot be impersonated")
+	case err != nil:
+		return err
+	}
+
+	return c.JSON(resp)
+}
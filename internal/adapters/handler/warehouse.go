@@ -1,142 +1,231 @@
 package handler
 
 import (
+	"errors"
 	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
 	"github.com/slmbngl/OrderAplication/internal/models"
 	"github.com/slmbngl/OrderAplication/internal/repository"
 )
 
-var warehouseRepo = repository.NewWarehouseRepository()
+// WarehouseHandler serves the warehouse, stock and transfer endpoints
+type WarehouseHandler struct {
+	warehouses repository.WarehouseRepository
+}
+
+func NewWarehouseHandler(warehouses repository.WarehouseRepository) *WarehouseHandler {
+	return &WarehouseHandler{warehouses: warehouses}
+}
+
+// warehouseScope holds the warehouses a caller may act on; nil stands for
+// every warehouse
+type warehouseScope map[int]bool
+
+// allows reports whether every given warehouse is in the scope
+func (s warehouseScope) allows(warehouseIDs ...int) bool {
+	if s == nil {
+		return true
+	}
+	for _, id := range warehouseIDs {
+		if !s[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// touches reports whether any of the given warehouses is in the scope
+func (s warehouseScope) touches(warehouseIDs ...int) bool {
+	if s == nil {
+		return true
+	}
+	for _, id := range warehouseIDs {
+		if s[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// scope returns the warehouses the caller is assigned to
+func (h *WarehouseHandler) scope(c *fiber.Ctx) (warehouseScope, error) {
+	return scopeOf(c, h.warehouses)
+}
+
+// scopeOf returns the warehouses the caller is assigned to. Callers with the
+// warehouses:all permission act on every warehouse.
+func scopeOf(c *fiber.Ctx, warehouses repository.WarehouseRepository) (warehouseScope, error) {
+	if hasPermission(c, models.PermWarehousesAll) {
+		return nil, nil
+	}
+
+	ids, err := warehouses.GetUserWarehouseIDs(c.Locals("user_id").(int))
+	if err != nil {
+		return nil, err
+	}
+	scope := warehouseScope{}
+	for _, id := range ids {
+		scope[id] = true
+	}
+	return scope, nil
+}
+
+// transferWarehouses returns the warehouses a transfer moves stock between;
+// inbound and outbound transfers have only one
+func transferWarehouses(from, to *int) []int {
+	var ids []int
+	if from != nil {
+		ids = append(ids, *from)
+	}
+	if to != nil {
+		ids = append(ids, *to)
+	}
+	return ids
+}
+
+// scopedTransfer loads a transfer the caller can see, i.e. one touching any
+// of the caller's warehouses. Acting on it requires both of its warehouses.
+func (h *WarehouseHandler) scopedTransfer(c *fiber.Ctx, id int, act bool) (*models.StockTransfer, error) {
+	scope, err := h.scope(c)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer, err := h.warehouses.GetTransferByID(id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, apperr.NotFound("Transfer not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	warehouseIDs := transferWarehouses(transfer.FromWarehouseID, transfer.ToWarehouseID)
+	if !scope.touches(warehouseIDs...) {
+		return nil, apperr.NotFound("Transfer not found")
+	}
+	if act && !scope.allows(warehouseIDs...) {
+		return nil, forbiddenWarehouse()
+	}
+	return transfer, nil
+}
+
+func forbiddenWarehouse() error {
+	return apperr.Forbidden(apperr.CodeForbidden, "You are not assigned to this warehouse")
+}
 
 // Warehouse Management Handlers
 
 // @Summary Create warehouse
-// @Description Create a new warehouse (Admin only)
+// @Description Create a new warehouse, optionally with its location for the closest allocation strategy (requires warehouses:write)
 // @Tags warehouses
 // @Accept json
 // @Produce json
 // @Param warehouse body models.CreateWarehouseRequest true "Warehouse data"
 // @Success 201 {object} models.Warehouse
-// @Failure 400 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
-// @Failure 403 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/warehouses [post]
-func CreateWarehouse(c *fiber.Ctx) error {
+func (h *WarehouseHandler) CreateWarehouse(c *fiber.Ctx) error {
 	var req models.CreateWarehouseRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := bind(c, &req); err != nil {
+		return err
 	}
 
-	warehouse, err := warehouseRepo.CreateWarehouse(&req)
+	warehouse, err := h.warehouses.CreateWarehouse(&req)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create warehouse",
-		})
+		return err
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(warehouse)
 }
 
 // @Summary Get all warehouses
-// @Description Get list of all warehouses (Admin only)
+// @Description Get list of all warehouses (requires warehouses:read)
 // @Tags warehouses
 // @Produce json
 // @Success 200 {array} models.Warehouse
-// @Failure 401 {object} map[string]interface{}
-// @Failure 403 {object} map[string]interface{}
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/warehouses [get]
-func GetAllWarehouses(c *fiber.Ctx) error {
-	warehouses, err := warehouseRepo.GetAllWarehouses()
+func (h *WarehouseHandler) GetAllWarehouses(c *fiber.Ctx) error {
+	warehouses, err := h.warehouses.GetAllWarehouses()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get warehouses",
-		})
+		return err
 	}
 
 	return c.JSON(warehouses)
 }
 
 // @Summary Get warehouse by ID
-// @Description Get warehouse details by ID (Admin only)
+// @Description Get warehouse details by ID (requires warehouses:read)
 // @Tags warehouses
 // @Produce json
 // @Param id path int true "Warehouse ID"
 // @Success 200 {object} models.Warehouse
-// @Failure 400 {object} map[string]interface{}
-// @Failure 404 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
-// @Failure 403 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/warehouses/{id} [get]
-func GetWarehouseByID(c *fiber.Ctx) error {
+func (h *WarehouseHandler) GetWarehouseByID(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid warehouse ID",
-		})
+		return apperr.InvalidInput("Invalid warehouse ID")
 	}
 
-	warehouse, err := warehouseRepo.GetWarehouseByID(id)
+	warehouse, err := h.warehouses.GetWarehouseByID(id)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Warehouse not found",
-			})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.NotFound("Warehouse not found")
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get warehouse",
-		})
+		return err
 	}
 
 	return c.JSON(warehouse)
 }
 
 // @Summary Update warehouse
-// @Description Update warehouse details (Admin only)
+// @Description Update warehouse details, including its location (requires warehouses:write)
 // @Tags warehouses
 // @Accept json
 // @Produce json
 // @Param id path int true "Warehouse ID"
 // @Param warehouse body models.UpdateWarehouseRequest true "Warehouse data"
 // @Success 200 {object} map[string]interface{}
-// @Failure 400 {object} map[string]interface{}
-// @Failure 404 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
-// @Failure 403 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/warehouses/{id} [put]
-func UpdateWarehouse(c *fiber.Ctx) error {
+func (h *WarehouseHandler) UpdateWarehouse(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid warehouse ID",
-		})
+		return apperr.InvalidInput("Invalid warehouse ID")
 	}
 
 	var req models.UpdateWarehouseRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := bind(c, &req); err != nil {
+		return err
 	}
 
-	err = warehouseRepo.UpdateWarehouse(id, &req)
+	err = h.warehouses.UpdateWarehouse(id, &req)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Warehouse not found",
-			})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.NotFound("Warehouse not found")
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update warehouse",
-		})
+		return err
 	}
 
 	return c.JSON(fiber.Map{
@@ -145,42 +234,35 @@ func UpdateWarehouse(c *fiber.Ctx) error {
 }
 
 // @Summary Delete warehouse
-// @Description Delete warehouse (Admin only)
+// @Description Delete warehouse (requires warehouses:write)
 // @Tags warehouses
 // @Produce json
 // @Param id path int true "Warehouse ID"
 // @Success 200 {object} map[string]interface{}
-// @Failure 400 {object} map[string]interface{}
-// @Failure 404 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
-// @Failure 403 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/warehouses/{id} [delete]
-func DeleteWarehouse(c *fiber.Ctx) error {
+func (h *WarehouseHandler) DeleteWarehouse(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid warehouse ID",
-		})
+		return apperr.InvalidInput("Invalid warehouse ID")
 	}
 
-	err = warehouseRepo.DeleteWarehouse(id)
+	err = h.warehouses.DeleteWarehouse(id)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Warehouse not found",
-			})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.NotFound("Warehouse not found")
 		}
-		// Check for custom error type
-		if warehouseErr, ok := err.(*repository.WarehouseHasStockError); ok {
-			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-				"error":        "Cannot delete warehouse with existing stock",
-				"warehouse_id": warehouseErr.WarehouseID,
-			})
+		var warehouseErr *repository.WarehouseHasStockError
+		if errors.As(err, &warehouseErr) {
+			return apperr.Conflict(apperr.CodeWarehouseHasStock, "Cannot delete warehouse with existing stock").
+				With("warehouse_id", warehouseErr.WarehouseID)
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to delete warehouse",
-		})
+		return err
 	}
 
 	return c.JSON(fiber.Map{
@@ -191,79 +273,85 @@ func DeleteWarehouse(c *fiber.Ctx) error {
 // Stock Management Handlers
 
 // @Summary Get warehouse stocks
-// @Description Get all stocks for a specific warehouse (Admin only)
+// @Description Get all stocks for a specific warehouse (requires stock:read, assigned warehouses only)
 // @Tags warehouse-stocks
 // @Produce json
 // @Param id path int true "Warehouse ID"
 // @Success 200 {array} models.WarehouseStock
-// @Failure 400 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
-// @Failure 403 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/warehouses/{id}/stocks [get]
-func GetWarehouseStocks(c *fiber.Ctx) error {
+func (h *WarehouseHandler) GetWarehouseStocks(c *fiber.Ctx) error {
 	warehouseID, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid warehouse ID",
-		})
+		return apperr.InvalidInput("Invalid warehouse ID")
 	}
 
-	stocks, err := warehouseRepo.GetWarehouseStocks(warehouseID)
+	scope, err := h.scope(c)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get warehouse stocks",
-		})
+		return err
+	}
+	if !scope.allows(warehouseID) {
+		return forbiddenWarehouse()
+	}
+
+	stocks, err := h.warehouses.GetWarehouseStocks(warehouseID)
+	if err != nil {
+		return err
 	}
 
 	return c.JSON(stocks)
 }
 
 // @Summary Get product stock in warehouse
-// @Description Get specific product stock in warehouse (Admin only)
+// @Description Get specific product stock in warehouse (requires stock:read, assigned warehouses only)
 // @Tags warehouse-stocks
 // @Produce json
 // @Param warehouseId path int true "Warehouse ID"
 // @Param productId path int true "Product ID"
 // @Success 200 {object} models.WarehouseStock
-// @Failure 400 {object} map[string]interface{}
-// @Failure 404 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
-// @Failure 403 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/warehouses/{warehouseId}/stocks/{productId} [get]
-func GetProductStockInWarehouse(c *fiber.Ctx) error {
+func (h *WarehouseHandler) GetProductStockInWarehouse(c *fiber.Ctx) error {
 	warehouseID, err := strconv.Atoi(c.Params("warehouseId"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid warehouse ID",
-		})
+		return apperr.InvalidInput("Invalid warehouse ID")
 	}
 
 	productID, err := strconv.Atoi(c.Params("productId"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid product ID",
-		})
+		return apperr.InvalidInput("Invalid product ID")
 	}
 
-	stock, err := warehouseRepo.GetProductStockInWarehouse(warehouseID, productID)
+	scope, err := h.scope(c)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Stock not found",
-			})
+		return err
+	}
+	if !scope.allows(warehouseID) {
+		return forbiddenWarehouse()
+	}
+
+	stock, err := h.warehouses.GetProductStockInWarehouse(warehouseID, productID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.NotFound("Stock not found")
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get stock",
-		})
+		return err
 	}
 
 	return c.JSON(stock)
 }
 
 // @Summary Update stock
-// @Description Update product stock in warehouse (Admin only)
+// @Description Update product stock in warehouse (requires stock:adjust, assigned warehouses only)
 // @Tags warehouse-stocks
 // @Accept json
 // @Produce json
@@ -271,38 +359,39 @@ func GetProductStockInWarehouse(c *fiber.Ctx) error {
 // @Param productId path int true "Product ID"
 // @Param stock body models.UpdateStockRequest true "Stock data"
 // @Success 200 {object} map[string]interface{}
-// @Failure 400 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
-// @Failure 403 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/warehouses/{warehouseId}/stocks/{productId} [put]
-func UpdateStock(c *fiber.Ctx) error {
+func (h *WarehouseHandler) UpdateStock(c *fiber.Ctx) error {
 	warehouseID, err := strconv.Atoi(c.Params("warehouseId"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid warehouse ID",
-		})
+		return apperr.InvalidInput("Invalid warehouse ID")
 	}
 
 	productID, err := strconv.Atoi(c.Params("productId"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid product ID",
-		})
+		return apperr.InvalidInput("Invalid product ID")
+	}
+
+	scope, err := h.scope(c)
+	if err != nil {
+		return err
+	}
+	if !scope.allows(warehouseID) {
+		return forbiddenWarehouse()
 	}
 
 	var req models.UpdateStockRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := bind(c, &req); err != nil {
+		return err
 	}
 
-	err = warehouseRepo.UpdateStock(warehouseID, productID, req.Quantity)
+	err = h.warehouses.UpdateStock(warehouseID, productID, req.Quantity)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update stock",
-		})
+		return err
 	}
 
 	return c.JSON(fiber.Map{
@@ -311,7 +400,7 @@ func UpdateStock(c *fiber.Ctx) error {
 }
 
 // @Summary Add stock
-// @Description Add stock to product in warehouse (Admin only)
+// @Description Add stock to product in warehouse (requires stock:adjust, assigned warehouses only)
 // @Tags warehouse-stocks
 // @Accept json
 // @Produce json
@@ -319,38 +408,39 @@ func UpdateStock(c *fiber.Ctx) error {
 // @Param productId path int true "Product ID"
 // @Param stock body models.UpdateStockRequest true "Stock data"
 // @Success 200 {object} map[string]interface{}
-// @Failure 400 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
-// @Failure 403 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/warehouses/{warehouseId}/stocks/{productId}/add [post]
-func AddStock(c *fiber.Ctx) error {
+func (h *WarehouseHandler) AddStock(c *fiber.Ctx) error {
 	warehouseID, err := strconv.Atoi(c.Params("warehouseId"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid warehouse ID",
-		})
+		return apperr.InvalidInput("Invalid warehouse ID")
 	}
 
 	productID, err := strconv.Atoi(c.Params("productId"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid product ID",
-		})
+		return apperr.InvalidInput("Invalid product ID")
+	}
+
+	scope, err := h.scope(c)
+	if err != nil {
+		return err
+	}
+	if !scope.allows(warehouseID) {
+		return forbiddenWarehouse()
 	}
 
 	var req models.UpdateStockRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := bind(c, &req); err != nil {
+		return err
 	}
 
-	err = warehouseRepo.AddStock(warehouseID, productID, req.Quantity)
+	err = h.warehouses.AddStock(warehouseID, productID, req.Quantity)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to add stock",
-		})
+		return err
 	}
 
 	return c.JSON(fiber.Map{
@@ -359,165 +449,166 @@ func AddStock(c *fiber.Ctx) error {
 }
 
 // @Summary Get all stocks
-// @Description Get all stocks from all warehouses (Requires authentication)
+// @Description Get the stocks of the caller's warehouses (requires stock:read)
 // @Tags stocks
 // @Produce json
 // @Success 200 {array} models.WarehouseStock
-// @Failure 401 {object} map[string]interface{}
+// @Failure 401 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/stocks [get]
-func GetAllStocks(c *fiber.Ctx) error {
-	stocks, err := warehouseRepo.GetAllStocks()
+func (h *WarehouseHandler) GetAllStocks(c *fiber.Ctx) error {
+	scope, err := h.scope(c)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get stocks",
-		})
+		return err
 	}
 
-	return c.JSON(stocks)
+	stocks, err := h.warehouses.GetAllStocks()
+	if err != nil {
+		return err
+	}
+
+	visible := []models.WarehouseStock{}
+	for _, stock := range stocks {
+		if scope.allows(stock.WarehouseID) {
+			visible = append(visible, stock)
+		}
+	}
+
+	return c.JSON(visible)
 }
 
 // Transfer Management Handlers
 
 // @Summary Create stock transfer
-// @Description Create a new stock transfer (Requires authentication)
+// @Description Create a new stock transfer between the caller's warehouses (requires transfers:create)
 // @Tags transfers
 // @Accept json
 // @Produce json
 // @Param transfer body models.StockTransferRequest true "Transfer data"
 // @Success 201 {object} models.StockTransfer
-// @Failure 400 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/transfers [post]
-func CreateStockTransfer(c *fiber.Ctx) error {
+func (h *WarehouseHandler) CreateStockTransfer(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(int)
 
 	var req models.StockTransferRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	// Both ends of the transfer must be the caller's warehouses
+	scope, err := h.scope(c)
+	if err != nil {
+		return err
+	}
+	if !scope.allows(transferWarehouses(req.FromWarehouseID, req.ToWarehouseID)...) {
+		return forbiddenWarehouse()
 	}
 
-	transfer, err := warehouseRepo.CreateStockTransfer(&req, userID)
+	transfer, err := h.warehouses.CreateStockTransfer(&req, userID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create transfer",
-		})
+		return err
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(transfer)
 }
 
 // @Summary Get all transfers
-// @Description Get list of all stock transfers (Requires authentication)
+// @Description Get the stock transfers touching the caller's warehouses (requires transfers:read)
 // @Tags transfers
 // @Produce json
 // @Success 200 {array} models.StockTransfer
-// @Failure 401 {object} map[string]interface{}
+// @Failure 401 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/transfers [get]
-func GetAllTransfers(c *fiber.Ctx) error {
-	transfers, err := warehouseRepo.GetAllTransfers()
+func (h *WarehouseHandler) GetAllTransfers(c *fiber.Ctx) error {
+	scope, err := h.scope(c)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get transfers",
-		})
+		return err
 	}
 
-	return c.JSON(transfers)
+	transfers, err := h.warehouses.GetAllTransfers()
+	if err != nil {
+		return err
+	}
+
+	visible := []models.StockTransfer{}
+	for _, transfer := range transfers {
+		if scope.touches(transferWarehouses(transfer.FromWarehouseID, transfer.ToWarehouseID)...) {
+			visible = append(visible, transfer)
+		}
+	}
+
+	return c.JSON(visible)
 }
 
 // @Summary Get transfer by ID
-// @Description Get transfer details by ID (Requires authentication)
+// @Description Get transfer details by ID, if it touches the caller's warehouses (requires transfers:read)
 // @Tags transfers
 // @Produce json
 // @Param id path int true "Transfer ID"
 // @Success 200 {object} models.StockTransfer
-// @Failure 400 {object} map[string]interface{}
-// @Failure 404 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/transfers/{id} [get]
-func GetTransferByID(c *fiber.Ctx) error {
+func (h *WarehouseHandler) GetTransferByID(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid transfer ID",
-		})
+		return apperr.InvalidInput("Invalid transfer ID")
 	}
 
-	transfer, err := warehouseRepo.GetTransferByID(id)
+	transfer, err := h.scopedTransfer(c, id, false)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Transfer not found",
-			})
-		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get transfer",
-		})
+		return err
 	}
 
 	return c.JSON(transfer)
 }
 
 // @Summary Update transfer status
-// @Description Update transfer status (Admin only)
+// @Description Update transfer status, if both warehouses are the caller's (requires transfers:process)
 // @Tags transfers
 // @Accept json
 // @Produce json
 // @Param id path int true "Transfer ID"
 // @Param status body models.StockTransferStatusRequest true "Status data"
 // @Success 200 {object} map[string]interface{}
-// @Failure 400 {object} map[string]interface{}
-// @Failure 404 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
-// @Failure 403 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/transfers/{id}/status [put]
-func UpdateTransferStatus(c *fiber.Ctx) error {
+func (h *WarehouseHandler) UpdateTransferStatus(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid transfer ID",
-		})
+		return apperr.InvalidInput("Invalid transfer ID")
 	}
 
 	var req models.StockTransferStatusRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	// Validate status
-	validStatuses := []string{"pending", "completed", "failed", "cancelled"}
-	isValid := false
-	for _, status := range validStatuses {
-		if req.Status == status {
-			isValid = true
-			break
-		}
+	if err := bind(c, &req); err != nil {
+		return err
 	}
 
-	if !isValid {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid status. Valid statuses: pending, completed, failed, cancelled",
-		})
+	if _, err := h.scopedTransfer(c, id, true); err != nil {
+		return err
 	}
 
-	err = warehouseRepo.UpdateTransferStatus(id, req.Status)
+	err = h.warehouses.UpdateTransferStatus(id, req.Status)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Transfer not found",
-			})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.NotFound("Transfer not found")
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update transfer status",
-		})
+		return err
 	}
 
 	return c.JSON(fiber.Map{
@@ -526,58 +617,127 @@ func UpdateTransferStatus(c *fiber.Ctx) error {
 }
 
 // @Summary Process transfer
-// @Description Process pending transfer (Admin only)
+// @Description Process pending transfer, if both warehouses are the caller's (requires transfers:process)
 // @Tags transfers
 // @Produce json
 // @Param id path int true "Transfer ID"
 // @Success 200 {object} map[string]interface{}
-// @Failure 400 {object} map[string]interface{}
-// @Failure 404 {object} map[string]interface{}
-// @Failure 409 {object} map[string]interface{}
-// @Failure 401 {object} map[string]interface{}
-// @Failure 403 {object} map[string]interface{}
+// @Failure 400 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Failure 409 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
 // @Security BearerAuth
+// @Security APIKeyAuth
 // @Router /api/transfers/{id}/process [post]
-func ProcessTransfer(c *fiber.Ctx) error {
+func (h *WarehouseHandler) ProcessTransfer(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid transfer ID",
-		})
+		return apperr.InvalidInput("Invalid transfer ID")
+	}
+
+	if _, err := h.scopedTransfer(c, id, true); err != nil {
+		return err
 	}
 
-	err = warehouseRepo.ProcessTransfer(id)
+	err = h.warehouses.ProcessTransfer(id)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Transfer not found",
-			})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.NotFound("Transfer not found")
 		}
 
-		// Check for custom error types
-		if transferErr, ok := err.(*repository.TransferNotPendingError); ok {
-			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-				"error":          "Transfer is not in pending status",
-				"current_status": transferErr.Status,
-			})
+		var transferErr *repository.TransferNotPendingError
+		if errors.As(err, &transferErr) {
+			return apperr.Conflict(apperr.CodeTransferNotPending, "Transfer is not in pending status").
+				With("current_status", transferErr.Status)
 		}
 
-		if stockErr, ok := err.(*repository.InsufficientStockError); ok {
-			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-				"error":        "Insufficient stock for transfer",
-				"warehouse_id": stockErr.WarehouseID,
-				"product_id":   stockErr.ProductID,
-				"required":     stockErr.Required,
-				"available":    stockErr.Available,
-			})
+		var stockErr *repository.InsufficientStockError
+		if errors.As(err, &stockErr) {
+			return apperr.Conflict(apperr.CodeInsufficientStock, "Insufficient stock for transfer").
+				With("warehouse_id", stockErr.WarehouseID).
+				With("product_id", stockErr.ProductID).
+				With("required", stockErr.Required).
+				With("available", stockErr.Available)
 		}
 
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to process transfer",
-		})
+		return err
 	}
 
 	return c.JSON(fiber.Map{
 		"message": "Transfer processed successfully",
 	})
 }
+
+// Warehouse Assignment Handlers
+
+// @Summary Get user warehouses
+// @Description Get the warehouses a user is assigned to. Stock and transfer endpoints only act on these, unless the user's role grants warehouses:all.
+// @Tags admin
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} models.UserWarehouses
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Security BearerAuth
+// @Router /api/admin/users/{id}/warehouses [get]
+func (h *WarehouseHandler) GetUserWarehouses(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid user ID")
+	}
+
+	ids, err := h.warehouses.GetUserWarehouseIDs(userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(models.UserWarehouses{UserID: userID, WarehouseIDs: ids})
+}
+
+// @Summary Set user warehouses
+// @Description Replace the warehouses a user is assigned to
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param warehouses body models.SetUserWarehousesRequest true "Warehouse IDs"
+// @Success 200 {object} models.UserWarehouses
+// @Failure 400 {object} apperr.Problem
+// @Failure 401 {object} apperr.Problem
+// @Failure 403 {object} apperr.Problem
+// @Failure 404 {object} apperr.Problem
+// @Security BearerAuth
+// @Router /api/admin/users/{id}/warehouses [put]
+func (h *WarehouseHandler) SetUserWarehouses(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return apperr.InvalidInput("Invalid user ID")
+	}
+
+	var req models.SetUserWarehousesRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	err = h.warehouses.SetUserWarehouses(userID, req.WarehouseIDs)
+	if err != nil {
+		var userErr *repository.UserNotFoundError
+		if errors.As(err, &userErr) {
+			return apperr.NotFound("User not found")
+		}
+		var warehouseErr *repository.WarehouseNotFoundError
+		if errors.As(err, &warehouseErr) {
+			return apperr.InvalidInput("Warehouse not found").With("warehouse_id", warehouseErr.WarehouseID)
+		}
+		return err
+	}
+
+	ids, err := h.warehouses.GetUserWarehouseIDs(userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(models.UserWarehouses{UserID: userID, WarehouseIDs: ids})
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/service"
+)
+
+// APIKeyMiddleware authenticates requests with the key in the X-API-Key
+// header and saves the same locals as JWTMiddleware, plus api_key_id
+func APIKeyMiddleware(apiKeys *service.APIKeyService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(models.APIKeyHeader)
+		if key == "" {
+			return apperr.Unauthorized(apperr.CodeUnauthorized, "X-API-Key header is required")
+		}
+
+		principal, err := apiKeys.Authenticate(key)
+		if errors.Is(err, service.ErrInvalidAPIKey) {
+			return apperr.Unauthorized(apperr.CodeTokenInvalid, "Invalid API key")
+		}
+		if err != nil {
+			return err
+		}
+
+		c.Locals("user_id", principal.UserID)
+		c.Locals("role", principal.Role)
+		c.Locals("permissions", principal.Permissions)
+		c.Locals("api_key_id", principal.KeyID)
+
+		return c.Next()
+	}
+}
+
+// JWTOrAPIKey authenticates with an API key when the X-API-Key header is
+// sent and with an access token otherwise
+func JWTOrAPIKey(requireJWT, requireAPIKey fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Get(models.APIKeyHeader) != "" {
+			return requireAPIKey(c)
+		}
+		return requireJWT(c)
+	}
+}
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+// ErrorHandler renders every error a handler returns as RFC 7807 problem
+// details. Errors other than *apperr.Error are classified by type; anything
+// unknown becomes a 500 whose cause is logged and, outside production, shown.
+func ErrorHandler(production bool) fiber.ErrorHandler {
+	return func(c *fiber.Ctx, err error) error {
+		appErr := Classify(err)
+		if appErr.Status >= http.StatusInternalServerError {
+			slog.Error("request failed", "method", c.Method(), "path", c.Path(), "error", err)
+		}
+
+		c.Status(appErr.Status)
+		if err := c.JSON(appErr.Problem(c.Path(), production)); err != nil {
+			return err
+		}
+		c.Set(fiber.HeaderContentType, apperr.ContentType)
+		return nil
+	}
+}
+
+// Classify maps err to the client error it stands for
+func Classify(err error) *apperr.Error {
+	if appErr, ok := apperr.As(err); ok {
+		return appErr
+	}
+
+	var fiberErr *fiber.Error
+	var pgErr *pgconn.PgError
+	var userNotFound *repository.UserNotFoundError
+	var warehouseNotFound *repository.WarehouseNotFoundError
+	var roleNotFound *repository.RoleNotFoundError
+	var invitationNotFound *repository.InvitationNotFoundError
+	var apiKeyNotFound *repository.APIKeyNotFoundError
+	var insufficientStock *repository.InsufficientStockError
+	var insufficientWarehouseStock *repository.InsufficientWarehouseStockError
+	var hasStock *repository.WarehouseHasStockError
+	var productInUse *repository.ProductInUseError
+	var notDeletable *repository.OrderNotDeletableError
+	var notPending *repository.TransferNotPendingError
+	var invalidOperation *repository.InvalidOperationError
+	switch {
+	case errors.As(err, &fiberErr):
+		return apperr.New(fiberErr.Code, fiberCode(fiberErr.Code), fiberErr.Message)
+	case errors.As(err, &pgErr) && pgErr.Code == "23505":
+		return apperr.Wrap(err, http.StatusConflict, apperr.CodeAlreadyExists, "Resource already exists")
+	case errors.As(err, &pgErr) && pgErr.Code == "23503":
+		return apperr.Wrap(err, http.StatusConflict, apperr.CodeConflict, "Referenced resource does not exist or is still in use")
+	case errors.Is(err, pgx.ErrNoRows):
+		return apperr.Wrap(err, http.StatusNotFound, apperr.CodeNotFound, "Resource not found")
+	case errors.As(err, &userNotFound):
+		return apperr.Wrap(err, http.StatusNotFound, apperr.CodeNotFound, "User not found")
+	case errors.As(err, &warehouseNotFound):
+		return apperr.Wrap(err, http.StatusNotFound, apperr.CodeNotFound, "Warehouse not found")
+	case errors.As(err, &roleNotFound):
+		return apperr.Wrap(err, http.StatusNotFound, apperr.CodeNotFound, "Role not found")
+	case errors.As(err, &invitationNotFound):
+		return apperr.Wrap(err, http.StatusNotFound, apperr.CodeNotFound, "Invitation not found")
+	case errors.As(err, &apiKeyNotFound):
+		return apperr.Wrap(err, http.StatusNotFound, apperr.CodeNotFound, "API key not found")
+	case errors.As(err, &insufficientStock):
+		return apperr.Wrap(err, http.StatusConflict, apperr.CodeInsufficientStock,
+			fmt.Sprintf("Insufficient stock for product %d in warehouse %d: %d required, %d available",
+				insufficientStock.ProductID, insufficientStock.WarehouseID, insufficientStock.Required, insufficientStock.Available))
+	case errors.As(err, &insufficientWarehouseStock):
+		return apperr.Wrap(err, http.StatusConflict, apperr.CodeInsufficientStock,
+			fmt.Sprintf("Insufficient stock for product %d: %d required, %d available",
+				insufficientWarehouseStock.ProductID, insufficientWarehouseStock.RequiredStock, insufficientWarehouseStock.AvailableStock))
+	case errors.As(err, &hasStock):
+		return apperr.Wrap(err, http.StatusConflict, apperr.CodeWarehouseHasStock, "Warehouse still holds stock and cannot be deleted")
+	case errors.As(err, &productInUse):
+		return apperr.Wrap(err, http.StatusConflict, apperr.CodeProductInUse, "Product is part of orders and cannot be deleted")
+	case errors.As(err, &notDeletable):
+		return apperr.Wrap(err, http.StatusConflict, apperr.CodeOrderNotDeletable,
+			fmt.Sprintf("Order is %s, only pending and cancelled orders can be deleted", notDeletable.Status))
+	case errors.As(err, &notPending):
+		return apperr.Wrap(err, http.StatusConflict, apperr.CodeTransferNotPending,
+			fmt.Sprintf("Transfer is %s, only pending transfers can be changed", notPending.Status))
+	case errors.As(err, &invalidOperation):
+		return apperr.Wrap(err, http.StatusBadRequest, apperr.CodeInvalidInput, "Invalid operation "+invalidOperation.Operation)
+	}
+
+	return apperr.Internal(err)
+}
+
+// fiberCode returns the code of errors raised by Fiber itself, e.g. for
+// unknown routes or oversized bodies
+func fiberCode(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+		return apperr.CodeInvalidInput
+	case http.StatusNotFound:
+		return apperr.CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return apperr.CodeMethodNotAllowed
+	case http.StatusTooManyRequests:
+		return apperr.CodeTooManyRequests
+	}
+	if status >= http.StatusInternalServerError {
+		return apperr.CodeInternal
+	}
+	return apperr.CodeInvalidInput
+}
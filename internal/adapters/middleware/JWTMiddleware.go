@@ -1,74 +1,104 @@
 package middleware
 
 import (
+	"errors"
+	"slices"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
 	"github.com/slmbngl/OrderAplication/internal/service"
 )
 
-func JWTMiddleware() fiber.Handler {
+func JWTMiddleware(tokens *service.TokenService, revocations *service.RevocationService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		tokenStr := c.Get("Authorization")
 
 		// Check if Authorization header is present and starts with "Bearer "
 		if tokenStr == "" || !strings.HasPrefix(tokenStr, "Bearer ") {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Authorization header is required (Bearer token)",
-			})
+			return apperr.Unauthorized(apperr.CodeUnauthorized, "Authorization header is required (Bearer token)")
 		}
 
 		// Remove Bearer prefix
 		tokenStr = strings.TrimPrefix(tokenStr, "Bearer ")
 
-		token, err := service.ParseJWT(tokenStr)
-		if err != nil || !token.Valid {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid token",
-			})
+		claims, err := tokens.ParseAccessToken(tokenStr)
+		if err != nil {
+			return apperr.Unauthorized(apperr.CodeTokenInvalid, "Invalid token")
 		}
 
-		// Get user_id and role from token and save to context
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			if userID, exists := claims["user_id"]; exists {
-				c.Locals("user_id", int(userID.(float64)))
-			}
-			if role, exists := claims["role"]; exists {
-				c.Locals("role", role.(string))
+		// Logged out tokens and tokens issued before a role change are rejected
+		if err := revocations.Check(claims); err != nil {
+			if errors.Is(err, service.ErrAccessTokenRevoked) {
+				return apperr.Unauthorized(apperr.CodeTokenRevoked, "Token has been revoked")
 			}
+			return err
+		}
+
+		// Save user_id, role, permissions and session from token to context
+		c.Locals("user_id", claims.UserID)
+		c.Locals("role", claims.Role)
+		c.Locals("permissions", claims.Permissions)
+		if claims.SessionID != "" {
+			c.Locals("session_id", claims.SessionID)
+		}
+		if claims.ImpersonatorID != 0 {
+			c.Locals("impersonator_id", claims.ImpersonatorID)
 		}
 
 		return c.Next()
 	}
 }
 
-// RoleMiddleware creates a middleware that checks for specific roles
-func RoleMiddleware(allowedRoles ...string) fiber.Handler {
+// JWTOrMFAChallenge accepts an access token like JWTMiddleware or an MFA
+// challenge token, which lets users whose role requires MFA enroll before
+// their first complete login. A challenge is saved as mfa_challenge.
+func JWTOrMFAChallenge(tokens *service.TokenService, revocations *service.RevocationService,
+	mfa *service.MFAService) fiber.Handler {
+	requireJWT := JWTMiddleware(tokens, revocations)
 	return func(c *fiber.Ctx) error {
-		userRole := c.Locals("role")
-		if userRole == nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "No role information found in token",
-			})
+		tokenStr := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+
+		claims, err := mfa.ParseChallenge(tokenStr)
+		if errors.Is(err, service.ErrInvalidMFAChallenge) {
+			return requireJWT(c)
+		}
+		if err != nil {
+			return err
 		}
 
-		role := userRole.(string)
+		c.Locals("user_id", claims.UserID)
+		c.Locals("mfa_challenge", claims)
+		return c.Next()
+	}
+}
 
-		// Check if user's role is in the allowed roles
-		for _, allowedRole := range allowedRoles {
-			if role == allowedRole {
-				return c.Next()
-			}
+// RejectImpersonation refuses requests made with an impersonation token, for
+// endpoints only the user themselves may call
+func RejectImpersonation() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if _, ok := c.Locals("impersonator_id").(int); ok {
+			return apperr.Forbidden(apperr.CodeImpersonating, "Not allowed while impersonating a user")
 		}
-
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "Insufficient permissions",
-		})
+		return c.Next()
 	}
 }
 
-// AdminMiddleware is a convenience function for admin-only endpoints
-func AdminMiddleware() fiber.Handler {
-	return RoleMiddleware("admin")
+// RequirePermission creates a middleware that requires every given
+// permission in the access token
+func RequirePermission(permissions ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		granted, ok := c.Locals("permissions").([]string)
+		if !ok {
+			return apperr.Unauthorized(apperr.CodeTokenInvalid, "No permission information found in token")
+		}
+
+		for _, permission := range permissions {
+			if !slices.Contains(granted, permission) {
+				return apperr.Forbidden(apperr.CodeForbidden, "Insufficient permissions")
+			}
+		}
+
+		return c.Next()
+	}
 }
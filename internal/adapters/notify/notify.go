@@ -0,0 +1,70 @@
+// Package notify provides the notifiers that deliver service.Notification
+// messages, selected by configuration.
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/slmbngl/OrderAplication/internal/config"
+	"github.com/slmbngl/OrderAplication/internal/service"
+)
+
+// New returns the notifier selected by cfg.Notifier
+func New(cfg config.PasswordResetConfig) (service.Notifier, error) {
+	switch cfg.Notifier {
+	case "log":
+		return NewLogNotifier(), nil
+	case "file":
+		return NewFileNotifier(cfg.File), nil
+	}
+	return nil, fmt.Errorf("unknown notifier %q", cfg.Notifier)
+}
+
+// LogNotifier writes notifications, including any tokens in them, to the
+// application log
+type LogNotifier struct{}
+
+func NewLogNotifier() *LogNotifier {
+	return &LogNotifier{}
+}
+
+func (n *LogNotifier) Notify(msg service.Notification) error {
+	slog.Info("notification", "user_id", msg.UserID, "username", msg.Username,
+		"subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// FileNotifier appends notifications to a file, one JSON object per line
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+func (n *FileNotifier) Notify(msg service.Notification) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Readable by the owner only, the file holds reset tokens
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
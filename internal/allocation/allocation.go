@@ -0,0 +1,190 @@
+// Package allocation decides which warehouses the lines of an order are
+// taken from. A Strategy is given the lines and the unreserved stock of the
+// ordered products and may split a line across warehouses:
+//
+//	single_warehouse_first  a line from one warehouse if any covers it, the one with the most units
+//	closest                 warehouses nearest to the delivery location first
+//	minimise_splits         as few warehouses as possible for the whole order
+//	drain_oldest            warehouses that have held the product longest first
+package allocation
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+// Strategy names accepted by New
+const (
+	SingleWarehouseFirstName = "single_warehouse_first"
+	ClosestName              = "closest"
+	MinimiseSplitsName       = "minimise_splits"
+	DrainOldestName          = "drain_oldest"
+)
+
+// Names lists every strategy
+var Names = []string{SingleWarehouseFirstName, ClosestName, MinimiseSplitsName, DrainOldestName}
+
+// Line is a line of an order
+type Line struct {
+	ProductID int
+	Quantity  int
+}
+
+// Stock is what a warehouse can give of a product
+type Stock struct {
+	WarehouseID int
+	ProductID   int
+	Available   int
+	// When the warehouse was first stocked with the product
+	Since time.Time
+	// Where the warehouse is, if known
+	Location *models.Location
+}
+
+// Allocation takes Quantity units of the line with index Line from a
+// warehouse
+type Allocation struct {
+	Line        int
+	WarehouseID int
+	Quantity    int
+}
+
+// Strategy allocates every line of an order. The allocations of a line add
+// up to its quantity and never take more of a product from a warehouse than
+// it has available, also when several lines order the same product.
+type Strategy interface {
+	Allocate(lines []Line, stocks []Stock) ([]Allocation, error)
+}
+
+// InsufficientStockError is returned when the warehouses together cannot
+// cover a line
+type InsufficientStockError struct {
+	ProductID int
+	Required  int
+	Available int
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for product %d: required %d, available %d",
+		e.ProductID, e.Required, e.Available)
+}
+
+// New returns the strategy called name. The closest strategy sends orders to
+// shipTo; without it, it behaves like single_warehouse_first.
+func New(name string, shipTo *models.Location) (Strategy, error) {
+	switch name {
+	case SingleWarehouseFirstName:
+		return SingleWarehouseFirst{}, nil
+	case ClosestName:
+		return Closest{To: shipTo}, nil
+	case MinimiseSplitsName:
+		return MinimiseSplits{}, nil
+	case DrainOldestName:
+		return DrainOldest{}, nil
+	}
+	return nil, fmt.Errorf("unknown allocation strategy %q", name)
+}
+
+// ledger tracks the stock still available while an order is allocated
+type ledger struct {
+	stocks []Stock
+}
+
+func newLedger(stocks []Stock) *ledger {
+	return &ledger{stocks: slices.Clone(stocks)}
+}
+
+// of returns the stock of a product with units left, in warehouse order
+func (l *ledger) of(productID int) []*Stock {
+	var stocks []*Stock
+	for i := range l.stocks {
+		if l.stocks[i].ProductID == productID && l.stocks[i].Available > 0 {
+			stocks = append(stocks, &l.stocks[i])
+		}
+	}
+	slices.SortFunc(stocks, func(a, b *Stock) int { return a.WarehouseID - b.WarehouseID })
+	return stocks
+}
+
+// available returns the units of a product left in a warehouse
+func (l *ledger) available(warehouseID, productID int) int {
+	for _, s := range l.stocks {
+		if s.WarehouseID == warehouseID && s.ProductID == productID {
+			return s.Available
+		}
+	}
+	return 0
+}
+
+// fill allocates line i from stocks in the given order, taking as much as
+// each has left until the line is covered
+func (l *ledger) fill(i int, line Line, stocks []*Stock) ([]Allocation, error) {
+	var allocations []Allocation
+	remaining := line.Quantity
+	for _, s := range stocks {
+		if remaining == 0 {
+			break
+		}
+		take := min(remaining, s.Available)
+		if take <= 0 {
+			continue
+		}
+		s.Available -= take
+		remaining -= take
+		allocations = append(allocations, Allocation{Line: i, WarehouseID: s.WarehouseID, Quantity: take})
+	}
+
+	if remaining > 0 {
+		// Give back what was taken, so the error reports the full stock
+		for _, a := range allocations {
+			for _, s := range stocks {
+				if s.WarehouseID == a.WarehouseID {
+					s.Available += a.Quantity
+				}
+			}
+		}
+		total := 0
+		for _, s := range stocks {
+			total += s.Available
+		}
+		return nil, &InsufficientStockError{ProductID: line.ProductID, Required: line.Quantity, Available: total}
+	}
+	return allocations, nil
+}
+
+// allocateEach allocates the lines one by one, taking each from the stock in
+// the order returned by rank
+func allocateEach(lines []Line, stocks []Stock, rank func([]*Stock)) ([]Allocation, error) {
+	l := newLedger(stocks)
+	var allocations []Allocation
+	for i, line := range lines {
+		candidates := l.of(line.ProductID)
+		rank(candidates)
+		taken, err := l.fill(i, line, candidates)
+		if err != nil {
+			return nil, err
+		}
+		allocations = append(allocations, taken...)
+	}
+	return allocations, nil
+}
+
+// mostAvailableFirst ranks stock by the units left, most first
+func mostAvailableFirst(stocks []*Stock) {
+	slices.SortStableFunc(stocks, func(a, b *Stock) int { return b.Available - a.Available })
+}
+
+// distanceKm returns the great-circle distance between two locations
+func distanceKm(a, b models.Location) float64 {
+	const earthRadiusKm = 6371
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
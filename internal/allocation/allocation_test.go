@@ -0,0 +1,238 @@
+package allocation
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+var (
+	istanbul = &models.Location{Latitude: 41.01, Longitude: 28.98}
+	ankara   = &models.Location{Latitude: 39.93, Longitude: 32.86}
+	van      = &models.Location{Latitude: 38.49, Longitude: 43.38}
+)
+
+// allocationCase allocates lines from stocks and expects want, or an
+// InsufficientStockError equal to short
+type allocationCase struct {
+	name   string
+	lines  []Line
+	stocks []Stock
+	want   []Allocation
+	short  *InsufficientStockError
+}
+
+func runCases(t *testing.T, strategy Strategy, cases []allocationCase) {
+	t.Helper()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := strategy.Allocate(tc.lines, tc.stocks)
+			if tc.short != nil {
+				var short *InsufficientStockError
+				if !errors.As(err, &short) || *short != *tc.short {
+					t.Fatalf("Allocate() error = %v, want %v", err, tc.short)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Allocate() error = %v", err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("Allocate() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSingleWarehouseFirst(t *testing.T) {
+	runCases(t, SingleWarehouseFirst{}, []allocationCase{
+		{
+			name:   "fullest warehouse",
+			lines:  []Line{{ProductID: 1, Quantity: 5}},
+			stocks: []Stock{{WarehouseID: 1, ProductID: 1, Available: 5}, {WarehouseID: 2, ProductID: 1, Available: 8}},
+			want:   []Allocation{{Line: 0, WarehouseID: 2, Quantity: 5}},
+		},
+		{
+			name:   "tie goes to the lowest warehouse id",
+			lines:  []Line{{ProductID: 1, Quantity: 4}},
+			stocks: []Stock{{WarehouseID: 2, ProductID: 1, Available: 6}, {WarehouseID: 1, ProductID: 1, Available: 6}},
+			want:   []Allocation{{Line: 0, WarehouseID: 1, Quantity: 4}},
+		},
+		{
+			name:  "split fullest first",
+			lines: []Line{{ProductID: 1, Quantity: 9}},
+			stocks: []Stock{
+				{WarehouseID: 1, ProductID: 1, Available: 3},
+				{WarehouseID: 2, ProductID: 1, Available: 5},
+				{WarehouseID: 3, ProductID: 1, Available: 2},
+			},
+			want: []Allocation{{Line: 0, WarehouseID: 2, Quantity: 5}, {Line: 0, WarehouseID: 1, Quantity: 3}, {Line: 0, WarehouseID: 3, Quantity: 1}},
+		},
+		{
+			name:   "lines of the same product share the stock",
+			lines:  []Line{{ProductID: 1, Quantity: 4}, {ProductID: 1, Quantity: 4}},
+			stocks: []Stock{{WarehouseID: 1, ProductID: 1, Available: 5}, {WarehouseID: 2, ProductID: 1, Available: 6}},
+			want:   []Allocation{{Line: 0, WarehouseID: 2, Quantity: 4}, {Line: 1, WarehouseID: 1, Quantity: 4}},
+		},
+		{
+			name:   "insufficient total stock",
+			lines:  []Line{{ProductID: 1, Quantity: 6}},
+			stocks: []Stock{{WarehouseID: 1, ProductID: 1, Available: 3}, {WarehouseID: 2, ProductID: 1, Available: 2}},
+			short:  &InsufficientStockError{ProductID: 1, Required: 6, Available: 5},
+		},
+	})
+}
+
+func TestClosest(t *testing.T) {
+	runCases(t, Closest{To: istanbul}, []allocationCase{
+		{
+			name:  "nearest first, then split to the next nearest",
+			lines: []Line{{ProductID: 1, Quantity: 5}},
+			stocks: []Stock{
+				{WarehouseID: 1, ProductID: 1, Available: 10, Location: van},
+				{WarehouseID: 2, ProductID: 1, Available: 10, Location: ankara},
+				{WarehouseID: 3, ProductID: 1, Available: 2, Location: istanbul},
+			},
+			want: []Allocation{{Line: 0, WarehouseID: 3, Quantity: 2}, {Line: 0, WarehouseID: 2, Quantity: 3}},
+		},
+		{
+			name:  "warehouses without a location come last",
+			lines: []Line{{ProductID: 1, Quantity: 3}},
+			stocks: []Stock{
+				{WarehouseID: 1, ProductID: 1, Available: 100},
+				{WarehouseID: 2, ProductID: 1, Available: 1, Location: van},
+			},
+			want: []Allocation{{Line: 0, WarehouseID: 2, Quantity: 1}, {Line: 0, WarehouseID: 1, Quantity: 2}},
+		},
+		{
+			name:  "tie in distance goes to the fullest warehouse",
+			lines: []Line{{ProductID: 1, Quantity: 3}},
+			stocks: []Stock{
+				{WarehouseID: 1, ProductID: 1, Available: 4, Location: ankara},
+				{WarehouseID: 2, ProductID: 1, Available: 6, Location: ankara},
+			},
+			want: []Allocation{{Line: 0, WarehouseID: 2, Quantity: 3}},
+		},
+		{
+			name:   "insufficient total stock",
+			lines:  []Line{{ProductID: 1, Quantity: 4}},
+			stocks: []Stock{{WarehouseID: 1, ProductID: 1, Available: 3, Location: istanbul}},
+			short:  &InsufficientStockError{ProductID: 1, Required: 4, Available: 3},
+		},
+	})
+}
+
+func TestClosestWithoutShipTo(t *testing.T) {
+	// Without a delivery location the fullest warehouse wins, like
+	// single_warehouse_first
+	runCases(t, Closest{}, []allocationCase{
+		{
+			name:  "fullest warehouse",
+			lines: []Line{{ProductID: 1, Quantity: 5}},
+			stocks: []Stock{
+				{WarehouseID: 1, ProductID: 1, Available: 3, Location: istanbul},
+				{WarehouseID: 2, ProductID: 1, Available: 8, Location: van},
+			},
+			want: []Allocation{{Line: 0, WarehouseID: 2, Quantity: 5}},
+		},
+	})
+}
+
+func TestMinimiseSplits(t *testing.T) {
+	runCases(t, MinimiseSplits{}, []allocationCase{
+		{
+			name:  "one warehouse ships the whole order",
+			lines: []Line{{ProductID: 1, Quantity: 2}, {ProductID: 2, Quantity: 2}},
+			stocks: []Stock{
+				{WarehouseID: 1, ProductID: 1, Available: 5},
+				{WarehouseID: 2, ProductID: 2, Available: 5},
+				{WarehouseID: 3, ProductID: 1, Available: 2},
+				{WarehouseID: 3, ProductID: 2, Available: 2},
+			},
+			want: []Allocation{{Line: 0, WarehouseID: 3, Quantity: 2}, {Line: 1, WarehouseID: 3, Quantity: 2}},
+		},
+		{
+			name:   "tie goes to the lowest warehouse id",
+			lines:  []Line{{ProductID: 1, Quantity: 3}},
+			stocks: []Stock{{WarehouseID: 2, ProductID: 1, Available: 5}, {WarehouseID: 1, ProductID: 1, Available: 5}},
+			want:   []Allocation{{Line: 0, WarehouseID: 1, Quantity: 3}},
+		},
+		{
+			name:  "split prefers warehouses already shipping the order",
+			lines: []Line{{ProductID: 1, Quantity: 2}, {ProductID: 2, Quantity: 6}},
+			stocks: []Stock{
+				{WarehouseID: 1, ProductID: 1, Available: 5},
+				{WarehouseID: 1, ProductID: 2, Available: 2},
+				{WarehouseID: 2, ProductID: 2, Available: 4},
+				{WarehouseID: 3, ProductID: 2, Available: 3},
+			},
+			want: []Allocation{
+				{Line: 0, WarehouseID: 1, Quantity: 2},
+				{Line: 1, WarehouseID: 1, Quantity: 2},
+				{Line: 1, WarehouseID: 2, Quantity: 4},
+			},
+		},
+		{
+			name:   "insufficient stock left for a later line",
+			lines:  []Line{{ProductID: 1, Quantity: 3}, {ProductID: 1, Quantity: 3}},
+			stocks: []Stock{{WarehouseID: 1, ProductID: 1, Available: 5}},
+			short:  &InsufficientStockError{ProductID: 1, Required: 3, Available: 2},
+		},
+	})
+}
+
+func TestDrainOldest(t *testing.T) {
+	jan := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	feb := jan.AddDate(0, 1, 0)
+	mar := jan.AddDate(0, 2, 0)
+
+	runCases(t, DrainOldest{}, []allocationCase{
+		{
+			name:  "oldest stock first",
+			lines: []Line{{ProductID: 1, Quantity: 4}},
+			stocks: []Stock{
+				{WarehouseID: 1, ProductID: 1, Available: 5, Since: mar},
+				{WarehouseID: 2, ProductID: 1, Available: 2, Since: jan},
+				{WarehouseID: 3, ProductID: 1, Available: 10, Since: feb},
+			},
+			want: []Allocation{{Line: 0, WarehouseID: 2, Quantity: 2}, {Line: 0, WarehouseID: 3, Quantity: 2}},
+		},
+		{
+			name:  "tie goes to the lowest warehouse id",
+			lines: []Line{{ProductID: 1, Quantity: 3}},
+			stocks: []Stock{
+				{WarehouseID: 2, ProductID: 1, Available: 5, Since: jan},
+				{WarehouseID: 1, ProductID: 1, Available: 2, Since: jan},
+			},
+			want: []Allocation{{Line: 0, WarehouseID: 1, Quantity: 2}, {Line: 0, WarehouseID: 2, Quantity: 1}},
+		},
+		{
+			name:   "insufficient total stock",
+			lines:  []Line{{ProductID: 1, Quantity: 8}},
+			stocks: []Stock{{WarehouseID: 1, ProductID: 1, Available: 5, Since: jan}, {WarehouseID: 2, ProductID: 2, Available: 9, Since: jan}},
+			short:  &InsufficientStockError{ProductID: 1, Required: 8, Available: 5},
+		},
+	})
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range Names {
+		if _, err := New(name, nil); err != nil {
+			t.Fatalf("New(%q) error = %v", name, err)
+		}
+	}
+	if _, err := New("random", nil); err == nil {
+		t.Fatal("New accepted an unknown strategy")
+	}
+
+	strategy, err := New(ClosestName, istanbul)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closest, ok := strategy.(Closest); !ok || closest.To != istanbul {
+		t.Fatalf("New(%q) = %#v, want Closest to the ship_to location", ClosestName, strategy)
+	}
+}
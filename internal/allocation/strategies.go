@@ -0,0 +1,147 @@
+package allocation
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+// SingleWarehouseFirst takes each line from the warehouse with the most
+// units of the product. A line larger than any warehouse holds is split,
+// taking from the fullest warehouses first.
+type SingleWarehouseFirst struct{}
+
+func (SingleWarehouseFirst) Allocate(lines []Line, stocks []Stock) ([]Allocation, error) {
+	return allocateEach(lines, stocks, mostAvailableFirst)
+}
+
+// Closest takes each line from the warehouses nearest to To. Warehouses
+// without a location come after those with one, fullest first.
+type Closest struct {
+	To *models.Location
+}
+
+func (c Closest) Allocate(lines []Line, stocks []Stock) ([]Allocation, error) {
+	return allocateEach(lines, stocks, func(stocks []*Stock) {
+		mostAvailableFirst(stocks)
+		if c.To == nil {
+			return
+		}
+		slices.SortStableFunc(stocks, func(a, b *Stock) int {
+			switch {
+			case a.Location == nil && b.Location == nil:
+				return 0
+			case a.Location == nil:
+				return 1
+			case b.Location == nil:
+				return -1
+			}
+			return cmp.Compare(distanceKm(*c.To, *a.Location), distanceKm(*c.To, *b.Location))
+		})
+	})
+}
+
+// DrainOldest takes each line from the warehouses that have held the
+// product the longest, so old stock leaves first
+type DrainOldest struct{}
+
+func (DrainOldest) Allocate(lines []Line, stocks []Stock) ([]Allocation, error) {
+	return allocateEach(lines, stocks, func(stocks []*Stock) {
+		slices.SortStableFunc(stocks, func(a, b *Stock) int { return a.Since.Compare(b.Since) })
+	})
+}
+
+// MinimiseSplits ships the order from as few warehouses as possible. It
+// repeatedly picks the warehouse that can cover the most of the remaining
+// lines in full and takes those lines from it. Lines no single warehouse
+// covers are then split, preferring warehouses already shipping the order.
+type MinimiseSplits struct{}
+
+func (MinimiseSplits) Allocate(lines []Line, stocks []Stock) ([]Allocation, error) {
+	l := newLedger(stocks)
+	allocations := make([][]Allocation, len(lines))
+	used := map[int]bool{}
+
+	open := make([]int, len(lines))
+	for i := range open {
+		open[i] = i
+	}
+	for len(open) > 0 {
+		best, covered := 0, []int(nil)
+		for _, warehouseID := range warehouseIDs(stocks) {
+			if lines := coverable(l, warehouseID, lines, open); len(lines) > len(covered) {
+				best, covered = warehouseID, lines
+			}
+		}
+		if len(covered) == 0 {
+			break
+		}
+
+		used[best] = true
+		for _, i := range covered {
+			for _, s := range l.of(lines[i].ProductID) {
+				if s.WarehouseID == best {
+					s.Available -= lines[i].Quantity
+				}
+			}
+			allocations[i] = []Allocation{{Line: i, WarehouseID: best, Quantity: lines[i].Quantity}}
+		}
+		open = slices.DeleteFunc(open, func(i int) bool { return allocations[i] != nil })
+	}
+
+	for _, i := range open {
+		candidates := l.of(lines[i].ProductID)
+		mostAvailableFirst(candidates)
+		slices.SortStableFunc(candidates, func(a, b *Stock) int {
+			return compareBool(used[b.WarehouseID], used[a.WarehouseID])
+		})
+		taken, err := l.fill(i, lines[i], candidates)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range taken {
+			used[a.WarehouseID] = true
+		}
+		allocations[i] = taken
+	}
+
+	return slices.Concat(allocations...), nil
+}
+
+// coverable returns the open lines a warehouse can cover in full together
+func coverable(l *ledger, warehouseID int, lines []Line, open []int) []int {
+	left := map[int]int{}
+	var covered []int
+	for _, i := range open {
+		productID := lines[i].ProductID
+		if _, ok := left[productID]; !ok {
+			left[productID] = l.available(warehouseID, productID)
+		}
+		if left[productID] >= lines[i].Quantity {
+			left[productID] -= lines[i].Quantity
+			covered = append(covered, i)
+		}
+	}
+	return covered
+}
+
+// warehouseIDs returns the distinct warehouses of stocks in ascending order
+func warehouseIDs(stocks []Stock) []int {
+	var ids []int
+	for _, s := range stocks {
+		ids = append(ids, s.WarehouseID)
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/adapters/handler"
+	"github.com/slmbngl/OrderAplication/internal/adapters/notify"
+	"github.com/slmbngl/OrderAplication/internal/config"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+	"github.com/slmbngl/OrderAplication/internal/repository/memory"
+	"github.com/slmbngl/OrderAplication/internal/service"
+)
+
+// Repositories groups the repository implementations used by the handlers
+type Repositories struct {
+	Users          repository.UserRepository
+	Sessions       repository.SessionRepository
+	Denylist       repository.AccessTokenDenylist
+	Invitations    repository.InvitationRepository
+	Roles          repository.RoleRepository
+	LoginAttempts  repository.LoginAttemptRepository
+	Audit          repository.AuditRepository
+	MFA            repository.MFARepository
+	PasswordResets repository.PasswordResetRepository
+	APIKeys        repository.APIKeyRepository
+	Orders         repository.OrderRepository
+	Products       repository.ProductRepository
+	Warehouses     repository.WarehouseRepository
+}
+
+// Handlers groups the HTTP handlers registered by routes.SetupRoutes
+type Handlers struct {
+	Auth        *handler.AuthHandler
+	Sessions    *handler.SessionHandler
+	Invitations *handler.InvitationHandler
+	Roles       *handler.RoleHandler
+	Security    *handler.SecurityHandler
+	Accounts    *handler.AccountHandler
+	Users       *handler.UserHandler
+	APIKeys     *handler.APIKeyHandler
+	Orders      *handler.OrderHandler
+	Products    *handler.ProductHandler
+	Warehouses  *handler.WarehouseHandler
+}
+
+// Application is the fully wired object graph, built once in main
+type Application struct {
+	Config        *config.Config
+	Tokens        *service.TokenService
+	RefreshTokens *service.RefreshTokenService
+	Revocations   *service.RevocationService
+	Invitations   *service.InvitationService
+	Roles         *service.RoleService
+	Lockout       *service.LockoutService
+	MFA           *service.MFAService
+	Accounts      *service.AccountService
+	Users         *service.UserService
+	APIKeys       *service.APIKeyService
+	Orders        *service.OrderService
+	Passwords     service.PasswordHasher
+	Repositories  Repositories
+	Handlers      Handlers
+}
+
+// NewPostgresRepositories builds the PostgreSQL backed repositories. The
+// querier may be a pool or a transaction.
+func NewPostgresRepositories(q db.Querier) Repositories {
+	return Repositories{
+		Users:          repository.NewUserRepository(q),
+		Sessions:       repository.NewSessionRepository(q),
+		Denylist:       repository.NewAccessTokenDenylist(q),
+		Invitations:    repository.NewInvitationRepository(q),
+		Roles:          repository.NewRoleRepository(q),
+		LoginAttempts:  repository.NewLoginAttemptRepository(q),
+		Audit:          repository.NewAuditRepository(q),
+		MFA:            repository.NewMFARepository(q),
+		PasswordResets: repository.NewPasswordResetRepository(q),
+		APIKeys:        repository.NewAPIKeyRepository(q),
+		Orders:         repository.NewOrderRepository(q),
+		Products:       repository.NewProductRepository(q),
+		Warehouses:     repository.NewWarehouseRepository(q),
+	}
+}
+
+// New wires the application against a PostgreSQL pool
+func New(cfg *config.Config, pool *pgxpool.Pool) (*Application, error) {
+	repos := NewPostgresRepositories(pool)
+	if cfg.JWT.DenylistStore == "memory" {
+		repos.Denylist = memory.NewAccessTokenDenylist()
+	}
+	return NewWithRepositories(cfg, repos)
+}
+
+// NewWithRepositories wires the application around the given repositories,
+// which lets tests swap in alternative implementations.
+func NewWithRepositories(cfg *config.Config, repos Repositories) (*Application, error) {
+	tokens, err := service.NewTokenService(cfg.JWT)
+	if err != nil {
+		return nil, err
+	}
+	revocations := service.NewRevocationService(repos.Denylist, repos.Users, cfg.JWT)
+	refreshTokens := service.NewRefreshTokenService(repos.Users, repos.Sessions, revocations, cfg.JWT)
+	passwords, err := service.NewPasswordHasher(cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+	roles := service.NewRoleService(repos.Roles, repos.Users)
+	invitations := service.NewInvitationService(repos.Invitations, repos.Users, roles, passwords)
+	lockout := service.NewLockoutService(repos.LoginAttempts, repos.Audit, cfg.Lockout)
+	mfa := service.NewMFAService(repos.MFA, repos.Users, repos.Audit, tokens, lockout, cfg.MFA)
+	notifier, err := notify.New(cfg.PasswordReset)
+	if err != nil {
+		return nil, err
+	}
+	accounts := service.NewAccountService(repos.Users, repos.PasswordResets, repos.Audit,
+		refreshTokens, revocations, lockout, roles, passwords, notifier, cfg.PasswordReset)
+	users := service.NewUserService(repos.Users, repos.Orders, repos.Audit,
+		refreshTokens, roles, tokens, accounts, passwords)
+	apiKeys := service.NewAPIKeyService(repos.APIKeys, repos.Users, roles, repos.Audit)
+	orders := service.NewOrderService(repos.Orders, cfg.Orders)
+
+	return &Application{
+		Config:        cfg,
+		Tokens:        tokens,
+		RefreshTokens: refreshTokens,
+		Revocations:   revocations,
+		Invitations:   invitations,
+		Roles:         roles,
+		Lockout:       lockout,
+		MFA:           mfa,
+		Accounts:      accounts,
+		Users:         users,
+		APIKeys:       apiKeys,
+		Orders:        orders,
+		Passwords:     passwords,
+		Repositories:  repos,
+		Handlers: Handlers{
+			Auth:        handler.NewAuthHandler(repos.Users, tokens, refreshTokens, revocations, roles, lockout, mfa, accounts, passwords),
+			Sessions:    handler.NewSessionHandler(refreshTokens),
+			Invitations: handler.NewInvitationHandler(invitations),
+			Roles:       handler.NewRoleHandler(roles),
+			Security:    handler.NewSecurityHandler(repos.Users, lockout, mfa, repos.Audit),
+			Accounts:    handler.NewAccountHandler(accounts),
+			Users:       handler.NewUserHandler(users, accounts),
+			APIKeys:     handler.NewAPIKeyHandler(apiKeys),
+			Orders:      handler.NewOrderHandler(repos.Orders, orders),
+			Products:    handler.NewProductHandler(repos.Products, repos.Warehouses),
+			Warehouses:  handler.NewWarehouseHandler(repos.Warehouses),
+		},
+	}, nil
+}
+
+// Start runs the application's background jobs until ctx is cancelled
+func (a *Application) Start(ctx context.Context) {
+	go a.Tokens.Keys().Run(ctx)
+	go a.RefreshTokens.RunSweeper(ctx, a.Config.JWT.RefreshTokenSweepInterval)
+	go a.Revocations.RunSweeper(ctx, a.Config.JWT.DenylistSweepInterval)
+	go a.Lockout.RunSweeper(ctx, a.Config.Lockout.SweepInterval)
+	go a.Accounts.RunSweeper(ctx, a.Config.PasswordReset.SweepInterval)
+	go a.Orders.RunSweeper(ctx, a.Config.Orders.ReservationSweepInterval)
+}
@@ -0,0 +1,130 @@
+// Package apperr defines the errors handlers return to clients. An Error
+// carries the HTTP status, a stable machine-readable code that clients can
+// branch on and a message safe to show; the cause, if any, stays internal.
+// The error handler of the application renders them as RFC 7807 problem
+// details.
+package apperr
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Stable error codes. Clients rely on them, so existing codes must not change.
+const (
+	CodeInvalidInput       = "invalid_input"
+	CodeUnauthorized       = "unauthorized"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeTokenInvalid       = "token_invalid"
+	CodeTokenRevoked       = "token_revoked"
+	CodeForbidden          = "forbidden"
+	CodeImpersonating      = "impersonation_not_allowed"
+	CodeGrantNotAllowed    = "grant_not_allowed"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeConflict           = "conflict"
+	CodeAlreadyExists      = "already_exists"
+	CodeInsufficientStock  = "insufficient_stock"
+	CodeWarehouseHasStock  = "warehouse_has_stock"
+	CodeProductInUse       = "product_in_use"
+	CodeTransferNotPending = "transfer_not_pending"
+	CodeIllegalTransition  = "illegal_transition"
+	CodeOrderNotDeletable  = "order_not_deletable"
+	CodeWeakPassword       = "weak_password"
+	CodeWrongPassword      = "wrong_password"
+	CodeLastAdmin          = "last_admin"
+	CodeAccountInactive    = "account_inactive"
+	CodeMFARequired        = "mfa_required"
+	CodeMFAInvalidCode     = "mfa_invalid_code"
+	CodeMFAState           = "mfa_state_conflict"
+	CodeLoginLocked        = "login_locked"
+	CodeTooManyRequests    = "too_many_requests"
+	CodeInternal           = "internal_error"
+)
+
+// Error is an error meant for the client
+type Error struct {
+	Status int
+	Code   string
+	// Detail explains this occurrence of the problem to the client
+	Detail string
+	// Err is the underlying cause, logged but never shown in production
+	Err error
+	// Extensions are additional members of the problem details
+	Extensions map[string]any
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Code + ": " + e.Detail + ": " + e.Err.Error()
+	}
+	return e.Code + ": " + e.Detail
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// With adds the member key to the problem details of e and returns e
+func (e *Error) With(key string, value any) *Error {
+	if e.Extensions == nil {
+		e.Extensions = map[string]any{}
+	}
+	e.Extensions[key] = value
+	return e
+}
+
+// New returns an error with the given status, code and detail
+func New(status int, code, detail string) *Error {
+	return &Error{Status: status, Code: code, Detail: detail}
+}
+
+// Wrap returns an error with the given status, code and detail caused by err
+func Wrap(err error, status int, code, detail string) *Error {
+	return &Error{Status: status, Code: code, Detail: detail, Err: err}
+}
+
+// InvalidInput reports a malformed request
+func InvalidInput(detail string) *Error {
+	return New(http.StatusBadRequest, CodeInvalidInput, detail)
+}
+
+// BadRequest reports a request the server refuses for a reason given by code
+func BadRequest(code, detail string) *Error {
+	return New(http.StatusBadRequest, code, detail)
+}
+
+// Unauthorized reports missing or invalid credentials
+func Unauthorized(code, detail string) *Error {
+	return New(http.StatusUnauthorized, code, detail)
+}
+
+// Forbidden reports an authenticated caller lacking the right to act
+func Forbidden(code, detail string) *Error {
+	return New(http.StatusForbidden, code, detail)
+}
+
+// NotFound reports a missing resource
+func NotFound(detail string) *Error {
+	return New(http.StatusNotFound, CodeNotFound, detail)
+}
+
+// Conflict reports a request that clashes with the current state
+func Conflict(code, detail string) *Error {
+	return New(http.StatusConflict, code, detail)
+}
+
+// Internal wraps an unexpected error. Its detail is generic; the cause is
+// only shown outside production.
+func Internal(err error) *Error {
+	return Wrap(err, http.StatusInternalServerError, CodeInternal, "Internal server error")
+}
+
+// As returns err as an *Error if it is or wraps one
+func As(err error) (*Error, bool) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e, true
+	}
+	return nil, false
+}
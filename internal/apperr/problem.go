@@ -0,0 +1,61 @@
+package apperr
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ContentType is the media type of problem details
+const ContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object, extended with the stable
+// error code
+type Problem struct {
+	Type     string `json:"type" example:"about:blank"`
+	Title    string `json:"title" example:"Conflict"`
+	Status   int    `json:"status" example:"409"`
+	Detail   string `json:"detail,omitempty" example:"Insufficient stock for product 3: 2 required, 1 available"`
+	Instance string `json:"instance,omitempty" example:"/api/orders/7/status"`
+	Code     string `json:"code" example:"insufficient_stock"`
+	// Cause is the underlying error, only set outside production
+	Cause string `json:"cause,omitempty"`
+	// Extensions are rendered as additional top-level members
+	Extensions map[string]any `json:"-"`
+}
+
+// MarshalJSON renders the extension members next to the standard ones
+func (p Problem) MarshalJSON() ([]byte, error) {
+	type problem Problem
+	data, err := json.Marshal(problem(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return data, err
+	}
+
+	members := make(map[string]any, len(p.Extensions))
+	for key, value := range p.Extensions {
+		members[key] = value
+	}
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+	return json.Marshal(members)
+}
+
+// Problem describes e for the request path instance. The cause is left out
+// in production, where it could leak internals such as SQL errors.
+func (e *Error) Problem(instance string, production bool) Problem {
+	p := Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(e.Status),
+		Status:   e.Status,
+		Detail:   e.Detail,
+		Instance: instance,
+		Code:     e.Code,
+
+		Extensions: e.Extensions,
+	}
+	if !production && e.Err != nil {
+		p.Cause = e.Err.Error()
+	}
+	return p
+}
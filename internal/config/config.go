@@ -0,0 +1,562 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting the application reads at startup.
+// Values are resolved in order: defaults, config file, environment, flags.
+type Config struct {
+	Server        ServerConfig        `yaml:"server"`
+	Database      DatabaseConfig      `yaml:"database"`
+	JWT           JWTConfig           `yaml:"jwt"`
+	Password      PasswordConfig      `yaml:"password"`
+	Lockout       LockoutConfig       `yaml:"lockout"`
+	MFA           MFAConfig           `yaml:"mfa"`
+	PasswordReset PasswordResetConfig `yaml:"password_reset"`
+	Orders        OrdersConfig        `yaml:"orders"`
+	CORS          CORSConfig          `yaml:"cors"`
+	Log           LogConfig           `yaml:"log"`
+}
+
+type ServerConfig struct {
+	ListenAddr string `yaml:"listen_addr"`
+	// Environment is development or production. Error responses include
+	// the underlying cause only in development.
+	Environment string `yaml:"environment"`
+}
+
+type DatabaseConfig struct {
+	URL         string `yaml:"url"`
+	MaxConns    int32  `yaml:"max_conns"`
+	MinConns    int32  `yaml:"min_conns"`
+	AutoMigrate bool   `yaml:"auto_migrate"`
+}
+
+// JWKSMaxAge is how long clients may cache /.well-known/jwks.json and
+// KeyReloadInterval how often instances reload jwt.keys_dir. A new signing
+// key is published for at least both before it signs.
+const (
+	JWKSMaxAge        = 5 * time.Minute
+	KeyReloadInterval = time.Minute
+)
+
+// JWTConfig selects how access tokens are signed. HS256 with a shared secret
+// is meant for local development; RS256 and EdDSA sign with rotating keys
+// that other services verify through /.well-known/jwks.json.
+type JWTConfig struct {
+	Algorithm        string        `yaml:"algorithm"`
+	Secret           string        `yaml:"secret"`
+	KeysDir          string        `yaml:"keys_dir"`
+	RotationInterval time.Duration `yaml:"rotation_interval"`
+	// How long a new key is published before it signs
+	KeyPublishDelay time.Duration `yaml:"key_publish_delay"`
+	// Whether this instance creates and retires keys. Of several instances
+	// sharing keys_dir exactly one must be the rotator.
+	KeyRotator      bool          `yaml:"key_rotator"`
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+	// How often expired refresh tokens are purged
+	RefreshTokenSweepInterval time.Duration `yaml:"refresh_token_sweep_interval"`
+	// Where revoked access tokens are kept: "postgres" or, for a single
+	// instance, "memory"
+	DenylistStore string `yaml:"denylist_store"`
+	// How often denylist entries of expired tokens are purged
+	DenylistSweepInterval time.Duration `yaml:"denylist_sweep_interval"`
+}
+
+// PasswordConfig selects the algorithm used to hash new passwords. Hashes
+// produced with another algorithm or weaker parameters are upgraded on login.
+type PasswordConfig struct {
+	Algorithm  string       `yaml:"algorithm"`
+	Argon2     Argon2Config `yaml:"argon2"`
+	BcryptCost int          `yaml:"bcrypt_cost"`
+}
+
+type Argon2Config struct {
+	MemoryKiB   int `yaml:"memory_kib"`
+	Iterations  int `yaml:"iterations"`
+	Parallelism int `yaml:"parallelism"`
+}
+
+// LockoutConfig controls brute-force protection on login. After Threshold
+// failed attempts for one account, or IPThreshold from one address, logins
+// are refused for BaseDelay, doubling with every further failure up to
+// MaxDelay. Failures are forgotten after ResetAfter without a new one, and
+// purged by a sweep every SweepInterval.
+type LockoutConfig struct {
+	Threshold int `yaml:"threshold"`
+	// 0 disables per-address tracking, e.g. behind a proxy that hides
+	// client addresses
+	IPThreshold   int           `yaml:"ip_threshold"`
+	BaseDelay     time.Duration `yaml:"base_delay"`
+	MaxDelay      time.Duration `yaml:"max_delay"`
+	ResetAfter    time.Duration `yaml:"reset_after"`
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+}
+
+// MFAConfig controls TOTP two-factor authentication. Users with one of
+// RequiredRoles must enroll before they can log in; everyone else may opt in.
+type MFAConfig struct {
+	// Shown as the account's provider in authenticator apps
+	Issuer        string   `yaml:"issuer"`
+	RequiredRoles []string `yaml:"required_roles"`
+	// How long the challenge token returned by login stays valid
+	ChallengeTTL time.Duration `yaml:"challenge_ttl"`
+}
+
+// PasswordResetConfig controls the password reset flow. Reset tokens are
+// handed to a notifier: "log" writes them to the application log and "file"
+// appends them to File, both meant for local use until a real delivery
+// channel is plugged in. Expired tokens are purged every SweepInterval.
+type PasswordResetConfig struct {
+	TokenTTL      time.Duration `yaml:"token_ttl"`
+	Notifier      string        `yaml:"notifier"`
+	File          string        `yaml:"file"`
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+}
+
+// OrdersConfig controls stock reservations. Placing an order reserves its
+// items in the warehouses chosen by AllocationStrategy; orders still pending
+// after ReservationTTL are cancelled, releasing the stock, by a sweep every
+// ReservationSweepInterval.
+type OrdersConfig struct {
+	AllocationStrategy       string        `yaml:"allocation_strategy"`
+	ReservationTTL           time.Duration `yaml:"reservation_ttl"`
+	ReservationSweepInterval time.Duration `yaml:"reservation_sweep_interval"`
+}
+
+type CORSConfig struct {
+	AllowOrigins []string `yaml:"allow_origins"`
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"`
+}
+
+// FieldError describes a single invalid configuration value.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationError lists every invalid field found while loading.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString("invalid configuration:")
+	for _, f := range e.Fields {
+		b.WriteString("\n  - ")
+		b.WriteString(f.Field)
+		b.WriteString(": ")
+		b.WriteString(f.Message)
+	}
+	return b.String()
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Default returns the configuration used when nothing else is specified.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			ListenAddr:  ":4504",
+			Environment: "production",
+		},
+		Database: DatabaseConfig{
+			MaxConns:    10,
+			MinConns:    0,
+			AutoMigrate: true,
+		},
+		JWT: JWTConfig{
+			Algorithm:        "HS256",
+			RotationInterval: 30 * 24 * time.Hour,
+			KeyPublishDelay:  10 * time.Minute,
+			KeyRotator:       true,
+			AccessTokenTTL:   15 * time.Minute,
+			RefreshTokenTTL:  7 * 24 * time.Hour,
+
+			RefreshTokenSweepInterval: time.Hour,
+			DenylistStore:             "postgres",
+			DenylistSweepInterval:     time.Hour,
+		},
+		Password: PasswordConfig{
+			Algorithm: "argon2id",
+			Argon2: Argon2Config{
+				MemoryKiB:   64 * 1024,
+				Iterations:  3,
+				Parallelism: 2,
+			},
+			BcryptCost: 12,
+		},
+		Lockout: LockoutConfig{
+			Threshold:     5,
+			IPThreshold:   20,
+			BaseDelay:     time.Minute,
+			MaxDelay:      time.Hour,
+			ResetAfter:    24 * time.Hour,
+			SweepInterval: time.Hour,
+		},
+		MFA: MFAConfig{
+			Issuer:        "OrderApp",
+			RequiredRoles: []string{"admin"},
+			ChallengeTTL:  5 * time.Minute,
+		},
+		PasswordReset: PasswordResetConfig{
+			TokenTTL:      time.Hour,
+			Notifier:      "log",
+			File:          "notifications.log",
+			SweepInterval: time.Hour,
+		},
+		Orders: OrdersConfig{
+			AllocationStrategy:       "single_warehouse_first",
+			ReservationTTL:           24 * time.Hour,
+			ReservationSweepInterval: 5 * time.Minute,
+		},
+		CORS: CORSConfig{
+			AllowOrigins: []string{"*"},
+		},
+		Log: LogConfig{
+			Level: "info",
+		},
+	}
+}
+
+// Load builds the configuration from an optional YAML file, environment
+// variables and command line flags, and validates the result. The file is
+// taken from the -config flag or the CONFIG_FILE environment variable.
+// Positional arguments left after flag parsing are returned for subcommands.
+func Load(args []string) (*Config, []string, error) {
+	cfg := Default()
+	verr := &ValidationError{}
+
+	fs := flag.NewFlagSet("orderapp", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	listenAddr := fs.String("listen", "", "listen address, e.g. :4504")
+	databaseURL := fs.String("database-url", "", "PostgreSQL connection string")
+	logLevel := fs.String("log-level", "", "log level (debug, info, warn, error)")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configFile != "" {
+		if err := loadFile(cfg, *configFile); err != nil {
+			verr.add("config", "%v", err)
+		}
+	}
+
+	loadEnv(cfg, verr)
+
+	// Flags take precedence over everything else
+	if *listenAddr != "" {
+		cfg.Server.ListenAddr = *listenAddr
+	}
+	if *databaseURL != "" {
+		cfg.Database.URL = *databaseURL
+	}
+	if *logLevel != "" {
+		cfg.Log.Level = *logLevel
+	}
+
+	cfg.validate(verr)
+	if len(verr.Fields) > 0 {
+		return nil, nil, verr
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	// An empty file decodes to io.EOF and simply leaves the defaults in place
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+func loadEnv(cfg *Config, verr *ValidationError) {
+	envString("LISTEN_ADDR", &cfg.Server.ListenAddr)
+	envString("APP_ENV", &cfg.Server.Environment)
+	envString("DATABASE_URL", &cfg.Database.URL)
+	envInt32("DATABASE_MAX_CONNS", "database.max_conns", &cfg.Database.MaxConns, verr)
+	envInt32("DATABASE_MIN_CONNS", "database.min_conns", &cfg.Database.MinConns, verr)
+	envBool("DATABASE_AUTO_MIGRATE", "database.auto_migrate", &cfg.Database.AutoMigrate, verr)
+	envString("JWT_ALGORITHM", &cfg.JWT.Algorithm)
+	envString("JWT_SECRET", &cfg.JWT.Secret)
+	envString("JWT_KEYS_DIR", &cfg.JWT.KeysDir)
+	envDuration("JWT_ROTATION_INTERVAL", "jwt.rotation_interval", &cfg.JWT.RotationInterval, verr)
+	envDuration("JWT_KEY_PUBLISH_DELAY", "jwt.key_publish_delay", &cfg.JWT.KeyPublishDelay, verr)
+	envBool("JWT_KEY_ROTATOR", "jwt.key_rotator", &cfg.JWT.KeyRotator, verr)
+	envDuration("JWT_ACCESS_TOKEN_TTL", "jwt.access_token_ttl", &cfg.JWT.AccessTokenTTL, verr)
+	envDuration("JWT_REFRESH_TOKEN_TTL", "jwt.refresh_token_ttl", &cfg.JWT.RefreshTokenTTL, verr)
+	envDuration("JWT_REFRESH_TOKEN_SWEEP_INTERVAL", "jwt.refresh_token_sweep_interval", &cfg.JWT.RefreshTokenSweepInterval, verr)
+	envString("JWT_DENYLIST_STORE", &cfg.JWT.DenylistStore)
+	envDuration("JWT_DENYLIST_SWEEP_INTERVAL", "jwt.denylist_sweep_interval", &cfg.JWT.DenylistSweepInterval, verr)
+	envString("PASSWORD_ALGORITHM", &cfg.Password.Algorithm)
+	envInt("PASSWORD_ARGON2_MEMORY_KIB", "password.argon2.memory_kib", &cfg.Password.Argon2.MemoryKiB, verr)
+	envInt("PASSWORD_ARGON2_ITERATIONS", "password.argon2.iterations", &cfg.Password.Argon2.Iterations, verr)
+	envInt("PASSWORD_ARGON2_PARALLELISM", "password.argon2.parallelism", &cfg.Password.Argon2.Parallelism, verr)
+	envInt("PASSWORD_BCRYPT_COST", "password.bcrypt_cost", &cfg.Password.BcryptCost, verr)
+	envInt("LOCKOUT_THRESHOLD", "lockout.threshold", &cfg.Lockout.Threshold, verr)
+	envInt("LOCKOUT_IP_THRESHOLD", "lockout.ip_threshold", &cfg.Lockout.IPThreshold, verr)
+	envDuration("LOCKOUT_BASE_DELAY", "lockout.base_delay", &cfg.Lockout.BaseDelay, verr)
+	envDuration("LOCKOUT_MAX_DELAY", "lockout.max_delay", &cfg.Lockout.MaxDelay, verr)
+	envDuration("LOCKOUT_RESET_AFTER", "lockout.reset_after", &cfg.Lockout.ResetAfter, verr)
+	envDuration("LOCKOUT_SWEEP_INTERVAL", "lockout.sweep_interval", &cfg.Lockout.SweepInterval, verr)
+	envString("MFA_ISSUER", &cfg.MFA.Issuer)
+	envList("MFA_REQUIRED_ROLES", &cfg.MFA.RequiredRoles)
+	envDuration("MFA_CHALLENGE_TTL", "mfa.challenge_ttl", &cfg.MFA.ChallengeTTL, verr)
+	envDuration("PASSWORD_RESET_TOKEN_TTL", "password_reset.token_ttl", &cfg.PasswordReset.TokenTTL, verr)
+	envString("PASSWORD_RESET_NOTIFIER", &cfg.PasswordReset.Notifier)
+	envString("PASSWORD_RESET_FILE", &cfg.PasswordReset.File)
+	envDuration("PASSWORD_RESET_SWEEP_INTERVAL", "password_reset.sweep_interval", &cfg.PasswordReset.SweepInterval, verr)
+	envString("ORDER_ALLOCATION_STRATEGY", &cfg.Orders.AllocationStrategy)
+	envDuration("ORDER_RESERVATION_TTL", "orders.reservation_ttl", &cfg.Orders.ReservationTTL, verr)
+	envDuration("ORDER_RESERVATION_SWEEP_INTERVAL", "orders.reservation_sweep_interval", &cfg.Orders.ReservationSweepInterval, verr)
+	envList("CORS_ALLOW_ORIGINS", &cfg.CORS.AllowOrigins)
+	envString("LOG_LEVEL", &cfg.Log.Level)
+}
+
+func (c *Config) validate(verr *ValidationError) {
+	if c.Server.ListenAddr == "" {
+		verr.add("server.listen_addr", "must be set")
+	}
+	if c.Server.Environment != "development" && c.Server.Environment != "production" {
+		verr.add("server.environment", "must be development or production, got %q", c.Server.Environment)
+	}
+
+	if c.Database.URL == "" {
+		verr.add("database.url", "must be set (DATABASE_URL)")
+	}
+	if c.Database.MaxConns < 1 {
+		verr.add("database.max_conns", "must be at least 1, got %d", c.Database.MaxConns)
+	}
+	if c.Database.MinConns < 0 || c.Database.MinConns > c.Database.MaxConns {
+		verr.add("database.min_conns", "must be between 0 and max_conns (%d), got %d",
+			c.Database.MaxConns, c.Database.MinConns)
+	}
+
+	switch c.JWT.Algorithm {
+	case "HS256":
+		if len(c.JWT.Secret) < 32 {
+			verr.add("jwt.secret", "must be at least 32 characters (JWT_SECRET)")
+		}
+	case "RS256", "EdDSA":
+		if c.JWT.RotationInterval < 0 {
+			verr.add("jwt.rotation_interval", "must not be negative")
+		} else if c.JWT.RotationInterval > 0 && c.JWT.RotationInterval <= c.JWT.AccessTokenTTL {
+			verr.add("jwt.rotation_interval", "must be longer than the access token ttl")
+		}
+		if minDelay := JWKSMaxAge + KeyReloadInterval; c.JWT.KeyPublishDelay < minDelay {
+			verr.add("jwt.key_publish_delay", "must be at least %s, the JWKS cache lifetime plus the key reload interval", minDelay)
+		} else if c.JWT.RotationInterval > 0 && c.JWT.KeyPublishDelay >= c.JWT.RotationInterval {
+			verr.add("jwt.key_publish_delay", "must be shorter than the rotation interval")
+		}
+	default:
+		verr.add("jwt.algorithm", "must be HS256, RS256 or EdDSA, got %q", c.JWT.Algorithm)
+	}
+	if c.JWT.AccessTokenTTL <= 0 {
+		verr.add("jwt.access_token_ttl", "must be positive")
+	}
+	if c.JWT.RefreshTokenTTL <= c.JWT.AccessTokenTTL {
+		verr.add("jwt.refresh_token_ttl", "must be longer than the access token ttl")
+	}
+	if c.JWT.RefreshTokenSweepInterval <= 0 {
+		verr.add("jwt.refresh_token_sweep_interval", "must be positive")
+	}
+	if c.JWT.DenylistStore != "postgres" && c.JWT.DenylistStore != "memory" {
+		verr.add("jwt.denylist_store", "must be postgres or memory, got %q", c.JWT.DenylistStore)
+	}
+	if c.JWT.DenylistSweepInterval <= 0 {
+		verr.add("jwt.denylist_sweep_interval", "must be positive")
+	}
+
+	switch c.Password.Algorithm {
+	case "argon2id":
+		if c.Password.Argon2.MemoryKiB < 8*c.Password.Argon2.Parallelism {
+			verr.add("password.argon2.memory_kib", "must be at least 8 KiB per thread, got %d", c.Password.Argon2.MemoryKiB)
+		}
+		if c.Password.Argon2.Iterations < 1 {
+			verr.add("password.argon2.iterations", "must be at least 1, got %d", c.Password.Argon2.Iterations)
+		}
+		if c.Password.Argon2.Parallelism < 1 || c.Password.Argon2.Parallelism > 255 {
+			verr.add("password.argon2.parallelism", "must be between 1 and 255, got %d", c.Password.Argon2.Parallelism)
+		}
+	case "bcrypt":
+		if c.Password.BcryptCost < 4 || c.Password.BcryptCost > 31 {
+			verr.add("password.bcrypt_cost", "must be between 4 and 31, got %d", c.Password.BcryptCost)
+		}
+	default:
+		verr.add("password.algorithm", "must be argon2id or bcrypt, got %q", c.Password.Algorithm)
+	}
+
+	if c.Lockout.Threshold < 1 {
+		verr.add("lockout.threshold", "must be at least 1, got %d", c.Lockout.Threshold)
+	}
+	if c.Lockout.IPThreshold < 0 {
+		verr.add("lockout.ip_threshold", "must not be negative, got %d", c.Lockout.IPThreshold)
+	}
+	if c.Lockout.BaseDelay <= 0 {
+		verr.add("lockout.base_delay", "must be positive")
+	}
+	if c.Lockout.MaxDelay < c.Lockout.BaseDelay {
+		verr.add("lockout.max_delay", "must not be shorter than the base delay")
+	}
+	if c.Lockout.ResetAfter <= c.Lockout.MaxDelay {
+		verr.add("lockout.reset_after", "must be longer than the max delay")
+	}
+	if c.Lockout.SweepInterval <= 0 {
+		verr.add("lockout.sweep_interval", "must be positive")
+	}
+
+	if c.MFA.Issuer == "" || strings.Contains(c.MFA.Issuer, ":") {
+		verr.add("mfa.issuer", "must be set and must not contain a colon")
+	}
+	if c.MFA.ChallengeTTL <= 0 || c.MFA.ChallengeTTL > time.Hour {
+		verr.add("mfa.challenge_ttl", "must be positive and at most 1h")
+	}
+
+	if c.PasswordReset.TokenTTL <= 0 || c.PasswordReset.TokenTTL > 24*time.Hour {
+		verr.add("password_reset.token_ttl", "must be positive and at most 24h")
+	}
+	switch c.PasswordReset.Notifier {
+	case "log":
+	case "file":
+		if c.PasswordReset.File == "" {
+			verr.add("password_reset.file", "must be set for the file notifier")
+		}
+	default:
+		verr.add("password_reset.notifier", "must be log or file, got %q", c.PasswordReset.Notifier)
+	}
+	if c.PasswordReset.SweepInterval <= 0 {
+		verr.add("password_reset.sweep_interval", "must be positive")
+	}
+
+	switch c.Orders.AllocationStrategy {
+	case "single_warehouse_first", "closest", "minimise_splits", "drain_oldest":
+	default:
+		verr.add("orders.allocation_strategy",
+			"must be single_warehouse_first, closest, minimise_splits or drain_oldest, got %q",
+			c.Orders.AllocationStrategy)
+	}
+	if c.Orders.ReservationTTL <= 0 {
+		verr.add("orders.reservation_ttl", "must be positive")
+	}
+	if c.Orders.ReservationSweepInterval <= 0 {
+		verr.add("orders.reservation_sweep_interval", "must be positive")
+	}
+
+	if len(c.CORS.AllowOrigins) == 0 {
+		verr.add("cors.allow_origins", "must contain at least one origin")
+	}
+
+	if _, err := c.Log.SlogLevel(); err != nil {
+		verr.add("log.level", "%v", err)
+	}
+}
+
+// SlogLevel converts the configured level name to a slog.Level.
+func (l LogConfig) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		return 0, fmt.Errorf("unknown level %q", l.Level)
+	}
+	return level, nil
+}
+
+func envString(key string, dst *string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = v
+	}
+}
+
+func envList(key string, dst *[]string) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*dst = items
+}
+
+func envInt(key, field string, dst *int, verr *ValidationError) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		verr.add(field, "%s=%q is not a valid integer", key, v)
+		return
+	}
+	*dst = n
+}
+
+func envInt32(key, field string, dst *int32, verr *ValidationError) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		verr.add(field, "%s=%q is not a valid integer", key, v)
+		return
+	}
+	*dst = int32(n)
+}
+
+func envBool(key, field string, dst *bool, verr *ValidationError) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		verr.add(field, "%s=%q is not a valid boolean", key, v)
+		return
+	}
+	*dst = b
+}
+
+func envDuration(key, field string, dst *time.Duration, verr *ValidationError) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		verr.add(field, "%s=%q is not a valid duration (e.g. 15m, 168h)", key, v)
+		return
+	}
+	*dst = d
+}
@@ -0,0 +1,8 @@
+// Package e2e drives the complete Fiber application over HTTP. A Harness
+// boots the routes from routes.SetupRoutes on top of a seeded set of
+// repositories and offers helpers to authenticate users and call endpoints
+// through app.Test, so scenarios exercise the same middleware, handlers and
+// repositories as production traffic. The harness and the scenarios live in
+// test files; e2e_test.go runs them on the in-memory repositories and, when
+// TEST_DATABASE_URL is set, on PostgreSQL.
+package e2e
@@ -0,0 +1,19 @@
+package e2e
+
+import (
+	"os"
+	"testing"
+
+	"github.com/slmbngl/OrderAplication/internal/repository/repotest"
+)
+
+func TestMemoryScenarios(t *testing.T) {
+	RunScenarios(t, repotest.Memory)
+}
+
+func TestPostgresScenarios(t *testing.T) {
+	if os.Getenv("TEST_DATABASE_URL") == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	RunScenarios(t, repotest.Postgres)
+}
@@ -0,0 +1,278 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/slmbngl/OrderAplication/internal/adapters/middleware"
+	"github.com/slmbngl/OrderAplication/internal/app"
+	"github.com/slmbngl/OrderAplication/internal/config"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository/repotest"
+	"github.com/slmbngl/OrderAplication/internal/routes"
+)
+
+// DefaultPassword is the password of every user created by the harness
+const DefaultPassword = "password123"
+
+// Harness is a running application plus the data it was seeded with
+type Harness struct {
+	t           testing.TB
+	Server      *fiber.App
+	Application *app.Application
+	Repos       app.Repositories
+	Seed        Seed
+}
+
+// Seed is the baseline data every harness starts with
+type Seed struct {
+	Admin    *models.User
+	Customer *models.User
+	Main     *models.Warehouse
+	Annex    *models.Warehouse
+	Laptop   *models.Product
+	Mouse    *models.Product
+	Keyboard *models.Product
+}
+
+// Response is a recorded HTTP response
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Decode unmarshals the JSON body into v
+func (r *Response) Decode(t testing.TB, v any) {
+	t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		t.Fatalf("decode response %s: %v", r.Body, err)
+	}
+}
+
+// New boots the application on fresh repositories from newRepos and seeds an
+// admin, a customer, two warehouses and a few products stocked in Main.
+// Options may adjust the configuration before the application is wired.
+func New(t *testing.T, newRepos repotest.Factory, options ...func(*config.Config)) *Harness {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Database.URL = "postgres://unused"
+	cfg.JWT.Secret = "e2e-test-secret-that-is-long-enough"
+	// Cheap hashing parameters keep the scenarios fast
+	cfg.Password.Argon2.MemoryKiB = 64
+	cfg.Password.Argon2.Iterations = 1
+	cfg.Password.Argon2.Parallelism = 1
+	// Scenarios log in as admin many times within one TOTP period, in which
+	// a code works only once; the MFA scenario opts back in
+	cfg.MFA.RequiredRoles = nil
+	for _, option := range options {
+		option(cfg)
+	}
+
+	repos := newRepos(t)
+	application, err := app.NewWithRepositories(cfg, repos)
+	if err != nil {
+		t.Fatalf("wire application: %v", err)
+	}
+	server := fiber.New(fiber.Config{
+		ErrorHandler: middleware.ErrorHandler(cfg.Server.Environment == "production"),
+	})
+	routes.SetupRoutes(server, application)
+
+	h := &Harness{
+		t:           t,
+		Server:      server,
+		Application: application,
+		Repos:       repos,
+	}
+
+	h.Seed.Admin = h.CreateUser("admin", "admin")
+	h.Seed.Customer = h.CreateUser("customer", "customer")
+	h.Seed.Main = repotest.SeedWarehouse(t, repos, "Main")
+	h.Seed.Annex = repotest.SeedWarehouse(t, repos, "Annex")
+	h.Seed.Laptop = repotest.SeedProduct(t, repos, h.Seed.Main.ID, "Laptop", 1000, 5)
+	h.Seed.Mouse = repotest.SeedProduct(t, repos, h.Seed.Main.ID, "Mouse", 25, 10)
+	h.Seed.Keyboard = repotest.SeedProduct(t, repos, h.Seed.Main.ID, "Keyboard", 75, 3)
+
+	return h
+}
+
+// CreateUser stores a user with the given role and DefaultPassword directly
+// in the repository, bypassing the public registration endpoint
+func (h *Harness) CreateUser(username, role string) *models.User {
+	h.t.Helper()
+	hash, err := h.Application.Passwords.Hash(DefaultPassword)
+	if err != nil {
+		h.t.Fatalf("hash password: %v", err)
+	}
+	user, err := h.Repos.Users.Create(&models.User{
+		Username:     username,
+		PasswordHash: hash,
+		IsActive:     true,
+		Role:         role,
+	})
+	if err != nil {
+		h.t.Fatalf("create user %s: %v", username, err)
+	}
+	return user
+}
+
+// AssignWarehouses assigns a user to warehouses directly in the repository
+func (h *Harness) AssignWarehouses(username string, warehouseIDs ...int) {
+	h.t.Helper()
+	user, err := h.Repos.Users.GetByUsername(username)
+	if err != nil {
+		h.t.Fatalf("get user %s: %v", username, err)
+	}
+	if err := h.Repos.Warehouses.SetUserWarehouses(user.ID, warehouseIDs); err != nil {
+		h.t.Fatalf("assign warehouses to %s: %v", username, err)
+	}
+}
+
+// Do sends a request with an optional JSON body and Bearer token
+func (h *Harness) Do(method, path string, body any, token string) *Response {
+	h.t.Helper()
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return h.DoWithHeader(method, path, body, header)
+}
+
+// DoWithHeader sends a request with an optional JSON body and extra headers
+func (h *Harness) DoWithHeader(method, path string, body any, header http.Header) *Response {
+	h.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			h.t.Fatalf("encode request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	resp, err := h.Server.Test(req, -1)
+	if err != nil {
+		h.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatalf("read response of %s %s: %v", method, path, err)
+	}
+
+	return &Response{Status: resp.StatusCode, Header: resp.Header, Body: data}
+}
+
+// Expect sends a request and fails the test unless the status matches
+func (h *Harness) Expect(status int, method, path string, body any, token string) *Response {
+	h.t.Helper()
+	resp := h.Do(method, path, body, token)
+	if resp.Status != status {
+		h.t.Fatalf("%s %s = %d, want %d: %s", method, path, resp.Status, status, resp.Body)
+	}
+	return resp
+}
+
+// Tokens is the login response of the auth API
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Login authenticates through POST /api/auth/login
+func (h *Harness) Login(username, password string) Tokens {
+	h.t.Helper()
+	return h.LoginFrom(username, password, "")
+}
+
+// LoginFrom authenticates like Login, naming the device of the new session
+func (h *Harness) LoginFrom(username, password, deviceLabel string) Tokens {
+	h.t.Helper()
+	resp := h.Expect(http.StatusOK, http.MethodPost, "/api/auth/login",
+		models.UserLoginResponseReq{Username: username, Password: password, DeviceLabel: deviceLabel}, "")
+
+	var tokens Tokens
+	resp.Decode(h.t, &tokens)
+	return tokens
+}
+
+// Refresh exchanges a refresh token through POST /api/auth/refresh
+func (h *Harness) Refresh(refreshToken string) Tokens {
+	h.t.Helper()
+	resp := h.Expect(http.StatusOK, http.MethodPost, "/api/auth/refresh",
+		models.RefreshTokenRequest{RefreshToken: refreshToken}, "")
+
+	var tokens Tokens
+	resp.Decode(h.t, &tokens)
+	return tokens
+}
+
+// Register creates an account through POST /api/auth/register
+func (h *Harness) Register(username, password string) *models.User {
+	h.t.Helper()
+	resp := h.Expect(http.StatusCreated, http.MethodPost, "/api/auth/register",
+		models.RegisterRequest{Username: username, Password: password}, "")
+
+	var user models.User
+	resp.Decode(h.t, &user)
+	return &user
+}
+
+// TokenFor creates a user with the given role and returns its access token
+func (h *Harness) TokenFor(username, role string) string {
+	h.t.Helper()
+	h.CreateUser(username, role)
+	return h.Login(username, DefaultPassword).AccessToken
+}
+
+// AdminToken logs in as the seeded admin
+func (h *Harness) AdminToken() string {
+	h.t.Helper()
+	return h.Login(h.Seed.Admin.Username, DefaultPassword).AccessToken
+}
+
+// CustomerToken logs in as the seeded customer
+func (h *Harness) CustomerToken() string {
+	h.t.Helper()
+	return h.Login(h.Seed.Customer.Username, DefaultPassword).AccessToken
+}
+
+// StockOf reads a product's stock in a warehouse through the admin API
+func (h *Harness) StockOf(adminToken string, warehouseID, productID int) models.WarehouseStock {
+	h.t.Helper()
+	resp := h.Expect(http.StatusOK, http.MethodGet,
+		fmt.Sprintf("/api/warehouses/%d/stocks/%d", warehouseID, productID), nil, adminToken)
+
+	var stock models.WarehouseStock
+	resp.Decode(h.t, &stock)
+	return stock
+}
+
+// MustHaveStock fails the test unless the warehouse holds quantity units
+func (h *Harness) MustHaveStock(adminToken string, warehouseID, productID, quantity int) {
+	h.t.Helper()
+	if stock := h.StockOf(adminToken, warehouseID, productID); stock.Quantity != quantity {
+		h.t.Fatalf("stock of product %d in warehouse %d = %d, want %d",
+			productID, warehouseID, stock.Quantity, quantity)
+	}
+}
@@ -0,0 +1,1899 @@
+package e2e
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/slmbngl/OrderAplication/internal/allocation"
+	"github.com/slmbngl/OrderAplication/internal/apperr"
+	"github.com/slmbngl/OrderAplication/internal/config"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository/repotest"
+	"github.com/slmbngl/OrderAplication/internal/service"
+	"github.com/slmbngl/OrderAplication/internal/validation"
+)
+
+// RunScenarios runs every end-to-end scenario on repositories from newRepos
+func RunScenarios(t *testing.T, newRepos repotest.Factory) {
+	t.Run("OrderLifecycle", func(t *testing.T) { OrderLifecycle(t, newRepos) })
+	t.Run("OrderOwnership", func(t *testing.T) { OrderOwnership(t, newRepos) })
+	t.Run("OrderStateMachine", func(t *testing.T) { OrderStateMachine(t, newRepos) })
+	t.Run("ReservationExpiry", func(t *testing.T) { ReservationExpiry(t, newRepos) })
+	t.Run("OrderAllocation", func(t *testing.T) { OrderAllocation(t, newRepos) })
+	t.Run("TransferProcessing", func(t *testing.T) { TransferProcessing(t, newRepos) })
+	t.Run("PasswordUpgrade", func(t *testing.T) { PasswordUpgrade(t, newRepos) })
+	t.Run("SigningKeys", func(t *testing.T) { SigningKeys(t, newRepos) })
+	t.Run("RefreshTokenRotation", func(t *testing.T) { RefreshTokenRotation(t, newRepos) })
+	t.Run("Sessions", func(t *testing.T) { Sessions(t, newRepos) })
+	t.Run("AccessTokenRevocation", func(t *testing.T) { AccessTokenRevocation(t, newRepos) })
+	t.Run("Invitations", func(t *testing.T) { Invitations(t, newRepos) })
+	t.Run("Permissions", func(t *testing.T) { Permissions(t, newRepos) })
+	t.Run("WarehouseScope", func(t *testing.T) { WarehouseScope(t, newRepos) })
+	t.Run("Lockout", func(t *testing.T) { Lockout(t, newRepos) })
+	t.Run("MFA", func(t *testing.T) { MFA(t, newRepos) })
+	t.Run("Accounts", func(t *testing.T) { Accounts(t, newRepos) })
+	t.Run("APIKeys", func(t *testing.T) { APIKeys(t, newRepos) })
+	t.Run("AdminUsers", func(t *testing.T) { AdminUsers(t, newRepos) })
+	t.Run("ProblemDetails", func(t *testing.T) { ProblemDetails(t, newRepos) })
+	t.Run("Validation", func(t *testing.T) { Validation(t, newRepos) })
+}
+
+// OrderLifecycle creates an order as a registered customer, confirms it and
+// cancels it again, checking that confirmation deducts warehouse stock,
+// cancellation puts it back and the order keeps the prices it was placed at
+func OrderLifecycle(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	admin := h.AdminToken()
+
+	h.Register("alice", DefaultPassword)
+	customer := h.Login("alice", DefaultPassword).AccessToken
+
+	resp := h.Expect(http.StatusCreated, http.MethodPost, "/api/orders", models.CreateOrderRequest{
+		Items: []models.CreateOrderItemRequest{
+			{ProductID: h.Seed.Laptop.ID, Quantity: 2},
+			{ProductID: h.Seed.Mouse.ID, Quantity: 3},
+		},
+	}, customer)
+
+	var created models.OrderWithItems
+	resp.Decode(t, &created)
+	if created.Order.Status != "pending" {
+		t.Fatalf("new order status = %q, want pending", created.Order.Status)
+	}
+	if want := 2*h.Seed.Laptop.Price + 3*h.Seed.Mouse.Price; created.Order.TotalAmount != want {
+		t.Fatalf("new order total = %v, want %v", created.Order.TotalAmount, want)
+	}
+	if len(created.Items) != 2 {
+		t.Fatalf("new order has %d items, want 2", len(created.Items))
+	}
+
+	// Creating an order only reserves warehouse stock
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Laptop.ID, 5)
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Mouse.ID, 10)
+
+	orderPath := fmt.Sprintf("/api/orders/%d", created.Order.ID)
+	statusPath := orderPath + "/status"
+
+	h.Expect(http.StatusOK, http.MethodPut, statusPath, models.UpdateOrderStatusRequest{Status: "confirmed"}, customer)
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Laptop.ID, 3)
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Mouse.ID, 7)
+	mustHaveOrderStatus(t, h, customer, created.Order.ID, "confirmed")
+
+	// Confirming twice must not deduct the stock again
+	h.Expect(http.StatusOK, http.MethodPut, statusPath, models.UpdateOrderStatusRequest{Status: "confirmed"}, customer)
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Laptop.ID, 3)
+
+	h.Expect(http.StatusOK, http.MethodPut, statusPath, models.UpdateOrderStatusRequest{Status: "cancelled"}, customer)
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Laptop.ID, 5)
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Mouse.ID, 10)
+	mustHaveOrderStatus(t, h, customer, created.Order.ID, "cancelled")
+
+	// The order keeps the prices it was placed at when the product changes
+	h.Expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/products/%d", h.Seed.Laptop.ID), models.ProductRequest{
+		Name: "Laptop", Description: "Laptop description", Price: 1100, Stock: 5, WarehouseID: h.Seed.Main.ID,
+	}, admin)
+	resp = h.Expect(http.StatusOK, http.MethodGet, orderPath, nil, customer)
+	var detail models.OrderWithItems
+	resp.Decode(t, &detail)
+	if len(detail.Items) != 2 {
+		t.Fatalf("order detail has %d items, want 2", len(detail.Items))
+	}
+	if item := detail.Items[0]; item.Price != h.Seed.Laptop.Price || item.LineTotal != 2*h.Seed.Laptop.Price {
+		t.Fatalf("laptop line after a price change = %+v, want price %v", item, h.Seed.Laptop.Price)
+	}
+	if detail.Order.TotalAmount != created.Order.TotalAmount {
+		t.Fatalf("order total after a price change = %v, want %v", detail.Order.TotalAmount, created.Order.TotalAmount)
+	}
+
+	// Ordered products stay for the order history; others can go
+	resp = h.Expect(http.StatusConflict, http.MethodDelete, fmt.Sprintf("/api/products/%d", h.Seed.Laptop.ID), nil, admin)
+	mustHaveProblem(t, resp, http.StatusConflict, apperr.CodeProductInUse)
+	var cable models.Product
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/products", models.ProductRequest{
+		Name: "Cable", Price: 5, Stock: 4, WarehouseID: h.Seed.Main.ID,
+	}, admin).Decode(t, &cable)
+	h.Expect(http.StatusOK, http.MethodDelete, fmt.Sprintf("/api/products/%d", cable.ID), nil, admin)
+	h.Expect(http.StatusNotFound, http.MethodDelete, fmt.Sprintf("/api/products/%d", cable.ID), nil, admin)
+
+	// Placing an order reserves its items, so the second of two competing
+	// orders is refused right away
+	first := createOrder(t, h, customer, h.Seed.Keyboard.ID, 2)
+	if stock := h.StockOf(admin, h.Seed.Main.ID, h.Seed.Keyboard.ID); stock.ReservedQuantity != 2 || stock.AvailableStock != 1 {
+		t.Fatalf("keyboard stock after order = %+v, want 2 reserved and 1 available", stock)
+	}
+
+	resp = h.Expect(http.StatusConflict, http.MethodPost, "/api/orders", models.CreateOrderRequest{
+		Items: []models.CreateOrderItemRequest{{ProductID: h.Seed.Keyboard.ID, Quantity: 2}},
+	}, customer)
+	mustHaveProblem(t, resp, http.StatusConflict, apperr.CodeInsufficientStock)
+
+	h.Expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/orders/%d/status", first.Order.ID),
+		models.UpdateOrderStatusRequest{Status: "confirmed"}, customer)
+	if stock := h.StockOf(admin, h.Seed.Main.ID, h.Seed.Keyboard.ID); stock.Quantity != 1 || stock.ReservedQuantity != 0 {
+		t.Fatalf("keyboard stock after confirmation = %+v, want 1 and nothing reserved", stock)
+	}
+
+	// Only pending and cancelled orders can be deleted
+	resp = h.Expect(http.StatusConflict, http.MethodDelete, fmt.Sprintf("/api/orders/%d", first.Order.ID), nil, customer)
+	mustHaveProblem(t, resp, http.StatusConflict, apperr.CodeOrderNotDeletable)
+	h.Expect(http.StatusOK, http.MethodDelete, orderPath, nil, customer)
+	h.Expect(http.StatusNotFound, http.MethodGet, orderPath, nil, customer)
+}
+
+// OrderOwnership checks that customers can neither read nor change orders of
+// other customers
+func OrderOwnership(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	owner := h.CustomerToken()
+	other := h.TokenFor("mallory", "customer")
+
+	order := createOrder(t, h, owner, h.Seed.Mouse.ID, 1)
+
+	orderPath := fmt.Sprintf("/api/orders/%d", order.Order.ID)
+	h.Expect(http.StatusUnauthorized, http.MethodGet, orderPath, nil, "")
+	h.Expect(http.StatusNotFound, http.MethodGet, orderPath, nil, other)
+	h.Expect(http.StatusNotFound, http.MethodPut, orderPath+"/status",
+		models.UpdateOrderStatusRequest{Status: "confirmed"}, other)
+	h.Expect(http.StatusNotFound, http.MethodDelete, orderPath, nil, other)
+
+	var orders []models.OrderWithItems
+	h.Expect(http.StatusOK, http.MethodGet, "/api/orders", nil, other).Decode(t, &orders)
+	if len(orders) != 0 {
+		t.Fatalf("other customer sees %d orders, want 0", len(orders))
+	}
+}
+
+// OrderStateMachine moves orders through picking, packing, shipping,
+// delivery and refund, checking who may make each change, that illegal
+// changes are refused and that every change is recorded in the history
+func OrderStateMachine(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	admin := h.AdminToken()
+	customer := h.CustomerToken()
+	other := h.TokenFor("mallory", "customer")
+	clerk := h.TokenFor("clara", "warehouse_clerk")
+	manager := h.TokenFor("mark", "warehouse_manager")
+	support := h.TokenFor("sam", "customer_support")
+
+	order := createOrder(t, h, customer, h.Seed.Laptop.ID, 2)
+	orderPath := fmt.Sprintf("/api/orders/%d", order.Order.ID)
+	setStatus := func(want int, status, token string) *Response {
+		t.Helper()
+		return h.Expect(want, http.MethodPut, orderPath+"/status", models.UpdateOrderStatusRequest{Status: status}, token)
+	}
+
+	setStatus(http.StatusOK, models.OrderConfirmed, customer)
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Laptop.ID, 3)
+
+	// Customers cannot fulfil their own orders, and nobody skips a step
+	resp := setStatus(http.StatusForbidden, models.OrderPicking, customer)
+	mustHaveProblem(t, resp, http.StatusForbidden, apperr.CodeForbidden)
+	resp = setStatus(http.StatusConflict, models.OrderShipped, clerk)
+	mustHaveProblem(t, resp, http.StatusConflict, apperr.CodeIllegalTransition)
+	var illegal struct {
+		From    string   `json:"from"`
+		Allowed []string `json:"allowed"`
+	}
+	resp.Decode(t, &illegal)
+	if illegal.From != models.OrderConfirmed || fmt.Sprint(illegal.Allowed) != "[picking cancelled]" {
+		t.Fatalf("illegal transition from %q allowed %v, want confirmed allowed picking and cancelled", illegal.From, illegal.Allowed)
+	}
+
+	setStatus(http.StatusOK, models.OrderPicking, clerk)
+	setStatus(http.StatusForbidden, models.OrderCancelled, customer)
+	setStatus(http.StatusOK, models.OrderPacked, clerk)
+	setStatus(http.StatusOK, models.OrderShipped, manager)
+	setStatus(http.StatusForbidden, models.OrderRefunded, manager)
+	setStatus(http.StatusConflict, models.OrderCancelled, clerk)
+	setStatus(http.StatusOK, models.OrderDelivered, clerk)
+	setStatus(http.StatusOK, models.OrderRefunded, support)
+	mustHaveOrderStatus(t, h, customer, order.Order.ID, models.OrderRefunded)
+
+	// Shipped stock has left the warehouse for good
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Laptop.ID, 3)
+
+	// Refunded orders are final
+	resp = setStatus(http.StatusConflict, models.OrderConfirmed, admin)
+	mustHaveProblem(t, resp, http.StatusConflict, apperr.CodeIllegalTransition)
+	illegal.Allowed = nil
+	resp.Decode(t, &illegal)
+	if illegal.Allowed == nil || len(illegal.Allowed) != 0 {
+		t.Fatalf("allowed after refund = %v, want an empty list: %s", illegal.Allowed, resp.Body)
+	}
+
+	var history []models.OrderStatusChange
+	h.Expect(http.StatusOK, http.MethodGet, orderPath+"/history", nil, customer).Decode(t, &history)
+	want := []string{
+		models.OrderPending, models.OrderConfirmed, models.OrderPicking, models.OrderPacked,
+		models.OrderShipped, models.OrderDelivered, models.OrderRefunded,
+	}
+	if len(history) != len(want) {
+		t.Fatalf("history has %d entries, want %d: %+v", len(history), len(want), history)
+	}
+	for i, change := range history {
+		if change.ToStatus != want[i] || (i > 0 && *change.FromStatus != want[i-1]) {
+			t.Fatalf("history[%d] = %+v, want change to %s", i, change, want[i])
+		}
+	}
+	if history[3].ChangedByUser != "clara" || history[6].ChangedByUser != "sam" {
+		t.Fatalf("history changed by %q and %q, want clara and sam", history[3].ChangedByUser, history[6].ChangedByUser)
+	}
+	h.Expect(http.StatusOK, http.MethodGet, orderPath+"/history", nil, support)
+	h.Expect(http.StatusNotFound, http.MethodGet, orderPath+"/history", nil, other)
+	h.Expect(http.StatusNotFound, http.MethodPut, orderPath+"/status",
+		models.UpdateOrderStatusRequest{Status: models.OrderCancelled}, other)
+
+	// Cancelling an order being picked puts its stock back
+	picked := createOrder(t, h, customer, h.Seed.Mouse.ID, 4)
+	pickedPath := fmt.Sprintf("/api/orders/%d/status", picked.Order.ID)
+	h.Expect(http.StatusOK, http.MethodPut, pickedPath, models.UpdateOrderStatusRequest{Status: models.OrderConfirmed}, customer)
+	h.Expect(http.StatusOK, http.MethodPut, pickedPath, models.UpdateOrderStatusRequest{Status: models.OrderPicking}, clerk)
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Mouse.ID, 6)
+	h.Expect(http.StatusOK, http.MethodPut, pickedPath, models.UpdateOrderStatusRequest{Status: models.OrderCancelled}, clerk)
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Mouse.ID, 10)
+	resp = h.Expect(http.StatusConflict, http.MethodPut, pickedPath,
+		models.UpdateOrderStatusRequest{Status: models.OrderConfirmed}, customer)
+	mustHaveProblem(t, resp, http.StatusConflict, apperr.CodeIllegalTransition)
+}
+
+// ReservationExpiry leaves an order pending beyond the reservation TTL and
+// checks that the sweep cancels it and releases its stock, while orders that
+// were confirmed in time keep theirs
+func ReservationExpiry(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos, func(cfg *config.Config) { cfg.Orders.ReservationTTL = time.Hour })
+	admin := h.AdminToken()
+	customer := h.CustomerToken()
+
+	stale := createOrder(t, h, customer, h.Seed.Laptop.ID, 3)
+	if a := stale.Items[0].Allocations; len(a) != 1 || a[0].WarehouseID != h.Seed.Main.ID || a[0].Quantity != 3 {
+		t.Fatalf("order item allocated to %+v, want 3 in Main", a)
+	}
+	kept := createOrder(t, h, customer, h.Seed.Laptop.ID, 1)
+	h.Expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/orders/%d/status", kept.Order.ID),
+		models.UpdateOrderStatusRequest{Status: models.OrderConfirmed}, customer)
+
+	if stock := h.StockOf(admin, h.Seed.Main.ID, h.Seed.Laptop.ID); stock.ReservedQuantity != 3 || stock.AvailableStock != 1 {
+		t.Fatalf("laptop stock = %+v, want 3 reserved and 1 available", stock)
+	}
+	// Reserved laptops cannot be ordered by anyone else
+	resp := h.Expect(http.StatusConflict, http.MethodPost, "/api/orders", models.CreateOrderRequest{
+		Items: []models.CreateOrderItemRequest{{ProductID: h.Seed.Laptop.ID, Quantity: 2}},
+	}, customer)
+	mustHaveProblem(t, resp, http.StatusConflict, apperr.CodeInsufficientStock)
+
+	expired, err := h.Application.Orders.ExpireReservations(time.Now().Add(59 * time.Minute))
+	if err != nil || expired != 0 {
+		t.Fatalf("sweep before the TTL = %d, %v, want nothing expired", expired, err)
+	}
+	expired, err = h.Application.Orders.ExpireReservations(time.Now().Add(61 * time.Minute))
+	if err != nil || expired != 1 {
+		t.Fatalf("sweep after the TTL = %d, %v, want 1 expired", expired, err)
+	}
+
+	mustHaveOrderStatus(t, h, customer, stale.Order.ID, models.OrderCancelled)
+	mustHaveOrderStatus(t, h, customer, kept.Order.ID, models.OrderConfirmed)
+	if stock := h.StockOf(admin, h.Seed.Main.ID, h.Seed.Laptop.ID); stock.Quantity != 4 || stock.ReservedQuantity != 0 {
+		t.Fatalf("laptop stock after expiry = %+v, want 4 and nothing reserved", stock)
+	}
+
+	var history []models.OrderStatusChange
+	h.Expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/api/orders/%d/history", stale.Order.ID), nil, customer).
+		Decode(t, &history)
+	if last := history[len(history)-1]; last.ToStatus != models.OrderCancelled || last.ChangedBy != nil {
+		t.Fatalf("expiry history entry = %+v, want cancelled without a user", last)
+	}
+
+	createOrder(t, h, customer, h.Seed.Laptop.ID, 4)
+}
+
+// OrderAllocation places orders with the closest allocation strategy, splitting
+// an item the nearest warehouse cannot cover, and checks that the order
+// detail shows where every item is taken from
+func OrderAllocation(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos, func(cfg *config.Config) { cfg.Orders.AllocationStrategy = allocation.ClosestName })
+	admin := h.AdminToken()
+	customer := h.CustomerToken()
+
+	istanbul := &models.Location{Latitude: 41.0082, Longitude: 28.9784}
+	ankara := &models.Location{Latitude: 39.9334, Longitude: 32.8597}
+	h.Expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/warehouses/%d", h.Seed.Main.ID),
+		models.UpdateWarehouseRequest{Name: "Main", Location: istanbul, IsActive: true}, admin)
+	h.Expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/warehouses/%d", h.Seed.Annex.ID),
+		models.UpdateWarehouseRequest{Name: "Annex", Location: ankara, IsActive: true}, admin)
+	h.Expect(http.StatusOK, http.MethodPost, fmt.Sprintf("/api/warehouses/%d/stocks/%d/add", h.Seed.Annex.ID, h.Seed.Laptop.ID),
+		models.UpdateStockRequest{Quantity: 3}, admin)
+
+	resp := h.Expect(http.StatusBadRequest, http.MethodPut, fmt.Sprintf("/api/warehouses/%d", h.Seed.Annex.ID),
+		models.UpdateWarehouseRequest{Name: "Annex", Location: &models.Location{Latitude: 39.9, Longitude: 200}}, admin)
+	mustHaveFieldErrors(t, resp, map[string]string{"location.longitude": "max"})
+	resp = h.Expect(http.StatusBadRequest, http.MethodPost, "/api/orders", models.CreateOrderRequest{
+		Items:  []models.CreateOrderItemRequest{{ProductID: h.Seed.Laptop.ID, Quantity: 1}},
+		ShipTo: &models.Location{Latitude: -91, Longitude: 32.8},
+	}, customer)
+	mustHaveFieldErrors(t, resp, map[string]string{"ship_to.latitude": "min"})
+
+	// Ankara holds only 3 of the 6 laptops, the rest come from Istanbul
+	var order models.OrderWithItems
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/orders", models.CreateOrderRequest{
+		Items:  []models.CreateOrderItemRequest{{ProductID: h.Seed.Laptop.ID, Quantity: 6}},
+		ShipTo: ankara,
+	}, customer).Decode(t, &order)
+
+	var detail models.OrderWithItems
+	h.Expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/api/orders/%d", order.Order.ID), nil, customer).
+		Decode(t, &detail)
+	want := []models.OrderItemAllocation{
+		{WarehouseID: h.Seed.Annex.ID, WarehouseName: "Annex", Quantity: 3},
+		{WarehouseID: h.Seed.Main.ID, WarehouseName: "Main", Quantity: 3},
+	}
+	for _, items := range [][]models.OrderItem{order.Items, detail.Items} {
+		if len(items) != 1 || !slices.Equal(items[0].Allocations, want) {
+			t.Fatalf("order items = %+v, want allocations %+v", items, want)
+		}
+	}
+
+	// Confirming takes the stock from both warehouses
+	h.Expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/orders/%d/status", order.Order.ID),
+		models.UpdateOrderStatusRequest{Status: models.OrderConfirmed}, customer)
+	h.MustHaveStock(admin, h.Seed.Annex.ID, h.Seed.Laptop.ID, 0)
+	h.MustHaveStock(admin, h.Seed.Main.ID, h.Seed.Laptop.ID, 2)
+
+	// Without a delivery location the fullest warehouse ships
+	h.Expect(http.StatusOK, http.MethodPost, fmt.Sprintf("/api/warehouses/%d/stocks/%d/add", h.Seed.Annex.ID, h.Seed.Mouse.ID),
+		models.UpdateStockRequest{Quantity: 4}, admin)
+	mice := createOrder(t, h, customer, h.Seed.Mouse.ID, 2)
+	if a := mice.Items[0].Allocations; len(a) != 1 || a[0].WarehouseID != h.Seed.Main.ID {
+		t.Fatalf("mouse allocated to %+v, want Main", a)
+	}
+}
+
+// TransferProcessing requests a transfer between warehouses as a warehouse
+// clerk and processes it as an admin, checking the stock of both warehouses
+func TransferProcessing(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	admin := h.AdminToken()
+	clerk := h.TokenFor("clerk", "warehouse_clerk")
+
+	from, to := h.Seed.Main.ID, h.Seed.Annex.ID
+	h.AssignWarehouses("clerk", from, to)
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/transfers", models.StockTransferRequest{
+		FromWarehouseID: &from,
+		ToWarehouseID:   &to,
+		ProductID:       h.Seed.Mouse.ID,
+		Quantity:        4,
+	}, h.CustomerToken())
+
+	resp := h.Expect(http.StatusCreated, http.MethodPost, "/api/transfers", models.StockTransferRequest{
+		FromWarehouseID: &from,
+		ToWarehouseID:   &to,
+		ProductID:       h.Seed.Mouse.ID,
+		Quantity:        4,
+		Reason:          "rebalance",
+	}, clerk)
+
+	var transfer models.StockTransfer
+	resp.Decode(t, &transfer)
+	if transfer.Status != "pending" {
+		t.Fatalf("new transfer status = %q, want pending", transfer.Status)
+	}
+
+	processPath := fmt.Sprintf("/api/transfers/%d/process", transfer.ID)
+	h.Expect(http.StatusForbidden, http.MethodPost, processPath, nil, clerk)
+	h.MustHaveStock(admin, from, h.Seed.Mouse.ID, 10)
+
+	h.Expect(http.StatusOK, http.MethodPost, processPath, nil, admin)
+	h.MustHaveStock(admin, from, h.Seed.Mouse.ID, 6)
+	h.MustHaveStock(admin, to, h.Seed.Mouse.ID, 4)
+
+	var processed models.StockTransfer
+	h.Expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/api/transfers/%d", transfer.ID), nil, admin).
+		Decode(t, &processed)
+	if processed.Status != "completed" {
+		t.Fatalf("processed transfer status = %q, want completed", processed.Status)
+	}
+	if processed.CompletedAt == nil {
+		t.Fatal("processed transfer has no completion time")
+	}
+
+	// A transfer can only be processed once
+	h.Expect(http.StatusConflict, http.MethodPost, processPath, nil, admin)
+	h.MustHaveStock(admin, from, h.Seed.Mouse.ID, 6)
+
+	// Transfers larger than the source stock are rejected without moving
+	// anything
+	resp = h.Expect(http.StatusCreated, http.MethodPost, "/api/transfers", models.StockTransferRequest{
+		FromWarehouseID: &from,
+		ToWarehouseID:   &to,
+		ProductID:       h.Seed.Mouse.ID,
+		Quantity:        7,
+	}, clerk)
+	var tooLarge models.StockTransfer
+	resp.Decode(t, &tooLarge)
+
+	h.Expect(http.StatusConflict, http.MethodPost, fmt.Sprintf("/api/transfers/%d/process", tooLarge.ID), nil, admin)
+	h.MustHaveStock(admin, from, h.Seed.Mouse.ID, 6)
+	h.MustHaveStock(admin, to, h.Seed.Mouse.ID, 4)
+
+	// Inbound transfers without a source warehouse add stock
+	resp = h.Expect(http.StatusCreated, http.MethodPost, "/api/transfers", models.StockTransferRequest{
+		ToWarehouseID: &to,
+		ProductID:     h.Seed.Laptop.ID,
+		Quantity:      2,
+		Reason:        "supplier delivery",
+	}, admin)
+	var inbound models.StockTransfer
+	resp.Decode(t, &inbound)
+
+	h.Expect(http.StatusOK, http.MethodPost, fmt.Sprintf("/api/transfers/%d/process", inbound.ID), nil, admin)
+	h.MustHaveStock(admin, to, h.Seed.Laptop.ID, 2)
+	h.MustHaveStock(admin, from, h.Seed.Laptop.ID, 5)
+}
+
+// PasswordUpgrade logs in a user whose password is still stored as an
+// unsalted SHA-256 digest and checks that the hash is replaced on login
+func PasswordUpgrade(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+
+	sum := sha256.Sum256([]byte(DefaultPassword))
+	_, err := h.Repos.Users.Create(&models.User{
+		Username:     "legacy",
+		PasswordHash: hex.EncodeToString(sum[:]),
+		IsActive:     true,
+		Role:         models.RoleCustomer,
+	})
+	if err != nil {
+		t.Fatalf("create legacy user: %v", err)
+	}
+
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/login",
+		models.UserLoginResponseReq{Username: "legacy", Password: "wrong"}, "")
+	h.Login("legacy", DefaultPassword)
+
+	user, err := h.Repos.Users.GetByUsername("legacy")
+	if err != nil {
+		t.Fatalf("load legacy user: %v", err)
+	}
+	if !strings.HasPrefix(user.PasswordHash, "$argon2id$") {
+		t.Fatalf("password hash after login = %q, want argon2id", user.PasswordHash)
+	}
+	if h.Application.Passwords.NeedsRehash(user.PasswordHash) {
+		t.Fatal("upgraded hash still needs a rehash")
+	}
+
+	// The upgraded hash keeps working
+	h.Login("legacy", DefaultPassword)
+}
+
+// SigningKeys checks that tokens signed with RS256 and EdDSA verify against
+// the published JWKS, survive a key rotation and that HMAC secrets are never
+// published
+func SigningKeys(t *testing.T, newRepos repotest.Factory) {
+	for _, alg := range []string{"RS256", "EdDSA"} {
+		t.Run(alg, func(t *testing.T) {
+			h := New(t, newRepos, func(cfg *config.Config) {
+				cfg.JWT.Algorithm = alg
+			})
+			customer := h.CustomerToken()
+
+			first := mustVerifyWithJWKS(t, h, customer)
+			h.Expect(http.StatusOK, http.MethodGet, "/api/auth/profile", nil, customer)
+
+			// A new key is published at once but does not sign before the
+			// publish delay has passed
+			if _, err := h.Application.Tokens.Keys().Rotate(time.Now()); err != nil {
+				t.Fatalf("rotate keys: %v", err)
+			}
+			var set service.JWKS
+			h.Expect(http.StatusOK, http.MethodGet, "/.well-known/jwks.json", nil, "").Decode(t, &set)
+			if len(set.Keys) != 2 {
+				t.Fatalf("JWKS has %d keys after rotation, want 2", len(set.Keys))
+			}
+			if kid := mustVerifyWithJWKS(t, h, h.CustomerToken()); kid != first {
+				t.Fatalf("token right after rotation signed with kid %q, want %q", kid, first)
+			}
+
+			// A key published a publish delay ago signs, and tokens signed
+			// with the previous key stay valid until they expire
+			published := time.Now().Add(-h.Application.Config.JWT.KeyPublishDelay)
+			if _, err := h.Application.Tokens.Keys().Rotate(published); err != nil {
+				t.Fatalf("rotate keys: %v", err)
+			}
+			h.Expect(http.StatusOK, http.MethodGet, "/api/auth/profile", nil, customer)
+			mustVerifyWithJWKS(t, h, customer)
+
+			rotated := h.CustomerToken()
+			if second := mustVerifyWithJWKS(t, h, rotated); second == first {
+				t.Fatalf("token after rotation still signed with kid %q", first)
+			}
+		})
+	}
+
+	t.Run("HS256", func(t *testing.T) {
+		h := New(t, newRepos)
+		h.Expect(http.StatusOK, http.MethodGet, "/api/auth/profile", nil, h.CustomerToken())
+
+		var set service.JWKS
+		h.Expect(http.StatusOK, http.MethodGet, "/.well-known/jwks.json", nil, "").Decode(t, &set)
+		if len(set.Keys) != 0 {
+			t.Fatalf("JWKS publishes %d keys in HS256 mode", len(set.Keys))
+		}
+	})
+}
+
+// mustVerifyWithJWKS verifies the token's signature the way another service
+// would, using only the published JWKS, and returns the token's kid
+func mustVerifyWithJWKS(t *testing.T, h *Harness, tokenStr string) string {
+	t.Helper()
+
+	var set service.JWKS
+	h.Expect(http.StatusOK, http.MethodGet, "/.well-known/jwks.json", nil, "").Decode(t, &set)
+
+	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range set.Keys {
+			if key.KeyID == kid {
+				return publicKey(key)
+			}
+		}
+		return nil, fmt.Errorf("kid %q not in JWKS", kid)
+	}, jwt.WithValidMethods([]string{"RS256", "EdDSA"}))
+	if err != nil || !token.Valid {
+		t.Fatalf("verify token with JWKS: %v", err)
+	}
+
+	return token.Header["kid"].(string)
+}
+
+func publicKey(key service.JWK) (any, error) {
+	switch key.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", key.KeyType)
+	}
+}
+
+// RefreshTokenRotation checks that refresh tokens rotate on every use, that
+// replaying a used token revokes its whole family but not other logins, and
+// that logout revokes the family
+func RefreshTokenRotation(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	username := h.Seed.Customer.Username
+
+	stolen := h.Login(username, DefaultPassword)
+	other := h.Login(username, DefaultPassword)
+
+	rotated := h.Refresh(stolen.RefreshToken)
+	if rotated.RefreshToken == "" || rotated.RefreshToken == stolen.RefreshToken {
+		t.Fatalf("refresh did not rotate the refresh token: %+v", rotated)
+	}
+	h.Expect(http.StatusOK, http.MethodGet, "/api/auth/profile", nil, rotated.AccessToken)
+	rotated = h.Refresh(rotated.RefreshToken)
+
+	// Replaying the first token revokes every token of that login
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/refresh",
+		models.RefreshTokenRequest{RefreshToken: stolen.RefreshToken}, "")
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/refresh",
+		models.RefreshTokenRequest{RefreshToken: rotated.RefreshToken}, "")
+
+	// The other login is a different family and keeps working
+	other = h.Refresh(other.RefreshToken)
+
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/logout",
+		models.LogoutRequest{RefreshToken: other.RefreshToken}, "")
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/refresh",
+		models.RefreshTokenRequest{RefreshToken: other.RefreshToken}, "")
+
+	// Only hashes are stored
+	if _, err := h.Repos.Users.GetRefreshToken(other.RefreshToken); err == nil {
+		t.Fatal("refresh token is stored in plaintext")
+	}
+}
+
+// Sessions logs a customer in on two devices, lists and revokes the sessions
+// as the customer and as an admin, and checks that a revoked session can no
+// longer refresh or use its access token
+func Sessions(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	customer := h.Seed.Customer
+	admin := h.AdminToken()
+
+	laptop := h.LoginFrom(customer.Username, DefaultPassword, "Work laptop")
+	phone := h.Login(customer.Username, DefaultPassword)
+
+	sessions := listSessions(t, h, "/api/auth/sessions", laptop.AccessToken)
+	if len(sessions) != 2 {
+		t.Fatalf("customer has %d sessions, want 2", len(sessions))
+	}
+	var laptopSession, phoneSession models.Session
+	for _, session := range sessions {
+		if session.DeviceLabel == "Work laptop" {
+			laptopSession = session
+		} else {
+			phoneSession = session
+		}
+	}
+	if !laptopSession.Current || phoneSession.Current {
+		t.Fatalf("current session flags = %v/%v, want laptop only", laptopSession.Current, phoneSession.Current)
+	}
+	if phoneSession.DeviceLabel != "Unknown device" {
+		t.Fatalf("default device label = %q, want Unknown device", phoneSession.DeviceLabel)
+	}
+
+	// Nobody else can end the session
+	other := h.TokenFor("mallory", "customer")
+	h.Expect(http.StatusNotFound, http.MethodDelete, "/api/auth/sessions/"+phoneSession.ID, nil, other)
+	h.Expect(http.StatusNotFound, http.MethodDelete, "/api/auth/sessions/unknown", nil, laptop.AccessToken)
+
+	h.Expect(http.StatusOK, http.MethodGet, "/api/auth/sessions", nil, phone.AccessToken)
+	h.Expect(http.StatusOK, http.MethodDelete, "/api/auth/sessions/"+phoneSession.ID, nil, laptop.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/refresh",
+		models.RefreshTokenRequest{RefreshToken: phone.RefreshToken}, "")
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/auth/sessions", nil, phone.AccessToken)
+	h.Expect(http.StatusOK, http.MethodGet, "/api/auth/sessions", nil, laptop.AccessToken)
+	laptop = h.Refresh(laptop.RefreshToken)
+
+	// Admins manage the sessions of every user
+	adminPath := fmt.Sprintf("/api/admin/users/%d/sessions", customer.ID)
+	h.Expect(http.StatusForbidden, http.MethodGet, adminPath, nil, laptop.AccessToken)
+	sessions = listSessions(t, h, adminPath, admin)
+	if len(sessions) != 1 || sessions[0].ID != laptopSession.ID || sessions[0].Current {
+		t.Fatalf("admin sees sessions %+v, want the laptop session only", sessions)
+	}
+	h.Expect(http.StatusNotFound, http.MethodDelete,
+		fmt.Sprintf("/api/admin/users/%d/sessions/%s", h.Seed.Admin.ID, laptopSession.ID), nil, admin)
+	h.Expect(http.StatusOK, http.MethodDelete, adminPath+"/"+laptopSession.ID, nil, admin)
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/refresh",
+		models.RefreshTokenRequest{RefreshToken: laptop.RefreshToken}, "")
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/auth/sessions", nil, laptop.AccessToken)
+	if sessions := listSessions(t, h, adminPath, admin); len(sessions) != 0 {
+		t.Fatalf("customer has %d sessions after revocation, want 0", len(sessions))
+	}
+}
+
+// AccessTokenRevocation checks that logging out and changing a user's role
+// invalidate access tokens at once instead of when they expire
+func AccessTokenRevocation(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	admin := h.AdminToken()
+	customer := h.Seed.Customer
+
+	// Logout revokes the access token sent along with it
+	tokens := h.Login(customer.Username, DefaultPassword)
+	other := h.Login(customer.Username, DefaultPassword)
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/logout",
+		models.LogoutRequest{RefreshToken: tokens.RefreshToken}, tokens.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/auth/profile", nil, tokens.AccessToken)
+	h.Expect(http.StatusOK, http.MethodGet, "/api/auth/profile", nil, other.AccessToken)
+
+	// A role change invalidates every token issued with the old role
+	h.Expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", customer.ID),
+		models.UpdateUserRoleRequest{Role: "admin"}, admin)
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/auth/profile", nil, other.AccessToken)
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/users", nil, admin)
+
+	// Refreshed and new tokens carry the new role
+	promoted := h.Refresh(other.RefreshToken)
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/users", nil, promoted.AccessToken)
+
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/logout-all", nil, promoted.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/auth/profile", nil, promoted.AccessToken)
+	h.Expect(http.StatusOK, http.MethodGet, "/api/auth/profile", nil,
+		h.Login(customer.Username, DefaultPassword).AccessToken)
+}
+
+// Invitations checks that self-registration cannot pick a role and that
+// admins hand out roles through single-use invite codes
+func Invitations(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	admin := h.AdminToken()
+
+	// The role of the request body is ignored
+	resp := h.Expect(http.StatusCreated, http.MethodPost, "/api/auth/register",
+		map[string]string{"username": "mallory", "password": DefaultPassword, "role": "admin"}, "")
+	var registered models.User
+	resp.Decode(t, &registered)
+	if registered.Role != models.RoleCustomer {
+		t.Fatalf("self-registered role = %q, want customer", registered.Role)
+	}
+	mallory := h.Login("mallory", DefaultPassword).AccessToken
+	h.Expect(http.StatusForbidden, http.MethodGet, "/api/admin/users", nil, mallory)
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/admin/invitations",
+		models.CreateInvitationRequest{Role: "admin"}, mallory)
+
+	h.Expect(http.StatusBadRequest, http.MethodPost, "/api/admin/invitations",
+		models.CreateInvitationRequest{Role: "superuser"}, admin)
+	h.Expect(http.StatusBadRequest, http.MethodPost, "/api/admin/invitations",
+		models.CreateInvitationRequest{Role: "admin", ExpiresIn: "-1h"}, admin)
+
+	var invitation models.CreateInvitationResponse
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/admin/invitations",
+		models.CreateInvitationRequest{Role: "admin", ExpiresIn: "1h"}, admin).Decode(t, &invitation)
+	if invitation.Code == "" || invitation.Role != "admin" {
+		t.Fatalf("created invitation = %+v", invitation)
+	}
+
+	// Taken usernames leave the invitation usable
+	h.Expect(http.StatusConflict, http.MethodPost, "/api/auth/invitations/accept",
+		models.AcceptInvitationRequest{Code: invitation.Code, Username: "mallory", Password: DefaultPassword}, "")
+
+	var accepted models.User
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/auth/invitations/accept",
+		models.AcceptInvitationRequest{Code: invitation.Code, Username: "bob", Password: DefaultPassword}, "").
+		Decode(t, &accepted)
+	if accepted.Role != "admin" {
+		t.Fatalf("invited user role = %q, want admin", accepted.Role)
+	}
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/users", nil, h.Login("bob", DefaultPassword).AccessToken)
+
+	// Codes are single-use
+	h.Expect(http.StatusBadRequest, http.MethodPost, "/api/auth/invitations/accept",
+		models.AcceptInvitationRequest{Code: invitation.Code, Username: "carol", Password: DefaultPassword}, "")
+
+	// Revoked codes no longer work
+	var revoked models.CreateInvitationResponse
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/admin/invitations",
+		models.CreateInvitationRequest{Role: "customer"}, admin).Decode(t, &revoked)
+	h.Expect(http.StatusOK, http.MethodDelete, fmt.Sprintf("/api/admin/invitations/%d", revoked.ID), nil, admin)
+	h.Expect(http.StatusNotFound, http.MethodDelete, fmt.Sprintf("/api/admin/invitations/%d", revoked.ID), nil, admin)
+	h.Expect(http.StatusBadRequest, http.MethodPost, "/api/auth/invitations/accept",
+		models.AcceptInvitationRequest{Code: revoked.Code, Username: "carol", Password: DefaultPassword}, "")
+
+	var invitations []models.Invitation
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/invitations", nil, admin).Decode(t, &invitations)
+	if len(invitations) != 1 || invitations[0].UsedBy == nil || *invitations[0].UsedBy != "bob" {
+		t.Fatalf("invitations = %+v, want the one used by bob", invitations)
+	}
+
+	// Inviters only hand out roles whose permissions they hold
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/admin/roles", models.CreateRoleRequest{
+		Name:        "recruiter",
+		Permissions: []string{models.PermOrdersCreate, models.PermOrdersRead, models.PermUsersManage},
+	}, admin)
+	recruiter := h.TokenFor("recruiter", "recruiter")
+	mustHaveProblem(t, h.Do(http.MethodPost, "/api/admin/invitations",
+		models.CreateInvitationRequest{Role: "admin"}, recruiter), http.StatusForbidden, apperr.CodeGrantNotAllowed)
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/admin/invitations",
+		models.CreateInvitationRequest{Role: "warehouse_clerk"}, recruiter)
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/admin/invitations",
+		models.CreateInvitationRequest{Role: models.RoleCustomer}, recruiter)
+
+	// The first admin can only be bootstrapped once
+	if _, err := h.Application.Invitations.BootstrapAdmin("root", DefaultPassword); !errors.Is(err, service.ErrAdminExists) {
+		t.Fatalf("BootstrapAdmin with an existing admin = %v, want ErrAdminExists", err)
+	}
+}
+
+func listSessions(t *testing.T, h *Harness, path, token string) []models.Session {
+	t.Helper()
+	var sessions []models.Session
+	h.Expect(http.StatusOK, http.MethodGet, path, nil, token).Decode(t, &sessions)
+	return sessions
+}
+
+func mustHaveOrderStatus(t *testing.T, h *Harness, token string, orderID int, status string) {
+	t.Helper()
+
+	var orders []models.OrderWithItems
+	h.Expect(http.StatusOK, http.MethodGet, "/api/orders", nil, token).Decode(t, &orders)
+	for _, o := range orders {
+		if o.Order.ID == orderID {
+			if o.Order.Status != status {
+				t.Fatalf("order %d status = %q, want %q", orderID, o.Order.Status, status)
+			}
+			return
+		}
+	}
+	t.Fatalf("order %d not listed", orderID)
+}
+
+func createOrder(t *testing.T, h *Harness, token string, productID, quantity int) models.OrderWithItems {
+	t.Helper()
+
+	var order models.OrderWithItems
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/orders", models.CreateOrderRequest{
+		Items: []models.CreateOrderItemRequest{{ProductID: productID, Quantity: quantity}},
+	}, token).Decode(t, &order)
+	return order
+}
+
+// Permissions checks the routes against the permissions of the default roles
+// and that editing a role applies to its users right away
+func Permissions(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	admin := h.AdminToken()
+	customer := h.CustomerToken()
+	clerk := h.TokenFor("clerk", "warehouse_clerk")
+	manager := h.TokenFor("manager", "warehouse_manager")
+	support := h.TokenFor("support", "customer_support")
+	h.AssignWarehouses("clerk", h.Seed.Main.ID)
+	h.AssignWarehouses("manager", h.Seed.Main.ID)
+
+	order := createOrder(t, h, customer, h.Seed.Mouse.ID, 1)
+	orderPath := fmt.Sprintf("/api/orders/%d", order.Order.ID)
+	stockPath := fmt.Sprintf("/api/warehouses/%d/stocks/%d", h.Seed.Main.ID, h.Seed.Mouse.ID)
+
+	// Customers place orders but cannot see the warehouses
+	h.Expect(http.StatusForbidden, http.MethodGet, "/api/warehouses", nil, customer)
+	h.Expect(http.StatusForbidden, http.MethodGet, "/api/stocks", nil, customer)
+	h.Expect(http.StatusForbidden, http.MethodGet, "/api/admin/orders", nil, customer)
+
+	// Clerks read stock but neither adjust it nor place orders
+	h.Expect(http.StatusOK, http.MethodGet, "/api/stocks", nil, clerk)
+	h.Expect(http.StatusForbidden, http.MethodPut, stockPath, models.UpdateStockRequest{Quantity: 1}, clerk)
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/orders", models.CreateOrderRequest{
+		Items: []models.CreateOrderItemRequest{{ProductID: h.Seed.Mouse.ID, Quantity: 1}},
+	}, clerk)
+
+	// Managers adjust stock but cannot create warehouses
+	h.Expect(http.StatusOK, http.MethodPut, stockPath, models.UpdateStockRequest{Quantity: 12}, manager)
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/warehouses",
+		models.CreateWarehouseRequest{Name: "Depot", Address: "Izmir"}, manager)
+
+	// Managers stock products only in the warehouses they are assigned to
+	cable := models.ProductRequest{Name: "Cable", Price: 5, Stock: 4, WarehouseID: h.Seed.Annex.ID}
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/products", cable, manager)
+	cable.WarehouseID = h.Seed.Main.ID
+	var product models.Product
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/products", cable, manager).Decode(t, &product)
+	productPath := fmt.Sprintf("/api/products/%d", product.ID)
+	cable.Stock = 6
+	h.Expect(http.StatusOK, http.MethodPut, productPath, cable, manager)
+	cable.WarehouseID = h.Seed.Annex.ID
+	h.Expect(http.StatusForbidden, http.MethodPut, productPath, cable, manager)
+	h.Expect(http.StatusOK, http.MethodPut, productPath, cable, admin)
+	cable.WarehouseID = h.Seed.Main.ID
+	h.Expect(http.StatusForbidden, http.MethodPut, productPath, cable, manager)
+
+	// Support reads every order and user but changes nothing
+	h.Expect(http.StatusOK, http.MethodGet, orderPath, nil, support)
+	var all []models.OrderWithItems
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/orders", nil, support).Decode(t, &all)
+	if len(all) != 1 || all[0].Order.ID != order.Order.ID {
+		t.Fatalf("support sees orders %+v, want the customer's order", all)
+	}
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/users", nil, support)
+	h.Expect(http.StatusForbidden, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", h.Seed.Customer.ID),
+		models.UpdateUserRoleRequest{Role: "admin"}, support)
+	h.Expect(http.StatusForbidden, http.MethodGet, "/api/admin/roles", nil, support)
+
+	// Granting a permission revokes the clerk's token; the next one carries it
+	h.Expect(http.StatusOK, http.MethodPut, "/api/admin/roles/warehouse_clerk/permissions",
+		models.UpdateRolePermissionsRequest{Permissions: []string{
+			models.PermWarehousesRead, models.PermStockRead, models.PermStockAdjust,
+		}}, admin)
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/stocks", nil, clerk)
+	clerk = h.Login("clerk", DefaultPassword).AccessToken
+	h.Expect(http.StatusOK, http.MethodPut, stockPath, models.UpdateStockRequest{Quantity: 11}, clerk)
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/transfers", models.StockTransferRequest{
+		ToWarehouseID: &h.Seed.Annex.ID,
+		ProductID:     h.Seed.Mouse.ID,
+		Quantity:      1,
+	}, clerk)
+
+	// New roles can be assigned right away
+	var auditor models.Role
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/admin/roles", models.CreateRoleRequest{
+		Name:        "auditor",
+		Permissions: []string{models.PermOrdersRead, models.PermOrdersReadAll},
+	}, admin).Decode(t, &auditor)
+	if auditor.Name != "auditor" || len(auditor.Permissions) != 2 {
+		t.Fatalf("created role = %+v", auditor)
+	}
+	h.Expect(http.StatusConflict, http.MethodPost, "/api/admin/roles",
+		models.CreateRoleRequest{Name: "auditor"}, admin)
+	h.Expect(http.StatusBadRequest, http.MethodPost, "/api/admin/roles",
+		models.CreateRoleRequest{Name: "broken", Permissions: []string{"orders:everything"}}, admin)
+	h.Expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", h.Seed.Customer.ID),
+		models.UpdateUserRoleRequest{Role: "auditor"}, admin)
+	h.Expect(http.StatusBadRequest, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", h.Seed.Customer.ID),
+		models.UpdateUserRoleRequest{Role: "missing"}, admin)
+	auditorToken := h.CustomerToken()
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/orders", nil, auditorToken)
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/orders", models.CreateOrderRequest{
+		Items: []models.CreateOrderItemRequest{{ProductID: h.Seed.Mouse.ID, Quantity: 1}},
+	}, auditorToken)
+
+	// The admin role always keeps every permission
+	h.Expect(http.StatusBadRequest, http.MethodPut, "/api/admin/roles/admin/permissions",
+		models.UpdateRolePermissionsRequest{Permissions: []string{}}, admin)
+	h.Expect(http.StatusNotFound, http.MethodPut, "/api/admin/roles/missing/permissions",
+		models.UpdateRolePermissionsRequest{Permissions: []string{}}, admin)
+	var permissions []models.Permission
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/permissions", nil, admin).Decode(t, &permissions)
+	if len(permissions) != len(models.Permissions) {
+		t.Fatalf("GET /api/admin/permissions = %d permissions, want %d", len(permissions), len(models.Permissions))
+	}
+
+	// Managing users and roles never grants more than the manager holds
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/admin/roles", models.CreateRoleRequest{
+		Name: "user_manager",
+		Permissions: []string{
+			models.PermOrdersRead, models.PermOrdersReadAll,
+			models.PermUsersRead, models.PermUsersManage, models.PermRolesManage,
+		},
+	}, admin)
+	userManager := h.CreateUser("usermanager", "user_manager")
+	manageUsers := h.Login("usermanager", DefaultPassword).AccessToken
+	h.Expect(http.StatusForbidden, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", userManager.ID),
+		models.UpdateUserRoleRequest{Role: "admin"}, manageUsers)
+	h.Expect(http.StatusForbidden, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", h.Seed.Customer.ID),
+		models.UpdateUserRoleRequest{Role: "warehouse_manager"}, manageUsers)
+	h.Expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", h.Seed.Customer.ID),
+		models.UpdateUserRoleRequest{Role: "auditor"}, manageUsers)
+	mustHaveProblem(t, h.Do(http.MethodPost, "/api/admin/roles", models.CreateRoleRequest{
+		Name:        "stocker",
+		Permissions: []string{models.PermStockAdjust},
+	}, manageUsers), http.StatusForbidden, apperr.CodeGrantNotAllowed)
+	h.Expect(http.StatusForbidden, http.MethodPut, "/api/admin/roles/auditor/permissions",
+		models.UpdateRolePermissionsRequest{Permissions: []string{models.PermOrdersRead, models.PermUsersImpersonate}},
+		manageUsers)
+	h.Expect(http.StatusOK, http.MethodPut, "/api/admin/roles/auditor/permissions",
+		models.UpdateRolePermissionsRequest{Permissions: []string{models.PermOrdersReadAll}}, manageUsers)
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/admin/roles",
+		models.CreateRoleRequest{Name: "reader", Permissions: []string{models.PermUsersRead}}, manageUsers)
+}
+
+// WarehouseScope checks that stock and transfer endpoints only act on the
+// warehouses a user is assigned to, while admins act on all of them
+func WarehouseScope(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	admin := h.AdminToken()
+	manager := h.CreateUser("manager", "warehouse_manager")
+	managerToken := h.Login("manager", DefaultPassword).AccessToken
+	main, annex := h.Seed.Main.ID, h.Seed.Annex.ID
+	assignmentsPath := fmt.Sprintf("/api/admin/users/%d/warehouses", manager.ID)
+
+	// Assignments are managed by admins
+	var assigned models.UserWarehouses
+	h.Expect(http.StatusOK, http.MethodPut, assignmentsPath,
+		models.SetUserWarehousesRequest{WarehouseIDs: []int{main}}, admin).Decode(t, &assigned)
+	if len(assigned.WarehouseIDs) != 1 || assigned.WarehouseIDs[0] != main {
+		t.Fatalf("assigned warehouses = %+v, want [%d]", assigned, main)
+	}
+	h.Expect(http.StatusBadRequest, http.MethodPut, assignmentsPath,
+		models.SetUserWarehousesRequest{WarehouseIDs: []int{404}}, admin)
+	h.Expect(http.StatusNotFound, http.MethodPut, "/api/admin/users/404/warehouses",
+		models.SetUserWarehousesRequest{WarehouseIDs: []int{main}}, admin)
+	h.Expect(http.StatusForbidden, http.MethodPut, assignmentsPath,
+		models.SetUserWarehousesRequest{WarehouseIDs: []int{main, annex}}, managerToken)
+
+	// Stock of other warehouses can be neither read nor changed
+	mainStock := fmt.Sprintf("/api/warehouses/%d/stocks/%d", main, h.Seed.Mouse.ID)
+	annexStock := fmt.Sprintf("/api/warehouses/%d/stocks/%d", annex, h.Seed.Mouse.ID)
+	h.Expect(http.StatusOK, http.MethodGet, mainStock, nil, managerToken)
+	h.Expect(http.StatusForbidden, http.MethodGet, annexStock, nil, managerToken)
+	h.Expect(http.StatusForbidden, http.MethodGet, fmt.Sprintf("/api/warehouses/%d/stocks", annex), nil, managerToken)
+	h.Expect(http.StatusForbidden, http.MethodPut, annexStock, models.UpdateStockRequest{Quantity: 50}, managerToken)
+	h.Expect(http.StatusForbidden, http.MethodPost, annexStock+"/add", models.UpdateStockRequest{Quantity: 5}, managerToken)
+	h.Expect(http.StatusOK, http.MethodPost, mainStock+"/add", models.UpdateStockRequest{Quantity: 5}, managerToken)
+	h.Expect(http.StatusOK, http.MethodPut, annexStock, models.UpdateStockRequest{Quantity: 3}, admin)
+
+	var stocks []models.WarehouseStock
+	h.Expect(http.StatusOK, http.MethodGet, "/api/stocks", nil, managerToken).Decode(t, &stocks)
+	for _, stock := range stocks {
+		if stock.WarehouseID != main {
+			t.Fatalf("manager sees stock of warehouse %d", stock.WarehouseID)
+		}
+	}
+
+	// Transfers need both warehouses; admins move stock anywhere
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/transfers", models.StockTransferRequest{
+		FromWarehouseID: &main, ToWarehouseID: &annex, ProductID: h.Seed.Mouse.ID, Quantity: 1,
+	}, managerToken)
+	var outbound models.StockTransfer
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/transfers", models.StockTransferRequest{
+		FromWarehouseID: &main, ToWarehouseID: &annex, ProductID: h.Seed.Mouse.ID, Quantity: 2,
+	}, admin).Decode(t, &outbound)
+	var annexOnly models.StockTransfer
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/transfers", models.StockTransferRequest{
+		ToWarehouseID: &annex, ProductID: h.Seed.Mouse.ID, Quantity: 1,
+	}, admin).Decode(t, &annexOnly)
+
+	// A transfer touching the manager's warehouse is visible but cannot be
+	// processed; one elsewhere is not visible at all
+	outboundPath := fmt.Sprintf("/api/transfers/%d", outbound.ID)
+	annexOnlyPath := fmt.Sprintf("/api/transfers/%d", annexOnly.ID)
+	h.Expect(http.StatusOK, http.MethodGet, outboundPath, nil, managerToken)
+	h.Expect(http.StatusForbidden, http.MethodPost, outboundPath+"/process", nil, managerToken)
+	h.Expect(http.StatusNotFound, http.MethodGet, annexOnlyPath, nil, managerToken)
+	h.Expect(http.StatusNotFound, http.MethodPut, annexOnlyPath+"/status",
+		models.StockTransferStatusRequest{Status: "cancelled"}, managerToken)
+
+	var transfers []models.StockTransfer
+	h.Expect(http.StatusOK, http.MethodGet, "/api/transfers", nil, managerToken).Decode(t, &transfers)
+	if len(transfers) != 1 || transfers[0].ID != outbound.ID {
+		t.Fatalf("manager sees transfers %+v, want only #%d", transfers, outbound.ID)
+	}
+
+	// Once assigned to both, the manager processes the transfer
+	h.Expect(http.StatusOK, http.MethodPut, assignmentsPath,
+		models.SetUserWarehousesRequest{WarehouseIDs: []int{main, annex}}, admin)
+	h.Expect(http.StatusOK, http.MethodPost, outboundPath+"/process", nil, managerToken)
+	h.MustHaveStock(admin, main, h.Seed.Mouse.ID, 13)
+	h.MustHaveStock(admin, annex, h.Seed.Mouse.ID, 5)
+}
+
+// Lockout fails logins until the account locks, checks that the delay doubles
+// once a lock has expired, that an admin can lift the lock and that the
+// source address locks once its own threshold is reached
+func Lockout(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos, func(cfg *config.Config) {
+		cfg.Lockout.Threshold = 3
+		cfg.Lockout.IPThreshold = 6
+		cfg.Lockout.BaseDelay = time.Minute
+		cfg.Lockout.MaxDelay = time.Hour
+	})
+	admin := h.AdminToken()
+	alice := h.CreateUser("alice", models.RoleCustomer)
+	wrong := models.UserLoginResponseReq{Username: "alice", Password: "wrong"}
+	right := models.UserLoginResponseReq{Username: "alice", Password: DefaultPassword}
+
+	for i := 0; i < 3; i++ {
+		h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/login", wrong, "")
+	}
+
+	// A locked account rejects even the right password
+	resp := h.Expect(http.StatusTooManyRequests, http.MethodPost, "/api/auth/login", right, "")
+	mustRetryAfter(t, resp, 1, 60)
+
+	// Once the lock has expired, the next failure locks for twice as long
+	expireLock(t, h, models.LoginScopeAccount, "alice")
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/login", wrong, "")
+	resp = h.Expect(http.StatusTooManyRequests, http.MethodPost, "/api/auth/login", right, "")
+	mustRetryAfter(t, resp, 61, 120)
+
+	// Unlocking is reserved to admins
+	unlockPath := fmt.Sprintf("/api/admin/users/%d/unlock", alice.ID)
+	h.Expect(http.StatusForbidden, http.MethodPost, unlockPath, nil, h.CustomerToken())
+	h.Expect(http.StatusNotFound, http.MethodPost, "/api/admin/users/404/unlock", nil, admin)
+	h.Expect(http.StatusOK, http.MethodPost, unlockPath, nil, admin)
+	h.Login("alice", DefaultPassword)
+
+	var events []models.AuditEvent
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/audit-log", nil, admin).Decode(t, &events)
+	if len(events) != 3 || events[0].Event != models.AuditAccountUnlocked ||
+		events[1].Event != models.AuditAccountLocked || events[2].Event != models.AuditAccountLocked {
+		t.Fatalf("audit log = %+v, want unlock after two locks", events)
+	}
+	if e := events[0]; e.ActorID == nil || *e.ActorID != h.Seed.Admin.ID || e.UserID == nil || *e.UserID != alice.ID {
+		t.Fatalf("unlock event = %+v, want actor %d and user %d", e, h.Seed.Admin.ID, alice.ID)
+	}
+	h.Expect(http.StatusForbidden, http.MethodGet, "/api/admin/audit-log", nil, h.CustomerToken())
+	h.Expect(http.StatusBadRequest, http.MethodGet, "/api/admin/audit-log?limit=0", nil, admin)
+
+	// Four failures so far came from this address, two more lock it for
+	// every account, including ones that do not exist
+	for _, username := range []string{"ghost", "phantom"} {
+		h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/login",
+			models.UserLoginResponseReq{Username: username, Password: "wrong"}, "")
+	}
+	h.Expect(http.StatusTooManyRequests, http.MethodPost, "/api/auth/login",
+		models.UserLoginResponseReq{Username: "admin", Password: DefaultPassword}, "")
+
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/audit-log?limit=1", nil, admin).Decode(t, &events)
+	if len(events) != 1 || events[0].Event != models.AuditIPLocked {
+		t.Fatalf("latest audit event = %+v, want %s", events, models.AuditIPLocked)
+	}
+}
+
+// expireLock moves a lock into the past, keeping its failure count
+func expireLock(t *testing.T, h *Harness, scope, subject string) {
+	t.Helper()
+	past := time.Now().UTC().Add(-time.Second)
+	if err := h.Repos.LoginAttempts.LockLoginAttempt(scope, subject, past); err != nil {
+		t.Fatalf("expire lock of %s %s: %v", scope, subject, err)
+	}
+}
+
+func mustRetryAfter(t *testing.T, resp *Response, min, max int) {
+	t.Helper()
+	var body struct {
+		RetryAfter int `json:"retry_after"`
+	}
+	resp.Decode(t, &body)
+	header, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || header != body.RetryAfter || body.RetryAfter < min || body.RetryAfter > max {
+		t.Fatalf("Retry-After = %q, retry_after = %d, want equal and in [%d, %d]",
+			resp.Header.Get("Retry-After"), body.RetryAfter, min, max)
+	}
+}
+
+// MFA enrolls an admin at their first login, completes logins with TOTP and
+// recovery codes, opts a customer in and out, resets a lost device and
+// checks that guessed codes lock the account
+func MFA(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos, func(cfg *config.Config) {
+		cfg.MFA.RequiredRoles = []string{models.RoleAdmin}
+	})
+
+	// Admins get a challenge instead of tokens until they have enrolled
+	challenge := mfaChallenge(t, h, "admin")
+	if !challenge.EnrollmentRequired {
+		t.Fatal("first admin login does not require enrollment")
+	}
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/auth/profile", nil, challenge.Token)
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/auth/mfa/verify",
+		models.MFAVerifyRequest{MFAToken: challenge.Token, Code: "123456"}, "")
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/mfa/verify",
+		models.MFAVerifyRequest{MFAToken: "not-a-token", Code: "123456"}, "")
+
+	adminApp := enrollMFA(t, h, challenge.Token)
+	h.Expect(http.StatusBadRequest, http.MethodPost, "/api/auth/mfa/enroll/confirm",
+		models.MFACodeRequest{Code: adminApp.wrong()}, challenge.Token)
+	var enrolled struct {
+		Tokens
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/mfa/enroll/confirm",
+		models.MFACodeRequest{Code: adminApp.next()}, challenge.Token).Decode(t, &enrolled)
+	if enrolled.AccessToken == "" || len(enrolled.RecoveryCodes) != 10 {
+		t.Fatalf("confirming during login = %+v, want tokens and 10 recovery codes", enrolled)
+	}
+	admin := enrolled.AccessToken
+	mustHaveMFAStatus(t, h, admin, models.MFAStatus{Enabled: true, Required: true, RecoveryCodesLeft: 10})
+
+	// Later logins are completed with a code, each code working once
+	challenge = mfaChallenge(t, h, "admin")
+	if challenge.EnrollmentRequired {
+		t.Fatal("enrolled admin is asked to enroll again")
+	}
+	code := adminApp.next()
+	verify := models.MFAVerifyRequest{MFAToken: challenge.Token, Code: code}
+	var tokens Tokens
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/mfa/verify", verify, "").Decode(t, &tokens)
+	h.Expect(http.StatusOK, http.MethodGet, "/api/auth/profile", nil, tokens.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/mfa/verify", verify, "")
+
+	// Recovery codes work once, whatever their case and dashes
+	recovery := strings.ToUpper(strings.ReplaceAll(enrolled.RecoveryCodes[0], "-", ""))
+	verify = models.MFAVerifyRequest{MFAToken: challenge.Token, RecoveryCode: recovery}
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/mfa/verify", verify, "")
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/mfa/verify", verify, "")
+	mustHaveMFAStatus(t, h, admin, models.MFAStatus{Enabled: true, Required: true, RecoveryCodesLeft: 9})
+
+	var regenerated models.MFARecoveryCodes
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/mfa/recovery-codes",
+		models.MFACodeRequest{Code: adminApp.next()}, admin).Decode(t, &regenerated)
+	if len(regenerated.RecoveryCodes) != 10 || regenerated.RecoveryCodes[0] == enrolled.RecoveryCodes[0] {
+		t.Fatalf("regenerated recovery codes = %v", regenerated.RecoveryCodes)
+	}
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/mfa/verify",
+		models.MFAVerifyRequest{MFAToken: challenge.Token, RecoveryCode: enrolled.RecoveryCodes[1]}, "")
+
+	// Admins cannot opt out
+	h.Expect(http.StatusForbidden, http.MethodDelete, "/api/auth/mfa",
+		models.MFACodeRequest{Code: "123456"}, admin)
+
+	// Customers may opt in and out again
+	customer := h.CustomerToken()
+	mustHaveMFAStatus(t, h, customer, models.MFAStatus{})
+	h.Expect(http.StatusConflict, http.MethodPost, "/api/auth/mfa/enroll/confirm",
+		models.MFACodeRequest{Code: "123456"}, customer)
+	customerApp := enrollMFA(t, h, customer)
+	var codes models.MFARecoveryCodes
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/mfa/enroll/confirm",
+		models.MFACodeRequest{Code: customerApp.next()}, customer).Decode(t, &codes)
+	if len(codes.RecoveryCodes) != 10 {
+		t.Fatalf("recovery codes = %v, want 10", codes.RecoveryCodes)
+	}
+	h.Expect(http.StatusConflict, http.MethodPost, "/api/auth/mfa/enroll", nil, customer)
+
+	challenge = mfaChallenge(t, h, "customer")
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/mfa/verify",
+		models.MFAVerifyRequest{MFAToken: challenge.Token, Code: customerApp.next()}, "")
+	h.Expect(http.StatusOK, http.MethodDelete, "/api/auth/mfa",
+		models.MFACodeRequest{Code: customerApp.next()}, customer)
+	customer = h.CustomerToken()
+
+	// Admins reset the enrollment of a lost device
+	enrollMFA(t, h, customer)
+	resetPath := fmt.Sprintf("/api/admin/users/%d/mfa", h.Seed.Customer.ID)
+	h.Expect(http.StatusForbidden, http.MethodDelete, resetPath, nil, customer)
+	h.Expect(http.StatusOK, http.MethodDelete, resetPath, nil, admin)
+	h.Expect(http.StatusNotFound, http.MethodDelete, resetPath, nil, admin)
+	h.CustomerToken()
+
+	var events []models.AuditEvent
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/audit-log?limit=1", nil, admin).Decode(t, &events)
+	if len(events) != 1 || events[0].Event != models.AuditMFAReset || events[0].UserID == nil ||
+		*events[0].UserID != h.Seed.Customer.ID {
+		t.Fatalf("latest audit event = %+v, want %s of the customer", events, models.AuditMFAReset)
+	}
+
+	// Guessing codes locks the account like guessing passwords
+	h.CreateUser("carol", models.RoleCustomer)
+	carol := h.Login("carol", DefaultPassword).AccessToken
+	carolApp := enrollMFA(t, h, carol)
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/mfa/enroll/confirm",
+		models.MFACodeRequest{Code: carolApp.next()}, carol)
+	challenge = mfaChallenge(t, h, "carol")
+	for i := 0; i < h.Application.Config.Lockout.Threshold; i++ {
+		h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/mfa/verify",
+			models.MFAVerifyRequest{MFAToken: challenge.Token, Code: carolApp.wrong()}, "")
+	}
+	h.Expect(http.StatusTooManyRequests, http.MethodPost, "/api/auth/mfa/verify",
+		models.MFAVerifyRequest{MFAToken: challenge.Token, Code: carolApp.next()}, "")
+}
+
+type mfaLoginChallenge struct {
+	Required           bool   `json:"mfa_required"`
+	EnrollmentRequired bool   `json:"mfa_enrollment_required"`
+	Token              string `json:"mfa_token"`
+}
+
+// mfaChallenge logs in with the right password and returns the challenge
+func mfaChallenge(t *testing.T, h *Harness, username string) mfaLoginChallenge {
+	t.Helper()
+	var challenge mfaLoginChallenge
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/login",
+		models.UserLoginResponseReq{Username: username, Password: DefaultPassword}, "").Decode(t, &challenge)
+	if !challenge.Required || challenge.Token == "" {
+		t.Fatalf("login of %s did not return an MFA challenge", username)
+	}
+	return challenge
+}
+
+// enrollMFA starts an enrollment with an access or challenge token and
+// returns an authenticator app for the new secret
+func enrollMFA(t *testing.T, h *Harness, token string) *authenticator {
+	t.Helper()
+	var enrollment models.MFAEnrollment
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/mfa/enroll", nil, token).Decode(t, &enrollment)
+	if enrollment.Secret == "" || !strings.HasPrefix(enrollment.OTPAuthURL, "otpauth://totp/OrderApp:") {
+		t.Fatalf("enrollment = %+v", enrollment)
+	}
+	return &authenticator{t: t, secret: enrollment.Secret}
+}
+
+func mustHaveMFAStatus(t *testing.T, h *Harness, token string, want models.MFAStatus) {
+	t.Helper()
+	var status models.MFAStatus
+	h.Expect(http.StatusOK, http.MethodGet, "/api/auth/mfa", nil, token).Decode(t, &status)
+	if status != want {
+		t.Fatalf("MFA status = %+v, want %+v", status, want)
+	}
+}
+
+// authenticator produces TOTP codes like an authenticator app. The server
+// accepts every code once, so it hands out the codes of the time steps
+// around now in order and fails the test when they run out.
+type authenticator struct {
+	t      *testing.T
+	secret string
+	last   int64
+}
+
+func (a *authenticator) next() string {
+	a.t.Helper()
+	now := service.TOTPStep(time.Now())
+	step := max(now-1, a.last+1)
+	if step > now+1 {
+		a.t.Fatal("no unused TOTP code left in this period")
+	}
+	a.last = step
+	return a.code(step)
+}
+
+// wrong returns a code far outside the accepted time steps
+func (a *authenticator) wrong() string {
+	a.t.Helper()
+	return a.code(service.TOTPStep(time.Now()) + 1000)
+}
+
+func (a *authenticator) code(step int64) string {
+	a.t.Helper()
+	code, err := service.TOTPCode(a.secret, step)
+	if err != nil {
+		a.t.Fatalf("compute TOTP code: %v", err)
+	}
+	return code
+}
+
+// Accounts checks password changes and resets and the (de)activation of
+// accounts, and that each ends the sessions it should
+func Accounts(t *testing.T, newRepos repotest.Factory) {
+	outbox := filepath.Join(t.TempDir(), "notifications.log")
+	h := New(t, newRepos, func(cfg *config.Config) {
+		cfg.PasswordReset.Notifier = "file"
+		cfg.PasswordReset.File = outbox
+	})
+	admin := h.AdminToken()
+	alice := h.CreateUser("alice", models.RoleCustomer)
+
+	// Changing the password keeps the current session and ends the others
+	laptop := h.Login("alice", DefaultPassword)
+	phone := h.Login("alice", DefaultPassword)
+	h.Expect(http.StatusBadRequest, http.MethodPut, "/api/auth/password",
+		models.ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "new-password-1"}, laptop.AccessToken)
+	h.Expect(http.StatusBadRequest, http.MethodPut, "/api/auth/password",
+		models.ChangePasswordRequest{CurrentPassword: DefaultPassword, NewPassword: "short"}, laptop.AccessToken)
+	h.Expect(http.StatusOK, http.MethodPut, "/api/auth/password",
+		models.ChangePasswordRequest{CurrentPassword: DefaultPassword, NewPassword: "new-password-1"}, laptop.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/auth/profile", nil, laptop.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/refresh",
+		models.RefreshTokenRequest{RefreshToken: phone.RefreshToken}, "")
+	laptop = h.Refresh(laptop.RefreshToken)
+	h.Expect(http.StatusOK, http.MethodGet, "/api/auth/profile", nil, laptop.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/login",
+		models.UserLoginResponseReq{Username: "alice", Password: DefaultPassword}, "")
+	laptop = h.Login("alice", "new-password-1")
+
+	// Reset requests look the same for unknown users, who get no token
+	for _, username := range []string{"alice", "ghost"} {
+		h.Expect(http.StatusAccepted, http.MethodPost, "/api/auth/password/forgot",
+			models.ForgotPasswordRequest{Username: username}, "")
+	}
+	sent := readNotifications(t, outbox)
+	if len(sent) != 1 || sent[0].UserID != alice.ID {
+		t.Fatalf("notifications = %+v, want one for alice", sent)
+	}
+	token := resetToken(t, sent[0])
+
+	h.Expect(http.StatusBadRequest, http.MethodPost, "/api/auth/password/reset",
+		models.ResetPasswordRequest{Token: "unknown", NewPassword: "new-password-2"}, "")
+	h.Expect(http.StatusBadRequest, http.MethodPost, "/api/auth/password/reset",
+		models.ResetPasswordRequest{Token: token, NewPassword: "short"}, "")
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/password/reset",
+		models.ResetPasswordRequest{Token: token, NewPassword: "new-password-2"}, "")
+	h.Expect(http.StatusBadRequest, http.MethodPost, "/api/auth/password/reset",
+		models.ResetPasswordRequest{Token: token, NewPassword: "new-password-3"}, "")
+
+	// A reset ends every session
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/auth/profile", nil, laptop.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/refresh",
+		models.RefreshTokenRequest{RefreshToken: laptop.RefreshToken}, "")
+	tokens := h.Login("alice", "new-password-2")
+
+	// Self-deactivation needs the password and ends every session
+	h.Expect(http.StatusBadRequest, http.MethodPost, "/api/auth/deactivate",
+		models.DeactivateAccountRequest{Password: "wrong"}, tokens.AccessToken)
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/deactivate",
+		models.DeactivateAccountRequest{Password: "new-password-2"}, tokens.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/auth/profile", nil, tokens.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/refresh",
+		models.RefreshTokenRequest{RefreshToken: tokens.RefreshToken}, "")
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/login",
+		models.UserLoginResponseReq{Username: "alice", Password: "new-password-2"}, "")
+
+	// Inactive users get no reset token
+	h.Expect(http.StatusAccepted, http.MethodPost, "/api/auth/password/forgot",
+		models.ForgotPasswordRequest{Username: "alice"}, "")
+	if sent := readNotifications(t, outbox); len(sent) != 1 {
+		t.Fatalf("%d notifications after reset request of inactive user, want 1", len(sent))
+	}
+
+	// Admins activate and deactivate accounts
+	activatePath := fmt.Sprintf("/api/admin/users/%d/activate", alice.ID)
+	deactivatePath := fmt.Sprintf("/api/admin/users/%d/deactivate", alice.ID)
+	h.Expect(http.StatusForbidden, http.MethodPost, activatePath, nil, h.CustomerToken())
+	h.Expect(http.StatusNotFound, http.MethodPost, "/api/admin/users/404/activate", nil, admin)
+	h.Expect(http.StatusOK, http.MethodPost, activatePath, nil, admin)
+	tokens = h.Login("alice", "new-password-2")
+	h.Expect(http.StatusOK, http.MethodPost, deactivatePath, nil, admin)
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/auth/profile", nil, tokens.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/refresh",
+		models.RefreshTokenRequest{RefreshToken: tokens.RefreshToken}, "")
+
+	// The last active admin stays
+	h.Expect(http.StatusConflict, http.MethodPost,
+		fmt.Sprintf("/api/admin/users/%d/deactivate", h.Seed.Admin.ID), nil, admin)
+
+	var events []models.AuditEvent
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/audit-log?limit=5", nil, admin).Decode(t, &events)
+	want := []string{
+		models.AuditUserDeactivated, models.AuditUserActivated, models.AuditUserDeactivated,
+		models.AuditPasswordReset, models.AuditPasswordChanged,
+	}
+	for i, event := range events {
+		if i >= len(want) || event.Event != want[i] {
+			t.Fatalf("audit log = %+v, want events %v", events, want)
+		}
+	}
+	if e := events[0]; e.ActorID == nil || *e.ActorID != h.Seed.Admin.ID || e.UserID == nil || *e.UserID != alice.ID {
+		t.Fatalf("deactivation event = %+v, want actor %d and user %d", e, h.Seed.Admin.ID, alice.ID)
+	}
+}
+
+// readNotifications returns the notifications a file notifier wrote so far
+func readNotifications(t *testing.T, path string) []service.Notification {
+	t.Helper()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("open notifications: %v", err)
+	}
+	defer f.Close()
+
+	var sent []service.Notification
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var n service.Notification
+		if err := json.Unmarshal(scanner.Bytes(), &n); err != nil {
+			t.Fatalf("decode notification %s: %v", scanner.Bytes(), err)
+		}
+		sent = append(sent, n)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("read notifications: %v", err)
+	}
+	return sent
+}
+
+// resetToken takes the reset token from the end of a notification
+func resetToken(t *testing.T, n service.Notification) string {
+	t.Helper()
+	i := strings.LastIndex(n.Body, " ")
+	if i < 0 || i == len(n.Body)-1 {
+		t.Fatalf("no reset token in %q", n.Body)
+	}
+	return n.Body[i+1:]
+}
+
+// APIKeys checks that integrations reach the warehouse endpoints with an
+// API key that acts as its user, limited to its scopes
+func APIKeys(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	admin := h.AdminToken()
+	scanner := h.CreateUser("scanner", "warehouse_clerk")
+	h.AssignWarehouses("scanner", h.Seed.Main.ID)
+
+	// Scopes must exist and be granted by the user's role
+	create := func(status int, req models.CreateAPIKeyRequest) *Response {
+		t.Helper()
+		return h.Expect(status, http.MethodPost, "/api/admin/api-keys", req, admin)
+	}
+	scopes := []string{models.PermStockRead, models.PermWarehousesRead}
+	create(http.StatusBadRequest, models.CreateAPIKeyRequest{UserID: scanner.ID, Name: "Scanner"})
+	create(http.StatusBadRequest, models.CreateAPIKeyRequest{UserID: scanner.ID, Name: "Scanner", Scopes: []string{"stock:everything"}})
+	create(http.StatusBadRequest, models.CreateAPIKeyRequest{UserID: scanner.ID, Name: "Scanner", Scopes: []string{models.PermStockAdjust}})
+	create(http.StatusBadRequest, models.CreateAPIKeyRequest{UserID: scanner.ID, Name: " ", Scopes: scopes})
+	create(http.StatusBadRequest, models.CreateAPIKeyRequest{UserID: scanner.ID, Name: "Scanner", Scopes: scopes, ExpiresIn: "-1h"})
+	create(http.StatusNotFound, models.CreateAPIKeyRequest{UserID: 404, Name: "Scanner", Scopes: scopes})
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/admin/api-keys",
+		models.CreateAPIKeyRequest{UserID: scanner.ID, Name: "Scanner", Scopes: scopes}, h.CustomerToken())
+
+	var created models.CreateAPIKeyResponse
+	create(http.StatusCreated, models.CreateAPIKeyRequest{UserID: scanner.ID, Name: "Scanner", Scopes: scopes}).Decode(t, &created)
+	if !strings.HasPrefix(created.Key, created.Prefix+"_") || created.ExpiresAt == nil {
+		t.Fatalf("created key %q with prefix %q and expiry %v", created.Key, created.Prefix, created.ExpiresAt)
+	}
+
+	// The key acts as its user: scoped permissions, assigned warehouses only
+	withKey := func(status int, method, path, key string) {
+		t.Helper()
+		resp := h.DoWithHeader(method, path, nil, http.Header{models.APIKeyHeader: {key}})
+		if resp.Status != status {
+			t.Fatalf("%s %s with API key = %d, want %d: %s", method, path, resp.Status, status, resp.Body)
+		}
+	}
+	mainStocks := fmt.Sprintf("/api/warehouses/%d/stocks", h.Seed.Main.ID)
+	withKey(http.StatusOK, http.MethodGet, mainStocks, created.Key)
+	withKey(http.StatusForbidden, http.MethodGet, fmt.Sprintf("/api/warehouses/%d/stocks", h.Seed.Annex.ID), created.Key)
+	withKey(http.StatusForbidden, http.MethodGet, "/api/transfers", created.Key)
+	withKey(http.StatusUnauthorized, http.MethodGet, "/api/auth/profile", created.Key)
+	withKey(http.StatusUnauthorized, http.MethodGet, "/api/admin/api-keys", created.Key)
+	withKey(http.StatusUnauthorized, http.MethodGet, mainStocks, created.Key[:len(created.Key)-1]+"x")
+	withKey(http.StatusUnauthorized, http.MethodGet, mainStocks, "not-a-key")
+
+	var keys []models.APIKey
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/api-keys", nil, admin).Decode(t, &keys)
+	if len(keys) != 1 || keys[0].Prefix != created.Prefix || keys[0].LastUsedAt == nil {
+		t.Fatalf("listed keys = %+v, want the scanner key with its last use", keys)
+	}
+	if strings.Contains(string(h.Expect(http.StatusOK, http.MethodGet, "/api/admin/api-keys", nil, admin).Body), created.Key) {
+		t.Fatal("key list contains the key itself")
+	}
+
+	// A role change narrows the key to what the new role grants
+	rolePath := fmt.Sprintf("/api/admin/users/%d/role", scanner.ID)
+	h.Expect(http.StatusOK, http.MethodPut, rolePath, models.UpdateUserRoleRequest{Role: models.RoleCustomer}, admin)
+	withKey(http.StatusForbidden, http.MethodGet, mainStocks, created.Key)
+	h.Expect(http.StatusOK, http.MethodPut, rolePath, models.UpdateUserRoleRequest{Role: "warehouse_clerk"}, admin)
+	withKey(http.StatusOK, http.MethodGet, mainStocks, created.Key)
+
+	// Keys of deactivated users and revoked keys stop working
+	h.Expect(http.StatusOK, http.MethodPost, fmt.Sprintf("/api/admin/users/%d/deactivate", scanner.ID), nil, admin)
+	withKey(http.StatusUnauthorized, http.MethodGet, mainStocks, created.Key)
+	h.Expect(http.StatusOK, http.MethodPost, fmt.Sprintf("/api/admin/users/%d/activate", scanner.ID), nil, admin)
+	withKey(http.StatusOK, http.MethodGet, mainStocks, created.Key)
+
+	revokePath := fmt.Sprintf("/api/admin/api-keys/%d", created.ID)
+	h.Expect(http.StatusOK, http.MethodDelete, revokePath, nil, admin)
+	h.Expect(http.StatusNotFound, http.MethodDelete, revokePath, nil, admin)
+	withKey(http.StatusUnauthorized, http.MethodGet, mainStocks, created.Key)
+
+	var events []models.AuditEvent
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/audit-log?limit=1", nil, admin).Decode(t, &events)
+	if len(events) != 1 || events[0].Event != models.AuditAPIKeyRevoked || events[0].Subject != created.Prefix {
+		t.Fatalf("latest audit event = %+v, want revocation of %s", events, created.Prefix)
+	}
+}
+
+// AdminUsers checks the admin user management: searching, the detail view,
+// creating accounts for customers, soft deletion and impersonation
+func AdminUsers(t *testing.T, newRepos repotest.Factory) {
+	outbox := filepath.Join(t.TempDir(), "notifications.log")
+	h := New(t, newRepos, func(cfg *config.Config) {
+		cfg.PasswordReset.Notifier = "file"
+		cfg.PasswordReset.File = outbox
+	})
+	admin := h.AdminToken()
+	alice := h.CreateUser("alice", models.RoleCustomer)
+	h.CreateUser("alina", models.RoleCustomer)
+	h.CreateUser("clerk", "warehouse_clerk")
+
+	// Search with filters and pagination; the total is in a header
+	search := func(query string, wantTotal int) []models.User {
+		t.Helper()
+		var users []models.User
+		resp := h.Expect(http.StatusOK, http.MethodGet, "/api/admin/users"+query, nil, admin)
+		resp.Decode(t, &users)
+		if total := resp.Header.Get("X-Total-Count"); total != strconv.Itoa(wantTotal) {
+			t.Fatalf("GET /api/admin/users%s total = %s, want %d", query, total, wantTotal)
+		}
+		return users
+	}
+	if users := search("", 5); len(users) != 5 || users[0].Username != "clerk" {
+		t.Fatalf("user list = %+v, want 5 users, newest first", users)
+	}
+	if users := search("?username=ALI&role=customer", 2); len(users) != 2 {
+		t.Fatalf("filtered user list = %+v, want alice and alina", users)
+	}
+	if users := search("?limit=2&offset=2", 5); len(users) != 2 || users[0].Username != "alice" {
+		t.Fatalf("second page = %+v, want alice and customer", users)
+	}
+	search("?active=false", 0)
+	search("?created_from=2000-01-01&created_to="+time.Now().Add(24*time.Hour).Format(time.DateOnly), 5)
+	for _, query := range []string{"?limit=0", "?limit=201", "?offset=-1", "?active=maybe", "?created_from=yesterday"} {
+		h.Expect(http.StatusBadRequest, http.MethodGet, "/api/admin/users"+query, nil, admin)
+	}
+
+	// The detail shows orders and sessions
+	aliceTokens := h.Login("alice", DefaultPassword)
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/orders", models.CreateOrderRequest{
+		Items: []models.CreateOrderItemRequest{{ProductID: h.Seed.Mouse.ID, Quantity: 1}},
+	}, aliceTokens.AccessToken)
+	alicePath := fmt.Sprintf("/api/admin/users/%d", alice.ID)
+	var detail models.UserDetail
+	h.Expect(http.StatusOK, http.MethodGet, alicePath, nil, admin).Decode(t, &detail)
+	if detail.Username != "alice" || len(detail.Orders) != 1 || len(detail.Sessions) != 1 {
+		t.Fatalf("user detail = %+v, want alice with one order and one session", detail)
+	}
+	h.Expect(http.StatusNotFound, http.MethodGet, "/api/admin/users/404", nil, admin)
+	h.Expect(http.StatusForbidden, http.MethodGet, alicePath, nil, h.TokenFor("clerk2", "warehouse_clerk"))
+
+	// Accounts created for customers, with or without a password
+	create := func(status int, req models.CreateUserRequest) *Response {
+		t.Helper()
+		return h.Expect(status, http.MethodPost, "/api/admin/users", req, admin)
+	}
+	create(http.StatusBadRequest, models.CreateUserRequest{Username: " "})
+	create(http.StatusBadRequest, models.CreateUserRequest{Username: "bob", Password: "short"})
+	create(http.StatusBadRequest, models.CreateUserRequest{Username: "bob", Role: "pirate"})
+	create(http.StatusConflict, models.CreateUserRequest{Username: "alice", Password: "password-bob"})
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/admin/users",
+		models.CreateUserRequest{Username: "bob"}, h.CustomerToken())
+
+	var created struct {
+		User      models.User `json:"user"`
+		ResetSent bool        `json:"password_reset_sent"`
+	}
+	create(http.StatusCreated, models.CreateUserRequest{Username: "bob", Password: "password-bob"}).Decode(t, &created)
+	if created.User.Role != models.RoleCustomer || created.ResetSent {
+		t.Fatalf("created user = %+v, want a customer without reset token", created)
+	}
+	h.Login("bob", "password-bob")
+
+	create(http.StatusCreated, models.CreateUserRequest{Username: "carol", Role: "warehouse_clerk"}).Decode(t, &created)
+	if created.User.Role != "warehouse_clerk" || !created.ResetSent {
+		t.Fatalf("created user = %+v, want a clerk with reset token", created)
+	}
+	sent := readNotifications(t, outbox)
+	if len(sent) != 1 || sent[0].UserID != created.User.ID {
+		t.Fatalf("notifications = %+v, want one for carol", sent)
+	}
+	h.Expect(http.StatusOK, http.MethodPost, "/api/auth/password/reset",
+		models.ResetPasswordRequest{Token: resetToken(t, sent[0]), NewPassword: "password-carol"}, "")
+	h.Login("carol", "password-carol")
+
+	// Accounts only get roles whose permissions the creator holds
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/admin/roles", models.CreateRoleRequest{
+		Name:        "onboarding",
+		Permissions: []string{models.PermOrdersCreate, models.PermOrdersRead, models.PermUsersManage},
+	}, admin)
+	onboarding := h.TokenFor("onboarder", "onboarding")
+	mustHaveProblem(t, h.Do(http.MethodPost, "/api/admin/users",
+		models.CreateUserRequest{Username: "dave", Role: models.RoleAdmin}, onboarding),
+		http.StatusForbidden, apperr.CodeGrantNotAllowed)
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/admin/users",
+		models.CreateUserRequest{Username: "dave", Password: "password-dave"}, onboarding)
+
+	// Impersonation acts as the user, but not on their credentials
+	impersonatePath := fmt.Sprintf("/api/admin/users/%d/impersonate", alice.ID)
+	var impersonation models.ImpersonationResponse
+	h.Expect(http.StatusOK, http.MethodPost, impersonatePath, nil, admin).Decode(t, &impersonation)
+	if impersonation.UserID != alice.ID || impersonation.ImpersonatorID != h.Seed.Admin.ID {
+		t.Fatalf("impersonation = %+v, want alice by admin", impersonation)
+	}
+	asAlice := impersonation.AccessToken
+	var orders []models.OrderWithItems
+	h.Expect(http.StatusOK, http.MethodGet, "/api/orders", nil, asAlice).Decode(t, &orders)
+	if len(orders) != 1 || orders[0].Order.UserID != alice.ID {
+		t.Fatalf("orders seen while impersonating = %+v, want alice's order", orders)
+	}
+	h.Expect(http.StatusForbidden, http.MethodGet, "/api/admin/users", nil, asAlice)
+	h.Expect(http.StatusForbidden, http.MethodPut, "/api/auth/password",
+		models.ChangePasswordRequest{CurrentPassword: DefaultPassword, NewPassword: "new-password-1"}, asAlice)
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/auth/deactivate",
+		models.DeactivateAccountRequest{Password: DefaultPassword}, asAlice)
+	h.Expect(http.StatusForbidden, http.MethodPost, "/api/auth/mfa/enroll", nil, asAlice)
+
+	var events []models.AuditEvent
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/audit-log?limit=1", nil, admin).Decode(t, &events)
+	if len(events) != 1 || events[0].Event != models.AuditImpersonation ||
+		events[0].ActorID == nil || *events[0].ActorID != h.Seed.Admin.ID {
+		t.Fatalf("latest audit event = %+v, want impersonation by admin", events)
+	}
+
+	// Support staff may impersonate customers, but not users with permissions
+	// they lack, and nobody impersonates admins
+	support := h.TokenFor("support", "customer_support")
+	h.Expect(http.StatusOK, http.MethodPost, impersonatePath, nil, support).Decode(t, &impersonation)
+	h.Expect(http.StatusForbidden, http.MethodPost,
+		fmt.Sprintf("/api/admin/users/%d/impersonate", created.User.ID), nil, support)
+	h.Expect(http.StatusForbidden, http.MethodPost,
+		fmt.Sprintf("/api/admin/users/%d/impersonate", h.Seed.Admin.ID), nil, support)
+	h.Expect(http.StatusBadRequest, http.MethodPost,
+		fmt.Sprintf("/api/admin/users/%d/impersonate", h.Seed.Admin.ID), nil, admin)
+	h.Expect(http.StatusForbidden, http.MethodPost, impersonatePath, nil, h.CustomerToken())
+
+	// Impersonation tokens die with the impersonator's rights
+	h.Expect(http.StatusOK, http.MethodGet, "/api/orders", nil, impersonation.AccessToken)
+	h.Expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", impersonation.ImpersonatorID),
+		models.UpdateUserRoleRequest{Role: models.RoleCustomer}, admin)
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/orders", nil, impersonation.AccessToken)
+	support = h.Login("support", DefaultPassword).AccessToken
+
+	// The last active admin keeps the admin role
+	h.Expect(http.StatusConflict, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", h.Seed.Admin.ID),
+		models.UpdateUserRoleRequest{Role: models.RoleCustomer}, admin)
+	h.Expect(http.StatusOK, http.MethodGet, "/api/admin/users", nil, admin)
+
+	// Soft deletion ends access but keeps the orders
+	h.Expect(http.StatusConflict, http.MethodDelete,
+		fmt.Sprintf("/api/admin/users/%d", h.Seed.Admin.ID), nil, admin)
+	h.Expect(http.StatusForbidden, http.MethodDelete, alicePath, nil, support)
+	h.Expect(http.StatusOK, http.MethodDelete, alicePath, nil, admin)
+	h.Expect(http.StatusNotFound, http.MethodDelete, alicePath, nil, admin)
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/orders", nil, aliceTokens.AccessToken)
+	h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/orders", nil, asAlice)
+	h.Expect(http.StatusUnauthorized, http.MethodPost, "/api/auth/login",
+		models.UserLoginResponseReq{Username: "alice", Password: DefaultPassword}, "")
+	h.Expect(http.StatusConflict, http.MethodPost, fmt.Sprintf("/api/admin/users/%d/activate", alice.ID), nil, admin)
+	h.Expect(http.StatusConflict, http.MethodPost, impersonatePath, nil, admin)
+
+	for _, user := range search("?username=alice", 0) {
+		t.Fatalf("deleted user %s still listed", user.Username)
+	}
+	if users := search("?username=alice&include_deleted=true", 1); users[0].DeletedAt == nil {
+		t.Fatalf("deleted user = %+v, want deleted_at", users[0])
+	}
+	h.Expect(http.StatusOK, http.MethodGet, alicePath, nil, admin).Decode(t, &detail)
+	if detail.DeletedAt == nil || len(detail.Orders) != 1 || len(detail.Sessions) != 0 {
+		t.Fatalf("deleted user detail = %+v, want the order kept and no sessions", detail)
+	}
+}
+
+// ProblemDetails checks that errors are rendered as RFC 7807 problem details
+// with a stable code, and that causes are shown only outside production
+func ProblemDetails(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	customer := h.CustomerToken()
+	tooMany := models.CreateOrderRequest{
+		Items: []models.CreateOrderItemRequest{{ProductID: h.Seed.Laptop.ID, Quantity: 100}},
+	}
+
+	resp := h.Expect(http.StatusConflict, http.MethodPost, "/api/orders", tooMany, customer)
+	problem := mustHaveProblem(t, resp, http.StatusConflict, apperr.CodeInsufficientStock)
+	if problem.Instance != "/api/orders" || problem.Title != "Conflict" || problem.Detail == "" {
+		t.Fatalf("problem = %+v, want title, detail and instance set", problem)
+	}
+	if problem.Cause != "" {
+		t.Fatalf("production problem exposes its cause %q", problem.Cause)
+	}
+
+	resp = h.Expect(http.StatusNotFound, http.MethodGet, "/api/no-such-route", nil, "")
+	mustHaveProblem(t, resp, http.StatusNotFound, apperr.CodeNotFound)
+
+	resp = h.Expect(http.StatusUnauthorized, http.MethodGet, "/api/orders", nil, "")
+	mustHaveProblem(t, resp, http.StatusUnauthorized, apperr.CodeUnauthorized)
+
+	resp = h.Expect(http.StatusForbidden, http.MethodGet, "/api/admin/users", nil, customer)
+	mustHaveProblem(t, resp, http.StatusForbidden, apperr.CodeForbidden)
+
+	resp = h.Expect(http.StatusBadRequest, http.MethodPost, "/api/orders",
+		models.CreateOrderRequest{}, customer)
+	mustHaveProblem(t, resp, http.StatusBadRequest, apperr.CodeInvalidInput)
+
+	// Extensions sit next to the standard members
+	resp = h.Expect(http.StatusConflict, http.MethodDelete, fmt.Sprintf("/api/warehouses/%d", h.Seed.Main.ID), nil, h.AdminToken())
+	mustHaveProblem(t, resp, http.StatusConflict, apperr.CodeWarehouseHasStock)
+	var extended struct {
+		WarehouseID int `json:"warehouse_id"`
+	}
+	resp.Decode(t, &extended)
+	if extended.WarehouseID != h.Seed.Main.ID {
+		t.Fatalf("problem warehouse_id = %d, want %d: %s", extended.WarehouseID, h.Seed.Main.ID, resp.Body)
+	}
+
+	// Development shows the underlying error to ease debugging
+	dev := New(t, newRepos, func(cfg *config.Config) { cfg.Server.Environment = "development" })
+	resp = dev.Expect(http.StatusConflict, http.MethodPost, "/api/orders", tooMany, dev.CustomerToken())
+	problem = mustHaveProblem(t, resp, http.StatusConflict, apperr.CodeInsufficientStock)
+	if problem.Cause == "" {
+		t.Fatalf("development problem has no cause: %s", resp.Body)
+	}
+}
+
+// mustHaveProblem checks that resp holds problem details with status and code
+func mustHaveProblem(t *testing.T, resp *Response, status int, code string) apperr.Problem {
+	t.Helper()
+	if contentType := resp.Header.Get("Content-Type"); contentType != apperr.ContentType {
+		t.Fatalf("error content type = %q, want %q: %s", contentType, apperr.ContentType, resp.Body)
+	}
+	var problem apperr.Problem
+	resp.Decode(t, &problem)
+	if problem.Status != status || problem.Code != code {
+		t.Fatalf("problem status %d code %q, want %d %q: %s", problem.Status, problem.Code, status, code, resp.Body)
+	}
+	return problem
+}
+
+// Validation checks that request bodies are validated before anything is
+// stored and that every invalid field is reported
+func Validation(t *testing.T, newRepos repotest.Factory) {
+	h := New(t, newRepos)
+	admin := h.AdminToken()
+	customer := h.CustomerToken()
+
+	resp := h.Expect(http.StatusBadRequest, http.MethodPost, "/api/products", models.ProductRequest{
+		Price: -5, Stock: -1, WarehouseID: h.Seed.Main.ID,
+	}, admin)
+	mustHaveFieldErrors(t, resp, map[string]string{"name": "required", "price": "money", "stock": "min"})
+
+	resp = h.Expect(http.StatusBadRequest, http.MethodPost, "/api/products", models.ProductRequest{
+		Name: "Cable", Price: 9.999, WarehouseID: h.Seed.Main.ID,
+	}, admin)
+	mustHaveFieldErrors(t, resp, map[string]string{"price": "money"})
+
+	// A product without initial stock is fine
+	h.Expect(http.StatusCreated, http.MethodPost, "/api/products", models.ProductRequest{
+		Name: "Cable", Price: 9.99, WarehouseID: h.Seed.Main.ID,
+	}, admin)
+
+	resp = h.Expect(http.StatusBadRequest, http.MethodPost, "/api/orders", models.CreateOrderRequest{
+		Items: []models.CreateOrderItemRequest{
+			{ProductID: h.Seed.Mouse.ID, Quantity: 1},
+			{ProductID: h.Seed.Laptop.ID, Quantity: -2},
+		},
+	}, customer)
+	mustHaveFieldErrors(t, resp, map[string]string{"items[1].quantity": "min"})
+
+	order := createOrder(t, h, customer, h.Seed.Mouse.ID, 1)
+	resp = h.Expect(http.StatusBadRequest, http.MethodPut, fmt.Sprintf("/api/orders/%d/status", order.Order.ID),
+		models.UpdateOrderStatusRequest{Status: "teleported"}, customer)
+	mustHaveFieldErrors(t, resp, map[string]string{"status": "order_status"})
+	mustHaveOrderStatus(t, h, customer, order.Order.ID, models.OrderPending)
+
+	main := h.Seed.Main.ID
+	resp = h.Expect(http.StatusBadRequest, http.MethodPost, "/api/transfers", models.StockTransferRequest{
+		FromWarehouseID: &main, ToWarehouseID: &main, ProductID: h.Seed.Mouse.ID, Quantity: 0,
+	}, admin)
+	mustHaveFieldErrors(t, resp, map[string]string{"to_warehouse_id": "distinct_warehouses", "quantity": "required"})
+
+	resp = h.Expect(http.StatusBadRequest, http.MethodPost, "/api/transfers", models.StockTransferRequest{
+		ProductID: h.Seed.Mouse.ID, Quantity: 1,
+	}, admin)
+	mustHaveFieldErrors(t, resp, map[string]string{"from_warehouse_id": "required_without", "to_warehouse_id": "required_without"})
+
+	// Stock can be set to zero but not below, nor below what pending orders
+	// have reserved
+	stockPath := fmt.Sprintf("/api/warehouses/%d/stocks/%d", main, h.Seed.Mouse.ID)
+	resp = h.Expect(http.StatusBadRequest, http.MethodPut, stockPath, models.UpdateStockRequest{Quantity: -1}, admin)
+	mustHaveFieldErrors(t, resp, map[string]string{"quantity": "min"})
+	h.Expect(http.StatusConflict, http.MethodPut, stockPath, models.UpdateStockRequest{Quantity: 0}, admin)
+	h.Expect(http.StatusOK, http.MethodPut, fmt.Sprintf("/api/orders/%d/status", order.Order.ID),
+		models.UpdateOrderStatusRequest{Status: models.OrderCancelled}, customer)
+	h.Expect(http.StatusOK, http.MethodPut, stockPath, models.UpdateStockRequest{Quantity: 0}, admin)
+	h.MustHaveStock(admin, main, h.Seed.Mouse.ID, 0)
+
+	resp = h.Expect(http.StatusBadRequest, http.MethodPost, "/api/auth/refresh", models.RefreshTokenRequest{}, "")
+	mustHaveFieldErrors(t, resp, map[string]string{"refresh_token": "required"})
+
+	// Bodies that are not JSON at all are rejected before validation
+	resp = h.DoWithHeader(http.MethodPost, "/api/auth/login", "{", http.Header{})
+	if resp.Status != http.StatusBadRequest {
+		t.Fatalf("malformed login body = %d, want 400: %s", resp.Status, resp.Body)
+	}
+}
+
+// mustHaveFieldErrors checks that resp is a validation problem listing
+// exactly the fields in want, each failing the given rule
+func mustHaveFieldErrors(t *testing.T, resp *Response, want map[string]string) {
+	t.Helper()
+	mustHaveProblem(t, resp, http.StatusBadRequest, apperr.CodeInvalidInput)
+
+	var problem struct {
+		Errors []validation.FieldError `json:"errors"`
+	}
+	resp.Decode(t, &problem)
+	got := map[string]string{}
+	for _, fe := range problem.Errors {
+		if fe.Message == "" {
+			t.Fatalf("field error %s has no message: %s", fe.Field, resp.Body)
+		}
+		got[fe.Field] = fe.Rule
+	}
+	if len(got) != len(want) {
+		t.Fatalf("field errors = %v, want %v: %s", got, want, resp.Body)
+	}
+	for field, rule := range want {
+		if got[field] != rule {
+			t.Fatalf("field errors = %v, want %v: %s", got, want, resp.Body)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// PasswordReset is a single-use token for setting a new password without
+// the old one. Only the SHA-256 hash of the token is stored.
+type PasswordReset struct {
+	ID        int        `json:"id" db:"id"`
+	UserID    int        `json:"user_id" db:"user_id"`
+	TokenHash string     `json:"-" db:"token_hash"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty" db:"used_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+}
+
+// ChangePasswordRequest is the body of PUT /api/auth/password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required" example:"correct horse battery staple"`
+}
+
+// ForgotPasswordRequest is the body of POST /api/auth/password/forgot
+type ForgotPasswordRequest struct {
+	Username string `json:"username" validate:"required" example:"alice"`
+}
+
+// ResetPasswordRequest is the body of POST /api/auth/password/reset
+type ResetPasswordRequest struct {
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required"`
+}
+
+// DeactivateAccountRequest is the body of POST /api/auth/deactivate. The
+// password is asked again so a stolen access token cannot close the account.
+type DeactivateAccountRequest struct {
+	Password string `json:"password" validate:"required"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// APIKeyHeader is the request header API keys are sent in
+const APIKeyHeader = "X-API-Key"
+
+// APIKey lets an integration call the API as the user it belongs to, limited
+// to its scopes. The prefix identifies a key in lists and logs; only the
+// SHA-256 hash of the whole key is stored, the key itself is shown once.
+type APIKey struct {
+	ID         int        `json:"id" db:"id"`
+	UserID     int        `json:"user_id" db:"user_id"`
+	Name       string     `json:"name" db:"name" example:"ERP stock sync"`
+	Prefix     string     `json:"prefix" db:"prefix" example:"oak_3f9a1c2e"`
+	KeyHash    string     `json:"-" db:"key_hash"`
+	Scopes     []string   `json:"scopes" db:"scopes" example:"stock:read"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+	CreatedBy  *int       `json:"created_by" db:"created_by"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+// CreateAPIKeyRequest is the body of POST /api/admin/api-keys
+type CreateAPIKeyRequest struct {
+	UserID    int      `json:"user_id" validate:"required" example:"7"`
+	Name      string   `json:"name" validate:"required" example:"ERP stock sync"`
+	Scopes    []string `json:"scopes" validate:"required,min=1" example:"stock:read"`
+	ExpiresIn string   `json:"expires_in,omitempty" example:"2160h"` // Go duration, defaults to 90 days
+}
+
+// CreateAPIKeyResponse carries the only copy of the key
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key" example:"oak_3f9a1c2e_6b86b273ff34fce19d6b804eff5a3f57"`
+}
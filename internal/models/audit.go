@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// Audit log events
+const (
+	AuditAccountLocked   = "login.account_locked"
+	AuditIPLocked        = "login.ip_locked"
+	AuditAccountUnlocked = "login.account_unlocked"
+	AuditMFAEnabled      = "mfa.enabled"
+	AuditMFADisabled     = "mfa.disabled"
+	AuditMFAReset        = "mfa.reset"
+	AuditPasswordChanged = "account.password_changed"
+	AuditPasswordReset   = "account.password_reset"
+	AuditUserDeactivated = "account.deactivated"
+	AuditUserActivated   = "account.activated"
+	AuditAPIKeyCreated   = "api_key.created"
+	AuditAPIKeyRevoked   = "api_key.revoked"
+	AuditUserCreated     = "user.created"
+	AuditUserDeleted     = "user.deleted"
+	AuditImpersonation   = "user.impersonated"
+)
+
+// AuditEvent is an entry of the audit log. ActorID is the user who caused the
+// event, if any; UserID the user it concerns. Subject names what the event
+// is about when there is no user, e.g. a username or an address.
+type AuditEvent struct {
+	ID        int       `json:"id" db:"id"`
+	Event     string    `json:"event" db:"event" example:"login.account_locked"`
+	ActorID   *int      `json:"actor_id,omitempty" db:"actor_id"`
+	UserID    *int      `json:"user_id,omitempty" db:"user_id"`
+	Subject   string    `json:"subject,omitempty" db:"subject" example:"alice"`
+	IP        string    `json:"ip,omitempty" db:"ip" example:"203.0.113.7"`
+	Details   string    `json:"details,omitempty" db:"details" example:"5 failed attempts, locked for 1m0s"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// Invitation lets someone sign up with a role other than "customer". Only the
+// SHA-256 hash of the code is stored; the code itself is shown once, when the
+// invitation is created.
+type Invitation struct {
+	ID        int        `json:"id" db:"id"`
+	CodeHash  string     `json:"-" db:"code_hash"`
+	Role      string     `json:"role" db:"role"`
+	CreatedBy *int       `json:"created_by" db:"created_by"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty" db:"used_at"`
+	UsedBy    *string    `json:"used_by,omitempty" db:"used_by"` // Username of the account created with it
+}
+
+// CreateInvitationRequest is the body of POST /api/admin/invitations
+type CreateInvitationRequest struct {
+	Role      string `json:"role" validate:"required" example:"admin"`
+	ExpiresIn string `json:"expires_in,omitempty" example:"72h"` // Go duration, defaults to 72h
+}
+
+// CreateInvitationResponse carries the only copy of the invite code
+type CreateInvitationResponse struct {
+	Invitation
+	Code string `json:"code" example:"9f86d081884c7d659a2feaa0c55ad015"`
+}
+
+// AcceptInvitationRequest is the body of POST /api/auth/invitations/accept
+type AcceptInvitationRequest struct {
+	Code     string `json:"code" validate:"required"`
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// Scopes failed logins are counted in
+const (
+	LoginScopeAccount = "account"
+	LoginScopeIP      = "ip"
+)
+
+// LoginAttempt counts the failed logins of an account or a source address
+type LoginAttempt struct {
+	Scope         string     `json:"scope" db:"scope"`
+	Subject       string     `json:"subject" db:"subject"`
+	Failures      int        `json:"failures" db:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at" db:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty" db:"locked_until"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// UserMFA is the TOTP enrollment of a user. EnabledAt is nil until the user
+// has confirmed a first code.
+type UserMFA struct {
+	UserID       int        `json:"user_id" db:"user_id"`
+	Secret       string     `json:"-" db:"secret"`
+	EnabledAt    *time.Time `json:"enabled_at,omitempty" db:"enabled_at"`
+	LastUsedStep int64      `json:"-" db:"last_used_step"` // Time step of the last accepted code
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+}
+
+// MFAStatus is the response of GET /api/auth/mfa
+type MFAStatus struct {
+	Enabled           bool `json:"enabled"`
+	Required          bool `json:"required"` // Whether the user's role requires MFA
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// MFAEnrollment is the response of POST /api/auth/mfa/enroll. The secret is
+// shown once, for entry into an authenticator app.
+type MFAEnrollment struct {
+	Secret     string `json:"secret" example:"JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"`
+	OTPAuthURL string `json:"otpauth_url" example:"otpauth://totp/OrderApp:alice?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=OrderApp"`
+}
+
+// MFACodeRequest carries a code from the authenticator app
+type MFACodeRequest struct {
+	Code string `json:"code" validate:"required" example:"123456"`
+}
+
+// MFAVerifyRequest completes a login that returned an MFA challenge. Either
+// a code from the authenticator app or an unused recovery code is required.
+type MFAVerifyRequest struct {
+	MFAToken     string `json:"mfa_token" validate:"required"`
+	Code         string `json:"code,omitempty" validate:"required_without=RecoveryCode" example:"123456"`
+	RecoveryCode string `json:"recovery_code,omitempty" example:"3f9a1-c07d2"`
+}
+
+// MFARecoveryCodes lists new recovery codes. They are not stored in clear
+// and cannot be shown again.
+type MFARecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
@@ -1,6 +1,41 @@
 package models
 
-import "time"
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+// Order statuses. Orders move pending → confirmed → picking → packed →
+// shipped → delivered; they may be cancelled until they are shipped and
+// refunded once shipped.
+const (
+	OrderPending   = "pending"
+	OrderConfirmed = "confirmed"
+	OrderPicking   = "picking"
+	OrderPacked    = "packed"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+	OrderRefunded  = "refunded"
+)
+
+// OrderStatuses lists every status an order can be in
+var OrderStatuses = []string{
+	OrderPending, OrderConfirmed, OrderPicking, OrderPacked,
+	OrderShipped, OrderDelivered, OrderCancelled, OrderRefunded,
+}
+
+// IsOrderStatus reports whether status is a known order status
+func IsOrderStatus(status string) bool {
+	return slices.Contains(OrderStatuses, status)
+}
+
+// OrderHoldsStock reports whether the items of an order in status have been
+// taken from warehouse stock but not yet left the warehouse
+func OrderHoldsStock(status string) bool {
+	return status == OrderConfirmed || status == OrderPicking || status == OrderPacked
+}
 
 type Order struct {
 	ID          int       `json:"id" db:"id"`
@@ -8,27 +43,49 @@ type Order struct {
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 	Status      string    `json:"status,omitempty"`
 	TotalAmount float64   `json:"total_amount" db:"total_amount"`
-	Username    string    `json:"username,omitempty"` // View'dan gelecek
+	Username    string    `json:"username,omitempty"` // Joined from users, not stored on the order
 }
 
+// OrderItem is a line of an order. Price, product name and description are
+// snapshots taken when the order was placed, so they show what the customer
+// was charged for even after the product changes.
 type OrderItem struct {
 	ID                 int     `json:"id" db:"id"`
 	OrderID            int     `json:"order_id" db:"order_id"`
 	ProductID          int     `json:"product_id" db:"product_id"`
 	Quantity           int     `json:"quantity" db:"quantity"`
-	Price              float64 `json:"price" db:"price"`
-	ProductName        string  `json:"product_name,omitempty"`
-	ProductDescription string  `json:"product_description,omitempty"`
+	Price              float64 `json:"price" db:"unit_price"`
+	LineTotal          float64 `json:"line_total" db:"line_total"`
+	ProductName        string  `json:"product_name,omitempty" db:"product_name"`
+	ProductDescription string  `json:"product_description,omitempty" db:"product_description"`
+	// Warehouses the item is taken from, empty for orders placed before
+	// stock was reserved
+	Allocations []OrderItemAllocation `json:"allocations"`
+}
+
+// OrderItemAllocation is the part of an order item taken from one warehouse
+type OrderItemAllocation struct {
+	WarehouseID   int    `json:"warehouse_id" db:"warehouse_id"`
+	WarehouseName string `json:"warehouse_name,omitempty"`
+	Quantity      int    `json:"quantity" db:"quantity"`
+}
+
+// LineTotal returns the price of quantity units at unitPrice, rounded to
+// cents like the DECIMAL columns it is stored in
+func LineTotal(unitPrice float64, quantity int) float64 {
+	return math.Round(unitPrice*float64(quantity)*100) / 100
 }
 
 // Request structs
 type CreateOrderRequest struct {
-	Items []CreateOrderItemRequest `json:"items"`
+	Items []CreateOrderItemRequest `json:"items" validate:"required,min=1,dive"`
+	// Delivery location, used by the closest allocation strategy
+	ShipTo *Location `json:"ship_to,omitempty"`
 }
 
 type CreateOrderItemRequest struct {
-	ProductID int `json:"product_id"`
-	Quantity  int `json:"quantity"`
+	ProductID int `json:"product_id" validate:"required,min=1"`
+	Quantity  int `json:"quantity" validate:"required,min=1"`
 }
 
 type OrderWithItems struct {
@@ -36,8 +93,20 @@ type OrderWithItems struct {
 	Items []OrderItem `json:"items"`
 }
 
+// OrderStatusChange is an entry of the status history of an order. The
+// first entry of every order has no previous status.
+type OrderStatusChange struct {
+	ID            int       `json:"id" db:"id"`
+	OrderID       int       `json:"order_id" db:"order_id"`
+	FromStatus    *string   `json:"from_status" db:"from_status" example:"confirmed"`
+	ToStatus      string    `json:"to_status" db:"to_status" example:"picking"`
+	ChangedBy     *int      `json:"changed_by" db:"changed_by"`
+	ChangedByUser string    `json:"changed_by_user,omitempty"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+}
+
 type UpdateOrderStatusRequest struct {
-	Status string `json:"status" example:"confirmed"`
+	Status string `json:"status" validate:"required,order_status" example:"confirmed"`
 }
 
 // View related structs
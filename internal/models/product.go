@@ -16,9 +16,9 @@ type Product struct {
 }
 
 type ProductRequest struct {
-	Name        string  `json:"name" validate:"required" example:"Laptop"`
+	Name        string  `json:"name" validate:"required,max=255" example:"Laptop"`
 	Description string  `json:"description" example:"High performance laptop"`
-	Price       float64 `json:"price" validate:"required" example:"999.99"`
-	Stock       int     `json:"stock" validate:"required" example:"10"`
-	WarehouseID int     `json:"warehouse_id" validate:"required"`
+	Price       float64 `json:"price" validate:"required,money" example:"999.99"`
+	Stock       int     `json:"stock" validate:"min=0" example:"10"`
+	WarehouseID int     `json:"warehouse_id" validate:"required,min=1"`
 }
@@ -0,0 +1,132 @@
+package models
+
+// Built-in roles referenced by the code
+const (
+	RoleAdmin    = "admin"
+	RoleCustomer = "customer"
+)
+
+// Permissions checked by the routes. The catalogue is fixed by the code; the
+// permissions of each role are stored in the database and editable by admins.
+const (
+	PermOrdersCreate     = "orders:create"
+	PermOrdersRead       = "orders:read"
+	PermOrdersReadAll    = "orders:read_all"
+	PermOrdersFulfil     = "orders:fulfil"
+	PermOrdersRefund     = "orders:refund"
+	PermProductsWrite    = "products:write"
+	PermWarehousesRead   = "warehouses:read"
+	PermWarehousesWrite  = "warehouses:write"
+	PermWarehousesAll    = "warehouses:all"
+	PermStockRead        = "stock:read"
+	PermStockAdjust      = "stock:adjust"
+	PermTransfersCreate  = "transfers:create"
+	PermTransfersRead    = "transfers:read"
+	PermTransfersProcess = "transfers:process"
+	PermUsersRead        = "users:read"
+	PermUsersManage      = "users:manage"
+	PermUsersImpersonate = "users:impersonate"
+	PermRolesManage      = "roles:manage"
+	PermAuditRead        = "audit:read"
+	PermAPIKeysManage    = "api_keys:manage"
+)
+
+type Permission struct {
+	Name        string `json:"name" db:"name" example:"transfers:process"`
+	Description string `json:"description" db:"description"`
+}
+
+type Role struct {
+	Name        string   `json:"name" db:"name" example:"warehouse_clerk"`
+	Description string   `json:"description" db:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// Permissions is the catalogue seeded by the migrations
+var Permissions = []Permission{
+	{PermOrdersCreate, "Place, confirm, cancel and delete own orders"},
+	{PermOrdersRead, "Read own orders"},
+	{PermOrdersReadAll, "Read the orders of every user"},
+	{PermOrdersFulfil, "Move any order through picking, packing and shipping, or cancel it"},
+	{PermOrdersRefund, "Refund shipped and delivered orders"},
+	{PermProductsWrite, "Create, update and delete products"},
+	{PermWarehousesRead, "Read warehouses"},
+	{PermWarehousesWrite, "Create, update and delete warehouses"},
+	{PermWarehousesAll, "Act on every warehouse, not only the assigned ones"},
+	{PermStockRead, "Read warehouse stock"},
+	{PermStockAdjust, "Set and add warehouse stock"},
+	{PermTransfersCreate, "Request stock transfers"},
+	{PermTransfersRead, "Read stock transfers"},
+	{PermTransfersProcess, "Change the status of and process stock transfers"},
+	{PermUsersRead, "Read users and their sessions"},
+	{PermUsersManage, "Change roles, revoke sessions and invite users"},
+	{PermUsersImpersonate, "Act as another user through an impersonation token"},
+	{PermRolesManage, "Create roles and edit their permissions"},
+	{PermAuditRead, "Read the audit log"},
+	{PermAPIKeysManage, "Create, list and revoke API keys"},
+}
+
+// DefaultRoles are the roles seeded by the migrations. The admin role
+// always holds every permission and cannot be edited.
+var DefaultRoles = []Role{
+	{
+		Name:        RoleAdmin,
+		Description: "Full access",
+		Permissions: allPermissions(),
+	},
+	{
+		Name:        "warehouse_manager",
+		Description: "Runs the warehouses: stock, transfers and products",
+		Permissions: []string{
+			PermOrdersRead, PermOrdersReadAll, PermOrdersFulfil, PermProductsWrite, PermWarehousesRead,
+			PermStockRead, PermStockAdjust, PermTransfersCreate, PermTransfersRead, PermTransfersProcess,
+		},
+	},
+	{
+		Name:        "warehouse_clerk",
+		Description: "Checks stock and requests transfers",
+		Permissions: []string{PermOrdersFulfil, PermWarehousesRead, PermStockRead, PermTransfersCreate, PermTransfersRead},
+	},
+	{
+		Name:        "customer_support",
+		Description: "Looks up customers and their orders",
+		Permissions: []string{
+			PermOrdersCreate, PermOrdersRead, PermOrdersReadAll, PermOrdersRefund, PermUsersRead, PermUsersImpersonate,
+		},
+	},
+	{
+		Name:        RoleCustomer,
+		Description: "Places orders",
+		Permissions: []string{PermOrdersCreate, PermOrdersRead},
+	},
+}
+
+func allPermissions() []string {
+	names := make([]string, len(Permissions))
+	for i, p := range Permissions {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// IsPermission reports whether name is in the permission catalogue
+func IsPermission(name string) bool {
+	for _, p := range Permissions {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateRoleRequest is the body of POST /api/admin/roles
+type CreateRoleRequest struct {
+	Name        string   `json:"name" validate:"required" example:"auditor"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions" example:"orders:read_all"`
+}
+
+// UpdateRolePermissionsRequest is the body of PUT /api/admin/roles/{name}/permissions
+type UpdateRolePermissionsRequest struct {
+	Permissions []string `json:"permissions" example:"transfers:process"`
+}
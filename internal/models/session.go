@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Session is one login on one device. Every refresh token issued from that
+// login belongs to the session.
+type Session struct {
+	ID          string    `json:"id" db:"id"`
+	UserID      int       `json:"user_id" db:"user_id"`
+	UserAgent   string    `json:"user_agent" db:"user_agent"`
+	IPAddress   string    `json:"ip_address" db:"ip_address"`
+	DeviceLabel string    `json:"device_label" db:"device_label" example:"Firefox on Linux"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at" db:"last_used_at"`
+	ExpiresAt   time.Time `json:"expires_at"` // Expiry of the session's current refresh token
+	Current     bool      `json:"current"`    // Session of the access token used for the request
+}
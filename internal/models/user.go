@@ -3,12 +3,14 @@ package models
 import "time"
 
 type User struct {
-	ID           int       `json:"id" db:"id"`
-	Username     string    `json:"username" db:"username"`
-	PasswordHash string    `json:"-" db:"password_hash"`
-	IsActive     bool      `json:"is_active" db:"is_active"`
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
-	Role         string    `json:"role" db:"role"`
+	ID           int        `json:"id" db:"id"`
+	Username     string     `json:"username" db:"username"`
+	PasswordHash string     `json:"-" db:"password_hash"`
+	IsActive     bool       `json:"is_active" db:"is_active"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	Role         string     `json:"role" db:"role"`
+	TokenVersion int        `json:"-" db:"token_version"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty" db:"deleted_at"` // Set once soft-deleted
 }
 type GetMeResponseReq struct {
 	ID        int       `json:"id"`
@@ -18,13 +20,9 @@ type GetMeResponseReq struct {
 	Role      string    `json:"role"`
 }
 type UserLoginResponseReq struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
-type UserRegisterResponseReq struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Role     string `json:"role"`
+	Username    string `json:"username" validate:"required"`
+	Password    string `json:"password" validate:"required"`
+	DeviceLabel string `json:"device_label,omitempty" example:"Work laptop"` // Defaults to browser and OS
 }
 type UserResponseReq struct {
 	Username string `json:"username"`
@@ -33,12 +31,12 @@ type UserResponseReq struct {
 }
 
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string `json:"username" validate:"required,max=255"`
+	Password string `json:"password" validate:"required"`
 }
 
 type UpdateUserRoleRequest struct {
-	Role string `json:"role" validate:"required,oneof=user admin" example:"admin"`
+	Role string `json:"role" validate:"required" example:"warehouse_clerk"`
 }
 
 // RefreshTokenRequest represents the request body for refresh token endpoint
@@ -57,3 +55,39 @@ type RefreshTokenResponse struct {
 	TokenType   string `json:"token_type" example:"Bearer"`
 	ExpiresIn   int    `json:"expires_in" example:"900"`
 }
+
+// UserFilter selects users for GET /api/admin/users. Zero values do not
+// filter; deleted users are left out unless IncludeDeleted is set.
+type UserFilter struct {
+	Username       string // Case-insensitive substring
+	Role           string
+	IsActive       *bool
+	CreatedFrom    *time.Time
+	CreatedTo      *time.Time // Exclusive
+	IncludeDeleted bool
+	Limit          int
+	Offset         int
+}
+
+// UserDetail is a user with their orders and active sessions
+type UserDetail struct {
+	User
+	Orders   []OrderWithItems `json:"orders"`
+	Sessions []Session        `json:"sessions"`
+}
+
+// CreateUserRequest is the body of POST /api/admin/users
+type CreateUserRequest struct {
+	Username string `json:"username" validate:"required" example:"alice"`
+	Password string `json:"password,omitempty"`                // Without one, a reset token is sent to the user
+	Role     string `json:"role,omitempty" example:"customer"` // Defaults to customer
+}
+
+// ImpersonationResponse carries an access token acting as another user
+type ImpersonationResponse struct {
+	AccessToken    string `json:"access_token" example:"eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9..."`
+	TokenType      string `json:"token_type" example:"Bearer"`
+	ExpiresIn      int    `json:"expires_in" example:"900"`
+	UserID         int    `json:"user_id" example:"7"`
+	ImpersonatorID int    `json:"impersonator_id" example:"1"`
+}
@@ -6,10 +6,17 @@ type Warehouse struct {
 	ID        int       `json:"id" db:"id"`
 	Name      string    `json:"name" db:"name" validate:"required"`
 	Address   string    `json:"address" db:"address"`
+	Location  *Location `json:"location,omitempty"`
 	IsActive  bool      `json:"is_active" db:"is_active"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 }
 
+// Location is a point on the map in decimal degrees
+type Location struct {
+	Latitude  float64 `json:"latitude" db:"latitude" validate:"min=-90,max=90" example:"41.0082"`
+	Longitude float64 `json:"longitude" db:"longitude" validate:"min=-180,max=180" example:"28.9784"`
+}
+
 type WarehouseStock struct {
 	ID               int       `json:"id" db:"id"`
 	WarehouseID      int       `json:"warehouse_id" db:"warehouse_id"`
@@ -47,29 +54,42 @@ type StockTransfer struct {
 
 // Request models
 type CreateWarehouseRequest struct {
-	Name    string `json:"name" validate:"required"`
-	Address string `json:"address"`
+	Name     string    `json:"name" validate:"required,max=255"`
+	Address  string    `json:"address"`
+	Location *Location `json:"location"`
 }
 
 type UpdateWarehouseRequest struct {
-	Name     string `json:"name" validate:"required"`
-	Address  string `json:"address"`
-	IsActive bool   `json:"is_active"`
+	Name     string    `json:"name" validate:"required,max=255"`
+	Address  string    `json:"address"`
+	Location *Location `json:"location"`
+	IsActive bool      `json:"is_active"`
 }
 
 type StockTransferRequest struct {
-	FromWarehouseID *int   `json:"from_warehouse_id"`
-	ToWarehouseID   *int   `json:"to_warehouse_id"`
-	ProductID       int    `json:"product_id" validate:"required"`
+	FromWarehouseID *int   `json:"from_warehouse_id" validate:"required_without=ToWarehouseID"`
+	ToWarehouseID   *int   `json:"to_warehouse_id" validate:"required_without=FromWarehouseID"`
+	ProductID       int    `json:"product_id" validate:"required,min=1"`
 	Quantity        int    `json:"quantity" validate:"required,min=1"`
 	Reason          string `json:"reason"`
 }
 
 type UpdateStockRequest struct {
-	Quantity int    `json:"quantity" validate:"required,min=0"`
+	Quantity int    `json:"quantity" validate:"min=0"`
 	Reason   string `json:"reason"`
 }
 
 type StockTransferStatusRequest struct {
-	Status string `json:"status" validate:"required"`
+	Status string `json:"status" validate:"required,oneof=pending completed failed cancelled"`
+}
+
+// UserWarehouses lists the warehouses a user is assigned to
+type UserWarehouses struct {
+	UserID       int   `json:"user_id" example:"7"`
+	WarehouseIDs []int `json:"warehouse_ids" validate:"dive,min=1" example:"1,2"`
+}
+
+// SetUserWarehousesRequest is the body of PUT /api/admin/users/{id}/warehouses
+type SetUserWarehousesRequest struct {
+	WarehouseIDs []int `json:"warehouse_ids" validate:"dive,min=1" example:"1,2"`
 }
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+)
+
+// AccessTokenDenylist holds the ids (jti) of access tokens revoked before
+// their expiry, and the ids (sid) of sessions whose access tokens are all
+// revoked. Entries only matter until the last such token expires.
+type AccessTokenDenylist interface {
+	Deny(id string, expiresAt time.Time) error
+	// IsDenied reports whether any of ids is denied at now
+	IsDenied(ids []string, now time.Time) (bool, error)
+	DeleteExpired(before time.Time) (int64, error)
+}
+
+type accessTokenDenylist struct {
+	q db.Querier
+}
+
+func NewAccessTokenDenylist(q db.Querier) AccessTokenDenylist {
+	return &accessTokenDenylist{q: q}
+}
+
+func (r *accessTokenDenylist) Deny(id string, expiresAt time.Time) error {
+	_, err := r.q.Exec(context.Background(),
+		`INSERT INTO revoked_access_tokens (jti, expires_at) VALUES ($1, $2)
+         ON CONFLICT (jti) DO UPDATE SET expires_at = GREATEST(revoked_access_tokens.expires_at, EXCLUDED.expires_at)`,
+		id, expiresAt)
+	return err
+}
+
+func (r *accessTokenDenylist) IsDenied(ids []string, now time.Time) (bool, error) {
+	var denied bool
+	err := r.q.QueryRow(context.Background(),
+		`SELECT EXISTS (SELECT 1 FROM revoked_access_tokens WHERE jti = ANY($1) AND expires_at > $2)`,
+		ids, now).Scan(&denied)
+	return denied, err
+}
+
+func (r *accessTokenDenylist) DeleteExpired(before time.Time) (int64, error) {
+	result, err := r.q.Exec(context.Background(),
+		`DELETE FROM revoked_access_tokens WHERE expires_at <= $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+type APIKeyRepository interface {
+	CreateAPIKey(key *models.APIKey) error
+	// GetAPIKeys returns every key, newest first
+	GetAPIKeys() ([]models.APIKey, error)
+	GetAPIKey(id int) (*models.APIKey, error)
+	GetAPIKeyByPrefix(prefix string) (*models.APIKey, error)
+	TouchAPIKey(id int, usedAt time.Time) error
+	// RevokeAPIKey revokes an active key, or returns an APIKeyNotFoundError
+	RevokeAPIKey(id int, revokedAt time.Time) error
+}
+
+type apiKeyRepo struct {
+	q db.Querier
+}
+
+func NewAPIKeyRepository(q db.Querier) APIKeyRepository {
+	return &apiKeyRepo{q: q}
+}
+
+func (r *apiKeyRepo) CreateAPIKey(key *models.APIKey) error {
+	return r.q.QueryRow(context.Background(),
+		`INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at, created_by)
+         VALUES ($1, $2, $3, $4, $5, $6, $7)
+         RETURNING id, created_at`,
+		key.UserID, key.Name, key.Prefix, key.KeyHash, key.Scopes, key.ExpiresAt, key.CreatedBy).
+		Scan(&key.ID, &key.CreatedAt)
+}
+
+func (r *apiKeyRepo) GetAPIKeys() ([]models.APIKey, error) {
+	rows, err := r.q.Query(context.Background(),
+		`SELECT id, user_id, name, prefix, key_hash, scopes, expires_at, last_used_at, revoked_at,
+                created_by, created_at
+         FROM api_keys ORDER BY created_at DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		var key models.APIKey
+		err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.KeyHash, &key.Scopes,
+			&key.ExpiresAt, &key.LastUsedAt, &key.RevokedAt, &key.CreatedBy, &key.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (r *apiKeyRepo) GetAPIKey(id int) (*models.APIKey, error) {
+	var key models.APIKey
+	err := r.q.QueryRow(context.Background(),
+		`SELECT id, user_id, name, prefix, key_hash, scopes, expires_at, last_used_at, revoked_at,
+                created_by, created_at
+         FROM api_keys WHERE id = $1`,
+		id).Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.KeyHash, &key.Scopes,
+		&key.ExpiresAt, &key.LastUsedAt, &key.RevokedAt, &key.CreatedBy, &key.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (r *apiKeyRepo) GetAPIKeyByPrefix(prefix string) (*models.APIKey, error) {
+	var key models.APIKey
+	err := r.q.QueryRow(context.Background(),
+		`SELECT id, user_id, name, prefix, key_hash, scopes, expires_at, last_used_at, revoked_at,
+                created_by, created_at
+         FROM api_keys WHERE prefix = $1`,
+		prefix).Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.KeyHash, &key.Scopes,
+		&key.ExpiresAt, &key.LastUsedAt, &key.RevokedAt, &key.CreatedBy, &key.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (r *apiKeyRepo) TouchAPIKey(id int, usedAt time.Time) error {
+	_, err := r.q.Exec(context.Background(),
+		`UPDATE api_keys SET last_used_at = $2 WHERE id = $1`, id, usedAt)
+	return err
+}
+
+func (r *apiKeyRepo) RevokeAPIKey(id int, revokedAt time.Time) error {
+	result, err := r.q.Exec(context.Background(),
+		`UPDATE api_keys SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL`, id, revokedAt)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return &APIKeyNotFoundError{ID: id}
+	}
+
+	return nil
+}
+
+// APIKeyNotFoundError is returned for unknown or already revoked keys
+type APIKeyNotFoundError struct {
+	ID int
+}
+
+func (e *APIKeyNotFoundError) Error() string {
+	return "api key not found"
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+// AuditRepository appends to and reads the audit log
+type AuditRepository interface {
+	RecordEvent(event *models.AuditEvent) error
+	// GetEvents returns the newest events first
+	GetEvents(limit int) ([]models.AuditEvent, error)
+}
+
+type auditRepo struct {
+	q db.Querier
+}
+
+func NewAuditRepository(q db.Querier) AuditRepository {
+	return &auditRepo{q: q}
+}
+
+func (r *auditRepo) RecordEvent(event *models.AuditEvent) error {
+	return r.q.QueryRow(context.Background(),
+		`INSERT INTO audit_log (event, actor_id, user_id, subject, ip, details)
+         VALUES ($1, $2, $3, $4, $5, $6)
+         RETURNING id, created_at`,
+		event.Event, event.ActorID, event.UserID, event.Subject, event.IP, event.Details).
+		Scan(&event.ID, &event.CreatedAt)
+}
+
+func (r *auditRepo) GetEvents(limit int) ([]models.AuditEvent, error) {
+	rows, err := r.q.Query(context.Background(),
+		`SELECT id, event, actor_id, user_id, subject, ip, details, created_at
+         FROM audit_log ORDER BY created_at DESC, id DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var e models.AuditEvent
+		err := rows.Scan(&e.ID, &e.Event, &e.ActorID, &e.UserID, &e.Subject, &e.IP, &e.Details, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+type InvitationRepository interface {
+	CreateInvitation(invitation *models.Invitation) error
+	GetInvitations() ([]models.Invitation, error)
+	GetInvitationByCodeHash(codeHash string) (*models.Invitation, error)
+	// ClaimInvitation marks an unused, unexpired invitation as used by
+	// username. Only one caller can claim an invitation; everyone else gets an
+	// InvitationClaimedError.
+	ClaimInvitation(id int, username string, usedAt time.Time) error
+	// ReleaseInvitation undoes a claim whose sign-up failed
+	ReleaseInvitation(id int) error
+	DeleteInvitation(id int) error
+}
+
+type invitationRepo struct {
+	q db.Querier
+}
+
+func NewInvitationRepository(q db.Querier) InvitationRepository {
+	return &invitationRepo{q: q}
+}
+
+func (r *invitationRepo) CreateInvitation(invitation *models.Invitation) error {
+	return r.q.QueryRow(context.Background(),
+		`INSERT INTO invitations (code_hash, role, created_by, expires_at)
+         VALUES ($1, $2, $3, $4)
+         RETURNING id, created_at`,
+		invitation.CodeHash, invitation.Role, invitation.CreatedBy, invitation.ExpiresAt).
+		Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+func (r *invitationRepo) GetInvitations() ([]models.Invitation, error) {
+	rows, err := r.q.Query(context.Background(),
+		`SELECT id, code_hash, role, created_by, expires_at, created_at, used_at, used_by
+         FROM invitations ORDER BY created_at DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []models.Invitation{}
+	for rows.Next() {
+		var inv models.Invitation
+		err := rows.Scan(&inv.ID, &inv.CodeHash, &inv.Role, &inv.CreatedBy, &inv.ExpiresAt,
+			&inv.CreatedAt, &inv.UsedAt, &inv.UsedBy)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+func (r *invitationRepo) GetInvitationByCodeHash(codeHash string) (*models.Invitation, error) {
+	var inv models.Invitation
+	err := r.q.QueryRow(context.Background(),
+		`SELECT id, code_hash, role, created_by, expires_at, created_at, used_at, used_by
+         FROM invitations WHERE code_hash = $1`,
+		codeHash).Scan(&inv.ID, &inv.CodeHash, &inv.Role, &inv.CreatedBy, &inv.ExpiresAt,
+		&inv.CreatedAt, &inv.UsedAt, &inv.UsedBy)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &inv, nil
+}
+
+func (r *invitationRepo) ClaimInvitation(id int, username string, usedAt time.Time) error {
+	result, err := r.q.Exec(context.Background(),
+		`UPDATE invitations SET used_at = $1, used_by = $2
+         WHERE id = $3 AND used_at IS NULL AND expires_at > $1`,
+		usedAt, username, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return &InvitationClaimedError{InvitationID: id}
+	}
+
+	return nil
+}
+
+func (r *invitationRepo) ReleaseInvitation(id int) error {
+	_, err := r.q.Exec(context.Background(),
+		`UPDATE invitations SET used_at = NULL, used_by = NULL WHERE id = $1`, id)
+	return err
+}
+
+func (r *invitationRepo) DeleteInvitation(id int) error {
+	result, err := r.q.Exec(context.Background(),
+		`DELETE FROM invitations WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return &InvitationNotFoundError{InvitationID: id}
+	}
+
+	return nil
+}
+
+// InvitationNotFoundError is returned for unknown invitation ids
+type InvitationNotFoundError struct {
+	InvitationID int
+}
+
+func (e *InvitationNotFoundError) Error() string {
+	return "invitation not found"
+}
+
+// InvitationClaimedError is returned when an invitation is already used,
+// expired or gone
+type InvitationClaimedError struct {
+	InvitationID int
+}
+
+func (e *InvitationClaimedError) Error() string {
+	return "invitation already used or expired"
+}
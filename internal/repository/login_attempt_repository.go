@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+// LoginAttemptRepository counts failed logins per scope and subject, e.g.
+// per username and per source address
+type LoginAttemptRepository interface {
+	GetLoginAttempt(scope, subject string) (*models.LoginAttempt, error)
+	// RecordLoginFailure counts a failure at the given time. Counts whose
+	// last failure is older than resetBefore start over.
+	RecordLoginFailure(scope, subject string, at, resetBefore time.Time) (*models.LoginAttempt, error)
+	LockLoginAttempt(scope, subject string, until time.Time) error
+	ResetLoginAttempts(scope, subject string) error
+	DeleteStaleLoginAttempts(before time.Time) (int64, error)
+}
+
+type loginAttemptRepo struct {
+	q db.Querier
+}
+
+func NewLoginAttemptRepository(q db.Querier) LoginAttemptRepository {
+	return &loginAttemptRepo{q: q}
+}
+
+func (r *loginAttemptRepo) GetLoginAttempt(scope, subject string) (*models.LoginAttempt, error) {
+	var a models.LoginAttempt
+	err := r.q.QueryRow(context.Background(),
+		`SELECT scope, subject, failures, last_failure_at, locked_until
+         FROM login_attempts WHERE scope = $1 AND subject = $2`,
+		scope, subject).Scan(&a.Scope, &a.Subject, &a.Failures, &a.LastFailureAt, &a.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (r *loginAttemptRepo) RecordLoginFailure(scope, subject string, at, resetBefore time.Time) (*models.LoginAttempt, error) {
+	var a models.LoginAttempt
+	err := r.q.QueryRow(context.Background(),
+		`INSERT INTO login_attempts (scope, subject, failures, last_failure_at)
+         VALUES ($1, $2, 1, $3)
+         ON CONFLICT (scope, subject) DO UPDATE SET
+             failures = CASE WHEN login_attempts.last_failure_at < $4 THEN 1
+                             ELSE login_attempts.failures + 1 END,
+             locked_until = CASE WHEN login_attempts.last_failure_at < $4 THEN NULL
+                                 ELSE login_attempts.locked_until END,
+             last_failure_at = $3
+         RETURNING scope, subject, failures, last_failure_at, locked_until`,
+		scope, subject, at, resetBefore).Scan(&a.Scope, &a.Subject, &a.Failures, &a.LastFailureAt, &a.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (r *loginAttemptRepo) LockLoginAttempt(scope, subject string, until time.Time) error {
+	_, err := r.q.Exec(context.Background(),
+		`UPDATE login_attempts SET locked_until = $3 WHERE scope = $1 AND subject = $2`,
+		scope, subject, until)
+	return err
+}
+
+func (r *loginAttemptRepo) ResetLoginAttempts(scope, subject string) error {
+	_, err := r.q.Exec(context.Background(),
+		`DELETE FROM login_attempts WHERE scope = $1 AND subject = $2`, scope, subject)
+	return err
+}
+
+// DeleteStaleLoginAttempts removes counts that neither failed nor were
+// locked since before
+func (r *loginAttemptRepo) DeleteStaleLoginAttempts(before time.Time) (int64, error) {
+	result, err := r.q.Exec(context.Background(),
+		`DELETE FROM login_attempts
+         WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $1)`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
@@ -0,0 +1,57 @@
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+// accessTokenDenylist keeps revoked token and session ids until they
+// expire. Unlike the
+// other repositories of this package it is also used in production, by
+// single-instance deployments that configure the memory denylist store.
+type accessTokenDenylist struct {
+	mu     sync.Mutex
+	denied map[string]time.Time // jti or sid -> expiry
+}
+
+func NewAccessTokenDenylist() repository.AccessTokenDenylist {
+	return &accessTokenDenylist{denied: map[string]time.Time{}}
+}
+
+func (r *accessTokenDenylist) Deny(id string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if expiresAt.After(r.denied[id]) {
+		r.denied[id] = expiresAt
+	}
+	return nil
+}
+
+func (r *accessTokenDenylist) IsDenied(ids []string, now time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range ids {
+		if expiresAt, ok := r.denied[id]; ok && expiresAt.After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *accessTokenDenylist) DeleteExpired(before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deleted int64
+	for jti, expiresAt := range r.denied {
+		if !expiresAt.After(before) {
+			delete(r.denied, jti)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
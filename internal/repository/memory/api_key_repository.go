@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type apiKeyRepo struct {
+	s *Store
+}
+
+func NewAPIKeyRepository(s *Store) repository.APIKeyRepository {
+	return &apiKeyRepo{s: s}
+}
+
+func (r *apiKeyRepo) CreateAPIKey(key *models.APIKey) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.users[key.UserID]; !ok {
+		return ErrForeignKey
+	}
+	if key.CreatedBy != nil {
+		if _, ok := r.s.users[*key.CreatedBy]; !ok {
+			return ErrForeignKey
+		}
+	}
+	for _, existing := range r.s.apiKeys {
+		if existing.Prefix == key.Prefix {
+			return ErrUniqueViolation
+		}
+	}
+
+	key.ID = r.s.nextID("api_keys")
+	key.CreatedAt = r.s.now()
+	row := copyAPIKey(key)
+	row.LastUsedAt = nil
+	row.RevokedAt = nil
+	r.s.apiKeys[row.ID] = &row
+	return nil
+}
+
+func (r *apiKeyRepo) GetAPIKeys() ([]models.APIKey, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	keys := []models.APIKey{}
+	for _, key := range r.s.apiKeys {
+		keys = append(keys, copyAPIKey(key))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ID > keys[j].ID
+	})
+
+	return keys, nil
+}
+
+func (r *apiKeyRepo) GetAPIKey(id int) (*models.APIKey, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	key, ok := r.s.apiKeys[id]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	result := copyAPIKey(key)
+	return &result, nil
+}
+
+func (r *apiKeyRepo) GetAPIKeyByPrefix(prefix string) (*models.APIKey, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for _, key := range r.s.apiKeys {
+		if key.Prefix == prefix {
+			result := copyAPIKey(key)
+			return &result, nil
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+func (r *apiKeyRepo) TouchAPIKey(id int, usedAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if key, ok := r.s.apiKeys[id]; ok {
+		key.LastUsedAt = &usedAt
+	}
+	return nil
+}
+
+func (r *apiKeyRepo) RevokeAPIKey(id int, revokedAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	key, ok := r.s.apiKeys[id]
+	if !ok || key.RevokedAt != nil {
+		return &repository.APIKeyNotFoundError{ID: id}
+	}
+	key.RevokedAt = &revokedAt
+	return nil
+}
+
+// copyAPIKey copies a key including its scopes, so callers cannot change
+// the stored row
+func copyAPIKey(key *models.APIKey) models.APIKey {
+	result := *key
+	result.Scopes = append([]string{}, key.Scopes...)
+	return result
+}
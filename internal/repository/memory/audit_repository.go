@@ -0,0 +1,53 @@
+package memory
+
+import (
+	"sort"
+
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type auditRepo struct {
+	s *Store
+}
+
+func NewAuditRepository(s *Store) repository.AuditRepository {
+	return &auditRepo{s: s}
+}
+
+func (r *auditRepo) RecordEvent(event *models.AuditEvent) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for _, id := range []*int{event.ActorID, event.UserID} {
+		if id == nil {
+			continue
+		}
+		if _, ok := r.s.users[*id]; !ok {
+			return ErrForeignKey
+		}
+	}
+
+	event.ID = r.s.nextID("audit_log")
+	event.CreatedAt = r.s.now()
+	row := *event
+	r.s.auditLog[row.ID] = &row
+	return nil
+}
+
+func (r *auditRepo) GetEvents(limit int) ([]models.AuditEvent, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	events := []models.AuditEvent{}
+	for _, e := range r.s.auditLog {
+		events = append(events, *e)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID > events[j].ID
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
@@ -0,0 +1,108 @@
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type invitationRepo struct {
+	s *Store
+}
+
+func NewInvitationRepository(s *Store) repository.InvitationRepository {
+	return &invitationRepo{s: s}
+}
+
+func (r *invitationRepo) CreateInvitation(invitation *models.Invitation) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.roles[invitation.Role]; !ok {
+		return ErrForeignKey
+	}
+	if invitation.CreatedBy != nil {
+		if _, ok := r.s.users[*invitation.CreatedBy]; !ok {
+			return ErrForeignKey
+		}
+	}
+	for _, inv := range r.s.invitations {
+		if inv.CodeHash == invitation.CodeHash {
+			return ErrUniqueViolation
+		}
+	}
+
+	invitation.ID = r.s.nextID("invitations")
+	invitation.CreatedAt = r.s.now()
+	row := *invitation
+	row.UsedAt = nil
+	row.UsedBy = nil
+	r.s.invitations[row.ID] = &row
+	return nil
+}
+
+func (r *invitationRepo) GetInvitations() ([]models.Invitation, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	invitations := []models.Invitation{}
+	for _, inv := range r.s.invitations {
+		invitations = append(invitations, *inv)
+	}
+	sort.Slice(invitations, func(i, j int) bool {
+		return invitations[i].ID > invitations[j].ID
+	})
+
+	return invitations, nil
+}
+
+func (r *invitationRepo) GetInvitationByCodeHash(codeHash string) (*models.Invitation, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for _, inv := range r.s.invitations {
+		if inv.CodeHash == codeHash {
+			result := *inv
+			return &result, nil
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+func (r *invitationRepo) ClaimInvitation(id int, username string, usedAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	inv, ok := r.s.invitations[id]
+	if !ok || inv.UsedAt != nil || !inv.ExpiresAt.After(usedAt) {
+		return &repository.InvitationClaimedError{InvitationID: id}
+	}
+	inv.UsedAt = &usedAt
+	inv.UsedBy = &username
+	return nil
+}
+
+func (r *invitationRepo) ReleaseInvitation(id int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if inv, ok := r.s.invitations[id]; ok {
+		inv.UsedAt = nil
+		inv.UsedBy = nil
+	}
+	return nil
+}
+
+func (r *invitationRepo) DeleteInvitation(id int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.invitations[id]; !ok {
+		return &repository.InvitationNotFoundError{InvitationID: id}
+	}
+	delete(r.s.invitations, id)
+	return nil
+}
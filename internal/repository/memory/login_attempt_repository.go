@@ -0,0 +1,83 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type loginAttemptRepo struct {
+	s *Store
+}
+
+func NewLoginAttemptRepository(s *Store) repository.LoginAttemptRepository {
+	return &loginAttemptRepo{s: s}
+}
+
+func (r *loginAttemptRepo) GetLoginAttempt(scope, subject string) (*models.LoginAttempt, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	a, ok := r.s.loginAttempts[[2]string{scope, subject}]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	result := *a
+	return &result, nil
+}
+
+func (r *loginAttemptRepo) RecordLoginFailure(scope, subject string, at, resetBefore time.Time) (*models.LoginAttempt, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	key := [2]string{scope, subject}
+	a, ok := r.s.loginAttempts[key]
+	switch {
+	case !ok:
+		a = &models.LoginAttempt{Scope: scope, Subject: subject, Failures: 1}
+		r.s.loginAttempts[key] = a
+	case a.LastFailureAt.Before(resetBefore):
+		a.Failures = 1
+		a.LockedUntil = nil
+	default:
+		a.Failures++
+	}
+	a.LastFailureAt = at
+
+	result := *a
+	return &result, nil
+}
+
+func (r *loginAttemptRepo) LockLoginAttempt(scope, subject string, until time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if a, ok := r.s.loginAttempts[[2]string{scope, subject}]; ok {
+		a.LockedUntil = &until
+	}
+	return nil
+}
+
+func (r *loginAttemptRepo) ResetLoginAttempts(scope, subject string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	delete(r.s.loginAttempts, [2]string{scope, subject})
+	return nil
+}
+
+func (r *loginAttemptRepo) DeleteStaleLoginAttempts(before time.Time) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var deleted int64
+	for key, a := range r.s.loginAttempts {
+		if a.LastFailureAt.Before(before) && (a.LockedUntil == nil || a.LockedUntil.Before(before)) {
+			delete(r.s.loginAttempts, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,130 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type mfaRepo struct {
+	s *Store
+}
+
+func NewMFARepository(s *Store) repository.MFARepository {
+	return &mfaRepo{s: s}
+}
+
+func (r *mfaRepo) GetMFA(userID int) (*models.UserMFA, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	m, ok := r.s.mfa[userID]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	result := *m
+	return &result, nil
+}
+
+func (r *mfaRepo) StartMFAEnrollment(userID int, secret string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.users[userID]; !ok {
+		return ErrForeignKey
+	}
+	if m, ok := r.s.mfa[userID]; ok && m.EnabledAt != nil {
+		return &repository.MFAAlreadyEnabledError{UserID: userID}
+	}
+
+	r.s.mfa[userID] = &models.UserMFA{UserID: userID, Secret: secret, CreatedAt: r.s.now()}
+	return nil
+}
+
+func (r *mfaRepo) EnableMFA(userID int, step int64, enabledAt time.Time, recoveryCodeHashes []string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	m, ok := r.s.mfa[userID]
+	if !ok || m.EnabledAt != nil {
+		return &repository.MFANotFoundError{UserID: userID}
+	}
+
+	m.EnabledAt = &enabledAt
+	m.LastUsedStep = step
+	r.replaceRecoveryCodes(userID, recoveryCodeHashes)
+	return nil
+}
+
+func (r *mfaRepo) UseMFAStep(userID int, step int64) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	m, ok := r.s.mfa[userID]
+	if !ok || m.EnabledAt == nil || m.LastUsedStep >= step {
+		return &repository.MFACodeUsedError{UserID: userID}
+	}
+
+	m.LastUsedStep = step
+	return nil
+}
+
+func (r *mfaRepo) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.users[userID]; !ok {
+		return ErrForeignKey
+	}
+	r.replaceRecoveryCodes(userID, codeHashes)
+	return nil
+}
+
+// replaceRecoveryCodes must be called with the store locked
+func (r *mfaRepo) replaceRecoveryCodes(userID int, codeHashes []string) {
+	codes := map[string]*time.Time{}
+	for _, hash := range codeHashes {
+		codes[hash] = nil
+	}
+	r.s.recoveryCodes[userID] = codes
+}
+
+func (r *mfaRepo) UseRecoveryCode(userID int, codeHash string, usedAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	usedAtRow, ok := r.s.recoveryCodes[userID][codeHash]
+	if !ok || usedAtRow != nil {
+		return &repository.RecoveryCodeNotFoundError{UserID: userID}
+	}
+
+	r.s.recoveryCodes[userID][codeHash] = &usedAt
+	return nil
+}
+
+func (r *mfaRepo) CountRecoveryCodes(userID int) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	count := 0
+	for _, usedAt := range r.s.recoveryCodes[userID] {
+		if usedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *mfaRepo) DeleteMFA(userID int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	delete(r.s.recoveryCodes, userID)
+	if _, ok := r.s.mfa[userID]; !ok {
+		return &repository.MFANotFoundError{UserID: userID}
+	}
+	delete(r.s.mfa, userID)
+	return nil
+}
@@ -0,0 +1,414 @@
+package memory
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/allocation"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type orderRepo struct {
+	s *Store
+}
+
+func NewOrderRepository(s *Store) repository.OrderRepository {
+	return &orderRepo{s: s}
+}
+
+// itemsOf returns the order's items with their allocations, in insertion
+// order
+func (s *Store) itemsOf(orderID int) []models.OrderItem {
+	var items []models.OrderItem
+	for _, row := range s.orderItems {
+		if row.OrderID != orderID {
+			continue
+		}
+		items = append(items, models.OrderItem{
+			ID:                 row.ID,
+			OrderID:            row.OrderID,
+			ProductID:          row.ProductID,
+			Quantity:           row.Quantity,
+			Price:              row.UnitPrice,
+			LineTotal:          row.LineTotal,
+			ProductName:        row.ProductName,
+			ProductDescription: row.ProductDescription,
+			Allocations:        s.allocationsOf(row.ID),
+		})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID < items[j].ID
+	})
+	return items
+}
+
+// reserves reports whether any item of an order has reserved stock
+func (s *Store) reserves(orderID int) bool {
+	for itemID, item := range s.orderItems {
+		if item.OrderID == orderID && len(s.allocationsOf(itemID)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// allocationsOf returns the allocations of an order item joined with their
+// warehouses, in insertion order
+func (s *Store) allocationsOf(itemID int) []models.OrderItemAllocation {
+	var rows []*orderAllocationRow
+	for _, row := range s.allocations {
+		if row.OrderItemID == itemID {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].ID < rows[j].ID
+	})
+
+	allocations := []models.OrderItemAllocation{}
+	for _, row := range rows {
+		share := models.OrderItemAllocation{WarehouseID: row.WarehouseID, Quantity: row.Quantity}
+		if w, ok := s.warehouses[row.WarehouseID]; ok {
+			share.WarehouseName = w.Name
+		}
+		allocations = append(allocations, share)
+	}
+	return allocations
+}
+
+// deleteOrderItem removes an order item and its allocations
+func (s *Store) deleteOrderItem(itemID int) {
+	for id, row := range s.allocations {
+		if row.OrderItemID == itemID {
+			delete(s.allocations, id)
+		}
+	}
+	delete(s.orderItems, itemID)
+}
+
+func (r *orderRepo) GetOrdersByUserID(userID int) ([]models.OrderWithItems, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.ordersWithItems(func(o *models.Order) bool { return o.UserID == userID }), nil
+}
+
+func (r *orderRepo) GetAllOrders() ([]models.OrderWithItems, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.ordersWithItems(func(*models.Order) bool { return true }), nil
+}
+
+// ordersWithItems returns the matching orders with their items, newest first,
+// like order_summary_view
+func (s *Store) ordersWithItems(match func(*models.Order) bool) []models.OrderWithItems {
+	var ordersWithItems []models.OrderWithItems
+	for _, o := range s.orders {
+		if !match(o) {
+			continue
+		}
+		u, ok := s.users[o.UserID]
+		if !ok {
+			continue
+		}
+		order := *o
+		order.Username = u.Username
+		ordersWithItems = append(ordersWithItems, models.OrderWithItems{
+			Order: order,
+			Items: s.itemsOf(o.ID),
+		})
+	}
+	sort.Slice(ordersWithItems, func(i, j int) bool {
+		a, b := ordersWithItems[i].Order, ordersWithItems[j].Order
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return a.ID > b.ID
+	})
+
+	return ordersWithItems
+}
+
+func (r *orderRepo) GetOrder(orderID int) (*models.Order, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	o, ok := r.s.orders[orderID]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	u, ok := r.s.users[o.UserID]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+
+	order := *o
+	order.Username = u.Username
+	return &order, nil
+}
+
+func (r *orderRepo) GetOrderByID(orderID, userID int) (*models.Order, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	o, ok := r.s.orders[orderID]
+	if !ok || o.UserID != userID {
+		return nil, pgx.ErrNoRows
+	}
+
+	return &models.Order{
+		ID:          o.ID,
+		UserID:      o.UserID,
+		TotalAmount: o.TotalAmount,
+		CreatedAt:   o.CreatedAt,
+		Status:      o.Status,
+	}, nil
+}
+
+func (r *orderRepo) GetOrderItems(orderID int) ([]models.OrderItem, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.itemsOf(orderID), nil
+}
+
+func (r *orderRepo) CreateOrder(userID int, items []models.CreateOrderItemRequest, strategy allocation.Strategy) (*models.OrderWithItems, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	// Like the PostgreSQL transaction, a failing reservation releases the
+	// reservations before it
+	allocations, err := repository.Allocate(strategy, items, r.s.availableStock(repository.ProductIDs(items)))
+	if err != nil {
+		return nil, err
+	}
+	rollback := r.s.snapshotStock()
+	for _, a := range allocations {
+		if err := r.s.adjustWarehouseStock(a.WarehouseID, items[a.Line].ProductID, 0, a.Quantity); err != nil {
+			rollback()
+			return nil, err
+		}
+	}
+	if _, ok := r.s.users[userID]; !ok {
+		rollback()
+		return nil, ErrForeignKey
+	}
+
+	orderID := r.s.nextID("orders")
+	var totalAmount float64
+	for i, item := range items {
+		p := r.s.products[item.ProductID]
+		row := &orderItemRow{
+			ID:                 r.s.nextID("order_items"),
+			OrderID:            orderID,
+			ProductID:          item.ProductID,
+			Quantity:           item.Quantity,
+			UnitPrice:          p.Price,
+			ProductName:        p.Name,
+			ProductDescription: p.Description,
+			LineTotal:          models.LineTotal(p.Price, item.Quantity),
+		}
+		r.s.orderItems[row.ID] = row
+		// Summed in cents, as PostgreSQL sums the DECIMAL line totals
+		totalAmount = math.Round((totalAmount+row.LineTotal)*100) / 100
+
+		for _, a := range allocations {
+			if a.Line != i {
+				continue
+			}
+			id := r.s.nextID("order_item_allocations")
+			r.s.allocations[id] = &orderAllocationRow{
+				ID:          id,
+				OrderItemID: row.ID,
+				WarehouseID: a.WarehouseID,
+				Quantity:    a.Quantity,
+			}
+		}
+	}
+
+	r.s.orders[orderID] = &models.Order{
+		ID:          orderID,
+		UserID:      userID,
+		TotalAmount: totalAmount,
+		Status:      models.OrderPending,
+		CreatedAt:   r.s.now(),
+	}
+	r.s.recordStatusChange(orderID, nil, models.OrderPending, &userID)
+
+	return &models.OrderWithItems{
+		Order: models.Order{
+			ID:          orderID,
+			UserID:      userID,
+			TotalAmount: totalAmount,
+			Status:      models.OrderPending,
+		},
+		Items: r.s.itemsOf(orderID),
+	}, nil
+}
+
+func (r *orderRepo) UpdateOrderStatus(orderID int, from, to string, changedBy int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	o, ok := r.s.orders[orderID]
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	if o.Status != from {
+		return &repository.OrderStatusChangedError{OrderID: orderID, Status: o.Status}
+	}
+
+	// Like the PostgreSQL transaction, a failing item undoes the stock
+	// changes of the items before it
+	rollback := r.s.snapshotStock()
+	if err := r.s.moveStock(orderID, from, to); err != nil {
+		rollback()
+		return err
+	}
+
+	o.Status = to
+	r.s.recordStatusChange(orderID, &from, to, &changedBy)
+	return nil
+}
+
+// moveStock mirrors the stock movements of the PostgreSQL repository
+func (s *Store) moveStock(orderID int, from, to string) error {
+	quantity, reserved := repository.StockChange(from, to)
+	if quantity == 0 && reserved == 0 {
+		return nil
+	}
+
+	for _, item := range s.itemsOf(orderID) {
+		for _, a := range item.Allocations {
+			err := s.adjustWarehouseStock(a.WarehouseID, item.ProductID, quantity*a.Quantity, reserved*a.Quantity)
+			if err != nil {
+				return err
+			}
+		}
+		if len(item.Allocations) > 0 {
+			continue
+		}
+
+		var err error
+		switch {
+		case quantity < 0:
+			_, err = s.checkWarehouseStock(item.ProductID, item.Quantity)
+			if err == nil {
+				err = s.updateWarehouseStock(item.ProductID, item.Quantity, "decrease")
+			}
+		case quantity > 0:
+			err = s.updateWarehouseStock(item.ProductID, item.Quantity, "increase")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordStatusChange appends to the status history of an order
+func (s *Store) recordStatusChange(orderID int, from *string, to string, changedBy *int) {
+	id := s.nextID("order_status_history")
+	s.orderHistory[id] = &models.OrderStatusChange{
+		ID:         id,
+		OrderID:    orderID,
+		FromStatus: from,
+		ToStatus:   to,
+		ChangedBy:  changedBy,
+		CreatedAt:  s.now(),
+	}
+}
+
+func (r *orderRepo) GetOrderStatusHistory(orderID int) ([]models.OrderStatusChange, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	history := []models.OrderStatusChange{}
+	for _, change := range r.s.orderHistory {
+		if change.OrderID != orderID {
+			continue
+		}
+		entry := *change
+		if entry.ChangedBy != nil {
+			if u, ok := r.s.users[*entry.ChangedBy]; ok {
+				entry.ChangedByUser = u.Username
+			}
+		}
+		history = append(history, entry)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].ID < history[j].ID
+	})
+
+	return history, nil
+}
+
+// deleteOrder removes an order together with its items and history
+func (s *Store) deleteOrder(orderID int) {
+	for itemID, item := range s.orderItems {
+		if item.OrderID == orderID {
+			s.deleteOrderItem(itemID)
+		}
+	}
+	for id, change := range s.orderHistory {
+		if change.OrderID == orderID {
+			delete(s.orderHistory, id)
+		}
+	}
+	delete(s.orders, orderID)
+}
+
+func (r *orderRepo) DeleteOrder(orderID, userID int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	o, ok := r.s.orders[orderID]
+	if !ok || o.UserID != userID {
+		return pgx.ErrNoRows
+	}
+	if o.Status != models.OrderPending && o.Status != models.OrderCancelled {
+		return &repository.OrderNotDeletableError{OrderID: orderID, Status: o.Status}
+	}
+
+	if o.Status == models.OrderPending {
+		rollback := r.s.snapshotStock()
+		if err := r.s.moveStock(orderID, models.OrderPending, models.OrderCancelled); err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	r.s.deleteOrder(orderID)
+	return nil
+}
+
+func (r *orderRepo) ExpirePendingOrders(placedBefore time.Time) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var orderIDs []int
+	for id, o := range r.s.orders {
+		if o.Status == models.OrderPending && o.CreatedAt.Before(placedBefore) && r.s.reserves(id) {
+			orderIDs = append(orderIDs, id)
+		}
+	}
+	sort.Ints(orderIDs)
+
+	var expired int64
+	for _, orderID := range orderIDs {
+		rollback := r.s.snapshotStock()
+		if err := r.s.moveStock(orderID, models.OrderPending, models.OrderCancelled); err != nil {
+			rollback()
+			return expired, err
+		}
+		r.s.orders[orderID].Status = models.OrderCancelled
+		pending := models.OrderPending
+		r.s.recordStatusChange(orderID, &pending, models.OrderCancelled, nil)
+		expired++
+	}
+	return expired, nil
+}
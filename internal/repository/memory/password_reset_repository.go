@@ -0,0 +1,79 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type passwordResetRepo struct {
+	s *Store
+}
+
+func NewPasswordResetRepository(s *Store) repository.PasswordResetRepository {
+	return &passwordResetRepo{s: s}
+}
+
+func (r *passwordResetRepo) CreatePasswordReset(reset *models.PasswordReset) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.users[reset.UserID]; !ok {
+		return ErrForeignKey
+	}
+	for _, existing := range r.s.passwordResets {
+		if existing.TokenHash == reset.TokenHash {
+			return ErrUniqueViolation
+		}
+	}
+
+	reset.ID = r.s.nextID("password_resets")
+	reset.CreatedAt = r.s.now()
+	row := *reset
+	row.UsedAt = nil
+	r.s.passwordResets[row.ID] = &row
+	return nil
+}
+
+func (r *passwordResetRepo) ClaimPasswordReset(tokenHash string, usedAt time.Time) (*models.PasswordReset, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for _, reset := range r.s.passwordResets {
+		if reset.TokenHash != tokenHash || reset.UsedAt != nil || !reset.ExpiresAt.After(usedAt) {
+			continue
+		}
+		reset.UsedAt = &usedAt
+		result := *reset
+		return &result, nil
+	}
+	return nil, pgx.ErrNoRows
+}
+
+func (r *passwordResetRepo) DeleteUserPasswordResets(userID int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for id, reset := range r.s.passwordResets {
+		if reset.UserID == userID {
+			delete(r.s.passwordResets, id)
+		}
+	}
+	return nil
+}
+
+func (r *passwordResetRepo) DeleteExpiredPasswordResets(before time.Time) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var deleted int64
+	for id, reset := range r.s.passwordResets {
+		if reset.ExpiresAt.Before(before) {
+			delete(r.s.passwordResets, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
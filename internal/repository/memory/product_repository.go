@@ -0,0 +1,342 @@
+package memory
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/allocation"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type productRepo struct {
+	s *Store
+}
+
+func NewProductRepository(s *Store) repository.ProductRepository {
+	return &productRepo{s: s}
+}
+
+// productView returns a copy of the product joined with its warehouse name;
+// ok is false when the join would drop the row
+func (s *Store) productView(p *models.Product) (models.Product, bool) {
+	w, ok := s.warehouses[p.WarehouseID]
+	if !ok {
+		return models.Product{}, false
+	}
+	product := *p
+	product.WarehouseName = w.Name
+	return product, true
+}
+
+func (r *productRepo) GetAllProducts() ([]models.Product, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var products []models.Product
+	for _, p := range r.s.products {
+		if product, ok := r.s.productView(p); ok {
+			products = append(products, product)
+		}
+	}
+	sort.Slice(products, func(i, j int) bool {
+		return products[i].ID < products[j].ID
+	})
+
+	return products, nil
+}
+
+func (r *productRepo) GetProductByID(id int) (*models.Product, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	p, ok := r.s.products[id]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	product, ok := r.s.productView(p)
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return &product, nil
+}
+
+func (r *productRepo) CreateProduct(productReq *models.ProductRequest) (*models.Product, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.warehouses[productReq.WarehouseID]; !ok {
+		return nil, ErrForeignKey
+	}
+
+	product := &models.Product{
+		ID:          r.s.nextID("products"),
+		Name:        productReq.Name,
+		Description: productReq.Description,
+		Price:       productReq.Price,
+		Stock:       productReq.Stock,
+		WarehouseID: productReq.WarehouseID,
+		CreatedAt:   r.s.now(),
+	}
+	r.s.products[product.ID] = product
+	r.s.addStock(productReq.WarehouseID, product.ID, productReq.Stock)
+
+	result := *product
+	return &result, nil
+}
+
+func (r *productRepo) UpdateProduct(id int, productReq *models.ProductRequest) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	p, ok := r.s.products[id]
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	if _, ok := r.s.warehouses[productReq.WarehouseID]; !ok {
+		return ErrForeignKey
+	}
+
+	currentWarehouseID, currentStock := p.WarehouseID, p.Stock
+	taken := currentStock
+	if currentWarehouseID == productReq.WarehouseID {
+		taken -= productReq.Stock
+	}
+	if err := r.s.checkTake(currentWarehouseID, id, taken); err != nil {
+		return err
+	}
+
+	p.Name = productReq.Name
+	p.Description = productReq.Description
+	p.Price = productReq.Price
+	p.Stock = productReq.Stock
+	p.WarehouseID = productReq.WarehouseID
+
+	if currentWarehouseID != productReq.WarehouseID {
+		if row, ok := r.s.stocks[[2]int{currentWarehouseID, id}]; ok {
+			row.Quantity -= currentStock
+			row.UpdatedAt = r.s.now()
+		}
+		r.s.addStock(productReq.WarehouseID, id, productReq.Stock)
+	} else if diff := productReq.Stock - currentStock; diff != 0 {
+		if row, ok := r.s.stocks[[2]int{productReq.WarehouseID, id}]; ok {
+			row.Quantity += diff
+			row.UpdatedAt = r.s.now()
+		}
+	}
+
+	return nil
+}
+
+func (r *productRepo) DeleteProduct(id int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.products[id]; !ok {
+		return pgx.ErrNoRows
+	}
+
+	for _, item := range r.s.orderItems {
+		if item.ProductID == id {
+			return &repository.ProductInUseError{ProductID: id}
+		}
+	}
+
+	for key := range r.s.stocks {
+		if key[1] == id {
+			delete(r.s.stocks, key)
+		}
+	}
+
+	delete(r.s.products, id)
+	return nil
+}
+
+func (r *productRepo) CheckWarehouseStock(productID, quantity int) (*models.WarehouseStock, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.checkWarehouseStock(productID, quantity)
+}
+
+func (s *Store) checkWarehouseStock(productID, quantity int) (*models.WarehouseStock, error) {
+	// Warehouse with the most unreserved units that covers the request
+	var best *models.WarehouseStock
+	for _, row := range s.stocks {
+		available := row.Quantity - row.ReservedQuantity
+		if row.ProductID != productID || available < quantity {
+			continue
+		}
+		if best == nil || available > best.Quantity-best.ReservedQuantity {
+			best = row
+		}
+	}
+
+	if best == nil {
+		totalAvailable := 0
+		for _, row := range s.stocks {
+			if row.ProductID == productID {
+				totalAvailable += row.Quantity - row.ReservedQuantity
+			}
+		}
+		return nil, &repository.InsufficientWarehouseStockError{
+			ProductID:      productID,
+			WarehouseID:    0,
+			RequiredStock:  quantity,
+			AvailableStock: totalAvailable,
+		}
+	}
+
+	stock, ok := s.stockView(best)
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	if stock.AvailableStock < quantity {
+		return nil, &repository.InsufficientWarehouseStockError{
+			ProductID:      productID,
+			WarehouseID:    stock.WarehouseID,
+			RequiredStock:  quantity,
+			AvailableStock: stock.AvailableStock,
+		}
+	}
+
+	return &stock, nil
+}
+
+func (r *productRepo) UpdateWarehouseStock(productID, quantity int, operation string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.updateWarehouseStock(productID, quantity, operation)
+}
+
+func (s *Store) updateWarehouseStock(productID, quantity int, operation string) error {
+	switch operation {
+	case "decrease":
+		var best *models.WarehouseStock
+		for _, row := range s.stocks {
+			available := row.Quantity - row.ReservedQuantity
+			if row.ProductID != productID || available < quantity {
+				continue
+			}
+			if best == nil || available > best.Quantity-best.ReservedQuantity {
+				best = row
+			}
+		}
+		if best == nil {
+			return &repository.InsufficientWarehouseStockError{ProductID: productID, RequiredStock: quantity}
+		}
+		best.Quantity -= quantity
+		best.UpdatedAt = s.now()
+		if p, ok := s.products[productID]; ok {
+			p.Stock -= quantity
+		}
+
+	case "increase":
+		warehouseID := 0
+		if p, ok := s.products[productID]; ok {
+			warehouseID = p.WarehouseID
+		} else {
+			for key := range s.stocks {
+				if key[1] == productID {
+					warehouseID = key[0]
+					break
+				}
+			}
+			if warehouseID == 0 {
+				return pgx.ErrNoRows
+			}
+		}
+		if row, ok := s.stocks[[2]int{warehouseID, productID}]; ok {
+			row.Quantity += quantity
+			row.UpdatedAt = s.now()
+		}
+		if p, ok := s.products[productID]; ok {
+			p.Stock += quantity
+		}
+
+	default:
+		return &repository.InvalidOperationError{Operation: operation}
+	}
+
+	return nil
+}
+
+func (r *productRepo) AdjustWarehouseStock(warehouseID, productID, quantity, reserved int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.adjustWarehouseStock(warehouseID, productID, quantity, reserved)
+}
+
+func (s *Store) adjustWarehouseStock(warehouseID, productID, quantity, reserved int) error {
+	row, ok := s.stocks[[2]int{warehouseID, productID}]
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	if row.ReservedQuantity+reserved < 0 || row.Quantity+quantity < row.ReservedQuantity+reserved {
+		return &repository.InsufficientWarehouseStockError{
+			ProductID:      productID,
+			WarehouseID:    warehouseID,
+			RequiredStock:  max(reserved, -quantity),
+			AvailableStock: row.Quantity - row.ReservedQuantity,
+		}
+	}
+
+	row.Quantity += quantity
+	row.ReservedQuantity += reserved
+	row.UpdatedAt = s.now()
+	if p, ok := s.products[productID]; ok {
+		p.Stock += quantity
+	}
+	return nil
+}
+
+// checkTake returns an InsufficientWarehouseStockError when taking quantity
+// units of a product out of a warehouse would leave less than is reserved
+func (s *Store) checkTake(warehouseID, productID, quantity int) error {
+	row, ok := s.stocks[[2]int{warehouseID, productID}]
+	if !ok || quantity <= 0 || row.Quantity-quantity >= row.ReservedQuantity {
+		return nil
+	}
+	return &repository.InsufficientWarehouseStockError{
+		ProductID:      productID,
+		WarehouseID:    warehouseID,
+		RequiredStock:  quantity,
+		AvailableStock: row.Quantity - row.ReservedQuantity,
+	}
+}
+
+func (r *productRepo) LockAvailableStock(productIDs []int) ([]allocation.Stock, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.availableStock(productIDs), nil
+}
+
+// availableStock mirrors the PostgreSQL query, ordered by product and
+// warehouse
+func (s *Store) availableStock(productIDs []int) []allocation.Stock {
+	var stocks []allocation.Stock
+	for key, row := range s.stocks {
+		w, ok := s.warehouses[key[0]]
+		if !ok || !w.IsActive || !slices.Contains(productIDs, key[1]) || row.Quantity <= row.ReservedQuantity {
+			continue
+		}
+		stocks = append(stocks, allocation.Stock{
+			WarehouseID: key[0],
+			ProductID:   key[1],
+			Available:   row.Quantity - row.ReservedQuantity,
+			Since:       row.CreatedAt,
+			Location:    copyLocation(w.Location),
+		})
+	}
+	sort.Slice(stocks, func(i, j int) bool {
+		if stocks[i].ProductID != stocks[j].ProductID {
+			return stocks[i].ProductID < stocks[j].ProductID
+		}
+		return stocks[i].WarehouseID < stocks[j].WarehouseID
+	})
+	return stocks
+}
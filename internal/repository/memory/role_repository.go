@@ -0,0 +1,123 @@
+package memory
+
+import (
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type roleRepo struct {
+	s *Store
+}
+
+func NewRoleRepository(s *Store) repository.RoleRepository {
+	return &roleRepo{s: s}
+}
+
+func (r *roleRepo) GetPermissions() ([]models.Permission, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	permissions := append([]models.Permission{}, r.s.permissions...)
+	sort.Slice(permissions, func(i, j int) bool {
+		return permissions[i].Name < permissions[j].Name
+	})
+	return permissions, nil
+}
+
+func (r *roleRepo) GetRoles() ([]models.Role, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	roles := []models.Role{}
+	for _, role := range r.s.roles {
+		roles = append(roles, copyRole(role))
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+	return roles, nil
+}
+
+func (r *roleRepo) GetRole(name string) (*models.Role, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	role, ok := r.s.roles[name]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	result := copyRole(role)
+	return &result, nil
+}
+
+func (r *roleRepo) CreateRole(role *models.Role) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.roles[role.Name]; ok {
+		return ErrUniqueViolation
+	}
+	if !r.s.knownPermissions(role.Permissions) {
+		return ErrForeignKey
+	}
+
+	row := copyRole(role)
+	r.s.roles[role.Name] = &row
+	return nil
+}
+
+func (r *roleRepo) SetRolePermissions(name string, permissions []string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	role, ok := r.s.roles[name]
+	if !ok {
+		return &repository.RoleNotFoundError{Role: name}
+	}
+	if !r.s.knownPermissions(permissions) {
+		return ErrForeignKey
+	}
+
+	role.Permissions = dedupeSorted(permissions)
+	return nil
+}
+
+func (s *Store) knownPermissions(names []string) bool {
+	for _, name := range names {
+		found := false
+		for _, p := range s.permissions {
+			if p.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// copyRole returns a copy with sorted permissions, like the array built by
+// the PostgreSQL query
+func copyRole(role *models.Role) models.Role {
+	result := *role
+	result.Permissions = dedupeSorted(role.Permissions)
+	return result
+}
+
+func dedupeSorted(names []string) []string {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,103 @@
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type sessionRepo struct {
+	s *Store
+}
+
+func NewSessionRepository(s *Store) repository.SessionRepository {
+	return &sessionRepo{s: s}
+}
+
+func (r *sessionRepo) CreateSession(session *models.Session) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.users[session.UserID]; !ok {
+		return ErrForeignKey
+	}
+	if _, ok := r.s.sessions[session.ID]; ok {
+		return ErrUniqueViolation
+	}
+
+	row := *session
+	row.ExpiresAt = time.Time{}
+	row.Current = false
+	r.s.sessions[session.ID] = &row
+	return nil
+}
+
+func (r *sessionRepo) GetSession(sessionID string) (*models.Session, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	session, ok := r.s.sessions[sessionID]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	result := *session
+	return &result, nil
+}
+
+func (r *sessionRepo) TouchSession(sessionID string, lastUsedAt time.Time, userAgent, ipAddress string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if session, ok := r.s.sessions[sessionID]; ok {
+		session.LastUsedAt = lastUsedAt
+		session.UserAgent = userAgent
+		session.IPAddress = ipAddress
+	}
+	return nil
+}
+
+func (r *sessionRepo) GetActiveSessions(userID int, now time.Time) ([]models.Session, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	sessions := []models.Session{}
+	for _, rt := range r.s.refreshTokens {
+		if rt.UserID != userID || rt.UsedAt != nil || rt.RevokedAt != nil || !rt.ExpiresAt.After(now) {
+			continue
+		}
+		session, ok := r.s.sessions[rt.FamilyID]
+		if !ok || session.UserID != userID {
+			continue
+		}
+		result := *session
+		result.ExpiresAt = rt.ExpiresAt
+		sessions = append(sessions, result)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	return sessions, nil
+}
+
+func (r *sessionRepo) DeleteOrphanedSessions() (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	families := map[string]bool{}
+	for _, rt := range r.s.refreshTokens {
+		families[rt.FamilyID] = true
+	}
+
+	var deleted int64
+	for id := range r.s.sessions {
+		if !families[id] {
+			delete(r.s.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
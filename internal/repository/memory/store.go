@@ -0,0 +1,147 @@
+// Package memory provides in-memory implementations of the repository
+// interfaces. They follow the same semantics as the PostgreSQL repositories,
+// including the returned error types, so they can stand in for them in tests.
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+// ErrForeignKey mirrors a PostgreSQL foreign key violation
+var ErrForeignKey error = &pgconn.PgError{Code: "23503", Message: "violates foreign key constraint"}
+
+// ErrUniqueViolation mirrors a PostgreSQL unique constraint violation
+var ErrUniqueViolation error = &pgconn.PgError{Code: "23505", Message: "duplicate key value violates unique constraint"}
+
+type orderItemRow struct {
+	ID                 int
+	OrderID            int
+	ProductID          int
+	Quantity           int
+	UnitPrice          float64
+	ProductName        string
+	ProductDescription string
+	LineTotal          float64
+}
+
+type orderAllocationRow struct {
+	ID          int
+	OrderItemID int
+	WarehouseID int
+	Quantity    int
+}
+
+// Store holds the tables shared by all in-memory repositories, so that an
+// order confirmation can see the stock written by the warehouse repository
+// just like the PostgreSQL implementations share one database.
+type Store struct {
+	mu sync.Mutex
+
+	users          map[int]*models.User
+	refreshTokens  map[string]*repository.RefreshToken
+	sessions       map[string]*models.Session
+	invitations    map[int]*models.Invitation
+	permissions    []models.Permission
+	roles          map[string]*models.Role
+	products       map[int]*models.Product
+	warehouses     map[int]*models.Warehouse
+	assignments    map[int]map[int]bool              // warehouse IDs keyed by user ID
+	stocks         map[[2]int]*models.WarehouseStock // keyed by warehouse ID, product ID
+	transfers      map[int]*models.StockTransfer
+	orders         map[int]*models.Order
+	orderItems     map[int]*orderItemRow
+	allocations    map[int]*orderAllocationRow
+	orderHistory   map[int]*models.OrderStatusChange
+	loginAttempts  map[[2]string]*models.LoginAttempt // keyed by scope, subject
+	auditLog       map[int]*models.AuditEvent
+	mfa            map[int]*models.UserMFA
+	recoveryCodes  map[int]map[string]*time.Time // used_at keyed by user ID, code hash
+	passwordResets map[int]*models.PasswordReset
+	apiKeys        map[int]*models.APIKey
+
+	lastID   map[string]int
+	lastTime time.Time
+}
+
+// NewStore returns an empty store holding only the roles and permissions
+// seeded by the migrations
+func NewStore() *Store {
+	s := &Store{
+		users:          map[int]*models.User{},
+		refreshTokens:  map[string]*repository.RefreshToken{},
+		sessions:       map[string]*models.Session{},
+		invitations:    map[int]*models.Invitation{},
+		products:       map[int]*models.Product{},
+		warehouses:     map[int]*models.Warehouse{},
+		assignments:    map[int]map[int]bool{},
+		stocks:         map[[2]int]*models.WarehouseStock{},
+		transfers:      map[int]*models.StockTransfer{},
+		orders:         map[int]*models.Order{},
+		orderItems:     map[int]*orderItemRow{},
+		allocations:    map[int]*orderAllocationRow{},
+		orderHistory:   map[int]*models.OrderStatusChange{},
+		loginAttempts:  map[[2]string]*models.LoginAttempt{},
+		auditLog:       map[int]*models.AuditEvent{},
+		mfa:            map[int]*models.UserMFA{},
+		recoveryCodes:  map[int]map[string]*time.Time{},
+		passwordResets: map[int]*models.PasswordReset{},
+		apiKeys:        map[int]*models.APIKey{},
+		lastID:         map[string]int{},
+		permissions:    append([]models.Permission(nil), models.Permissions...),
+		roles:          map[string]*models.Role{},
+	}
+	for _, role := range models.DefaultRoles {
+		row := role
+		row.Permissions = append([]string(nil), role.Permissions...)
+		s.roles[role.Name] = &row
+	}
+	return s
+}
+
+// nextID emulates a SERIAL column for the given table
+func (s *Store) nextID(table string) int {
+	s.lastID[table]++
+	return s.lastID[table]
+}
+
+// now returns strictly increasing timestamps so that "ORDER BY created_at"
+// is deterministic
+func (s *Store) now() time.Time {
+	t := time.Now()
+	if !t.After(s.lastTime) {
+		t = s.lastTime.Add(time.Microsecond)
+	}
+	s.lastTime = t
+	return t
+}
+
+// snapshotStock returns a function that puts warehouse and product stock back
+// to their current quantities, emulating the rollback of a failed transaction
+func (s *Store) snapshotStock() (rollback func()) {
+	stocks := make(map[[2]int]models.WarehouseStock, len(s.stocks))
+	for key, row := range s.stocks {
+		stocks[key] = *row
+	}
+	products := make(map[int]int, len(s.products))
+	for id, p := range s.products {
+		products[id] = p.Stock
+	}
+
+	return func() {
+		for key, row := range stocks {
+			if current, ok := s.stocks[key]; ok {
+				*current = row
+			}
+		}
+		for id, stock := range products {
+			if p, ok := s.products[id]; ok {
+				p.Stock = stock
+			}
+		}
+	}
+}
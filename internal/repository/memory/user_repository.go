@@ -0,0 +1,293 @@
+package memory
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type userRepo struct {
+	s *Store
+}
+
+func NewUserRepository(s *Store) repository.UserRepository {
+	return &userRepo{s: s}
+}
+
+func (r *userRepo) Create(user *models.User) (*models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if user.Role == "" {
+		user.Role = models.RoleCustomer
+	}
+	if _, ok := r.s.roles[user.Role]; !ok {
+		return nil, ErrForeignKey
+	}
+	for _, u := range r.s.users {
+		if u.Username == user.Username {
+			return nil, ErrUniqueViolation
+		}
+	}
+
+	stored := *user
+	stored.ID = r.s.nextID("users")
+	stored.TokenVersion = 0
+	stored.CreatedAt = r.s.now()
+	r.s.users[stored.ID] = &stored
+
+	user.ID = stored.ID
+	return user, nil
+}
+
+func (r *userRepo) GetByUsername(username string) (*models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for _, u := range r.s.users {
+		if u.Username == username {
+			user := *u
+			return &user, nil
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+func (r *userRepo) GetAllUsers() ([]models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var users []models.User
+	for _, u := range r.s.users {
+		user := *u
+		user.PasswordHash = ""
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].CreatedAt.After(users[j].CreatedAt)
+	})
+
+	return users, nil
+}
+
+func (r *userRepo) UpdateUserRole(userID int, role string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[userID]
+	if !ok {
+		return &repository.UserNotFoundError{UserID: userID}
+	}
+	if _, ok := r.s.roles[role]; !ok {
+		return ErrForeignKey
+	}
+	u.Role = role
+	return nil
+}
+
+func (r *userRepo) UpdatePasswordHash(userID int, passwordHash string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[userID]
+	if !ok {
+		return &repository.UserNotFoundError{UserID: userID}
+	}
+	u.PasswordHash = passwordHash
+	return nil
+}
+
+func (r *userRepo) SetActive(userID int, active bool) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[userID]
+	if !ok {
+		return &repository.UserNotFoundError{UserID: userID}
+	}
+	u.IsActive = active
+	return nil
+}
+
+func (r *userRepo) SearchUsers(filter models.UserFilter) ([]models.User, int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	username := strings.ToLower(filter.Username)
+	matches := []models.User{}
+	for _, u := range r.s.users {
+		switch {
+		case username != "" && !strings.Contains(strings.ToLower(u.Username), username),
+			filter.Role != "" && u.Role != filter.Role,
+			filter.IsActive != nil && u.IsActive != *filter.IsActive,
+			filter.CreatedFrom != nil && u.CreatedAt.Before(*filter.CreatedFrom),
+			filter.CreatedTo != nil && !u.CreatedAt.Before(*filter.CreatedTo),
+			!filter.IncludeDeleted && u.DeletedAt != nil:
+			continue
+		}
+		user := *u
+		user.PasswordHash = ""
+		matches = append(matches, user)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].CreatedAt.Equal(matches[j].CreatedAt) {
+			return matches[i].CreatedAt.After(matches[j].CreatedAt)
+		}
+		return matches[i].ID > matches[j].ID
+	})
+
+	total := len(matches)
+	start := min(filter.Offset, total)
+	end := min(start+filter.Limit, total)
+	return matches[start:end], total, nil
+}
+
+func (r *userRepo) SoftDelete(userID int, deletedAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[userID]
+	if !ok || u.DeletedAt != nil {
+		return &repository.UserNotFoundError{UserID: userID}
+	}
+	u.DeletedAt = &deletedAt
+	u.IsActive = false
+	return nil
+}
+
+func (r *userRepo) GetByID(userID int) (*models.GetMeResponseReq, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[userID]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+
+	return &models.GetMeResponseReq{
+		ID:        u.ID,
+		Username:  u.Username,
+		CreatedAt: u.CreatedAt,
+		IsActive:  u.IsActive,
+		Role:      u.Role,
+	}, nil
+}
+
+func (r *userRepo) GetTokenVersion(userID int) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[userID]
+	if !ok {
+		return 0, pgx.ErrNoRows
+	}
+	return u.TokenVersion, nil
+}
+
+func (r *userRepo) IncrementTokenVersion(userID int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[userID]
+	if !ok {
+		return &repository.UserNotFoundError{UserID: userID}
+	}
+	u.TokenVersion++
+	return nil
+}
+
+func (r *userRepo) IncrementRoleTokenVersions(role string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for _, u := range r.s.users {
+		if u.Role == role {
+			u.TokenVersion++
+		}
+	}
+	return nil
+}
+
+func (r *userRepo) SaveRefreshToken(token *repository.RefreshToken) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.users[token.UserID]; !ok {
+		return ErrForeignKey
+	}
+	if _, ok := r.s.refreshTokens[token.TokenHash]; ok {
+		return ErrUniqueViolation
+	}
+
+	token.ID = r.s.nextID("refresh_tokens")
+	token.CreatedAt = r.s.now()
+	row := *token
+	r.s.refreshTokens[token.TokenHash] = &row
+	return nil
+}
+
+func (r *userRepo) GetRefreshToken(tokenHash string) (*repository.RefreshToken, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	rt, ok := r.s.refreshTokens[tokenHash]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	result := *rt
+	return &result, nil
+}
+
+func (r *userRepo) MarkRefreshTokenUsed(tokenHash string, usedAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	rt, ok := r.s.refreshTokens[tokenHash]
+	if !ok || rt.UsedAt != nil || rt.RevokedAt != nil {
+		return &repository.RefreshTokenUsedError{}
+	}
+	rt.UsedAt = &usedAt
+	return nil
+}
+
+func (r *userRepo) RevokeRefreshTokenFamily(familyID string, revokedAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for _, rt := range r.s.refreshTokens {
+		if rt.FamilyID == familyID && rt.RevokedAt == nil {
+			rt.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+func (r *userRepo) DeleteUserRefreshTokens(userID int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for hash, rt := range r.s.refreshTokens {
+		if rt.UserID == userID {
+			delete(r.s.refreshTokens, hash)
+		}
+	}
+	return nil
+}
+
+func (r *userRepo) DeleteExpiredRefreshTokens(before time.Time) (int64, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var deleted int64
+	for hash, rt := range r.s.refreshTokens {
+		if rt.ExpiresAt.Before(before) {
+			delete(r.s.refreshTokens, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,508 @@
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+type warehouseRepo struct {
+	s *Store
+}
+
+func NewWarehouseRepository(s *Store) repository.WarehouseRepository {
+	return &warehouseRepo{s: s}
+}
+
+// addStock inserts a stock row or adds to the existing one
+func (s *Store) addStock(warehouseID, productID, quantity int) {
+	key := [2]int{warehouseID, productID}
+	if row, ok := s.stocks[key]; ok {
+		row.Quantity += quantity
+		row.UpdatedAt = s.now()
+		return
+	}
+
+	now := s.now()
+	s.stocks[key] = &models.WarehouseStock{
+		ID:          s.nextID("warehouse_stocks"),
+		WarehouseID: warehouseID,
+		ProductID:   productID,
+		Quantity:    quantity,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+}
+
+// stockView returns a copy of the stock row joined with warehouse and product
+func (s *Store) stockView(row *models.WarehouseStock) (models.WarehouseStock, bool) {
+	w, ok := s.warehouses[row.WarehouseID]
+	if !ok {
+		return models.WarehouseStock{}, false
+	}
+	p, ok := s.products[row.ProductID]
+	if !ok {
+		return models.WarehouseStock{}, false
+	}
+
+	stock := *row
+	stock.WarehouseName = w.Name
+	stock.ProductName = p.Name
+	stock.ProductPrice = p.Price
+	stock.AvailableStock = stock.Quantity - stock.ReservedQuantity
+	return stock, true
+}
+
+// Warehouse management
+func (r *warehouseRepo) CreateWarehouse(req *models.CreateWarehouseRequest) (*models.Warehouse, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	warehouse := &models.Warehouse{
+		ID:        r.s.nextID("warehouses"),
+		Name:      req.Name,
+		Address:   req.Address,
+		Location:  copyLocation(req.Location),
+		IsActive:  true,
+		CreatedAt: r.s.now(),
+	}
+	r.s.warehouses[warehouse.ID] = warehouse
+
+	result := *warehouse
+	return &result, nil
+}
+
+func (r *warehouseRepo) GetAllWarehouses() ([]models.Warehouse, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var warehouses []models.Warehouse
+	for _, w := range r.s.warehouses {
+		warehouses = append(warehouses, *w)
+	}
+	sort.Slice(warehouses, func(i, j int) bool {
+		return warehouses[i].Name < warehouses[j].Name
+	})
+
+	return warehouses, nil
+}
+
+func (r *warehouseRepo) GetWarehouseByID(id int) (*models.Warehouse, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	w, ok := r.s.warehouses[id]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	warehouse := *w
+	return &warehouse, nil
+}
+
+func (r *warehouseRepo) UpdateWarehouse(id int, req *models.UpdateWarehouseRequest) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	w, ok := r.s.warehouses[id]
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	w.Name = req.Name
+	w.Address = req.Address
+	w.Location = copyLocation(req.Location)
+	w.IsActive = req.IsActive
+	return nil
+}
+
+// copyLocation returns a copy of l, so stored warehouses share nothing with
+// requests
+func copyLocation(l *models.Location) *models.Location {
+	if l == nil {
+		return nil
+	}
+	location := *l
+	return &location
+}
+
+func (r *warehouseRepo) DeleteWarehouse(id int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for key, row := range r.s.stocks {
+		if key[0] == id && row.Quantity > 0 {
+			return &repository.WarehouseHasStockError{WarehouseID: id}
+		}
+	}
+
+	if _, ok := r.s.warehouses[id]; !ok {
+		return pgx.ErrNoRows
+	}
+
+	// Rows still referencing the warehouse block the delete, as in PostgreSQL
+	for key := range r.s.stocks {
+		if key[0] == id {
+			return ErrForeignKey
+		}
+	}
+	for _, p := range r.s.products {
+		if p.WarehouseID == id {
+			return ErrForeignKey
+		}
+	}
+	for _, a := range r.s.allocations {
+		if a.WarehouseID == id {
+			return ErrForeignKey
+		}
+	}
+	for _, t := range r.s.transfers {
+		if (t.FromWarehouseID != nil && *t.FromWarehouseID == id) ||
+			(t.ToWarehouseID != nil && *t.ToWarehouseID == id) {
+			return ErrForeignKey
+		}
+	}
+
+	delete(r.s.warehouses, id)
+	for _, warehouseIDs := range r.s.assignments {
+		delete(warehouseIDs, id)
+	}
+	return nil
+}
+
+// Stock management
+func (r *warehouseRepo) GetWarehouseStocks(warehouseID int) ([]models.WarehouseStock, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var stocks []models.WarehouseStock
+	for key, row := range r.s.stocks {
+		if key[0] != warehouseID {
+			continue
+		}
+		if stock, ok := r.s.stockView(row); ok {
+			stocks = append(stocks, stock)
+		}
+	}
+	sort.Slice(stocks, func(i, j int) bool {
+		return stocks[i].ProductName < stocks[j].ProductName
+	})
+
+	return stocks, nil
+}
+
+func (r *warehouseRepo) GetAllStocks() ([]models.WarehouseStock, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var stocks []models.WarehouseStock
+	for _, row := range r.s.stocks {
+		if stock, ok := r.s.stockView(row); ok {
+			stocks = append(stocks, stock)
+		}
+	}
+	sort.Slice(stocks, func(i, j int) bool {
+		if stocks[i].WarehouseName != stocks[j].WarehouseName {
+			return stocks[i].WarehouseName < stocks[j].WarehouseName
+		}
+		return stocks[i].ProductName < stocks[j].ProductName
+	})
+
+	return stocks, nil
+}
+
+func (r *warehouseRepo) GetProductStockInWarehouse(warehouseID, productID int) (*models.WarehouseStock, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	row, ok := r.s.stocks[[2]int{warehouseID, productID}]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	stock, ok := r.s.stockView(row)
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return &stock, nil
+}
+
+func (r *warehouseRepo) UpdateStock(warehouseID, productID, quantity int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if row, ok := r.s.stocks[[2]int{warehouseID, productID}]; ok {
+		if err := r.s.checkTake(warehouseID, productID, row.Quantity-quantity); err != nil {
+			return err
+		}
+		row.Quantity = quantity
+		row.UpdatedAt = r.s.now()
+		return nil
+	}
+
+	if err := r.s.checkStockReferences(warehouseID, productID); err != nil {
+		return err
+	}
+	r.s.addStock(warehouseID, productID, quantity)
+	return nil
+}
+
+func (r *warehouseRepo) AddStock(warehouseID, productID, quantity int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.stocks[[2]int{warehouseID, productID}]; !ok {
+		if err := r.s.checkStockReferences(warehouseID, productID); err != nil {
+			return err
+		}
+	}
+	r.s.addStock(warehouseID, productID, quantity)
+	return nil
+}
+
+func (s *Store) checkStockReferences(warehouseID, productID int) error {
+	if _, ok := s.warehouses[warehouseID]; !ok {
+		return ErrForeignKey
+	}
+	if _, ok := s.products[productID]; !ok {
+		return ErrForeignKey
+	}
+	return nil
+}
+
+// Transfer management
+func (r *warehouseRepo) CreateStockTransfer(req *models.StockTransferRequest, requestedBy int) (*models.StockTransfer, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if req.FromWarehouseID != nil {
+		if _, ok := r.s.warehouses[*req.FromWarehouseID]; !ok {
+			return nil, ErrForeignKey
+		}
+	}
+	if req.ToWarehouseID != nil {
+		if _, ok := r.s.warehouses[*req.ToWarehouseID]; !ok {
+			return nil, ErrForeignKey
+		}
+	}
+	if _, ok := r.s.products[req.ProductID]; !ok {
+		return nil, ErrForeignKey
+	}
+	if _, ok := r.s.users[requestedBy]; !ok {
+		return nil, ErrForeignKey
+	}
+
+	transfer := &models.StockTransfer{
+		ID:              r.s.nextID("stock_transfers"),
+		FromWarehouseID: copyIntPtr(req.FromWarehouseID),
+		ToWarehouseID:   copyIntPtr(req.ToWarehouseID),
+		ProductID:       req.ProductID,
+		Quantity:        req.Quantity,
+		Status:          "pending",
+		Reason:          req.Reason,
+		RequestedBy:     requestedBy,
+		CreatedAt:       r.s.now(),
+	}
+	r.s.transfers[transfer.ID] = transfer
+
+	result := *transfer
+	result.FromWarehouseID = copyIntPtr(transfer.FromWarehouseID)
+	result.ToWarehouseID = copyIntPtr(transfer.ToWarehouseID)
+	return &result, nil
+}
+
+// transferView returns a copy of the transfer joined with warehouse, product
+// and user names
+func (s *Store) transferView(t *models.StockTransfer) (models.StockTransfer, bool) {
+	p, ok := s.products[t.ProductID]
+	if !ok {
+		return models.StockTransfer{}, false
+	}
+	u, ok := s.users[t.RequestedBy]
+	if !ok {
+		return models.StockTransfer{}, false
+	}
+
+	transfer := *t
+	transfer.FromWarehouseID = copyIntPtr(t.FromWarehouseID)
+	transfer.ToWarehouseID = copyIntPtr(t.ToWarehouseID)
+	if t.CompletedAt != nil {
+		completedAt := *t.CompletedAt
+		transfer.CompletedAt = &completedAt
+	}
+	transfer.FromWarehouseName = "External"
+	if t.FromWarehouseID != nil {
+		if w, ok := s.warehouses[*t.FromWarehouseID]; ok {
+			transfer.FromWarehouseName = w.Name
+		}
+	}
+	transfer.ToWarehouseName = "External"
+	if t.ToWarehouseID != nil {
+		if w, ok := s.warehouses[*t.ToWarehouseID]; ok {
+			transfer.ToWarehouseName = w.Name
+		}
+	}
+	transfer.ProductName = p.Name
+	transfer.RequestedByUser = u.Username
+	return transfer, true
+}
+
+func (r *warehouseRepo) GetAllTransfers() ([]models.StockTransfer, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	var transfers []models.StockTransfer
+	for _, t := range r.s.transfers {
+		if transfer, ok := r.s.transferView(t); ok {
+			transfers = append(transfers, transfer)
+		}
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].CreatedAt.After(transfers[j].CreatedAt)
+	})
+
+	return transfers, nil
+}
+
+func (r *warehouseRepo) GetTransferByID(id int) (*models.StockTransfer, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	t, ok := r.s.transfers[id]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	transfer, ok := r.s.transferView(t)
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return &transfer, nil
+}
+
+func (r *warehouseRepo) UpdateTransferStatus(id int, status string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	t, ok := r.s.transfers[id]
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	if t.Status == status {
+		return nil
+	}
+
+	if status == "completed" && t.Status == "pending" {
+		if err := r.s.moveTransferStock(t); err != nil {
+			return err
+		}
+	}
+
+	var completedAt *time.Time
+	if status == "completed" || status == "failed" || status == "cancelled" {
+		now := r.s.now()
+		completedAt = &now
+	}
+	t.Status = status
+	t.CompletedAt = completedAt
+	return nil
+}
+
+func (r *warehouseRepo) ProcessTransfer(id int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	t, ok := r.s.transfers[id]
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	if t.Status != "pending" {
+		return &repository.TransferNotPendingError{TransferID: id, Status: t.Status}
+	}
+
+	if err := r.s.moveTransferStock(t); err != nil {
+		return err
+	}
+
+	now := r.s.now()
+	t.Status = "completed"
+	t.CompletedAt = &now
+	return nil
+}
+
+// moveTransferStock moves the transfer quantity between warehouses, checking
+// the source first so that nothing changes when stock is insufficient
+func (s *Store) moveTransferStock(t *models.StockTransfer) error {
+	if t.FromWarehouseID != nil {
+		row, ok := s.stocks[[2]int{*t.FromWarehouseID, t.ProductID}]
+		available := 0
+		if ok {
+			// Units reserved by orders cannot be moved
+			available = row.Quantity - row.ReservedQuantity
+		}
+		if available < t.Quantity {
+			return &repository.InsufficientStockError{
+				WarehouseID: *t.FromWarehouseID,
+				ProductID:   t.ProductID,
+				Required:    t.Quantity,
+				Available:   available,
+			}
+		}
+
+		row.Quantity -= t.Quantity
+		row.UpdatedAt = s.now()
+		if p, ok := s.products[t.ProductID]; ok {
+			p.Stock -= t.Quantity
+		}
+	}
+
+	if t.ToWarehouseID != nil {
+		s.addStock(*t.ToWarehouseID, t.ProductID, t.Quantity)
+		if p, ok := s.products[t.ProductID]; ok {
+			p.Stock += t.Quantity
+		}
+	}
+
+	return nil
+}
+
+func copyIntPtr(v *int) *int {
+	if v == nil {
+		return nil
+	}
+	c := *v
+	return &c
+}
+
+// Warehouse assignments
+func (r *warehouseRepo) GetUserWarehouseIDs(userID int) ([]int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	ids := []int{}
+	for id := range r.s.assignments[userID] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (r *warehouseRepo) SetUserWarehouses(userID int, warehouseIDs []int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.users[userID]; !ok {
+		return &repository.UserNotFoundError{UserID: userID}
+	}
+	for _, id := range warehouseIDs {
+		if _, ok := r.s.warehouses[id]; !ok {
+			return &repository.WarehouseNotFoundError{WarehouseID: id}
+		}
+	}
+
+	assigned := map[int]bool{}
+	for _, id := range warehouseIDs {
+		assigned[id] = true
+	}
+	r.s.assignments[userID] = assigned
+	return nil
+}
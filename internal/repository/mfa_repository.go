@@ -0,0 +1,229 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+type MFARepository interface {
+	GetMFA(userID int) (*models.UserMFA, error)
+	// StartMFAEnrollment stores a new secret, replacing a pending enrollment.
+	// Users with enabled MFA get an MFAAlreadyEnabledError.
+	StartMFAEnrollment(userID int, secret string) error
+	// EnableMFA enables a pending enrollment, whose first code was of step,
+	// and stores the hashes of its recovery codes
+	EnableMFA(userID int, step int64, enabledAt time.Time, recoveryCodeHashes []string) error
+	// UseMFAStep records the time step of an accepted code. A step at or
+	// before the last used one gets an MFACodeUsedError, so a code works once.
+	UseMFAStep(userID int, step int64) error
+	ReplaceRecoveryCodes(userID int, codeHashes []string) error
+	// UseRecoveryCode marks an unused recovery code as used, or returns a
+	// RecoveryCodeNotFoundError
+	UseRecoveryCode(userID int, codeHash string, usedAt time.Time) error
+	CountRecoveryCodes(userID int) (int, error)
+	DeleteMFA(userID int) error
+}
+
+type mfaRepo struct {
+	q db.Querier
+}
+
+func NewMFARepository(q db.Querier) MFARepository {
+	return &mfaRepo{q: q}
+}
+
+func (r *mfaRepo) GetMFA(userID int) (*models.UserMFA, error) {
+	var m models.UserMFA
+	err := r.q.QueryRow(context.Background(),
+		`SELECT user_id, secret, enabled_at, last_used_step, created_at
+         FROM user_mfa WHERE user_id = $1`,
+		userID).Scan(&m.UserID, &m.Secret, &m.EnabledAt, &m.LastUsedStep, &m.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func (r *mfaRepo) StartMFAEnrollment(userID int, secret string) error {
+	result, err := r.q.Exec(context.Background(),
+		`INSERT INTO user_mfa (user_id, secret) VALUES ($1, $2)
+         ON CONFLICT (user_id) DO UPDATE
+             SET secret = EXCLUDED.secret, last_used_step = 0, created_at = CURRENT_TIMESTAMP
+             WHERE user_mfa.enabled_at IS NULL`,
+		userID, secret)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return &MFAAlreadyEnabledError{UserID: userID}
+	}
+
+	return nil
+}
+
+func (r *mfaRepo) EnableMFA(userID int, step int64, enabledAt time.Time, recoveryCodeHashes []string) error {
+	// Begin transaction
+	tx, err := r.q.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	result, err := tx.Exec(context.Background(),
+		`UPDATE user_mfa SET enabled_at = $2, last_used_step = $3
+         WHERE user_id = $1 AND enabled_at IS NULL`,
+		userID, enabledAt, step)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return &MFANotFoundError{UserID: userID}
+	}
+
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func (r *mfaRepo) UseMFAStep(userID int, step int64) error {
+	result, err := r.q.Exec(context.Background(),
+		`UPDATE user_mfa SET last_used_step = $2
+         WHERE user_id = $1 AND enabled_at IS NOT NULL AND last_used_step < $2`,
+		userID, step)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return &MFACodeUsedError{UserID: userID}
+	}
+
+	return nil
+}
+
+func (r *mfaRepo) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	// Begin transaction
+	tx, err := r.q.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func replaceRecoveryCodes(tx pgx.Tx, userID int, codeHashes []string) error {
+	_, err := tx.Exec(context.Background(),
+		`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if len(codeHashes) == 0 {
+		return nil
+	}
+	_, err = tx.Exec(context.Background(),
+		`INSERT INTO mfa_recovery_codes (user_id, code_hash)
+         SELECT $1, unnest($2::text[])`,
+		userID, codeHashes)
+	return err
+}
+
+func (r *mfaRepo) UseRecoveryCode(userID int, codeHash string, usedAt time.Time) error {
+	result, err := r.q.Exec(context.Background(),
+		`UPDATE mfa_recovery_codes SET used_at = $3
+         WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, codeHash, usedAt)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return &RecoveryCodeNotFoundError{UserID: userID}
+	}
+
+	return nil
+}
+
+func (r *mfaRepo) CountRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := r.q.QueryRow(context.Background(),
+		`SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1 AND used_at IS NULL`,
+		userID).Scan(&count)
+	return count, err
+}
+
+func (r *mfaRepo) DeleteMFA(userID int) error {
+	// Begin transaction
+	tx, err := r.q.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(),
+		`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(context.Background(),
+		`DELETE FROM user_mfa WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return &MFANotFoundError{UserID: userID}
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// MFANotFoundError is returned when a user has no MFA enrollment, or none
+// pending where one is expected
+type MFANotFoundError struct {
+	UserID int
+}
+
+func (e *MFANotFoundError) Error() string {
+	return "mfa enrollment not found"
+}
+
+// MFAAlreadyEnabledError is returned when enrolling a user whose MFA is
+// already enabled
+type MFAAlreadyEnabledError struct {
+	UserID int
+}
+
+func (e *MFAAlreadyEnabledError) Error() string {
+	return "mfa already enabled"
+}
+
+// MFACodeUsedError is returned for codes of a time step that was already used
+type MFACodeUsedError struct {
+	UserID int
+}
+
+func (e *MFACodeUsedError) Error() string {
+	return "mfa code already used"
+}
+
+// RecoveryCodeNotFoundError is returned for unknown or used recovery codes
+type RecoveryCodeNotFoundError struct {
+	UserID int
+}
+
+func (e *RecoveryCodeNotFoundError) Error() string {
+	return "recovery code not found or already used"
+}
@@ -3,30 +3,61 @@ package repository
 import (
 	"context"
 	"errors"
-	"strconv"
+	"slices"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/allocation"
 	"github.com/slmbngl/OrderAplication/internal/models"
 )
 
 type OrderRepository interface {
 	GetOrderByID(orderID, userID int) (*models.Order, error)
+	GetOrder(orderID int) (*models.Order, error)
 	GetOrderItems(orderID int) ([]models.OrderItem, error)
-	CreateOrder(userID int, items []models.CreateOrderItemRequest) (*models.OrderWithItems, error)
+	// CreateOrder places an order and reserves its items in the warehouses
+	// chosen by strategy, recording the allocations of each item. Items keep
+	// the price, name and description their product had at that moment, and
+	// the order total is the sum of their line totals. An item
+	// the warehouses cannot cover fails the whole order with an
+	// InsufficientWarehouseStockError.
+	CreateOrder(userID int, items []models.CreateOrderItemRequest, strategy allocation.Strategy) (*models.OrderWithItems, error)
+	// DeleteOrder deletes a pending or cancelled order of the user,
+	// releasing the reserved stock of a pending order. Orders past pending
+	// hold stock and history that only the state machine may change; they
+	// get an OrderNotDeletableError.
 	DeleteOrder(orderID, userID int) error
-	UpdateOrderStatus(orderID, userID int, status string) error
+	// UpdateOrderStatus moves an order from status from to status to and
+	// records the change in its history. Confirming deducts the items from
+	// warehouse stock; cancelling an order that holds stock puts it back.
+	// The change and its stock movements apply together or not at all. An
+	// order no longer in status from gets an OrderStatusChangedError.
+	UpdateOrderStatus(orderID int, from, to string, changedBy int) error
+	// GetOrderStatusHistory returns the status changes of an order, oldest
+	// first
+	GetOrderStatusHistory(orderID int) ([]models.OrderStatusChange, error)
+	// ExpirePendingOrders cancels the orders placed before placedBefore that
+	// are still pending, releasing their reserved stock, and returns how
+	// many it cancelled. Orders placed before reservations existed hold no
+	// stock and are left alone.
+	ExpirePendingOrders(placedBefore time.Time) (int64, error)
+	GetOrdersByUserID(userID int) ([]models.OrderWithItems, error)
+	GetAllOrders() ([]models.OrderWithItems, error)
 }
 
-type orderRepo struct{}
+type orderRepo struct {
+	q        db.Querier
+	products ProductRepository
+}
 
-func NewOrderRepository() OrderRepository {
-	return &orderRepo{}
+func NewOrderRepository(q db.Querier) OrderRepository {
+	return &orderRepo{q: q, products: NewProductRepository(q)}
 }
 
-func GetOrdersByUserID(userID int) ([]models.OrderWithItems, error) {
-	// Önce siparişleri al
-	orderRows, err := db.Pool.Query(context.Background(),
+func (r *orderRepo) GetOrdersByUserID(userID int) ([]models.OrderWithItems, error) {
+	// The orders first, their items are loaded for each order below
+	orderRows, err := r.q.Query(context.Background(),
 		`SELECT DISTINCT order_id, user_id, total_amount, status, created_at, username 
          FROM order_summary_view 
          WHERE user_id = $1 
@@ -34,6 +65,22 @@ func GetOrdersByUserID(userID int) ([]models.OrderWithItems, error) {
 	if err != nil {
 		return nil, err
 	}
+	return r.scanOrdersWithItems(orderRows)
+}
+
+// GetAllOrders returns the orders of every user, newest first
+func (r *orderRepo) GetAllOrders() ([]models.OrderWithItems, error) {
+	orderRows, err := r.q.Query(context.Background(),
+		`SELECT DISTINCT order_id, user_id, total_amount, status, created_at, username 
+         FROM order_summary_view 
+         ORDER BY created_at DESC, order_id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	return r.scanOrdersWithItems(orderRows)
+}
+
+func (r *orderRepo) scanOrdersWithItems(orderRows pgx.Rows) ([]models.OrderWithItems, error) {
 	defer orderRows.Close()
 
 	var ordersWithItems []models.OrderWithItems
@@ -45,9 +92,8 @@ func GetOrdersByUserID(userID int) ([]models.OrderWithItems, error) {
 			return nil, err
 		}
 
-		// Her sipariş için items'ları al
-		orderRepo := NewOrderRepository()
-		items, err := orderRepo.GetOrderItems(order.ID)
+		// Load the items of each order
+		items, err := r.GetOrderItems(order.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -59,28 +105,42 @@ func GetOrdersByUserID(userID int) ([]models.OrderWithItems, error) {
 		ordersWithItems = append(ordersWithItems, orderWithItems)
 	}
 
-	return ordersWithItems, nil
+	return ordersWithItems, orderRows.Err()
 }
+
+// GetOrder returns an order regardless of its owner
+func (r *orderRepo) GetOrder(orderID int) (*models.Order, error) {
+	var order models.Order
+	err := r.q.QueryRow(context.Background(),
+		`SELECT o.id, o.user_id, o.total_amount, o.status, o.created_at, u.username
+         FROM orders o JOIN users u ON u.id = o.user_id
+         WHERE o.id = $1`,
+		orderID).Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
 func (r *orderRepo) GetOrderByID(orderID, userID int) (*models.Order, error) {
 	var order models.Order
-	err := db.Pool.QueryRow(context.Background(),
-		"SELECT id, user_id, total_amount, created_at FROM orders WHERE id = $1 AND user_id = $2",
-		orderID, userID).Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.CreatedAt)
+	err := r.q.QueryRow(context.Background(),
+		"SELECT id, user_id, total_amount, status, created_at FROM orders WHERE id = $1 AND user_id = $2",
+		orderID, userID).Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CreatedAt)
 
 	if err != nil {
 		return nil, err
 	}
 
-	order.Status = "pending"
 	return &order, nil
 }
 
 func (r *orderRepo) GetOrderItems(orderID int) ([]models.OrderItem, error) {
-	itemRows, err := db.Pool.Query(context.Background(),
-		`SELECT oi.id, oi.product_id, oi.quantity, p.name, p.description 
-         FROM order_items oi 
-         JOIN products p ON oi.product_id = p.id 
-         WHERE oi.order_id = $1`, orderID)
+	itemRows, err := r.q.Query(context.Background(),
+		`SELECT id, product_id, quantity, unit_price, line_total, product_name, product_description
+         FROM order_items
+         WHERE order_id = $1
+         ORDER BY id`, orderID)
 	if err != nil {
 		return nil, err
 	}
@@ -89,48 +149,70 @@ func (r *orderRepo) GetOrderItems(orderID int) ([]models.OrderItem, error) {
 	var items []models.OrderItem
 	for itemRows.Next() {
 		var item models.OrderItem
-		var productName, productDescription string
-		err := itemRows.Scan(&item.ID, &item.ProductID, &item.Quantity, &productName, &productDescription)
+		err := itemRows.Scan(&item.ID, &item.ProductID, &item.Quantity, &item.Price, &item.LineTotal,
+			&item.ProductName, &item.ProductDescription)
 		if err != nil {
 			return nil, err
 		}
 		item.OrderID = orderID
-		item.ProductName = productName
-		item.ProductDescription = productDescription
+		item.Allocations = []models.OrderItemAllocation{}
 		items = append(items, item)
 	}
+	if err := itemRows.Err(); err != nil {
+		return nil, err
+	}
 
-	return items, nil
-}
-
-func (r *orderRepo) CreateOrder(userID int, items []models.CreateOrderItemRequest) (*models.OrderWithItems, error) {
-	// Begin transaction
-	tx, err := db.Pool.Begin(context.Background())
+	allocationRows, err := r.q.Query(context.Background(),
+		`SELECT a.order_item_id, a.warehouse_id, w.name, a.quantity
+         FROM order_item_allocations a
+         JOIN order_items oi ON oi.id = a.order_item_id
+         JOIN warehouses w ON w.id = a.warehouse_id
+         WHERE oi.order_id = $1
+         ORDER BY a.id`, orderID)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback(context.Background())
+	defer allocationRows.Close()
 
-	// Create product repository instance
-	productRepo := NewProductRepository()
-
-	// Check warehouse stock for all items first
-	for _, item := range items {
-		_, err := productRepo.CheckWarehouseStock(item.ProductID, item.Quantity)
+	for allocationRows.Next() {
+		var itemID int
+		var share models.OrderItemAllocation
+		err := allocationRows.Scan(&itemID, &share.WarehouseID, &share.WarehouseName, &share.Quantity)
 		if err != nil {
-			if warehouseErr, ok := err.(*InsufficientWarehouseStockError); ok {
-				return nil, errors.New("insufficient warehouse stock for product ID: " +
-					strconv.Itoa(warehouseErr.ProductID))
-			}
 			return nil, err
 		}
+		for i := range items {
+			if items[i].ID == itemID {
+				items[i].Allocations = append(items[i].Allocations, share)
+			}
+		}
+	}
 
-		// Additional check: ensure product exists and get details
-		var productPrice float64
-		var productName, productDescription string
-		err = tx.QueryRow(context.Background(),
-			"SELECT price, name, description FROM products WHERE id = $1",
-			item.ProductID).Scan(&productPrice, &productName, &productDescription)
+	return items, allocationRows.Err()
+}
+
+func (r *orderRepo) CreateOrder(userID int, items []models.CreateOrderItemRequest, strategy allocation.Strategy) (*models.OrderWithItems, error) {
+	// Begin transaction
+	tx, err := r.q.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	// Reserve every item first. The stock of the ordered products stays
+	// locked from the moment the strategy looks at it, and a line it cannot
+	// cover rolls back the whole order.
+	products := NewProductRepository(tx)
+	stocks, err := products.LockAvailableStock(ProductIDs(items))
+	if err != nil {
+		return nil, err
+	}
+	allocations, err := Allocate(strategy, items, stocks)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range allocations {
+		err = products.AdjustWarehouseStock(a.WarehouseID, items[a.Line].ProductID, 0, a.Quantity)
 		if err != nil {
 			return nil, err
 		}
@@ -145,50 +227,64 @@ func (r *orderRepo) CreateOrder(userID int, items []models.CreateOrderItemReques
 		return nil, err
 	}
 
-	// Add order items and calculate total
+	// Add order items with a snapshot of their product, so later product
+	// changes leave the order as it was placed
 	var orderItems []models.OrderItem
-	var totalAmount float64
-	for _, item := range items {
-		// Get product details again
-		var productPrice float64
-		var productName, productDescription string
-		err = tx.QueryRow(context.Background(),
-			"SELECT price, name, description FROM products WHERE id = $1",
-			item.ProductID).Scan(&productPrice, &productName, &productDescription)
-		if err != nil {
-			return nil, err
+	for i, item := range items {
+		orderItem := models.OrderItem{
+			OrderID:   orderID,
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
 		}
-
-		// Insert order item
-		var itemID int
 		err = tx.QueryRow(context.Background(),
-			"INSERT INTO order_items (order_id, product_id, quantity) VALUES ($1, $2, $3) RETURNING id",
-			orderID, item.ProductID, item.Quantity).Scan(&itemID)
+			`INSERT INTO order_items (order_id, product_id, quantity, unit_price, product_name,
+                                      product_description, line_total)
+             SELECT $1, p.id, $3, p.price, p.name, COALESCE(p.description, ''), p.price * $3
+             FROM products p WHERE p.id = $2
+             RETURNING id, unit_price, product_name, product_description, line_total`,
+			orderID, item.ProductID, item.Quantity).Scan(&orderItem.ID, &orderItem.Price,
+			&orderItem.ProductName, &orderItem.ProductDescription, &orderItem.LineTotal)
 		if err != nil {
 			return nil, err
 		}
 
-		orderItem := models.OrderItem{
-			ID:                 itemID,
-			OrderID:            orderID,
-			ProductID:          item.ProductID,
-			Quantity:           item.Quantity,
-			Price:              productPrice,
-			ProductName:        productName,
-			ProductDescription: productDescription,
+		// Record the warehouses the item is taken from
+		itemAllocations := []models.OrderItemAllocation{}
+		for _, a := range allocations {
+			if a.Line != i {
+				continue
+			}
+			share := models.OrderItemAllocation{WarehouseID: a.WarehouseID, Quantity: a.Quantity}
+			err = tx.QueryRow(context.Background(),
+				`INSERT INTO order_item_allocations (order_item_id, warehouse_id, quantity)
+                 VALUES ($1, $2, $3)
+                 RETURNING (SELECT name FROM warehouses WHERE id = $2)`,
+				orderItem.ID, a.WarehouseID, a.Quantity).Scan(&share.WarehouseName)
+			if err != nil {
+				return nil, err
+			}
+			itemAllocations = append(itemAllocations, share)
 		}
+		orderItem.Allocations = itemAllocations
 		orderItems = append(orderItems, orderItem)
-		totalAmount += float64(item.Quantity) * productPrice
 	}
 
-	// Update order with calculated total amount
-	_, err = tx.Exec(context.Background(),
-		"UPDATE orders SET total_amount = $1 WHERE id = $2",
-		totalAmount, orderID)
+	// The order total is the sum of its line totals
+	var totalAmount float64
+	err = tx.QueryRow(context.Background(),
+		`UPDATE orders SET total_amount = (
+             SELECT COALESCE(SUM(line_total), 0) FROM order_items WHERE order_id = $1)
+         WHERE id = $1
+         RETURNING total_amount`,
+		orderID).Scan(&totalAmount)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := recordStatusChange(tx, orderID, nil, models.OrderPending, &userID); err != nil {
+		return nil, err
+	}
+
 	// Commit transaction
 	err = tx.Commit(context.Background())
 	if err != nil {
@@ -200,7 +296,7 @@ func (r *orderRepo) CreateOrder(userID int, items []models.CreateOrderItemReques
 		ID:          orderID,
 		UserID:      userID,
 		TotalAmount: totalAmount,
-		Status:      "pending",
+		Status:      models.OrderPending,
 	}
 
 	orderWithItems := &models.OrderWithItems{
@@ -211,109 +307,260 @@ func (r *orderRepo) CreateOrder(userID int, items []models.CreateOrderItemReques
 	return orderWithItems, nil
 }
 
-func (r *orderRepo) UpdateOrderStatus(orderID, userID int, status string) error {
-	// Begin transaction
-	tx, err := db.Pool.Begin(context.Background())
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback(context.Background())
-
-	// Get current order status first
-	var currentStatus string
-	err = tx.QueryRow(context.Background(),
-		"SELECT status FROM orders WHERE id = $1 AND user_id = $2",
-		orderID, userID).Scan(&currentStatus)
-	if err != nil {
-		return err
-	}
-
-	// If status is the same, no need to update
-	if currentStatus == status {
-		return nil
+// ProductIDs returns the distinct products of the items in ascending order
+func ProductIDs(items []models.CreateOrderItemRequest) []int {
+	var ids []int
+	for _, item := range items {
+		ids = append(ids, item.ProductID)
 	}
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
 
-	// Update order status
-	result, err := tx.Exec(context.Background(),
-		"UPDATE orders SET status = $1 WHERE id = $2 AND user_id = $3",
-		status, orderID, userID)
-	if err != nil {
-		return err
+// Allocate lets strategy take the items from stocks. A line the warehouses
+// cannot cover is reported as an InsufficientWarehouseStockError.
+func Allocate(strategy allocation.Strategy, items []models.CreateOrderItemRequest, stocks []allocation.Stock) ([]allocation.Allocation, error) {
+	lines := make([]allocation.Line, len(items))
+	for i, item := range items {
+		lines[i] = allocation.Line{ProductID: item.ProductID, Quantity: item.Quantity}
 	}
 
-	rowsAffected := result.RowsAffected()
-	if rowsAffected == 0 {
-		return pgx.ErrNoRows
+	allocations, err := strategy.Allocate(lines, stocks)
+	var insufficient *allocation.InsufficientStockError
+	if errors.As(err, &insufficient) {
+		return nil, &InsufficientWarehouseStockError{
+			ProductID:      insufficient.ProductID,
+			RequiredStock:  insufficient.Required,
+			AvailableStock: insufficient.Available,
+		}
 	}
+	return allocations, err
+}
 
-	// Create product repository instance for warehouse operations
-	productRepo := NewProductRepository()
+func (r *orderRepo) UpdateOrderStatus(orderID int, from, to string, changedBy int) error {
+	return r.changeStatus(orderID, from, to, &changedBy)
+}
 
-	// If status is confirmed, check and update warehouse stock
-	if status == "confirmed" && currentStatus != "confirmed" {
-		// Get order items
-		items, err := r.GetOrderItems(orderID)
+// changeStatus moves an order from status from to status to. Changes made by
+// the application itself, such as expiries, have no changedBy.
+func (r *orderRepo) changeStatus(orderID int, from, to string, changedBy *int) error {
+	return db.InTx(context.Background(), r.q, func(tx pgx.Tx) error {
+		// Only an order still in the expected status is changed, so two
+		// concurrent changes cannot both apply their stock movements
+		result, err := tx.Exec(context.Background(),
+			"UPDATE orders SET status = $3 WHERE id = $1 AND status = $2",
+			orderID, from, to)
 		if err != nil {
 			return err
 		}
-
-		// Check and update warehouse stock for each item
-		for _, item := range items {
-			// Check warehouse stock availability
-			_, err := productRepo.CheckWarehouseStock(item.ProductID, item.Quantity)
+		if result.RowsAffected() == 0 {
+			var current string
+			err := tx.QueryRow(context.Background(),
+				"SELECT status FROM orders WHERE id = $1", orderID).Scan(&current)
 			if err != nil {
-				if warehouseErr, ok := err.(*InsufficientWarehouseStockError); ok {
-					return errors.New("insufficient warehouse stock for product: " + item.ProductName +
-						", required: " + strconv.Itoa(warehouseErr.RequiredStock) +
-						", available: " + strconv.Itoa(warehouseErr.AvailableStock))
-				}
 				return err
 			}
+			return &OrderStatusChangedError{OrderID: orderID, Status: current}
+		}
 
-			// Update warehouse stock (decrease)
-			err = productRepo.UpdateWarehouseStock(item.ProductID, item.Quantity, "decrease")
+		// Stock is moved by repositories on the same transaction, so a
+		// failing item rolls back the items before it and the status
+		uow := &orderRepo{q: tx, products: NewProductRepository(tx)}
+		if err := uow.moveStock(orderID, from, to); err != nil {
+			return err
+		}
+
+		return recordStatusChange(tx, orderID, &from, to, changedBy)
+	})
+}
+
+// moveStock applies the stock movements of a status change, see StockChange,
+// to every warehouse the items are allocated to. Items without allocations
+// were placed before stock was reserved; they are taken from stock on
+// confirmation and put back on cancellation.
+func (r *orderRepo) moveStock(orderID int, from, to string) error {
+	quantity, reserved := StockChange(from, to)
+	if quantity == 0 && reserved == 0 {
+		return nil
+	}
+
+	items, err := r.GetOrderItems(orderID)
+	if err != nil {
+		return err
+	}
+	// Stock rows are locked in product and warehouse order, so that
+	// concurrent confirmations of overlapping orders cannot deadlock
+	slices.SortFunc(items, func(a, b models.OrderItem) int { return a.ProductID - b.ProductID })
+
+	for _, item := range items {
+		slices.SortFunc(item.Allocations, func(a, b models.OrderItemAllocation) int {
+			return a.WarehouseID - b.WarehouseID
+		})
+		for _, a := range item.Allocations {
+			err := r.products.AdjustWarehouseStock(a.WarehouseID, item.ProductID,
+				quantity*a.Quantity, reserved*a.Quantity)
 			if err != nil {
 				return err
 			}
 		}
-	}
+		if len(item.Allocations) > 0 {
+			continue
+		}
 
-	// If status is cancelled or pending from confirmed, restore warehouse stock
-	if (status == "cancelled" && currentStatus == "confirmed") ||
-		(status == "pending" && currentStatus == "confirmed") {
-		// Get order items
-		items, err := r.GetOrderItems(orderID)
+		switch {
+		case quantity < 0:
+			_, err = r.products.CheckWarehouseStock(item.ProductID, item.Quantity)
+			if err == nil {
+				err = r.products.UpdateWarehouseStock(item.ProductID, item.Quantity, "decrease")
+			}
+		case quantity > 0:
+			err = r.products.UpdateWarehouseStock(item.ProductID, item.Quantity, "increase")
+		}
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// Restore warehouse stock for each item
-		for _, item := range items {
-			// Update warehouse stock (increase)
-			err = productRepo.UpdateWarehouseStock(item.ProductID, item.Quantity, "increase")
-			if err != nil {
-				return err
-			}
+// StockChange returns how the stock and the reserved quantity of a warehouse
+// change per unit of an order item reserved there when its order moves from
+// status from to status to. Confirming turns the reservation into a
+// deduction; cancelling releases the reservation of a pending order and puts
+// back the stock of an order that has not left the warehouse.
+func StockChange(from, to string) (quantity, reserved int) {
+	switch {
+	case from == models.OrderPending && to == models.OrderConfirmed:
+		return -1, -1
+	case from == models.OrderPending && to == models.OrderCancelled:
+		return 0, -1
+	case to == models.OrderCancelled && models.OrderHoldsStock(from):
+		return 1, 0
+	}
+	return 0, 0
+}
+
+func (r *orderRepo) ExpirePendingOrders(placedBefore time.Time) (int64, error) {
+	rows, err := r.q.Query(context.Background(),
+		`SELECT o.id FROM orders o
+         WHERE o.status = $1 AND o.created_at < $2
+           AND EXISTS (SELECT 1 FROM order_items oi
+                       JOIN order_item_allocations a ON a.order_item_id = oi.id
+                       WHERE oi.order_id = o.id)
+         ORDER BY o.id`,
+		models.OrderPending, placedBefore)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var orderIDs []int
+	for rows.Next() {
+		var orderID int
+		if err := rows.Scan(&orderID); err != nil {
+			return 0, err
 		}
+		orderIDs = append(orderIDs, orderID)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
 	}
 
-	// Commit transaction
-	return tx.Commit(context.Background())
+	// Each order is cancelled in its own transaction; orders confirmed or
+	// cancelled in the meantime are skipped
+	var expired int64
+	for _, orderID := range orderIDs {
+		err := r.changeStatus(orderID, models.OrderPending, models.OrderCancelled, nil)
+		var changed *OrderStatusChangedError
+		if errors.As(err, &changed) || errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
 }
 
-func (r *orderRepo) DeleteOrder(orderID, userID int) error {
-	result, err := db.Pool.Exec(context.Background(),
-		"DELETE FROM orders WHERE id = $1 AND user_id = $2",
-		orderID, userID)
+func recordStatusChange(tx pgx.Tx, orderID int, from *string, to string, changedBy *int) error {
+	_, err := tx.Exec(context.Background(),
+		`INSERT INTO order_status_history (order_id, from_status, to_status, changed_by)
+         VALUES ($1, $2, $3, $4)`,
+		orderID, from, to, changedBy)
+	return err
+}
 
+func (r *orderRepo) GetOrderStatusHistory(orderID int) ([]models.OrderStatusChange, error) {
+	rows, err := r.q.Query(context.Background(),
+		`SELECT h.id, h.order_id, h.from_status, h.to_status, h.changed_by,
+                COALESCE(u.username, ''), h.created_at
+         FROM order_status_history h
+         LEFT JOIN users u ON u.id = h.changed_by
+         WHERE h.order_id = $1
+         ORDER BY h.created_at, h.id`, orderID)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	rowsAffected := result.RowsAffected()
-	if rowsAffected == 0 {
-		return pgx.ErrNoRows
+	history := []models.OrderStatusChange{}
+	for rows.Next() {
+		var change models.OrderStatusChange
+		err := rows.Scan(&change.ID, &change.OrderID, &change.FromStatus, &change.ToStatus,
+			&change.ChangedBy, &change.ChangedByUser, &change.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, change)
 	}
 
-	return nil
+	return history, rows.Err()
+}
+
+func (r *orderRepo) DeleteOrder(orderID, userID int) error {
+	return db.InTx(context.Background(), r.q, func(tx pgx.Tx) error {
+		var status string
+		err := tx.QueryRow(context.Background(),
+			"SELECT status FROM orders WHERE id = $1 AND user_id = $2 FOR UPDATE",
+			orderID, userID).Scan(&status)
+		if err != nil {
+			return err
+		}
+		if status != models.OrderPending && status != models.OrderCancelled {
+			return &OrderNotDeletableError{OrderID: orderID, Status: status}
+		}
+
+		if status == models.OrderPending {
+			uow := &orderRepo{q: tx, products: NewProductRepository(tx)}
+			if err := uow.moveStock(orderID, models.OrderPending, models.OrderCancelled); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(context.Background(), "DELETE FROM orders WHERE id = $1", orderID)
+		return err
+	})
+}
+
+// OrderStatusChangedError is returned when an order is no longer in the
+// status a change expected, because it was changed in the meantime
+type OrderStatusChangedError struct {
+	OrderID int
+	Status  string
+}
+
+func (e *OrderStatusChangedError) Error() string {
+	return "order status changed concurrently"
+}
+
+// OrderNotDeletableError is returned when deleting an order that is neither
+// pending nor cancelled
+type OrderNotDeletableError struct {
+	OrderID int
+	Status  string
+}
+
+func (e *OrderNotDeletableError) Error() string {
+	return "only pending and cancelled orders can be deleted"
 }
@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+type PasswordResetRepository interface {
+	CreatePasswordReset(reset *models.PasswordReset) error
+	// ClaimPasswordReset marks an unused, unexpired token as used and returns
+	// it. Any other token gets pgx.ErrNoRows, so a token works once.
+	ClaimPasswordReset(tokenHash string, usedAt time.Time) (*models.PasswordReset, error)
+	DeleteUserPasswordResets(userID int) error
+	DeleteExpiredPasswordResets(before time.Time) (int64, error)
+}
+
+type passwordResetRepo struct {
+	q db.Querier
+}
+
+func NewPasswordResetRepository(q db.Querier) PasswordResetRepository {
+	return &passwordResetRepo{q: q}
+}
+
+func (r *passwordResetRepo) CreatePasswordReset(reset *models.PasswordReset) error {
+	return r.q.QueryRow(context.Background(),
+		`INSERT INTO password_resets (user_id, token_hash, expires_at)
+         VALUES ($1, $2, $3)
+         RETURNING id, created_at`,
+		reset.UserID, reset.TokenHash, reset.ExpiresAt).Scan(&reset.ID, &reset.CreatedAt)
+}
+
+func (r *passwordResetRepo) ClaimPasswordReset(tokenHash string, usedAt time.Time) (*models.PasswordReset, error) {
+	var reset models.PasswordReset
+	err := r.q.QueryRow(context.Background(),
+		`UPDATE password_resets SET used_at = $2
+         WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+         RETURNING id, user_id, token_hash, expires_at, used_at, created_at`,
+		tokenHash, usedAt).Scan(&reset.ID, &reset.UserID, &reset.TokenHash, &reset.ExpiresAt,
+		&reset.UsedAt, &reset.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &reset, nil
+}
+
+func (r *passwordResetRepo) DeleteUserPasswordResets(userID int) error {
+	_, err := r.q.Exec(context.Background(),
+		`DELETE FROM password_resets WHERE user_id = $1`, userID)
+	return err
+}
+
+func (r *passwordResetRepo) DeleteExpiredPasswordResets(before time.Time) (int64, error) {
+	result, err := r.q.Exec(context.Background(),
+		`DELETE FROM password_resets WHERE expires_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
@@ -2,9 +2,11 @@ package repository
 
 import (
 	"context"
+	"errors"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/allocation"
 	"github.com/slmbngl/OrderAplication/internal/models"
 )
 
@@ -12,20 +14,44 @@ type ProductRepository interface {
 	GetAllProducts() ([]models.Product, error)
 	GetProductByID(id int) (*models.Product, error)
 	CreateProduct(productReq *models.ProductRequest) (*models.Product, error)
+	// UpdateProduct updates a product and moves its stock along. Taking
+	// stock below the reserved quantity of its warehouse returns an
+	// InsufficientWarehouseStockError.
 	UpdateProduct(id int, productReq *models.ProductRequest) error
+	// DeleteProduct deletes a product and its warehouse stock. Products on
+	// any order are kept for the order history and return a
+	// ProductInUseError.
 	DeleteProduct(id int) error
+	// CheckWarehouseStock returns the warehouse with the most unreserved
+	// units of a product, if it has at least quantity. Inside a transaction
+	// the row stays locked until it ends, so no one else can take the stock
+	// in the meantime.
 	CheckWarehouseStock(productID, quantity int) (*models.WarehouseStock, error)
+	// UpdateWarehouseStock takes ("decrease") or puts back ("increase")
+	// quantity units of a product. Decreasing more than any warehouse holds
+	// returns an InsufficientWarehouseStockError.
 	UpdateWarehouseStock(productID, quantity int, operation string) error
+	// AdjustWarehouseStock adds quantity to the stock of a product in a
+	// warehouse and reserved to its reserved quantity; either may be
+	// negative. A change that would leave more reserved than in stock, or a
+	// negative reservation, returns an InsufficientWarehouseStockError.
+	AdjustWarehouseStock(warehouseID, productID, quantity, reserved int) error
+	// LockAvailableStock returns the unreserved stock of the products in
+	// active warehouses, for an allocation strategy to choose from. Inside a
+	// transaction the rows stay locked until it ends.
+	LockAvailableStock(productIDs []int) ([]allocation.Stock, error)
 }
 
-type productRepo struct{}
+type productRepo struct {
+	q db.Querier
+}
 
-func NewProductRepository() ProductRepository {
-	return &productRepo{}
+func NewProductRepository(q db.Querier) ProductRepository {
+	return &productRepo{q: q}
 }
 
 func (r *productRepo) GetAllProducts() ([]models.Product, error) {
-	rows, err := db.Pool.Query(context.Background(),
+	rows, err := r.q.Query(context.Background(),
 		`SELECT p.id, p.name, p.description, p.price, p.stock, p.warehouse_id, p.created_at, w.name 
          FROM products p 
          JOIN warehouses w ON p.warehouse_id = w.id 
@@ -51,7 +77,7 @@ func (r *productRepo) GetAllProducts() ([]models.Product, error) {
 
 func (r *productRepo) GetProductByID(id int) (*models.Product, error) {
 	var p models.Product
-	err := db.Pool.QueryRow(context.Background(),
+	err := r.q.QueryRow(context.Background(),
 		`SELECT p.id, p.name, p.description, p.price, p.stock, p.warehouse_id, p.created_at, w.name
          FROM products p 
          JOIN warehouses w ON p.warehouse_id = w.id 
@@ -68,7 +94,7 @@ func (r *productRepo) GetProductByID(id int) (*models.Product, error) {
 
 func (r *productRepo) CreateProduct(productReq *models.ProductRequest) (*models.Product, error) {
 	// Begin transaction
-	tx, err := db.Pool.Begin(context.Background())
+	tx, err := r.q.Begin(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -112,7 +138,7 @@ func (r *productRepo) CreateProduct(productReq *models.ProductRequest) (*models.
 
 func (r *productRepo) UpdateProduct(id int, productReq *models.ProductRequest) error {
 	// Begin transaction
-	tx, err := db.Pool.Begin(context.Background())
+	tx, err := r.q.Begin(context.Background())
 	if err != nil {
 		return err
 	}
@@ -145,11 +171,7 @@ func (r *productRepo) UpdateProduct(id int, productReq *models.ProductRequest) e
 	// Update warehouse stocks if warehouse changed
 	if currentWarehouseID != productReq.WarehouseID {
 		// Remove from old warehouse
-		_, err = tx.Exec(context.Background(),
-			`UPDATE warehouse_stocks SET quantity = quantity - $1, updated_at = CURRENT_TIMESTAMP
-             WHERE warehouse_id = $2 AND product_id = $3`,
-			currentStock, currentWarehouseID, id)
-		if err != nil {
+		if err := shiftStock(tx, currentWarehouseID, id, -currentStock); err != nil {
 			return err
 		}
 
@@ -166,106 +188,104 @@ func (r *productRepo) UpdateProduct(id int, productReq *models.ProductRequest) e
 	} else {
 		// Same warehouse, update stock difference
 		stockDiff := productReq.Stock - currentStock
-		if stockDiff != 0 {
-			_, err = tx.Exec(context.Background(),
-				`UPDATE warehouse_stocks SET quantity = quantity + $1, updated_at = CURRENT_TIMESTAMP
-                 WHERE warehouse_id = $2 AND product_id = $3`,
-				stockDiff, productReq.WarehouseID, id)
-			if err != nil {
-				return err
-			}
+		if err := shiftStock(tx, productReq.WarehouseID, id, stockDiff); err != nil {
+			return err
 		}
 	}
 
 	return tx.Commit(context.Background())
 }
 
-func (r *productRepo) DeleteProduct(id int) error {
-	// Begin transaction for cascading delete
-	tx, err := db.Pool.Begin(context.Background())
+// shiftStock adds delta to the stock of a product in a warehouse, but never
+// takes it below what orders have reserved. A missing stock row is left
+// alone.
+func shiftStock(tx pgx.Tx, warehouseID, productID, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	result, err := tx.Exec(context.Background(),
+		`UPDATE warehouse_stocks SET quantity = quantity + $1, updated_at = CURRENT_TIMESTAMP
+         WHERE warehouse_id = $2 AND product_id = $3 AND quantity + $1 >= reserved_quantity`,
+		delta, warehouseID, productID)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback(context.Background())
+	if result.RowsAffected() > 0 {
+		return nil
+	}
 
-	// First, get all order IDs that contain this product
-	orderRows, err := tx.Query(context.Background(),
-		"SELECT DISTINCT order_id FROM order_items WHERE product_id = $1", id)
+	var available int
+	err = tx.QueryRow(context.Background(),
+		`SELECT quantity - reserved_quantity FROM warehouse_stocks
+         WHERE warehouse_id = $1 AND product_id = $2`,
+		warehouseID, productID).Scan(&available)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	defer orderRows.Close()
-
-	var orderIDs []int
-	for orderRows.Next() {
-		var orderID int
-		err := orderRows.Scan(&orderID)
-		if err != nil {
-			return err
-		}
-		orderIDs = append(orderIDs, orderID)
+	return &InsufficientWarehouseStockError{
+		ProductID:      productID,
+		WarehouseID:    warehouseID,
+		RequiredStock:  -delta,
+		AvailableStock: available,
 	}
+}
 
-	// Delete order items for this product
-	_, err = tx.Exec(context.Background(),
-		"DELETE FROM order_items WHERE product_id = $1", id)
+func (r *productRepo) DeleteProduct(id int) error {
+	tx, err := r.q.Begin(context.Background())
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(context.Background())
 
-	// Delete orders that now have no items left
-	for _, orderID := range orderIDs {
-		var remainingItems int
-		err = tx.QueryRow(context.Background(),
-			"SELECT COUNT(*) FROM order_items WHERE order_id = $1", orderID).Scan(&remainingItems)
-		if err != nil {
-			return err
-		}
+	// Locking the product keeps orders from taking it up meanwhile
+	var exists int
+	err = tx.QueryRow(context.Background(),
+		"SELECT id FROM products WHERE id = $1 FOR UPDATE", id).Scan(&exists)
+	if err != nil {
+		return err
+	}
 
-		// If no items left in the order, delete the order
-		if remainingItems == 0 {
-			_, err = tx.Exec(context.Background(),
-				"DELETE FROM orders WHERE id = $1", orderID)
-			if err != nil {
-				return err
-			}
-		}
+	// Order lines keep what was charged for the product, so products that
+	// were ever ordered stay
+	var ordered bool
+	err = tx.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM order_items WHERE product_id = $1)", id).Scan(&ordered)
+	if err != nil {
+		return err
+	}
+	if ordered {
+		return &ProductInUseError{ProductID: id}
 	}
 
-	// Delete warehouse stocks
 	_, err = tx.Exec(context.Background(),
 		"DELETE FROM warehouse_stocks WHERE product_id = $1", id)
 	if err != nil {
 		return err
 	}
-
-	// Finally, delete the product
-	result, err := tx.Exec(context.Background(),
+	_, err = tx.Exec(context.Background(),
 		"DELETE FROM products WHERE id = $1", id)
 	if err != nil {
 		return err
 	}
 
-	rowsAffected := result.RowsAffected()
-	if rowsAffected == 0 {
-		return pgx.ErrNoRows
-	}
-
-	// Commit the transaction
 	return tx.Commit(context.Background())
 }
 
 func (r *productRepo) CheckWarehouseStock(productID, quantity int) (*models.WarehouseStock, error) {
-	// Önce ürünün hangi warehouse'larda stoku olduğunu kontrol et
-	rows, err := db.Pool.Query(context.Background(),
+	// Find the warehouse with the most available units of the product
+	rows, err := r.q.Query(context.Background(),
 		`SELECT ws.id, ws.warehouse_id, ws.product_id, ws.quantity, ws.reserved_quantity,
                 ws.created_at, ws.updated_at, w.name, p.name, p.price
          FROM warehouse_stocks ws
          JOIN warehouses w ON ws.warehouse_id = w.id
          JOIN products p ON ws.product_id = p.id
-         WHERE ws.product_id = $1 AND ws.quantity >= $2
-         ORDER BY ws.quantity DESC
-         LIMIT 1`,
+         WHERE ws.product_id = $1 AND ws.quantity - ws.reserved_quantity >= $2
+         ORDER BY ws.quantity - ws.reserved_quantity DESC
+         LIMIT 1
+         FOR UPDATE OF ws`,
 		productID, quantity)
 	if err != nil {
 		return nil, err
@@ -273,9 +293,9 @@ func (r *productRepo) CheckWarehouseStock(productID, quantity int) (*models.Ware
 	defer rows.Close()
 
 	if !rows.Next() {
-		// Hiçbir warehouse'da yeterli stok yok, tüm stokları kontrol et
+		// No warehouse has enough stock, report what all of them hold
 		var totalStock, totalAvailable int
-		err = db.Pool.QueryRow(context.Background(),
+		err = r.q.QueryRow(context.Background(),
 			`SELECT COALESCE(SUM(quantity), 0), COALESCE(SUM(quantity - reserved_quantity), 0)
              FROM warehouse_stocks WHERE product_id = $1`,
 			productID).Scan(&totalStock, &totalAvailable)
@@ -316,44 +336,52 @@ func (r *productRepo) CheckWarehouseStock(productID, quantity int) (*models.Ware
 
 func (r *productRepo) UpdateWarehouseStock(productID, quantity int, operation string) error {
 	// Begin transaction
-	tx, err := db.Pool.Begin(context.Background())
+	tx, err := r.q.Begin(context.Background())
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(context.Background())
 
-	var updateQuery string
-	var productUpdateQuery string
-
 	switch operation {
 	case "decrease":
-		// Önce hangi warehouse'dan düşeceğimizi belirle (en fazla stoku olan)
+		// Take the units from the warehouse with the most available stock.
+		// The row is locked, so a concurrent order cannot take the same
+		// units before the update below
 		var warehouseID int
 		err = tx.QueryRow(context.Background(),
 			`SELECT warehouse_id FROM warehouse_stocks 
-             WHERE product_id = $1 AND quantity >= $2 
-             ORDER BY quantity DESC LIMIT 1`,
+             WHERE product_id = $1 AND quantity - reserved_quantity >= $2 
+             ORDER BY quantity - reserved_quantity DESC LIMIT 1
+             FOR UPDATE`,
 			productID, quantity).Scan(&warehouseID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return &InsufficientWarehouseStockError{ProductID: productID, RequiredStock: quantity}
+		}
 		if err != nil {
 			return err
 		}
 
-		updateQuery = `UPDATE warehouse_stocks SET quantity = quantity - $1, updated_at = CURRENT_TIMESTAMP 
-                       WHERE product_id = $2 AND warehouse_id = $3`
-		_, err = tx.Exec(context.Background(), updateQuery, quantity, productID, warehouseID)
+		_, err = tx.Exec(context.Background(),
+			`UPDATE warehouse_stocks SET quantity = quantity - $1, updated_at = CURRENT_TIMESTAMP 
+             WHERE product_id = $2 AND warehouse_id = $3`,
+			quantity, productID, warehouseID)
+		if err != nil {
+			return err
+		}
 
-		// Products tablosunu da güncelle
-		productUpdateQuery = "UPDATE products SET stock = stock - $1 WHERE id = $2"
-		_, err = tx.Exec(context.Background(), productUpdateQuery, quantity, productID)
+		// Keep the stock column of products in step
+		_, err = tx.Exec(context.Background(),
+			"UPDATE products SET stock = stock - $1 WHERE id = $2", quantity, productID)
 
 	case "increase":
-		// Ürünün ana warehouse'ını bul
+		// Find the product's home warehouse
 		var warehouseID int
 		err = tx.QueryRow(context.Background(),
 			`SELECT warehouse_id FROM products WHERE id = $1`,
 			productID).Scan(&warehouseID)
 		if err != nil {
-			// Eğer products tablosunda warehouse_id yoksa, ilk bulduğu warehouse'ı kullan
+			// Without a warehouse_id on the product, use the first warehouse
+			// stocking it
 			err = tx.QueryRow(context.Background(),
 				`SELECT warehouse_id FROM warehouse_stocks WHERE product_id = $1 LIMIT 1`,
 				productID).Scan(&warehouseID)
@@ -362,13 +390,17 @@ func (r *productRepo) UpdateWarehouseStock(productID, quantity int, operation st
 			}
 		}
 
-		updateQuery = `UPDATE warehouse_stocks SET quantity = quantity + $1, updated_at = CURRENT_TIMESTAMP 
-                       WHERE product_id = $2 AND warehouse_id = $3`
-		_, err = tx.Exec(context.Background(), updateQuery, quantity, productID, warehouseID)
+		_, err = tx.Exec(context.Background(),
+			`UPDATE warehouse_stocks SET quantity = quantity + $1, updated_at = CURRENT_TIMESTAMP 
+             WHERE product_id = $2 AND warehouse_id = $3`,
+			quantity, productID, warehouseID)
+		if err != nil {
+			return err
+		}
 
-		// Products tablosunu da güncelle
-		productUpdateQuery = "UPDATE products SET stock = stock + $1 WHERE id = $2"
-		_, err = tx.Exec(context.Background(), productUpdateQuery, quantity, productID)
+		// Keep the stock column of products in step
+		_, err = tx.Exec(context.Background(),
+			"UPDATE products SET stock = stock + $1 WHERE id = $2", quantity, productID)
 
 	default:
 		return &InvalidOperationError{Operation: operation}
@@ -381,6 +413,77 @@ func (r *productRepo) UpdateWarehouseStock(productID, quantity int, operation st
 	return tx.Commit(context.Background())
 }
 
+func (r *productRepo) AdjustWarehouseStock(warehouseID, productID, quantity, reserved int) error {
+	return db.InTx(context.Background(), r.q, func(tx pgx.Tx) error {
+		result, err := tx.Exec(context.Background(),
+			`UPDATE warehouse_stocks
+             SET quantity = quantity + $3, reserved_quantity = reserved_quantity + $4,
+                 updated_at = CURRENT_TIMESTAMP
+             WHERE warehouse_id = $1 AND product_id = $2
+               AND reserved_quantity + $4 >= 0 AND quantity + $3 >= reserved_quantity + $4`,
+			warehouseID, productID, quantity, reserved)
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			var available int
+			err := tx.QueryRow(context.Background(),
+				`SELECT quantity - reserved_quantity FROM warehouse_stocks
+                 WHERE warehouse_id = $1 AND product_id = $2`,
+				warehouseID, productID).Scan(&available)
+			if err != nil {
+				return err
+			}
+			return &InsufficientWarehouseStockError{
+				ProductID:      productID,
+				WarehouseID:    warehouseID,
+				RequiredStock:  max(reserved, -quantity),
+				AvailableStock: available,
+			}
+		}
+
+		if quantity == 0 {
+			return nil
+		}
+		_, err = tx.Exec(context.Background(),
+			"UPDATE products SET stock = stock + $1 WHERE id = $2", quantity, productID)
+		return err
+	})
+}
+
+func (r *productRepo) LockAvailableStock(productIDs []int) ([]allocation.Stock, error) {
+	// Rows are locked in product order, as on confirmation, so concurrent
+	// orders cannot deadlock
+	rows, err := r.q.Query(context.Background(),
+		`SELECT ws.warehouse_id, ws.product_id, ws.quantity - ws.reserved_quantity, ws.created_at,
+                w.latitude, w.longitude
+         FROM warehouse_stocks ws
+         JOIN warehouses w ON ws.warehouse_id = w.id
+         WHERE ws.product_id = ANY($1) AND w.is_active AND ws.quantity > ws.reserved_quantity
+         ORDER BY ws.product_id, ws.warehouse_id
+         FOR UPDATE OF ws`,
+		productIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stocks []allocation.Stock
+	for rows.Next() {
+		var stock allocation.Stock
+		var latitude, longitude *float64
+		err := rows.Scan(&stock.WarehouseID, &stock.ProductID, &stock.Available, &stock.Since,
+			&latitude, &longitude)
+		if err != nil {
+			return nil, err
+		}
+		stock.Location = locationOf(latitude, longitude)
+		stocks = append(stocks, stock)
+	}
+
+	return stocks, rows.Err()
+}
+
 // Custom error types
 type InsufficientWarehouseStockError struct {
 	ProductID      int
@@ -393,6 +496,14 @@ func (e *InsufficientWarehouseStockError) Error() string {
 	return "insufficient warehouse stock"
 }
 
+type ProductInUseError struct {
+	ProductID int
+}
+
+func (e *ProductInUseError) Error() string {
+	return "product is part of orders and cannot be deleted"
+}
+
 type InvalidOperationError struct {
 	Operation string
 }
@@ -0,0 +1,1961 @@
+package repotest
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slmbngl/OrderAplication/internal/allocation"
+	"github.com/slmbngl/OrderAplication/internal/app"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+// Run executes the repository contract against the given implementation
+func Run(t *testing.T, newRepos Factory) {
+	t.Run("Users", func(t *testing.T) { runUserContract(t, newRepos) })
+	t.Run("Sessions", func(t *testing.T) { runSessionContract(t, newRepos) })
+	t.Run("Denylist", func(t *testing.T) { runDenylistContract(t, newRepos) })
+	t.Run("Invitations", func(t *testing.T) { runInvitationContract(t, newRepos) })
+	t.Run("Roles", func(t *testing.T) { runRoleContract(t, newRepos) })
+	t.Run("LoginAttempts", func(t *testing.T) { runLoginAttemptContract(t, newRepos) })
+	t.Run("Audit", func(t *testing.T) { runAuditContract(t, newRepos) })
+	t.Run("MFA", func(t *testing.T) { runMFAContract(t, newRepos) })
+	t.Run("PasswordResets", func(t *testing.T) { runPasswordResetContract(t, newRepos) })
+	t.Run("APIKeys", func(t *testing.T) { runAPIKeyContract(t, newRepos) })
+	t.Run("Warehouses", func(t *testing.T) { runWarehouseContract(t, newRepos) })
+	t.Run("Transfers", func(t *testing.T) { runTransferContract(t, newRepos) })
+	t.Run("Products", func(t *testing.T) { runProductContract(t, newRepos) })
+	t.Run("Orders", func(t *testing.T) { runOrderContract(t, newRepos) })
+}
+
+func runUserContract(t *testing.T, newRepos Factory) {
+	t.Run("CreateAndGet", func(t *testing.T) {
+		repos := newRepos(t)
+		created := SeedUser(t, repos, "alice", "admin")
+
+		byName, err := repos.Users.GetByUsername("alice")
+		mustNoError(t, err)
+		if byName.ID != created.ID || byName.Role != "admin" || !byName.IsActive {
+			t.Fatalf("GetByUsername = %+v, want id %d role admin active", byName, created.ID)
+		}
+		if byName.PasswordHash != "hash" {
+			t.Fatalf("GetByUsername password hash = %q, want %q", byName.PasswordHash, "hash")
+		}
+
+		byID, err := repos.Users.GetByID(created.ID)
+		mustNoError(t, err)
+		if byID.Username != "alice" || byID.Role != "admin" {
+			t.Fatalf("GetByID = %+v, want alice/admin", byID)
+		}
+	})
+
+	t.Run("DuplicateUsername", func(t *testing.T) {
+		repos := newRepos(t)
+		SeedUser(t, repos, "alice", "customer")
+
+		_, err := repos.Users.Create(&models.User{Username: "alice", PasswordHash: "x", IsActive: true, Role: "customer"})
+		if err == nil {
+			t.Fatal("creating a duplicate username succeeded")
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		repos := newRepos(t)
+
+		_, err := repos.Users.GetByUsername("nobody")
+		mustBeNoRows(t, err)
+		_, err = repos.Users.GetByID(404)
+		mustBeNoRows(t, err)
+
+		var notFound *repository.UserNotFoundError
+		if err := repos.Users.UpdateUserRole(404, "admin"); !errors.As(err, &notFound) {
+			t.Fatalf("UpdateUserRole on missing user = %v, want *UserNotFoundError", err)
+		}
+		if err := repos.Users.UpdatePasswordHash(404, "hash"); !errors.As(err, &notFound) {
+			t.Fatalf("UpdatePasswordHash on missing user = %v, want *UserNotFoundError", err)
+		}
+	})
+
+	t.Run("ListAndUpdateRole", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+		SeedUser(t, repos, "bob", "customer")
+
+		mustNoError(t, repos.Users.UpdateUserRole(alice.ID, "admin"))
+
+		users, err := repos.Users.GetAllUsers()
+		mustNoError(t, err)
+		if len(users) != 2 {
+			t.Fatalf("GetAllUsers returned %d users, want 2", len(users))
+		}
+		if users[0].Username != "bob" {
+			t.Fatalf("GetAllUsers first user = %q, want newest (bob)", users[0].Username)
+		}
+		for _, u := range users {
+			if u.PasswordHash != "" {
+				t.Fatalf("GetAllUsers leaked password hash for %s", u.Username)
+			}
+			if u.Username == "alice" && u.Role != "admin" {
+				t.Fatalf("alice role = %q, want admin", u.Role)
+			}
+		}
+	})
+
+	t.Run("UpdatePasswordHash", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+
+		mustNoError(t, repos.Users.UpdatePasswordHash(alice.ID, "new-hash"))
+
+		user, err := repos.Users.GetByUsername("alice")
+		mustNoError(t, err)
+		if user.PasswordHash != "new-hash" {
+			t.Fatalf("password hash = %q, want new-hash", user.PasswordHash)
+		}
+	})
+
+	t.Run("SetActive", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+
+		mustNoError(t, repos.Users.SetActive(alice.ID, false))
+		user, err := repos.Users.GetByUsername("alice")
+		mustNoError(t, err)
+		if user.IsActive {
+			t.Fatal("user still active after SetActive(false)")
+		}
+
+		mustNoError(t, repos.Users.SetActive(alice.ID, true))
+		user, err = repos.Users.GetByUsername("alice")
+		mustNoError(t, err)
+		if !user.IsActive {
+			t.Fatal("user inactive after SetActive(true)")
+		}
+
+		var notFound *repository.UserNotFoundError
+		if err := repos.Users.SetActive(alice.ID+1000, false); !errors.As(err, &notFound) {
+			t.Fatalf("SetActive of unknown user = %v, want *UserNotFoundError", err)
+		}
+	})
+
+	t.Run("SearchUsers", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+		SeedUser(t, repos, "alicia", "customer")
+		SeedUser(t, repos, "bob", "warehouse_clerk")
+		SeedUser(t, repos, "al_x", "customer")
+		mustNoError(t, repos.Users.SetActive(alice.ID, false))
+
+		users, total, err := repos.Users.SearchUsers(models.UserFilter{Limit: 10})
+		mustNoError(t, err)
+		if total != 4 || len(users) != 4 {
+			t.Fatalf("SearchUsers returned %d of %d users, want 4 of 4", len(users), total)
+		}
+		if users[0].Username != "al_x" {
+			t.Fatalf("SearchUsers first user = %q, want newest (al_x)", users[0].Username)
+		}
+		if users[0].PasswordHash != "" {
+			t.Fatal("SearchUsers leaked password hash")
+		}
+
+		users, total, err = repos.Users.SearchUsers(models.UserFilter{Username: "ALI", Limit: 10})
+		mustNoError(t, err)
+		if total != 2 || len(users) != 2 {
+			t.Fatalf("username filter returned %d of %d users, want 2 of 2", len(users), total)
+		}
+		// Wildcards in the filter match literally
+		_, total, err = repos.Users.SearchUsers(models.UserFilter{Username: "l_", Limit: 10})
+		mustNoError(t, err)
+		if total != 1 {
+			t.Fatalf("username filter l_ matched %d users, want 1", total)
+		}
+
+		inactive := false
+		users, total, err = repos.Users.SearchUsers(models.UserFilter{Role: "customer", IsActive: &inactive, Limit: 10})
+		mustNoError(t, err)
+		if total != 1 || users[0].ID != alice.ID {
+			t.Fatalf("role and active filter returned %+v, want only alice", users)
+		}
+
+		users, total, err = repos.Users.SearchUsers(models.UserFilter{Limit: 3, Offset: 3})
+		mustNoError(t, err)
+		if total != 4 || len(users) != 1 || users[0].ID != alice.ID {
+			t.Fatalf("second page returned %d of %d users, want alice of 4", len(users), total)
+		}
+
+		future := time.Now().Add(time.Hour)
+		_, total, err = repos.Users.SearchUsers(models.UserFilter{CreatedFrom: &future, Limit: 10})
+		mustNoError(t, err)
+		if total != 0 {
+			t.Fatalf("created_from in the future matched %d users, want 0", total)
+		}
+		_, total, err = repos.Users.SearchUsers(models.UserFilter{CreatedTo: &future, Limit: 10})
+		mustNoError(t, err)
+		if total != 4 {
+			t.Fatalf("created_to in the future matched %d users, want 4", total)
+		}
+	})
+
+	t.Run("SoftDelete", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+		SeedUser(t, repos, "bob", "customer")
+
+		mustNoError(t, repos.Users.SoftDelete(alice.ID, time.Now()))
+
+		user, err := repos.Users.GetByUsername("alice")
+		mustNoError(t, err)
+		if user.DeletedAt == nil || user.IsActive {
+			t.Fatalf("deleted user = %+v, want deleted_at set and inactive", user)
+		}
+
+		users, total, err := repos.Users.SearchUsers(models.UserFilter{Limit: 10})
+		mustNoError(t, err)
+		if total != 1 || users[0].Username != "bob" {
+			t.Fatalf("SearchUsers returned %+v, want only bob", users)
+		}
+		_, total, err = repos.Users.SearchUsers(models.UserFilter{IncludeDeleted: true, Limit: 10})
+		mustNoError(t, err)
+		if total != 2 {
+			t.Fatalf("SearchUsers with deleted users matched %d, want 2", total)
+		}
+
+		var notFound *repository.UserNotFoundError
+		if err := repos.Users.SoftDelete(alice.ID, time.Now()); !errors.As(err, &notFound) {
+			t.Fatalf("second SoftDelete = %v, want *UserNotFoundError", err)
+		}
+		if err := repos.Users.SoftDelete(alice.ID+1000, time.Now()); !errors.As(err, &notFound) {
+			t.Fatalf("SoftDelete of unknown user = %v, want *UserNotFoundError", err)
+		}
+	})
+
+	t.Run("TokenVersion", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+
+		version, err := repos.Users.GetTokenVersion(alice.ID)
+		mustNoError(t, err)
+		if version != 0 {
+			t.Fatalf("token version of a new user = %d, want 0", version)
+		}
+
+		mustNoError(t, repos.Users.IncrementTokenVersion(alice.ID))
+		mustNoError(t, repos.Users.IncrementTokenVersion(alice.ID))
+		version, err = repos.Users.GetTokenVersion(alice.ID)
+		mustNoError(t, err)
+		if version != 2 {
+			t.Fatalf("token version = %d, want 2", version)
+		}
+		user, err := repos.Users.GetByUsername("alice")
+		mustNoError(t, err)
+		if user.TokenVersion != 2 {
+			t.Fatalf("GetByUsername token version = %d, want 2", user.TokenVersion)
+		}
+
+		_, err = repos.Users.GetTokenVersion(404)
+		mustBeNoRows(t, err)
+		var notFound *repository.UserNotFoundError
+		if err := repos.Users.IncrementTokenVersion(404); !errors.As(err, &notFound) {
+			t.Fatalf("IncrementTokenVersion on missing user = %v, want *UserNotFoundError", err)
+		}
+	})
+
+	t.Run("RefreshTokens", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+		expiresAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+
+		first := &repository.RefreshToken{UserID: alice.ID, TokenHash: "hash-1", FamilyID: "family-1", ExpiresAt: expiresAt}
+		mustNoError(t, repos.Users.SaveRefreshToken(first))
+		if first.ID == 0 || first.CreatedAt.IsZero() {
+			t.Fatalf("SaveRefreshToken did not set id and created_at: %+v", first)
+		}
+		mustNoError(t, repos.Users.SaveRefreshToken(&repository.RefreshToken{
+			UserID: alice.ID, TokenHash: "hash-2", FamilyID: "family-1", ExpiresAt: expiresAt,
+		}))
+		mustNoError(t, repos.Users.SaveRefreshToken(&repository.RefreshToken{
+			UserID: alice.ID, TokenHash: "hash-3", FamilyID: "family-2", ExpiresAt: expiresAt,
+		}))
+
+		rt, err := repos.Users.GetRefreshToken("hash-1")
+		mustNoError(t, err)
+		if rt.UserID != alice.ID || rt.FamilyID != "family-1" || !rt.ExpiresAt.Equal(expiresAt) {
+			t.Fatalf("GetRefreshToken = %+v, want user %d family-1 expiring %v", rt, alice.ID, expiresAt)
+		}
+		if rt.UsedAt != nil || rt.RevokedAt != nil {
+			t.Fatalf("new refresh token is already used or revoked: %+v", rt)
+		}
+		_, err = repos.Users.GetRefreshToken("missing")
+		mustBeNoRows(t, err)
+
+		// A token can be used exactly once
+		now := time.Now().UTC().Truncate(time.Second)
+		mustNoError(t, repos.Users.MarkRefreshTokenUsed("hash-1", now))
+		var used *repository.RefreshTokenUsedError
+		if err := repos.Users.MarkRefreshTokenUsed("hash-1", now); !errors.As(err, &used) {
+			t.Fatalf("second MarkRefreshTokenUsed = %v, want *RefreshTokenUsedError", err)
+		}
+		rt, err = repos.Users.GetRefreshToken("hash-1")
+		mustNoError(t, err)
+		if rt.UsedAt == nil {
+			t.Fatal("used refresh token has no used_at")
+		}
+
+		// Revoking a family leaves other families alone
+		mustNoError(t, repos.Users.RevokeRefreshTokenFamily("family-1", now))
+		rt, err = repos.Users.GetRefreshToken("hash-2")
+		mustNoError(t, err)
+		if rt.RevokedAt == nil {
+			t.Fatal("token of revoked family has no revoked_at")
+		}
+		if err := repos.Users.MarkRefreshTokenUsed("hash-2", now); !errors.As(err, &used) {
+			t.Fatalf("MarkRefreshTokenUsed on revoked token = %v, want *RefreshTokenUsedError", err)
+		}
+		rt, err = repos.Users.GetRefreshToken("hash-3")
+		mustNoError(t, err)
+		if rt.RevokedAt != nil {
+			t.Fatal("token of another family was revoked")
+		}
+
+		mustNoError(t, repos.Users.DeleteUserRefreshTokens(alice.ID))
+		_, err = repos.Users.GetRefreshToken("hash-3")
+		mustBeNoRows(t, err)
+	})
+
+	t.Run("ExpiredRefreshTokens", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+		now := time.Now().UTC().Truncate(time.Second)
+
+		mustNoError(t, repos.Users.SaveRefreshToken(&repository.RefreshToken{
+			UserID: alice.ID, TokenHash: "expired", FamilyID: "family-1", ExpiresAt: now.Add(-time.Minute),
+		}))
+		mustNoError(t, repos.Users.SaveRefreshToken(&repository.RefreshToken{
+			UserID: alice.ID, TokenHash: "valid", FamilyID: "family-1", ExpiresAt: now.Add(time.Hour),
+		}))
+
+		deleted, err := repos.Users.DeleteExpiredRefreshTokens(now)
+		mustNoError(t, err)
+		if deleted != 1 {
+			t.Fatalf("DeleteExpiredRefreshTokens deleted %d tokens, want 1", deleted)
+		}
+		_, err = repos.Users.GetRefreshToken("expired")
+		mustBeNoRows(t, err)
+		_, err = repos.Users.GetRefreshToken("valid")
+		mustNoError(t, err)
+	})
+}
+
+func runSessionContract(t *testing.T, newRepos Factory) {
+	t.Run("CreateGetTouch", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+		now := time.Now().UTC().Truncate(time.Second)
+
+		mustNoError(t, repos.Sessions.CreateSession(&models.Session{
+			ID: "session-1", UserID: alice.ID, UserAgent: "curl/8.0", IPAddress: "10.0.0.1",
+			DeviceLabel: "laptop", CreatedAt: now, LastUsedAt: now,
+		}))
+		session, err := repos.Sessions.GetSession("session-1")
+		mustNoError(t, err)
+		if session.UserID != alice.ID || session.DeviceLabel != "laptop" || session.IPAddress != "10.0.0.1" {
+			t.Fatalf("GetSession = %+v", session)
+		}
+		_, err = repos.Sessions.GetSession("missing")
+		mustBeNoRows(t, err)
+
+		later := now.Add(time.Minute)
+		mustNoError(t, repos.Sessions.TouchSession("session-1", later, "Firefox", "10.0.0.2"))
+		session, err = repos.Sessions.GetSession("session-1")
+		mustNoError(t, err)
+		if !session.LastUsedAt.Equal(later) || session.UserAgent != "Firefox" || session.IPAddress != "10.0.0.2" {
+			t.Fatalf("touched session = %+v", session)
+		}
+		if !session.CreatedAt.Equal(now) || session.DeviceLabel != "laptop" {
+			t.Fatalf("TouchSession changed created_at or label: %+v", session)
+		}
+	})
+
+	t.Run("ActiveSessions", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+		bob := SeedUser(t, repos, "bob", "customer")
+		now := time.Now().UTC().Truncate(time.Second)
+
+		seed := func(id string, userID int, lastUsedAt time.Time, token *repository.RefreshToken) {
+			t.Helper()
+			mustNoError(t, repos.Sessions.CreateSession(&models.Session{
+				ID: id, UserID: userID, CreatedAt: now, LastUsedAt: lastUsedAt,
+			}))
+			token.UserID = userID
+			token.FamilyID = id
+			mustNoError(t, repos.Users.SaveRefreshToken(token))
+		}
+		seed("older", alice.ID, now.Add(-time.Hour), &repository.RefreshToken{TokenHash: "older", ExpiresAt: now.Add(time.Hour)})
+		seed("newer", alice.ID, now, &repository.RefreshToken{TokenHash: "newer", ExpiresAt: now.Add(2 * time.Hour)})
+		seed("expired", alice.ID, now, &repository.RefreshToken{TokenHash: "expired", ExpiresAt: now.Add(-time.Minute)})
+		seed("revoked", alice.ID, now, &repository.RefreshToken{TokenHash: "revoked", ExpiresAt: now.Add(time.Hour)})
+		seed("bobs", bob.ID, now, &repository.RefreshToken{TokenHash: "bobs", ExpiresAt: now.Add(time.Hour)})
+		mustNoError(t, repos.Users.RevokeRefreshTokenFamily("revoked", now))
+
+		// A used token does not count, but its successor does
+		mustNoError(t, repos.Users.MarkRefreshTokenUsed("newer", now))
+		mustNoError(t, repos.Users.SaveRefreshToken(&repository.RefreshToken{
+			UserID: alice.ID, TokenHash: "newer-2", FamilyID: "newer", ExpiresAt: now.Add(3 * time.Hour),
+		}))
+
+		sessions, err := repos.Sessions.GetActiveSessions(alice.ID, now)
+		mustNoError(t, err)
+		if len(sessions) != 2 || sessions[0].ID != "newer" || sessions[1].ID != "older" {
+			t.Fatalf("GetActiveSessions = %+v, want newer and older", sessions)
+		}
+		if !sessions[0].ExpiresAt.Equal(now.Add(3 * time.Hour)) {
+			t.Fatalf("session expires at %v, want expiry of its newest token", sessions[0].ExpiresAt)
+		}
+
+		sessions, err = repos.Sessions.GetActiveSessions(SeedUser(t, repos, "carol", "customer").ID, now)
+		mustNoError(t, err)
+		if sessions == nil || len(sessions) != 0 {
+			t.Fatalf("GetActiveSessions without sessions = %#v, want empty slice", sessions)
+		}
+	})
+
+	t.Run("DeleteOrphanedSessions", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+		now := time.Now().UTC().Truncate(time.Second)
+
+		for _, id := range []string{"kept", "orphaned"} {
+			mustNoError(t, repos.Sessions.CreateSession(&models.Session{
+				ID: id, UserID: alice.ID, CreatedAt: now, LastUsedAt: now,
+			}))
+		}
+		mustNoError(t, repos.Users.SaveRefreshToken(&repository.RefreshToken{
+			UserID: alice.ID, TokenHash: "kept", FamilyID: "kept", ExpiresAt: now.Add(time.Hour),
+		}))
+
+		deleted, err := repos.Sessions.DeleteOrphanedSessions()
+		mustNoError(t, err)
+		if deleted != 1 {
+			t.Fatalf("DeleteOrphanedSessions deleted %d sessions, want 1", deleted)
+		}
+		_, err = repos.Sessions.GetSession("orphaned")
+		mustBeNoRows(t, err)
+		_, err = repos.Sessions.GetSession("kept")
+		mustNoError(t, err)
+	})
+}
+
+func runDenylistContract(t *testing.T, newRepos Factory) {
+	repos := newRepos(t)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	mustNoError(t, repos.Denylist.Deny("active", now.Add(time.Minute)))
+	mustNoError(t, repos.Denylist.Deny("active", now.Add(time.Minute)))
+	mustNoError(t, repos.Denylist.Deny("expired", now.Add(-time.Minute)))
+
+	for jti, want := range map[string]bool{"active": true, "expired": false, "unknown": false} {
+		denied, err := repos.Denylist.IsDenied([]string{jti}, now)
+		mustNoError(t, err)
+		if denied != want {
+			t.Fatalf("IsDenied(%q) = %v, want %v", jti, denied, want)
+		}
+	}
+	denied, err := repos.Denylist.IsDenied([]string{"unknown", "active"}, now)
+	mustNoError(t, err)
+	if !denied {
+		t.Fatal("IsDenied of several ids ignored the denied one")
+	}
+
+	deleted, err := repos.Denylist.DeleteExpired(now)
+	mustNoError(t, err)
+	if deleted != 1 {
+		t.Fatalf("DeleteExpired deleted %d entries, want 1", deleted)
+	}
+	denied, err = repos.Denylist.IsDenied([]string{"active"}, now)
+	mustNoError(t, err)
+	if !denied {
+		t.Fatal("DeleteExpired removed an entry that has not expired")
+	}
+
+	// Denying an id again keeps the later expiry
+	mustNoError(t, repos.Denylist.Deny("active", now.Add(-time.Minute)))
+	mustNoError(t, repos.Denylist.Deny("session", now.Add(time.Minute)))
+	mustNoError(t, repos.Denylist.Deny("session", now.Add(time.Hour)))
+	for id, at := range map[string]time.Time{"active": now, "session": now.Add(30 * time.Minute)} {
+		denied, err := repos.Denylist.IsDenied([]string{id}, at)
+		mustNoError(t, err)
+		if !denied {
+			t.Fatalf("IsDenied(%q) after denying it again = false, want true", id)
+		}
+	}
+}
+
+func runInvitationContract(t *testing.T, newRepos Factory) {
+	t.Run("CreateClaimRelease", func(t *testing.T) {
+		repos := newRepos(t)
+		admin := SeedUser(t, repos, "admin", "admin")
+		now := time.Now().UTC().Truncate(time.Second)
+
+		inv := &models.Invitation{CodeHash: "hash-1", Role: "admin", CreatedBy: &admin.ID, ExpiresAt: now.Add(time.Hour)}
+		mustNoError(t, repos.Invitations.CreateInvitation(inv))
+		if inv.ID == 0 || inv.CreatedAt.IsZero() {
+			t.Fatalf("CreateInvitation did not set id and created_at: %+v", inv)
+		}
+		if err := repos.Invitations.CreateInvitation(&models.Invitation{
+			CodeHash: "hash-1", Role: "customer", ExpiresAt: now.Add(time.Hour),
+		}); err == nil {
+			t.Fatal("CreateInvitation accepted a duplicate code hash")
+		}
+
+		got, err := repos.Invitations.GetInvitationByCodeHash("hash-1")
+		mustNoError(t, err)
+		if got.ID != inv.ID || got.Role != "admin" || got.CreatedBy == nil || *got.CreatedBy != admin.ID || got.UsedAt != nil {
+			t.Fatalf("GetInvitationByCodeHash = %+v", got)
+		}
+		_, err = repos.Invitations.GetInvitationByCodeHash("missing")
+		mustBeNoRows(t, err)
+
+		// An invitation can be claimed once, until it is released again
+		var claimed *repository.InvitationClaimedError
+		mustNoError(t, repos.Invitations.ClaimInvitation(inv.ID, "alice", now))
+		if err := repos.Invitations.ClaimInvitation(inv.ID, "bob", now); !errors.As(err, &claimed) {
+			t.Fatalf("second ClaimInvitation = %v, want *InvitationClaimedError", err)
+		}
+		got, err = repos.Invitations.GetInvitationByCodeHash("hash-1")
+		mustNoError(t, err)
+		if got.UsedAt == nil || got.UsedBy == nil || *got.UsedBy != "alice" {
+			t.Fatalf("claimed invitation = %+v, want used by alice", got)
+		}
+		mustNoError(t, repos.Invitations.ReleaseInvitation(inv.ID))
+		mustNoError(t, repos.Invitations.ClaimInvitation(inv.ID, "bob", now))
+
+		// Expired invitations cannot be claimed
+		expired := &models.Invitation{CodeHash: "hash-2", Role: "customer", ExpiresAt: now.Add(-time.Minute)}
+		mustNoError(t, repos.Invitations.CreateInvitation(expired))
+		if err := repos.Invitations.ClaimInvitation(expired.ID, "carol", now); !errors.As(err, &claimed) {
+			t.Fatalf("ClaimInvitation on expired invitation = %v, want *InvitationClaimedError", err)
+		}
+	})
+
+	t.Run("ListAndDelete", func(t *testing.T) {
+		repos := newRepos(t)
+		expiresAt := time.Now().UTC().Add(time.Hour)
+
+		first := &models.Invitation{CodeHash: "hash-1", Role: "customer", ExpiresAt: expiresAt}
+		second := &models.Invitation{CodeHash: "hash-2", Role: "admin", ExpiresAt: expiresAt}
+		mustNoError(t, repos.Invitations.CreateInvitation(first))
+		mustNoError(t, repos.Invitations.CreateInvitation(second))
+
+		invitations, err := repos.Invitations.GetInvitations()
+		mustNoError(t, err)
+		if len(invitations) != 2 || invitations[0].ID != second.ID || invitations[1].ID != first.ID {
+			t.Fatalf("GetInvitations = %+v, want newest first", invitations)
+		}
+
+		mustNoError(t, repos.Invitations.DeleteInvitation(first.ID))
+		var notFound *repository.InvitationNotFoundError
+		if err := repos.Invitations.DeleteInvitation(first.ID); !errors.As(err, &notFound) {
+			t.Fatalf("DeleteInvitation on missing invitation = %v, want *InvitationNotFoundError", err)
+		}
+		invitations, err = repos.Invitations.GetInvitations()
+		mustNoError(t, err)
+		if len(invitations) != 1 {
+			t.Fatalf("GetInvitations after delete = %d invitations, want 1", len(invitations))
+		}
+	})
+}
+
+func runRoleContract(t *testing.T, newRepos Factory) {
+	t.Run("Defaults", func(t *testing.T) {
+		repos := newRepos(t)
+
+		permissions, err := repos.Roles.GetPermissions()
+		mustNoError(t, err)
+		if len(permissions) != len(models.Permissions) {
+			t.Fatalf("GetPermissions = %d permissions, want %d", len(permissions), len(models.Permissions))
+		}
+
+		roles, err := repos.Roles.GetRoles()
+		mustNoError(t, err)
+		if len(roles) != len(models.DefaultRoles) {
+			t.Fatalf("GetRoles = %+v, want the default roles", roles)
+		}
+
+		admin, err := repos.Roles.GetRole(models.RoleAdmin)
+		mustNoError(t, err)
+		if len(admin.Permissions) != len(models.Permissions) {
+			t.Fatalf("admin permissions = %v, want all", admin.Permissions)
+		}
+		customer, err := repos.Roles.GetRole(models.RoleCustomer)
+		mustNoError(t, err)
+		if len(customer.Permissions) != 2 || customer.Permissions[0] != models.PermOrdersCreate {
+			t.Fatalf("customer permissions = %v, want sorted orders:create, orders:read", customer.Permissions)
+		}
+		_, err = repos.Roles.GetRole("missing")
+		mustBeNoRows(t, err)
+	})
+
+	t.Run("CreateAndSetPermissions", func(t *testing.T) {
+		repos := newRepos(t)
+
+		auditor := &models.Role{Name: "auditor", Description: "Reads orders", Permissions: []string{models.PermOrdersReadAll}}
+		mustNoError(t, repos.Roles.CreateRole(auditor))
+		if err := repos.Roles.CreateRole(&models.Role{Name: "auditor"}); err == nil {
+			t.Fatal("CreateRole accepted a duplicate name")
+		}
+		if err := repos.Roles.CreateRole(&models.Role{Name: "broken", Permissions: []string{"nope"}}); err == nil {
+			t.Fatal("CreateRole accepted an unknown permission")
+		}
+		_, err := repos.Roles.GetRole("broken")
+		mustBeNoRows(t, err)
+
+		mustNoError(t, repos.Roles.SetRolePermissions("auditor", []string{models.PermUsersRead, models.PermOrdersRead}))
+		got, err := repos.Roles.GetRole("auditor")
+		mustNoError(t, err)
+		if got.Description != "Reads orders" || len(got.Permissions) != 2 ||
+			got.Permissions[0] != models.PermOrdersRead || got.Permissions[1] != models.PermUsersRead {
+			t.Fatalf("GetRole after SetRolePermissions = %+v", got)
+		}
+
+		// A failed update leaves the permissions untouched
+		if err := repos.Roles.SetRolePermissions("auditor", []string{models.PermStockRead, "nope"}); err == nil {
+			t.Fatal("SetRolePermissions accepted an unknown permission")
+		}
+		got, err = repos.Roles.GetRole("auditor")
+		mustNoError(t, err)
+		if len(got.Permissions) != 2 {
+			t.Fatalf("permissions after failed update = %v", got.Permissions)
+		}
+
+		mustNoError(t, repos.Roles.SetRolePermissions("auditor", nil))
+		got, err = repos.Roles.GetRole("auditor")
+		mustNoError(t, err)
+		if len(got.Permissions) != 0 {
+			t.Fatalf("permissions after clearing = %v, want none", got.Permissions)
+		}
+
+		var notFound *repository.RoleNotFoundError
+		if err := repos.Roles.SetRolePermissions("missing", nil); !errors.As(err, &notFound) {
+			t.Fatalf("SetRolePermissions on missing role = %v, want *RoleNotFoundError", err)
+		}
+	})
+
+	t.Run("UserRoles", func(t *testing.T) {
+		repos := newRepos(t)
+
+		if _, err := repos.Users.Create(&models.User{Username: "alice", PasswordHash: "x", IsActive: true, Role: "missing"}); err == nil {
+			t.Fatal("Create accepted an unknown role")
+		}
+		bob, err := repos.Users.Create(&models.User{Username: "bob", PasswordHash: "x", IsActive: true})
+		mustNoError(t, err)
+		if bob.Role != models.RoleCustomer {
+			t.Fatalf("default role = %q, want customer", bob.Role)
+		}
+		if err := repos.Users.UpdateUserRole(bob.ID, "missing"); err == nil {
+			t.Fatal("UpdateUserRole accepted an unknown role")
+		}
+
+		clerk := SeedUser(t, repos, "clerk", "warehouse_clerk")
+		mustNoError(t, repos.Users.IncrementRoleTokenVersions("warehouse_clerk"))
+		version, err := repos.Users.GetTokenVersion(clerk.ID)
+		mustNoError(t, err)
+		if version != 1 {
+			t.Fatalf("clerk token version = %d, want 1", version)
+		}
+		version, err = repos.Users.GetTokenVersion(bob.ID)
+		mustNoError(t, err)
+		if version != 0 {
+			t.Fatalf("customer token version = %d, want 0", version)
+		}
+	})
+}
+
+func runLoginAttemptContract(t *testing.T, newRepos Factory) {
+	t.Run("RecordLockReset", func(t *testing.T) {
+		repos := newRepos(t)
+		now := time.Now().UTC().Truncate(time.Second)
+		resetBefore := now.Add(-time.Hour)
+
+		_, err := repos.LoginAttempts.GetLoginAttempt(models.LoginScopeAccount, "alice")
+		mustBeNoRows(t, err)
+
+		for want := 1; want <= 3; want++ {
+			a, err := repos.LoginAttempts.RecordLoginFailure(models.LoginScopeAccount, "alice", now, resetBefore)
+			mustNoError(t, err)
+			if a.Failures != want || a.LockedUntil != nil {
+				t.Fatalf("RecordLoginFailure #%d = %+v, want %d failures and no lock", want, a, want)
+			}
+		}
+
+		// Counters are kept per scope
+		a, err := repos.LoginAttempts.RecordLoginFailure(models.LoginScopeIP, "alice", now, resetBefore)
+		mustNoError(t, err)
+		if a.Failures != 1 {
+			t.Fatalf("RecordLoginFailure in ip scope = %d failures, want 1", a.Failures)
+		}
+
+		until := now.Add(time.Minute)
+		mustNoError(t, repos.LoginAttempts.LockLoginAttempt(models.LoginScopeAccount, "alice", until))
+		a, err = repos.LoginAttempts.GetLoginAttempt(models.LoginScopeAccount, "alice")
+		mustNoError(t, err)
+		if a.Failures != 3 || a.LockedUntil == nil || !a.LockedUntil.Equal(until) {
+			t.Fatalf("GetLoginAttempt after lock = %+v, want 3 failures locked until %v", a, until)
+		}
+
+		// Failures older than resetBefore start the count over and lift the lock
+		a, err = repos.LoginAttempts.RecordLoginFailure(models.LoginScopeAccount, "alice", now.Add(2*time.Hour), now.Add(time.Hour))
+		mustNoError(t, err)
+		if a.Failures != 1 || a.LockedUntil != nil {
+			t.Fatalf("RecordLoginFailure after reset window = %+v, want 1 failure and no lock", a)
+		}
+
+		mustNoError(t, repos.LoginAttempts.ResetLoginAttempts(models.LoginScopeAccount, "alice"))
+		_, err = repos.LoginAttempts.GetLoginAttempt(models.LoginScopeAccount, "alice")
+		mustBeNoRows(t, err)
+		mustNoError(t, repos.LoginAttempts.ResetLoginAttempts(models.LoginScopeAccount, "alice"))
+		_, err = repos.LoginAttempts.GetLoginAttempt(models.LoginScopeIP, "alice")
+		mustNoError(t, err)
+	})
+
+	t.Run("DeleteStale", func(t *testing.T) {
+		repos := newRepos(t)
+		now := time.Now().UTC().Truncate(time.Second)
+		old := now.Add(-2 * time.Hour)
+
+		_, err := repos.LoginAttempts.RecordLoginFailure(models.LoginScopeAccount, "stale", old, old.Add(-time.Hour))
+		mustNoError(t, err)
+		_, err = repos.LoginAttempts.RecordLoginFailure(models.LoginScopeAccount, "locked", old, old.Add(-time.Hour))
+		mustNoError(t, err)
+		mustNoError(t, repos.LoginAttempts.LockLoginAttempt(models.LoginScopeAccount, "locked", now.Add(time.Hour)))
+		_, err = repos.LoginAttempts.RecordLoginFailure(models.LoginScopeAccount, "recent", now, now.Add(-time.Hour))
+		mustNoError(t, err)
+
+		deleted, err := repos.LoginAttempts.DeleteStaleLoginAttempts(now.Add(-time.Hour))
+		mustNoError(t, err)
+		if deleted != 1 {
+			t.Fatalf("DeleteStaleLoginAttempts = %d, want 1", deleted)
+		}
+		_, err = repos.LoginAttempts.GetLoginAttempt(models.LoginScopeAccount, "stale")
+		mustBeNoRows(t, err)
+		for _, subject := range []string{"locked", "recent"} {
+			_, err = repos.LoginAttempts.GetLoginAttempt(models.LoginScopeAccount, subject)
+			mustNoError(t, err)
+		}
+	})
+}
+
+func runAuditContract(t *testing.T, newRepos Factory) {
+	t.Run("RecordAndList", func(t *testing.T) {
+		repos := newRepos(t)
+		admin := SeedUser(t, repos, "admin", "admin")
+		alice := SeedUser(t, repos, "alice", "customer")
+
+		locked := &models.AuditEvent{Event: models.AuditAccountLocked, UserID: &alice.ID, Subject: "alice", IP: "10.0.0.1", Details: "locked for 1m0s"}
+		mustNoError(t, repos.Audit.RecordEvent(locked))
+		if locked.ID == 0 || locked.CreatedAt.IsZero() {
+			t.Fatalf("RecordEvent did not set id and created_at: %+v", locked)
+		}
+		unlocked := &models.AuditEvent{Event: models.AuditAccountUnlocked, ActorID: &admin.ID, UserID: &alice.ID, Subject: "alice"}
+		mustNoError(t, repos.Audit.RecordEvent(unlocked))
+		mustNoError(t, repos.Audit.RecordEvent(&models.AuditEvent{Event: models.AuditIPLocked, Subject: "10.0.0.1"}))
+
+		events, err := repos.Audit.GetEvents(10)
+		mustNoError(t, err)
+		if len(events) != 3 || events[0].Event != models.AuditIPLocked || events[2].ID != locked.ID {
+			t.Fatalf("GetEvents = %+v, want 3 events newest first", events)
+		}
+		if e := events[1]; e.ActorID == nil || *e.ActorID != admin.ID || e.UserID == nil || *e.UserID != alice.ID {
+			t.Fatalf("GetEvents unlock event = %+v, want actor %d and user %d", e, admin.ID, alice.ID)
+		}
+		if e := events[2]; e.ActorID != nil || e.IP != "10.0.0.1" || e.Details != "locked for 1m0s" {
+			t.Fatalf("GetEvents lock event = %+v", e)
+		}
+
+		events, err = repos.Audit.GetEvents(2)
+		mustNoError(t, err)
+		if len(events) != 2 || events[1].ID != unlocked.ID {
+			t.Fatalf("GetEvents(2) = %+v, want the 2 newest events", events)
+		}
+	})
+
+	t.Run("UnknownUser", func(t *testing.T) {
+		repos := newRepos(t)
+		missing := 9999
+		if err := repos.Audit.RecordEvent(&models.AuditEvent{Event: models.AuditAccountUnlocked, ActorID: &missing}); err == nil {
+			t.Fatal("RecordEvent accepted an unknown actor")
+		}
+	})
+}
+
+func runMFAContract(t *testing.T, newRepos Factory) {
+	t.Run("EnrollAndEnable", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "admin")
+		now := time.Now().UTC().Truncate(time.Second)
+
+		_, err := repos.MFA.GetMFA(alice.ID)
+		mustBeNoRows(t, err)
+
+		// A pending enrollment is replaced by the next one
+		mustNoError(t, repos.MFA.StartMFAEnrollment(alice.ID, "SECRET1"))
+		mustNoError(t, repos.MFA.StartMFAEnrollment(alice.ID, "SECRET2"))
+		m, err := repos.MFA.GetMFA(alice.ID)
+		mustNoError(t, err)
+		if m.Secret != "SECRET2" || m.EnabledAt != nil || m.LastUsedStep != 0 || m.CreatedAt.IsZero() {
+			t.Fatalf("GetMFA of pending enrollment = %+v", m)
+		}
+		var used *repository.MFACodeUsedError
+		if err := repos.MFA.UseMFAStep(alice.ID, 1); !errors.As(err, &used) {
+			t.Fatalf("UseMFAStep on pending enrollment = %v, want *MFACodeUsedError", err)
+		}
+
+		mustNoError(t, repos.MFA.EnableMFA(alice.ID, 100, now, []string{"hash-1", "hash-2"}))
+		m, err = repos.MFA.GetMFA(alice.ID)
+		mustNoError(t, err)
+		if m.EnabledAt == nil || !m.EnabledAt.Equal(now) || m.LastUsedStep != 100 {
+			t.Fatalf("GetMFA after enable = %+v, want enabled at %v with step 100", m, now)
+		}
+
+		var notFound *repository.MFANotFoundError
+		if err := repos.MFA.EnableMFA(alice.ID, 101, now, nil); !errors.As(err, &notFound) {
+			t.Fatalf("second EnableMFA = %v, want *MFANotFoundError", err)
+		}
+		var enabled *repository.MFAAlreadyEnabledError
+		if err := repos.MFA.StartMFAEnrollment(alice.ID, "SECRET3"); !errors.As(err, &enabled) {
+			t.Fatalf("StartMFAEnrollment with MFA enabled = %v, want *MFAAlreadyEnabledError", err)
+		}
+		if err := repos.MFA.EnableMFA(SeedUser(t, repos, "bob", "customer").ID, 1, now, nil); !errors.As(err, &notFound) {
+			t.Fatalf("EnableMFA without enrollment = %v, want *MFANotFoundError", err)
+		}
+	})
+
+	t.Run("StepsAndRecoveryCodes", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "admin")
+		bob := SeedUser(t, repos, "bob", "customer")
+		now := time.Now().UTC()
+		mustNoError(t, repos.MFA.StartMFAEnrollment(alice.ID, "SECRET"))
+		mustNoError(t, repos.MFA.EnableMFA(alice.ID, 100, now, []string{"hash-1", "hash-2"}))
+		mustNoError(t, repos.MFA.StartMFAEnrollment(bob.ID, "SECRET"))
+		mustNoError(t, repos.MFA.EnableMFA(bob.ID, 100, now, []string{"hash-1"}))
+
+		// Every time step is accepted once, and never an older one
+		var used *repository.MFACodeUsedError
+		for _, step := range []int64{100, 99} {
+			if err := repos.MFA.UseMFAStep(alice.ID, step); !errors.As(err, &used) {
+				t.Fatalf("UseMFAStep(%d) = %v, want *MFACodeUsedError", step, err)
+			}
+		}
+		mustNoError(t, repos.MFA.UseMFAStep(alice.ID, 102))
+		if err := repos.MFA.UseMFAStep(alice.ID, 101); !errors.As(err, &used) {
+			t.Fatalf("UseMFAStep before the last used step = %v, want *MFACodeUsedError", err)
+		}
+
+		// Recovery codes are used once and belong to one user
+		var notFound *repository.RecoveryCodeNotFoundError
+		mustNoError(t, repos.MFA.UseRecoveryCode(alice.ID, "hash-1", now))
+		if err := repos.MFA.UseRecoveryCode(alice.ID, "hash-1", now); !errors.As(err, &notFound) {
+			t.Fatalf("reused recovery code = %v, want *RecoveryCodeNotFoundError", err)
+		}
+		if err := repos.MFA.UseRecoveryCode(alice.ID, "unknown", now); !errors.As(err, &notFound) {
+			t.Fatalf("unknown recovery code = %v, want *RecoveryCodeNotFoundError", err)
+		}
+		mustNoError(t, repos.MFA.UseRecoveryCode(bob.ID, "hash-1", now))
+		mustHaveRecoveryCodes(t, repos, alice.ID, 1)
+
+		mustNoError(t, repos.MFA.ReplaceRecoveryCodes(alice.ID, []string{"hash-3", "hash-4", "hash-5"}))
+		mustHaveRecoveryCodes(t, repos, alice.ID, 3)
+		if err := repos.MFA.UseRecoveryCode(alice.ID, "hash-2", now); !errors.As(err, &notFound) {
+			t.Fatalf("replaced recovery code = %v, want *RecoveryCodeNotFoundError", err)
+		}
+
+		mustNoError(t, repos.MFA.DeleteMFA(alice.ID))
+		_, err := repos.MFA.GetMFA(alice.ID)
+		mustBeNoRows(t, err)
+		mustHaveRecoveryCodes(t, repos, alice.ID, 0)
+		var missing *repository.MFANotFoundError
+		if err := repos.MFA.DeleteMFA(alice.ID); !errors.As(err, &missing) {
+			t.Fatalf("second DeleteMFA = %v, want *MFANotFoundError", err)
+		}
+		_, err = repos.MFA.GetMFA(bob.ID)
+		mustNoError(t, err)
+	})
+}
+
+func runPasswordResetContract(t *testing.T, newRepos Factory) {
+	t.Run("CreateAndClaim", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+		now := time.Now().UTC().Truncate(time.Second)
+
+		reset := &models.PasswordReset{UserID: alice.ID, TokenHash: "hash-1", ExpiresAt: now.Add(time.Hour)}
+		mustNoError(t, repos.PasswordResets.CreatePasswordReset(reset))
+		if reset.ID == 0 || reset.CreatedAt.IsZero() {
+			t.Fatalf("CreatePasswordReset did not fill ID and CreatedAt: %+v", reset)
+		}
+		expired := &models.PasswordReset{UserID: alice.ID, TokenHash: "hash-2", ExpiresAt: now.Add(-time.Minute)}
+		mustNoError(t, repos.PasswordResets.CreatePasswordReset(expired))
+
+		claimed, err := repos.PasswordResets.ClaimPasswordReset("hash-1", now)
+		mustNoError(t, err)
+		if claimed.ID != reset.ID || claimed.UserID != alice.ID || claimed.UsedAt == nil || !claimed.UsedAt.Equal(now) {
+			t.Fatalf("ClaimPasswordReset = %+v, want reset %d used at %v", claimed, reset.ID, now)
+		}
+
+		// A token works once, and never after it expired
+		_, err = repos.PasswordResets.ClaimPasswordReset("hash-1", now)
+		mustBeNoRows(t, err)
+		_, err = repos.PasswordResets.ClaimPasswordReset("hash-2", now)
+		mustBeNoRows(t, err)
+		_, err = repos.PasswordResets.ClaimPasswordReset("unknown", now)
+		mustBeNoRows(t, err)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		repos := newRepos(t)
+		alice := SeedUser(t, repos, "alice", "customer")
+		bob := SeedUser(t, repos, "bob", "customer")
+		now := time.Now().UTC()
+
+		for i, r := range []*models.PasswordReset{
+			{UserID: alice.ID, TokenHash: "alice-1", ExpiresAt: now.Add(time.Hour)},
+			{UserID: alice.ID, TokenHash: "alice-2", ExpiresAt: now.Add(-time.Hour)},
+			{UserID: bob.ID, TokenHash: "bob-1", ExpiresAt: now.Add(time.Hour)},
+			{UserID: bob.ID, TokenHash: "bob-2", ExpiresAt: now.Add(-time.Hour)},
+		} {
+			if err := repos.PasswordResets.CreatePasswordReset(r); err != nil {
+				t.Fatalf("CreatePasswordReset #%d: %v", i, err)
+			}
+		}
+
+		mustNoError(t, repos.PasswordResets.DeleteUserPasswordResets(alice.ID))
+		_, err := repos.PasswordResets.ClaimPasswordReset("alice-1", now)
+		mustBeNoRows(t, err)
+
+		deleted, err := repos.PasswordResets.DeleteExpiredPasswordResets(now)
+		mustNoError(t, err)
+		if deleted != 1 {
+			t.Fatalf("DeleteExpiredPasswordResets = %d, want 1", deleted)
+		}
+		_, err = repos.PasswordResets.ClaimPasswordReset("bob-1", now)
+		mustNoError(t, err)
+	})
+}
+
+func runAPIKeyContract(t *testing.T, newRepos Factory) {
+	t.Run("CreateGetList", func(t *testing.T) {
+		repos := newRepos(t)
+		admin := SeedUser(t, repos, "admin", "admin")
+		scanner := SeedUser(t, repos, "scanner", "warehouse_clerk")
+		expiresAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+
+		first := &models.APIKey{UserID: scanner.ID, Name: "Scanner", Prefix: "oak_00000001", KeyHash: "hash-1",
+			Scopes: []string{"stock:read", "transfers:create"}, ExpiresAt: &expiresAt, CreatedBy: &admin.ID}
+		mustNoError(t, repos.APIKeys.CreateAPIKey(first))
+		if first.ID == 0 || first.CreatedAt.IsZero() {
+			t.Fatalf("CreateAPIKey did not fill ID and CreatedAt: %+v", first)
+		}
+		second := &models.APIKey{UserID: scanner.ID, Name: "ERP", Prefix: "oak_00000002", KeyHash: "hash-2",
+			Scopes: []string{"stock:read"}}
+		mustNoError(t, repos.APIKeys.CreateAPIKey(second))
+
+		// Prefixes identify a key
+		duplicate := &models.APIKey{UserID: scanner.ID, Name: "Copy", Prefix: "oak_00000001", KeyHash: "hash-3",
+			Scopes: []string{"stock:read"}}
+		if err := repos.APIKeys.CreateAPIKey(duplicate); err == nil {
+			t.Fatal("CreateAPIKey with duplicate prefix succeeded")
+		}
+
+		key, err := repos.APIKeys.GetAPIKeyByPrefix("oak_00000001")
+		mustNoError(t, err)
+		if key.ID != first.ID || key.KeyHash != "hash-1" || len(key.Scopes) != 2 || key.Scopes[1] != "transfers:create" ||
+			key.ExpiresAt == nil || !key.ExpiresAt.Equal(expiresAt) || key.CreatedBy == nil || *key.CreatedBy != admin.ID {
+			t.Fatalf("GetAPIKeyByPrefix = %+v", key)
+		}
+		key, err = repos.APIKeys.GetAPIKey(second.ID)
+		mustNoError(t, err)
+		if key.Prefix != "oak_00000002" || key.ExpiresAt != nil || key.CreatedBy != nil {
+			t.Fatalf("GetAPIKey = %+v", key)
+		}
+		_, err = repos.APIKeys.GetAPIKeyByPrefix("oak_unknown")
+		mustBeNoRows(t, err)
+		_, err = repos.APIKeys.GetAPIKey(second.ID + 100)
+		mustBeNoRows(t, err)
+
+		keys, err := repos.APIKeys.GetAPIKeys()
+		mustNoError(t, err)
+		if len(keys) != 2 || keys[0].ID != second.ID || keys[1].ID != first.ID {
+			t.Fatalf("GetAPIKeys = %+v, want newest first", keys)
+		}
+	})
+
+	t.Run("TouchAndRevoke", func(t *testing.T) {
+		repos := newRepos(t)
+		scanner := SeedUser(t, repos, "scanner", "warehouse_clerk")
+		now := time.Now().UTC().Truncate(time.Second)
+
+		key := &models.APIKey{UserID: scanner.ID, Name: "Scanner", Prefix: "oak_00000001", KeyHash: "hash-1",
+			Scopes: []string{"stock:read"}}
+		mustNoError(t, repos.APIKeys.CreateAPIKey(key))
+
+		mustNoError(t, repos.APIKeys.TouchAPIKey(key.ID, now))
+		mustNoError(t, repos.APIKeys.RevokeAPIKey(key.ID, now))
+		stored, err := repos.APIKeys.GetAPIKey(key.ID)
+		mustNoError(t, err)
+		if stored.LastUsedAt == nil || !stored.LastUsedAt.Equal(now) || stored.RevokedAt == nil || !stored.RevokedAt.Equal(now) {
+			t.Fatalf("key after touch and revoke = %+v", stored)
+		}
+
+		var notFound *repository.APIKeyNotFoundError
+		if err := repos.APIKeys.RevokeAPIKey(key.ID, now); !errors.As(err, &notFound) {
+			t.Fatalf("second RevokeAPIKey = %v, want *APIKeyNotFoundError", err)
+		}
+		if err := repos.APIKeys.RevokeAPIKey(key.ID+100, now); !errors.As(err, &notFound) {
+			t.Fatalf("RevokeAPIKey of unknown key = %v, want *APIKeyNotFoundError", err)
+		}
+	})
+}
+
+func mustHaveRecoveryCodes(t *testing.T, repos app.Repositories, userID, want int) {
+	t.Helper()
+	count, err := repos.MFA.CountRecoveryCodes(userID)
+	mustNoError(t, err)
+	if count != want {
+		t.Fatalf("CountRecoveryCodes = %d, want %d", count, want)
+	}
+}
+
+func runWarehouseContract(t *testing.T, newRepos Factory) {
+	t.Run("CRUD", func(t *testing.T) {
+		repos := newRepos(t)
+		w := SeedWarehouse(t, repos, "Main")
+		if !w.IsActive {
+			t.Fatal("new warehouse is not active")
+		}
+
+		mustNoError(t, repos.Warehouses.UpdateWarehouse(w.ID, &models.UpdateWarehouseRequest{
+			Name: "Central", Address: "Street 1", IsActive: false,
+		}))
+		got, err := repos.Warehouses.GetWarehouseByID(w.ID)
+		mustNoError(t, err)
+		if got.Name != "Central" || got.Address != "Street 1" || got.IsActive || got.Location != nil {
+			t.Fatalf("GetWarehouseByID after update = %+v", got)
+		}
+
+		location := models.Location{Latitude: 41.0082, Longitude: 28.9784}
+		mustNoError(t, repos.Warehouses.UpdateWarehouse(w.ID, &models.UpdateWarehouseRequest{
+			Name: "Central", Location: &location,
+		}))
+		got, err = repos.Warehouses.GetWarehouseByID(w.ID)
+		mustNoError(t, err)
+		if got.Location == nil || *got.Location != location {
+			t.Fatalf("GetWarehouseByID location = %+v, want %+v", got.Location, location)
+		}
+
+		SeedWarehouse(t, repos, "Annex")
+		all, err := repos.Warehouses.GetAllWarehouses()
+		mustNoError(t, err)
+		if len(all) != 2 || all[0].Name != "Annex" {
+			t.Fatalf("GetAllWarehouses = %+v, want 2 ordered by name", all)
+		}
+
+		mustNoError(t, repos.Warehouses.DeleteWarehouse(w.ID))
+		_, err = repos.Warehouses.GetWarehouseByID(w.ID)
+		mustBeNoRows(t, err)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		repos := newRepos(t)
+
+		_, err := repos.Warehouses.GetWarehouseByID(404)
+		mustBeNoRows(t, err)
+		mustBeNoRows(t, repos.Warehouses.UpdateWarehouse(404, &models.UpdateWarehouseRequest{Name: "x"}))
+		mustBeNoRows(t, repos.Warehouses.DeleteWarehouse(404))
+		_, err = repos.Warehouses.GetProductStockInWarehouse(404, 404)
+		mustBeNoRows(t, err)
+	})
+
+	t.Run("DeleteWithStock", func(t *testing.T) {
+		repos := newRepos(t)
+		w := SeedWarehouse(t, repos, "Main")
+		SeedProduct(t, repos, w.ID, "Laptop", 1000, 5)
+
+		var hasStock *repository.WarehouseHasStockError
+		if err := repos.Warehouses.DeleteWarehouse(w.ID); !errors.As(err, &hasStock) || hasStock.WarehouseID != w.ID {
+			t.Fatalf("DeleteWarehouse with stock = %v, want *WarehouseHasStockError", err)
+		}
+	})
+
+	t.Run("Stock", func(t *testing.T) {
+		repos := newRepos(t)
+		main := SeedWarehouse(t, repos, "Main")
+		annex := SeedWarehouse(t, repos, "Annex")
+		p := SeedProduct(t, repos, main.ID, "Laptop", 1000, 5)
+
+		mustNoError(t, repos.Warehouses.AddStock(main.ID, p.ID, 3))
+		mustNoError(t, repos.Warehouses.AddStock(annex.ID, p.ID, 2))
+		mustNoError(t, repos.Warehouses.UpdateStock(annex.ID, p.ID, 7))
+
+		MustHaveStock(t, repos, main.ID, p.ID, 8)
+		MustHaveStock(t, repos, annex.ID, p.ID, 7)
+
+		stock, err := repos.Warehouses.GetProductStockInWarehouse(annex.ID, p.ID)
+		mustNoError(t, err)
+		if stock.WarehouseName != "Annex" || stock.ProductName != "Laptop" || stock.ProductPrice != 1000 {
+			t.Fatalf("stock joined fields = %+v", stock)
+		}
+		if stock.AvailableStock != stock.Quantity-stock.ReservedQuantity {
+			t.Fatalf("available stock = %d, want quantity - reserved", stock.AvailableStock)
+		}
+
+		inMain, err := repos.Warehouses.GetWarehouseStocks(main.ID)
+		mustNoError(t, err)
+		if len(inMain) != 1 {
+			t.Fatalf("GetWarehouseStocks returned %d rows, want 1", len(inMain))
+		}
+
+		all, err := repos.Warehouses.GetAllStocks()
+		mustNoError(t, err)
+		if len(all) != 2 || all[0].WarehouseName != "Annex" {
+			t.Fatalf("GetAllStocks = %+v, want 2 ordered by warehouse name", all)
+		}
+	})
+
+	t.Run("Assignments", func(t *testing.T) {
+		repos := newRepos(t)
+		clerk := SeedUser(t, repos, "clerk", "warehouse_clerk")
+		main := SeedWarehouse(t, repos, "Main")
+		annex := SeedWarehouse(t, repos, "Annex")
+
+		ids, err := repos.Warehouses.GetUserWarehouseIDs(clerk.ID)
+		mustNoError(t, err)
+		if len(ids) != 0 {
+			t.Fatalf("new user warehouses = %v, want none", ids)
+		}
+
+		mustNoError(t, repos.Warehouses.SetUserWarehouses(clerk.ID, []int{annex.ID, main.ID, annex.ID}))
+		ids, err = repos.Warehouses.GetUserWarehouseIDs(clerk.ID)
+		mustNoError(t, err)
+		if len(ids) != 2 || ids[0] != main.ID || ids[1] != annex.ID {
+			t.Fatalf("GetUserWarehouseIDs = %v, want [%d %d]", ids, main.ID, annex.ID)
+		}
+
+		// Unknown warehouses reject the whole update
+		var warehouseErr *repository.WarehouseNotFoundError
+		err = repos.Warehouses.SetUserWarehouses(clerk.ID, []int{main.ID, 404})
+		if !errors.As(err, &warehouseErr) || warehouseErr.WarehouseID != 404 {
+			t.Fatalf("SetUserWarehouses with unknown warehouse = %v, want *WarehouseNotFoundError", err)
+		}
+		ids, err = repos.Warehouses.GetUserWarehouseIDs(clerk.ID)
+		mustNoError(t, err)
+		if len(ids) != 2 {
+			t.Fatalf("warehouses after failed update = %v", ids)
+		}
+
+		var userErr *repository.UserNotFoundError
+		if err := repos.Warehouses.SetUserWarehouses(404, []int{main.ID}); !errors.As(err, &userErr) {
+			t.Fatalf("SetUserWarehouses for unknown user = %v, want *UserNotFoundError", err)
+		}
+
+		// Deleting a warehouse drops its assignments
+		mustNoError(t, repos.Warehouses.DeleteWarehouse(annex.ID))
+		ids, err = repos.Warehouses.GetUserWarehouseIDs(clerk.ID)
+		mustNoError(t, err)
+		if len(ids) != 1 || ids[0] != main.ID {
+			t.Fatalf("warehouses after delete = %v, want [%d]", ids, main.ID)
+		}
+
+		mustNoError(t, repos.Warehouses.SetUserWarehouses(clerk.ID, nil))
+		ids, err = repos.Warehouses.GetUserWarehouseIDs(clerk.ID)
+		mustNoError(t, err)
+		if len(ids) != 0 {
+			t.Fatalf("warehouses after clearing = %v, want none", ids)
+		}
+	})
+}
+
+func runTransferContract(t *testing.T, newRepos Factory) {
+	setup := func(t *testing.T) (app.Repositories, *models.User, *models.Warehouse, *models.Warehouse, *models.Product) {
+		repos := newRepos(t)
+		user := SeedUser(t, repos, "clerk", "admin")
+		from := SeedWarehouse(t, repos, "From")
+		to := SeedWarehouse(t, repos, "To")
+		p := SeedProduct(t, repos, from.ID, "Laptop", 1000, 10)
+		return repos, user, from, to, p
+	}
+
+	t.Run("Process", func(t *testing.T) {
+		repos, user, from, to, p := setup(t)
+
+		transfer, err := repos.Warehouses.CreateStockTransfer(&models.StockTransferRequest{
+			FromWarehouseID: &from.ID, ToWarehouseID: &to.ID, ProductID: p.ID, Quantity: 4, Reason: "rebalance",
+		}, user.ID)
+		mustNoError(t, err)
+		if transfer.Status != "pending" || transfer.CompletedAt != nil {
+			t.Fatalf("new transfer = %+v, want pending", transfer)
+		}
+
+		mustNoError(t, repos.Warehouses.ProcessTransfer(transfer.ID))
+		MustHaveStock(t, repos, from.ID, p.ID, 6)
+		MustHaveStock(t, repos, to.ID, p.ID, 4)
+
+		got, err := repos.Warehouses.GetTransferByID(transfer.ID)
+		mustNoError(t, err)
+		if got.Status != "completed" || got.CompletedAt == nil {
+			t.Fatalf("processed transfer = %+v, want completed", got)
+		}
+		if got.FromWarehouseName != "From" || got.ToWarehouseName != "To" ||
+			got.ProductName != "Laptop" || got.RequestedByUser != "clerk" {
+			t.Fatalf("transfer joined fields = %+v", got)
+		}
+
+		var notPending *repository.TransferNotPendingError
+		if err := repos.Warehouses.ProcessTransfer(transfer.ID); !errors.As(err, &notPending) || notPending.Status != "completed" {
+			t.Fatalf("processing twice = %v, want *TransferNotPendingError", err)
+		}
+	})
+
+	t.Run("InsufficientStock", func(t *testing.T) {
+		repos, user, from, to, p := setup(t)
+
+		transfer, err := repos.Warehouses.CreateStockTransfer(&models.StockTransferRequest{
+			FromWarehouseID: &from.ID, ToWarehouseID: &to.ID, ProductID: p.ID, Quantity: 11,
+		}, user.ID)
+		mustNoError(t, err)
+
+		var insufficient *repository.InsufficientStockError
+		if err := repos.Warehouses.ProcessTransfer(transfer.ID); !errors.As(err, &insufficient) ||
+			insufficient.Required != 11 || insufficient.Available != 10 {
+			t.Fatalf("ProcessTransfer = %v, want *InsufficientStockError 11/10", err)
+		}
+		MustHaveStock(t, repos, from.ID, p.ID, 10)
+
+		got, err := repos.Warehouses.GetTransferByID(transfer.ID)
+		mustNoError(t, err)
+		if got.Status != "pending" {
+			t.Fatalf("failed transfer status = %q, want pending", got.Status)
+		}
+	})
+
+	t.Run("CompleteViaStatus", func(t *testing.T) {
+		repos, user, from, _, p := setup(t)
+
+		// Outbound transfer with no destination warehouse
+		transfer, err := repos.Warehouses.CreateStockTransfer(&models.StockTransferRequest{
+			FromWarehouseID: &from.ID, ProductID: p.ID, Quantity: 3,
+		}, user.ID)
+		mustNoError(t, err)
+
+		mustNoError(t, repos.Warehouses.UpdateTransferStatus(transfer.ID, "completed"))
+		MustHaveStock(t, repos, from.ID, p.ID, 7)
+
+		got, err := repos.Warehouses.GetTransferByID(transfer.ID)
+		mustNoError(t, err)
+		if got.ToWarehouseName != "External" || got.CompletedAt == nil {
+			t.Fatalf("completed transfer = %+v", got)
+		}
+
+		all, err := repos.Warehouses.GetAllTransfers()
+		mustNoError(t, err)
+		if len(all) != 1 {
+			t.Fatalf("GetAllTransfers returned %d, want 1", len(all))
+		}
+
+		mustBeNoRows(t, repos.Warehouses.UpdateTransferStatus(404, "cancelled"))
+		_, err = repos.Warehouses.GetTransferByID(404)
+		mustBeNoRows(t, err)
+	})
+}
+
+func runProductContract(t *testing.T, newRepos Factory) {
+	t.Run("CreateUpdateDelete", func(t *testing.T) {
+		repos := newRepos(t)
+		main := SeedWarehouse(t, repos, "Main")
+		annex := SeedWarehouse(t, repos, "Annex")
+		p := SeedProduct(t, repos, main.ID, "Laptop", 1000, 5)
+		MustHaveStock(t, repos, main.ID, p.ID, 5)
+
+		got, err := repos.Products.GetProductByID(p.ID)
+		mustNoError(t, err)
+		if got.WarehouseName != "Main" || got.Stock != 5 {
+			t.Fatalf("GetProductByID = %+v", got)
+		}
+
+		// Same warehouse: stock difference is applied
+		mustNoError(t, repos.Products.UpdateProduct(p.ID, &models.ProductRequest{
+			Name: "Laptop Pro", Price: 1500, Stock: 8, WarehouseID: main.ID,
+		}))
+		MustHaveStock(t, repos, main.ID, p.ID, 8)
+
+		// Warehouse change: stock moves to the new warehouse
+		mustNoError(t, repos.Products.UpdateProduct(p.ID, &models.ProductRequest{
+			Name: "Laptop Pro", Price: 1500, Stock: 8, WarehouseID: annex.ID,
+		}))
+		MustHaveStock(t, repos, main.ID, p.ID, 0)
+		MustHaveStock(t, repos, annex.ID, p.ID, 8)
+
+		all, err := repos.Products.GetAllProducts()
+		mustNoError(t, err)
+		if len(all) != 1 || all[0].Name != "Laptop Pro" || all[0].WarehouseName != "Annex" {
+			t.Fatalf("GetAllProducts = %+v", all)
+		}
+
+		mustNoError(t, repos.Products.DeleteProduct(p.ID))
+		_, err = repos.Products.GetProductByID(p.ID)
+		mustBeNoRows(t, err)
+		_, err = repos.Warehouses.GetProductStockInWarehouse(annex.ID, p.ID)
+		mustBeNoRows(t, err)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		repos := newRepos(t)
+		w := SeedWarehouse(t, repos, "Main")
+
+		_, err := repos.Products.GetProductByID(404)
+		mustBeNoRows(t, err)
+		mustBeNoRows(t, repos.Products.UpdateProduct(404, &models.ProductRequest{Name: "x", WarehouseID: w.ID}))
+		mustBeNoRows(t, repos.Products.DeleteProduct(404))
+	})
+
+	t.Run("WarehouseStock", func(t *testing.T) {
+		repos := newRepos(t)
+		main := SeedWarehouse(t, repos, "Main")
+		annex := SeedWarehouse(t, repos, "Annex")
+		p := SeedProduct(t, repos, main.ID, "Laptop", 1000, 5)
+		mustNoError(t, repos.Warehouses.AddStock(annex.ID, p.ID, 3))
+
+		stock, err := repos.Products.CheckWarehouseStock(p.ID, 4)
+		mustNoError(t, err)
+		if stock.WarehouseID != main.ID {
+			t.Fatalf("CheckWarehouseStock picked warehouse %d, want %d", stock.WarehouseID, main.ID)
+		}
+
+		var insufficient *repository.InsufficientWarehouseStockError
+		if _, err := repos.Products.CheckWarehouseStock(p.ID, 6); !errors.As(err, &insufficient) ||
+			insufficient.RequiredStock != 6 || insufficient.AvailableStock != 8 {
+			t.Fatalf("CheckWarehouseStock = %v, want *InsufficientWarehouseStockError 6/8", err)
+		}
+
+		mustNoError(t, repos.Products.UpdateWarehouseStock(p.ID, 4, "decrease"))
+		MustHaveStock(t, repos, main.ID, p.ID, 1)
+		mustNoError(t, repos.Products.UpdateWarehouseStock(p.ID, 4, "increase"))
+		MustHaveStock(t, repos, main.ID, p.ID, 5)
+
+		var invalid *repository.InvalidOperationError
+		if err := repos.Products.UpdateWarehouseStock(p.ID, 1, "steal"); !errors.As(err, &invalid) {
+			t.Fatalf("UpdateWarehouseStock with bad operation = %v, want *InvalidOperationError", err)
+		}
+	})
+}
+
+func runOrderContract(t *testing.T, newRepos Factory) {
+	t.Run("Lifecycle", func(t *testing.T) {
+		repos := newRepos(t)
+		customer := SeedUser(t, repos, "customer", "customer")
+		other := SeedUser(t, repos, "other", "customer")
+		w := SeedWarehouse(t, repos, "Main")
+		laptop := SeedProduct(t, repos, w.ID, "Laptop", 1000, 5)
+		mouse := SeedProduct(t, repos, w.ID, "Mouse", 25, 10)
+
+		created, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 2},
+			{ProductID: mouse.ID, Quantity: 4},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		if created.Order.TotalAmount != 2100 || created.Order.Status != "pending" || len(created.Items) != 2 {
+			t.Fatalf("CreateOrder = %+v, want total 2100 with 2 items", created)
+		}
+		orderID := created.Order.ID
+
+		_, err = repos.Orders.GetOrderByID(orderID, other.ID)
+		mustBeNoRows(t, err)
+		order, err := repos.Orders.GetOrderByID(orderID, customer.ID)
+		mustNoError(t, err)
+		if order.TotalAmount != 2100 {
+			t.Fatalf("GetOrderByID total = %v, want 2100", order.TotalAmount)
+		}
+
+		items, err := repos.Orders.GetOrderItems(orderID)
+		mustNoError(t, err)
+		if len(items) != 2 || items[0].ProductName != "Laptop" {
+			t.Fatalf("GetOrderItems = %+v", items)
+		}
+
+		mustBeNoRows(t, repos.Orders.UpdateOrderStatus(404, models.OrderPending, models.OrderConfirmed, customer.ID))
+
+		mustNoError(t, repos.Orders.UpdateOrderStatus(orderID, models.OrderPending, models.OrderConfirmed, customer.ID))
+		MustHaveStock(t, repos, w.ID, laptop.ID, 3)
+		MustHaveStock(t, repos, w.ID, mouse.ID, 6)
+
+		// A change expecting a status the order has left is refused and
+		// must not deduct the stock again
+		var changed *repository.OrderStatusChangedError
+		if err := repos.Orders.UpdateOrderStatus(orderID, models.OrderPending, models.OrderConfirmed, customer.ID); !errors.As(err, &changed) ||
+			changed.Status != models.OrderConfirmed {
+			t.Fatalf("UpdateOrderStatus from a stale status = %v, want *OrderStatusChangedError confirmed", err)
+		}
+		MustHaveStock(t, repos, w.ID, laptop.ID, 3)
+
+		mustNoError(t, repos.Orders.UpdateOrderStatus(orderID, models.OrderConfirmed, models.OrderCancelled, other.ID))
+		MustHaveStock(t, repos, w.ID, laptop.ID, 5)
+		MustHaveStock(t, repos, w.ID, mouse.ID, 10)
+
+		history, err := repos.Orders.GetOrderStatusHistory(orderID)
+		mustNoError(t, err)
+		if len(history) != 3 || history[0].FromStatus != nil || history[0].ToStatus != models.OrderPending ||
+			*history[1].FromStatus != models.OrderPending || history[1].ToStatus != models.OrderConfirmed ||
+			history[1].ChangedByUser != "customer" || history[2].ToStatus != models.OrderCancelled ||
+			*history[2].ChangedBy != other.ID {
+			t.Fatalf("GetOrderStatusHistory = %+v, want created, confirmed and cancelled", history)
+		}
+
+		orders, err := repos.Orders.GetOrdersByUserID(customer.ID)
+		mustNoError(t, err)
+		if len(orders) != 1 || orders[0].Order.Status != "cancelled" || orders[0].Order.Username != "customer" {
+			t.Fatalf("GetOrdersByUserID = %+v", orders)
+		}
+
+		// Reading any user's order
+		_, err = repos.Orders.CreateOrder(other.ID, []models.CreateOrderItemRequest{{ProductID: mouse.ID, Quantity: 1}}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		all, err := repos.Orders.GetAllOrders()
+		mustNoError(t, err)
+		if len(all) != 2 || all[1].Order.ID != orderID || all[0].Order.Username != "other" {
+			t.Fatalf("GetAllOrders = %+v, want both orders newest first", all)
+		}
+		order, err = repos.Orders.GetOrder(orderID)
+		mustNoError(t, err)
+		if order.UserID != customer.ID || order.Status != "cancelled" || order.Username != "customer" {
+			t.Fatalf("GetOrder = %+v", order)
+		}
+		_, err = repos.Orders.GetOrder(404)
+		mustBeNoRows(t, err)
+
+		mustBeNoRows(t, repos.Orders.DeleteOrder(orderID, other.ID))
+		mustNoError(t, repos.Orders.DeleteOrder(orderID, customer.ID))
+		orders, err = repos.Orders.GetOrdersByUserID(customer.ID)
+		mustNoError(t, err)
+		if len(orders) != 0 {
+			t.Fatalf("orders after delete = %d, want 0", len(orders))
+		}
+		history, err = repos.Orders.GetOrderStatusHistory(orderID)
+		mustNoError(t, err)
+		if len(history) != 0 {
+			t.Fatalf("history after delete = %+v, want none", history)
+		}
+	})
+
+	t.Run("ReservedStockCannotRunOut", func(t *testing.T) {
+		repos := newRepos(t)
+		customer := SeedUser(t, repos, "customer", "customer")
+		w := SeedWarehouse(t, repos, "Main")
+		laptop := SeedProduct(t, repos, w.ID, "Laptop", 1000, 5)
+		mouse := SeedProduct(t, repos, w.ID, "Mouse", 20, 10)
+
+		created, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 2},
+			{ProductID: mouse.ID, Quantity: 4},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		orderID := created.Order.ID
+
+		// The reserved mice cannot be taken from stock after the order was
+		// placed, so confirming cannot fail halfway
+		var insufficient *repository.InsufficientWarehouseStockError
+		err = repos.Warehouses.UpdateStock(w.ID, mouse.ID, 3)
+		if !errors.As(err, &insufficient) || insufficient.ProductID != mouse.ID {
+			t.Fatalf("taking reserved mice = %v, want *InsufficientWarehouseStockError", err)
+		}
+		MustHaveStock(t, repos, w.ID, mouse.ID, 10)
+
+		order, err := repos.Orders.GetOrder(orderID)
+		mustNoError(t, err)
+		if order.Status != models.OrderPending {
+			t.Fatalf("order status = %q, want pending", order.Status)
+		}
+
+		mustNoError(t, repos.Warehouses.UpdateStock(w.ID, mouse.ID, 4))
+		mustNoError(t, repos.Orders.UpdateOrderStatus(orderID, models.OrderPending, models.OrderConfirmed, customer.ID))
+		MustHaveStock(t, repos, w.ID, laptop.ID, 3)
+		MustHaveStock(t, repos, w.ID, mouse.ID, 0)
+		history, err := repos.Orders.GetOrderStatusHistory(orderID)
+		mustNoError(t, err)
+		if len(history) != 2 {
+			t.Fatalf("history after confirmation = %+v, want the creation and the confirmation", history)
+		}
+	})
+
+	t.Run("ConcurrentOrders", func(t *testing.T) {
+		repos := newRepos(t)
+		customer := SeedUser(t, repos, "customer", "customer")
+		w := SeedWarehouse(t, repos, "Main")
+		laptop := SeedProduct(t, repos, w.ID, "Laptop", 1000, 5)
+		mouse := SeedProduct(t, repos, w.ID, "Mouse", 20, 100)
+
+		// Eight orders for two laptops each are placed at once, listing
+		// their items in different orders. Only two fit the 5 laptops.
+		const orders = 8
+		placed := make(chan int, orders)
+		errs := make(chan error, 2*orders)
+		var wg sync.WaitGroup
+		for i := range orders {
+			items := []models.CreateOrderItemRequest{
+				{ProductID: mouse.ID, Quantity: 1},
+				{ProductID: laptop.ID, Quantity: 2},
+			}
+			if i%2 == 1 {
+				items[0], items[1] = items[1], items[0]
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				created, err := repos.Orders.CreateOrder(customer.ID, items, allocation.SingleWarehouseFirst{})
+				if err != nil {
+					errs <- err
+					return
+				}
+				placed <- created.Order.ID
+			}()
+		}
+		wg.Wait()
+		close(placed)
+
+		var orderIDs []int
+		for orderID := range placed {
+			orderIDs = append(orderIDs, orderID)
+		}
+		if len(orderIDs) != 2 {
+			t.Fatalf("%d concurrent orders placed, want 2", len(orderIDs))
+		}
+		mustHaveReserved(t, repos, w.ID, laptop.ID, 5, 4)
+		mustHaveReserved(t, repos, w.ID, mouse.ID, 100, 2)
+
+		// Every order is confirmed twice at once; only one confirmation of
+		// an order may apply
+		for _, orderID := range append(orderIDs, orderIDs...) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- repos.Orders.UpdateOrderStatus(orderID, models.OrderPending, models.OrderConfirmed, customer.ID)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		confirmed := 0
+		for err := range errs {
+			var insufficient *repository.InsufficientWarehouseStockError
+			var changed *repository.OrderStatusChangedError
+			switch {
+			case err == nil:
+				confirmed++
+			case errors.As(err, &insufficient), errors.As(err, &changed):
+			default:
+				t.Fatalf("concurrent order: %v", err)
+			}
+		}
+		if confirmed != 2 {
+			t.Fatalf("%d concurrent confirmations applied, want 2", confirmed)
+		}
+		mustHaveReserved(t, repos, w.ID, laptop.ID, 1, 0)
+		mustHaveReserved(t, repos, w.ID, mouse.ID, 98, 0)
+	})
+
+	t.Run("Reservations", func(t *testing.T) {
+		repos := newRepos(t)
+		customer := SeedUser(t, repos, "customer", "customer")
+		main := SeedWarehouse(t, repos, "Main")
+		annex := SeedWarehouse(t, repos, "Annex")
+		laptop := SeedProduct(t, repos, main.ID, "Laptop", 1000, 5)
+		mustNoError(t, repos.Warehouses.AddStock(annex.ID, laptop.ID, 3))
+
+		// Items are reserved where the most units are unreserved
+		first, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 3},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		second, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 3},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		mustHaveAllocations(t, first.Items[0], models.OrderItemAllocation{WarehouseID: main.ID, Quantity: 3})
+		mustHaveAllocations(t, second.Items[0], models.OrderItemAllocation{WarehouseID: annex.ID, Quantity: 3})
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 5, 3)
+		mustHaveReserved(t, repos, annex.ID, laptop.ID, 3, 3)
+
+		items, err := repos.Orders.GetOrderItems(second.Order.ID)
+		mustNoError(t, err)
+		mustHaveAllocations(t, items[0], models.OrderItemAllocation{WarehouseID: annex.ID, Quantity: 3})
+
+		// Only 4 unreserved laptops are left, 2 in each warehouse
+		var insufficient *repository.InsufficientWarehouseStockError
+		_, err = repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 1},
+			{ProductID: laptop.ID, Quantity: 4},
+		}, allocation.SingleWarehouseFirst{})
+		if !errors.As(err, &insufficient) {
+			t.Fatalf("CreateOrder beyond the unreserved stock = %v, want *InsufficientWarehouseStockError", err)
+		}
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 5, 3)
+		mustHaveReserved(t, repos, annex.ID, laptop.ID, 3, 3)
+
+		// Confirming deducts the reservation; cancelling releases it
+		mustNoError(t, repos.Orders.UpdateOrderStatus(first.Order.ID, models.OrderPending, models.OrderConfirmed, customer.ID))
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 2, 0)
+		mustNoError(t, repos.Orders.UpdateOrderStatus(second.Order.ID, models.OrderPending, models.OrderCancelled, customer.ID))
+		mustHaveReserved(t, repos, annex.ID, laptop.ID, 3, 0)
+		mustNoError(t, repos.Orders.UpdateOrderStatus(first.Order.ID, models.OrderConfirmed, models.OrderCancelled, customer.ID))
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 5, 0)
+
+		// Deleting a pending order releases its reservation
+		third, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 4},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 5, 4)
+		mustNoError(t, repos.Orders.DeleteOrder(third.Order.ID, customer.ID))
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 5, 0)
+
+		// Confirmed orders hold stock and are cancelled, not deleted
+		fourth, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 1},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		mustNoError(t, repos.Orders.UpdateOrderStatus(fourth.Order.ID, "pending", "confirmed", customer.ID))
+		var notDeletable *repository.OrderNotDeletableError
+		if err := repos.Orders.DeleteOrder(fourth.Order.ID, customer.ID); !errors.As(err, &notDeletable) ||
+			notDeletable.Status != "confirmed" {
+			t.Fatalf("DeleteOrder of a confirmed order = %v, want *OrderNotDeletableError", err)
+		}
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 4, 0)
+		mustNoError(t, repos.Orders.UpdateOrderStatus(fourth.Order.ID, "confirmed", "cancelled", customer.ID))
+		mustNoError(t, repos.Orders.DeleteOrder(fourth.Order.ID, customer.ID))
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 5, 0)
+	})
+
+	t.Run("StockEditsKeepReservations", func(t *testing.T) {
+		repos := newRepos(t)
+		customer := SeedUser(t, repos, "customer", "customer")
+		main := SeedWarehouse(t, repos, "Main")
+		annex := SeedWarehouse(t, repos, "Annex")
+		laptop := SeedProduct(t, repos, main.ID, "Laptop", 1000, 5)
+		_, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 3},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+
+		// Neither setting the stock nor editing the product may drop it below
+		// the 3 reserved laptops
+		var insufficient *repository.InsufficientWarehouseStockError
+		if err := repos.Warehouses.UpdateStock(main.ID, laptop.ID, 2); !errors.As(err, &insufficient) {
+			t.Fatalf("UpdateStock below the reservation = %v, want *InsufficientWarehouseStockError", err)
+		}
+		edit := models.ProductRequest{Name: "Laptop", Price: 1000, Stock: 1, WarehouseID: main.ID}
+		if err := repos.Products.UpdateProduct(laptop.ID, &edit); !errors.As(err, &insufficient) {
+			t.Fatalf("UpdateProduct below the reservation = %v, want *InsufficientWarehouseStockError", err)
+		}
+		edit = models.ProductRequest{Name: "Laptop", Price: 1000, Stock: 5, WarehouseID: annex.ID}
+		if err := repos.Products.UpdateProduct(laptop.ID, &edit); !errors.As(err, &insufficient) {
+			t.Fatalf("UpdateProduct moving reserved stock = %v, want *InsufficientWarehouseStockError", err)
+		}
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 5, 3)
+
+		edit = models.ProductRequest{Name: "Laptop", Price: 1000, Stock: 6, WarehouseID: main.ID}
+		mustNoError(t, repos.Products.UpdateProduct(laptop.ID, &edit))
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 6, 3)
+		mustNoError(t, repos.Warehouses.UpdateStock(main.ID, laptop.ID, 3))
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 3, 3)
+	})
+
+	t.Run("Allocation", func(t *testing.T) {
+		repos := newRepos(t)
+		customer := SeedUser(t, repos, "customer", "customer")
+		seedWarehouse := func(name string, location *models.Location) *models.Warehouse {
+			w, err := repos.Warehouses.CreateWarehouse(&models.CreateWarehouseRequest{Name: name, Location: location})
+			mustNoError(t, err)
+			return w
+		}
+		main := seedWarehouse("Main", &models.Location{Latitude: 41.0082, Longitude: 28.9784})   // Istanbul
+		annex := seedWarehouse("Annex", &models.Location{Latitude: 39.9334, Longitude: 32.8597}) // Ankara
+		depot := seedWarehouse("Depot", &models.Location{Latitude: 38.4237, Longitude: 27.1428}) // Izmir
+
+		// Main has held laptops the longest, Annex has the most
+		laptop := SeedProduct(t, repos, main.ID, "Laptop", 1000, 5)
+		mustNoError(t, repos.Warehouses.AddStock(annex.ID, laptop.ID, 8))
+		mustNoError(t, repos.Warehouses.AddStock(depot.ID, laptop.ID, 4))
+		mouse := SeedProduct(t, repos, main.ID, "Mouse", 25, 10)
+		mustNoError(t, repos.Warehouses.AddStock(annex.ID, mouse.ID, 2))
+
+		place := func(strategy allocation.Strategy, items ...models.CreateOrderItemRequest) *models.OrderWithItems {
+			t.Helper()
+			created, err := repos.Orders.CreateOrder(customer.ID, items, strategy)
+			mustNoError(t, err)
+			return created
+		}
+		release := func(order *models.OrderWithItems) {
+			t.Helper()
+			mustNoError(t, repos.Orders.DeleteOrder(order.Order.ID, customer.ID))
+		}
+		laptops := func(quantity int) models.CreateOrderItemRequest {
+			return models.CreateOrderItemRequest{ProductID: laptop.ID, Quantity: quantity}
+		}
+
+		// A line one warehouse covers is not split; larger lines take from the
+		// fullest warehouses first
+		order := place(allocation.SingleWarehouseFirst{}, laptops(6))
+		mustHaveAllocations(t, order.Items[0], models.OrderItemAllocation{WarehouseID: annex.ID, Quantity: 6})
+		release(order)
+		order = place(allocation.SingleWarehouseFirst{}, laptops(15))
+		mustHaveAllocations(t, order.Items[0],
+			models.OrderItemAllocation{WarehouseID: annex.ID, Quantity: 8},
+			models.OrderItemAllocation{WarehouseID: main.ID, Quantity: 5},
+			models.OrderItemAllocation{WarehouseID: depot.ID, Quantity: 2})
+		mustHaveReserved(t, repos, annex.ID, laptop.ID, 8, 8)
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 5, 5)
+		mustHaveReserved(t, repos, depot.ID, laptop.ID, 4, 2)
+
+		items, err := repos.Orders.GetOrderItems(order.Order.ID)
+		mustNoError(t, err)
+		mustHaveAllocations(t, items[0], order.Items[0].Allocations...)
+		if items[0].Allocations[0].WarehouseName != "Annex" {
+			t.Fatalf("GetOrderItems warehouse name = %q, want Annex", items[0].Allocations[0].WarehouseName)
+		}
+
+		// Confirming and cancelling a split item move the stock of every
+		// warehouse it is taken from
+		mustNoError(t, repos.Orders.UpdateOrderStatus(order.Order.ID, models.OrderPending, models.OrderConfirmed, customer.ID))
+		mustHaveReserved(t, repos, annex.ID, laptop.ID, 0, 0)
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 0, 0)
+		mustHaveReserved(t, repos, depot.ID, laptop.ID, 2, 0)
+		mustNoError(t, repos.Orders.UpdateOrderStatus(order.Order.ID, models.OrderConfirmed, models.OrderCancelled, customer.ID))
+		mustHaveReserved(t, repos, annex.ID, laptop.ID, 8, 0)
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 5, 0)
+		mustHaveReserved(t, repos, depot.ID, laptop.ID, 4, 0)
+
+		// The warehouses together hold 17 laptops
+		var insufficient *repository.InsufficientWarehouseStockError
+		_, err = repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{laptops(10), laptops(8)},
+			allocation.SingleWarehouseFirst{})
+		if !errors.As(err, &insufficient) || insufficient.ProductID != laptop.ID {
+			t.Fatalf("CreateOrder beyond the total stock = %v, want *InsufficientWarehouseStockError", err)
+		}
+		mustHaveReserved(t, repos, annex.ID, laptop.ID, 8, 0)
+
+		// The oldest stock leaves first
+		order = place(allocation.DrainOldest{}, laptops(6))
+		mustHaveAllocations(t, order.Items[0],
+			models.OrderItemAllocation{WarehouseID: main.ID, Quantity: 5},
+			models.OrderItemAllocation{WarehouseID: annex.ID, Quantity: 1})
+		release(order)
+
+		// Orders to Izmir ship from Izmir, then from Istanbul
+		izmir := &models.Location{Latitude: 38.4192, Longitude: 27.1287}
+		order = place(allocation.Closest{To: izmir}, laptops(6))
+		mustHaveAllocations(t, order.Items[0],
+			models.OrderItemAllocation{WarehouseID: depot.ID, Quantity: 4},
+			models.OrderItemAllocation{WarehouseID: main.ID, Quantity: 2})
+		release(order)
+
+		// Main can ship both lines, where the fullest warehouse of each
+		// product would ship from two
+		mice := models.CreateOrderItemRequest{ProductID: mouse.ID, Quantity: 3}
+		order = place(allocation.SingleWarehouseFirst{}, laptops(4), mice)
+		mustHaveAllocations(t, order.Items[0], models.OrderItemAllocation{WarehouseID: annex.ID, Quantity: 4})
+		mustHaveAllocations(t, order.Items[1], models.OrderItemAllocation{WarehouseID: main.ID, Quantity: 3})
+		release(order)
+		order = place(allocation.MinimiseSplits{}, laptops(4), mice)
+		mustHaveAllocations(t, order.Items[0], models.OrderItemAllocation{WarehouseID: main.ID, Quantity: 4})
+		mustHaveAllocations(t, order.Items[1], models.OrderItemAllocation{WarehouseID: main.ID, Quantity: 3})
+		release(order)
+
+		// Inactive warehouses are not allocated
+		mustNoError(t, repos.Warehouses.UpdateWarehouse(annex.ID, &models.UpdateWarehouseRequest{Name: "Annex"}))
+		order = place(allocation.SingleWarehouseFirst{}, laptops(6))
+		mustHaveAllocations(t, order.Items[0],
+			models.OrderItemAllocation{WarehouseID: main.ID, Quantity: 5},
+			models.OrderItemAllocation{WarehouseID: depot.ID, Quantity: 1})
+		release(order)
+		mustHaveReserved(t, repos, main.ID, laptop.ID, 5, 0)
+		mustHaveReserved(t, repos, depot.ID, laptop.ID, 4, 0)
+	})
+
+	t.Run("PriceSnapshots", func(t *testing.T) {
+		repos := newRepos(t)
+		customer := SeedUser(t, repos, "customer", "customer")
+		main := SeedWarehouse(t, repos, "Main")
+		laptop := SeedProduct(t, repos, main.ID, "Laptop", 1000, 5)
+		mouse := SeedProduct(t, repos, main.ID, "Mouse", 24.99, 10)
+
+		created, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 2},
+			{ProductID: mouse.ID, Quantity: 3},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		if created.Order.TotalAmount != 2074.97 {
+			t.Fatalf("CreateOrder total = %v, want 2074.97", created.Order.TotalAmount)
+		}
+
+		// Editing the product leaves the order as it was placed
+		mustNoError(t, repos.Products.UpdateProduct(laptop.ID, &models.ProductRequest{
+			Name: "Laptop Pro", Description: "Faster", Price: 1200, Stock: 5, WarehouseID: main.ID,
+		}))
+
+		want := []models.OrderItem{
+			{ProductID: laptop.ID, Quantity: 2, Price: 1000, LineTotal: 2000,
+				ProductName: "Laptop", ProductDescription: "Laptop description"},
+			{ProductID: mouse.ID, Quantity: 3, Price: 24.99, LineTotal: 74.97,
+				ProductName: "Mouse", ProductDescription: "Mouse description"},
+		}
+		items, err := repos.Orders.GetOrderItems(created.Order.ID)
+		mustNoError(t, err)
+		for _, got := range [][]models.OrderItem{created.Items, items} {
+			if len(got) != len(want) {
+				t.Fatalf("order items = %+v, want %d", got, len(want))
+			}
+			for i := range want {
+				g := got[i]
+				if g.ProductID != want[i].ProductID || g.Quantity != want[i].Quantity || g.Price != want[i].Price ||
+					g.LineTotal != want[i].LineTotal || g.ProductName != want[i].ProductName ||
+					g.ProductDescription != want[i].ProductDescription {
+					t.Fatalf("order item %d = %+v, want %+v", i, g, want[i])
+				}
+			}
+		}
+		order, err := repos.Orders.GetOrder(created.Order.ID)
+		mustNoError(t, err)
+		if order.TotalAmount != 2074.97 {
+			t.Fatalf("GetOrder total after the product changed = %v, want 2074.97", order.TotalAmount)
+		}
+
+		// New orders are charged the new price
+		later, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 1},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		if later.Order.TotalAmount != 1200 || later.Items[0].Price != 1200 || later.Items[0].ProductName != "Laptop Pro" {
+			t.Fatalf("order after the product changed = %+v", later)
+		}
+	})
+
+	t.Run("ExpirePendingOrders", func(t *testing.T) {
+		repos := newRepos(t)
+		customer := SeedUser(t, repos, "customer", "customer")
+		w := SeedWarehouse(t, repos, "Main")
+		laptop := SeedProduct(t, repos, w.ID, "Laptop", 1000, 5)
+
+		pending, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 2},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		confirmed, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 1},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		mustNoError(t, repos.Orders.UpdateOrderStatus(confirmed.Order.ID, models.OrderPending, models.OrderConfirmed, customer.ID))
+		mustHaveReserved(t, repos, w.ID, laptop.ID, 4, 2)
+
+		expired, err := repos.Orders.ExpirePendingOrders(time.Now().Add(-time.Hour))
+		mustNoError(t, err)
+		if expired != 0 {
+			t.Fatalf("ExpirePendingOrders of recent orders = %d, want 0", expired)
+		}
+
+		expired, err = repos.Orders.ExpirePendingOrders(time.Now().Add(time.Hour))
+		mustNoError(t, err)
+		if expired != 1 {
+			t.Fatalf("ExpirePendingOrders = %d, want 1", expired)
+		}
+		mustHaveReserved(t, repos, w.ID, laptop.ID, 4, 0)
+
+		order, err := repos.Orders.GetOrder(pending.Order.ID)
+		mustNoError(t, err)
+		if order.Status != models.OrderCancelled {
+			t.Fatalf("expired order status = %q, want cancelled", order.Status)
+		}
+		order, err = repos.Orders.GetOrder(confirmed.Order.ID)
+		mustNoError(t, err)
+		if order.Status != models.OrderConfirmed {
+			t.Fatalf("confirmed order status after expiry = %q, want confirmed", order.Status)
+		}
+
+		history, err := repos.Orders.GetOrderStatusHistory(pending.Order.ID)
+		mustNoError(t, err)
+		if last := history[len(history)-1]; last.ToStatus != models.OrderCancelled || last.ChangedBy != nil {
+			t.Fatalf("expiry history entry = %+v, want cancelled without a user", last)
+		}
+	})
+
+	t.Run("CancelAfterPicking", func(t *testing.T) {
+		repos := newRepos(t)
+		customer := SeedUser(t, repos, "customer", "customer")
+		w := SeedWarehouse(t, repos, "Main")
+		laptop := SeedProduct(t, repos, w.ID, "Laptop", 1000, 5)
+
+		created, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 2},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+		orderID := created.Order.ID
+
+		mustNoError(t, repos.Orders.UpdateOrderStatus(orderID, models.OrderPending, models.OrderConfirmed, customer.ID))
+		mustNoError(t, repos.Orders.UpdateOrderStatus(orderID, models.OrderConfirmed, models.OrderPicking, customer.ID))
+		MustHaveStock(t, repos, w.ID, laptop.ID, 3)
+
+		// Stock being picked is still in the warehouse
+		mustNoError(t, repos.Orders.UpdateOrderStatus(orderID, models.OrderPicking, models.OrderCancelled, customer.ID))
+		MustHaveStock(t, repos, w.ID, laptop.ID, 5)
+
+		order, err := repos.Orders.GetOrderByID(orderID, customer.ID)
+		mustNoError(t, err)
+		if order.Status != models.OrderCancelled {
+			t.Fatalf("GetOrderByID status = %q, want cancelled", order.Status)
+		}
+	})
+
+	t.Run("InsufficientStock", func(t *testing.T) {
+		repos := newRepos(t)
+		customer := SeedUser(t, repos, "customer", "customer")
+		w := SeedWarehouse(t, repos, "Main")
+		laptop := SeedProduct(t, repos, w.ID, "Laptop", 1000, 1)
+
+		var insufficient *repository.InsufficientWarehouseStockError
+		if _, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 2},
+		}, allocation.SingleWarehouseFirst{}); !errors.As(err, &insufficient) || insufficient.ProductID != laptop.ID {
+			t.Fatalf("CreateOrder with insufficient stock = %v, want *InsufficientWarehouseStockError", err)
+		}
+
+		orders, err := repos.Orders.GetOrdersByUserID(customer.ID)
+		mustNoError(t, err)
+		if len(orders) != 0 {
+			t.Fatalf("failed CreateOrder left %d orders", len(orders))
+		}
+	})
+
+	t.Run("DeleteProductKeepsOrders", func(t *testing.T) {
+		repos := newRepos(t)
+		customer := SeedUser(t, repos, "customer", "customer")
+		w := SeedWarehouse(t, repos, "Main")
+		laptop := SeedProduct(t, repos, w.ID, "Laptop", 1000, 5)
+
+		created, err := repos.Orders.CreateOrder(customer.ID, []models.CreateOrderItemRequest{
+			{ProductID: laptop.ID, Quantity: 1},
+		}, allocation.SingleWarehouseFirst{})
+		mustNoError(t, err)
+
+		var inUse *repository.ProductInUseError
+		if err := repos.Products.DeleteProduct(laptop.ID); !errors.As(err, &inUse) || inUse.ProductID != laptop.ID {
+			t.Fatalf("DeleteProduct of an ordered product = %v, want *ProductInUseError", err)
+		}
+		items, err := repos.Orders.GetOrderItems(created.Order.ID)
+		mustNoError(t, err)
+		if len(items) != 1 || items[0].ProductName != "Laptop" {
+			t.Fatalf("order items after refused delete = %+v, want the laptop line", items)
+		}
+		_, err = repos.Products.GetProductByID(laptop.ID)
+		mustNoError(t, err)
+	})
+}
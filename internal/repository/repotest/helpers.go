@@ -0,0 +1,110 @@
+package repotest
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/app"
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+// SeedUser creates an active user with the password hash "hash"
+func SeedUser(t testing.TB, repos app.Repositories, username, role string) *models.User {
+	t.Helper()
+	user, err := repos.Users.Create(&models.User{
+		Username:     username,
+		PasswordHash: "hash",
+		IsActive:     true,
+		Role:         role,
+	})
+	if err != nil {
+		t.Fatalf("seed user %s: %v", username, err)
+	}
+	return user
+}
+
+// SeedWarehouse creates an active warehouse
+func SeedWarehouse(t testing.TB, repos app.Repositories, name string) *models.Warehouse {
+	t.Helper()
+	warehouse, err := repos.Warehouses.CreateWarehouse(&models.CreateWarehouseRequest{Name: name})
+	if err != nil {
+		t.Fatalf("seed warehouse %s: %v", name, err)
+	}
+	return warehouse
+}
+
+// SeedProduct creates a product stocked in the given warehouse
+func SeedProduct(t testing.TB, repos app.Repositories, warehouseID int, name string, price float64, stock int) *models.Product {
+	t.Helper()
+	product, err := repos.Products.CreateProduct(&models.ProductRequest{
+		Name:        name,
+		Description: name + " description",
+		Price:       price,
+		Stock:       stock,
+		WarehouseID: warehouseID,
+	})
+	if err != nil {
+		t.Fatalf("seed product %s: %v", name, err)
+	}
+	return product
+}
+
+// MustHaveStock fails the test unless the warehouse holds exactly quantity
+// units of the product
+func MustHaveStock(t testing.TB, repos app.Repositories, warehouseID, productID, quantity int) {
+	t.Helper()
+	stock, err := repos.Warehouses.GetProductStockInWarehouse(warehouseID, productID)
+	if err != nil {
+		t.Fatalf("stock of product %d in warehouse %d: %v", productID, warehouseID, err)
+	}
+	if stock.Quantity != quantity {
+		t.Fatalf("stock of product %d in warehouse %d = %d, want %d",
+			productID, warehouseID, stock.Quantity, quantity)
+	}
+}
+
+// mustHaveReserved fails the test unless the warehouse holds quantity units
+// of the product, reserved of them reserved
+func mustHaveReserved(t testing.TB, repos app.Repositories, warehouseID, productID, quantity, reserved int) {
+	t.Helper()
+	stock, err := repos.Warehouses.GetProductStockInWarehouse(warehouseID, productID)
+	if err != nil {
+		t.Fatalf("stock of product %d in warehouse %d: %v", productID, warehouseID, err)
+	}
+	if stock.Quantity != quantity || stock.ReservedQuantity != reserved {
+		t.Fatalf("stock of product %d in warehouse %d = %d, %d reserved, want %d, %d reserved",
+			productID, warehouseID, stock.Quantity, stock.ReservedQuantity, quantity, reserved)
+	}
+}
+
+// mustHaveAllocations fails the test unless the item is taken from exactly
+// the given warehouses, in that order. Warehouse names are not compared.
+func mustHaveAllocations(t testing.TB, item models.OrderItem, want ...models.OrderItemAllocation) {
+	t.Helper()
+	withoutNames := func(allocations []models.OrderItemAllocation) []models.OrderItemAllocation {
+		stripped := make([]models.OrderItemAllocation, len(allocations))
+		for i, a := range allocations {
+			stripped[i] = models.OrderItemAllocation{WarehouseID: a.WarehouseID, Quantity: a.Quantity}
+		}
+		return stripped
+	}
+	if got, want := withoutNames(item.Allocations), withoutNames(want); !slices.Equal(got, want) {
+		t.Fatalf("allocations of product %d = %+v, want %+v", item.ProductID, got, want)
+	}
+}
+
+func mustNoError(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func mustBeNoRows(t testing.TB, err error) {
+	t.Helper()
+	if !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("error = %v, want pgx.ErrNoRows", err)
+	}
+}
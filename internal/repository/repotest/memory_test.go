@@ -0,0 +1,7 @@
+package repotest
+
+import "testing"
+
+func TestMemoryContract(t *testing.T) {
+	Run(t, Memory)
+}
@@ -0,0 +1,13 @@
+package repotest
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPostgresContract(t *testing.T) {
+	if os.Getenv("TEST_DATABASE_URL") == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	Run(t, Postgres)
+}
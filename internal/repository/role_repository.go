@@ -0,0 +1,171 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+type RoleRepository interface {
+	GetPermissions() ([]models.Permission, error)
+	GetRoles() ([]models.Role, error)
+	GetRole(name string) (*models.Role, error)
+	CreateRole(role *models.Role) error
+	// SetRolePermissions replaces the permissions of a role
+	SetRolePermissions(name string, permissions []string) error
+}
+
+type roleRepo struct {
+	q db.Querier
+}
+
+func NewRoleRepository(q db.Querier) RoleRepository {
+	return &roleRepo{q: q}
+}
+
+func (r *roleRepo) GetPermissions() ([]models.Permission, error) {
+	rows, err := r.q.Query(context.Background(),
+		`SELECT name, description FROM permissions ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []models.Permission{}
+	for rows.Next() {
+		var p models.Permission
+		if err := rows.Scan(&p.Name, &p.Description); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+func (r *roleRepo) GetRoles() ([]models.Role, error) {
+	rows, err := r.q.Query(context.Background(),
+		`SELECT r.name, r.description,
+                COALESCE(ARRAY_AGG(rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+         FROM roles r
+         LEFT JOIN role_permissions rp ON rp.role = r.name
+         GROUP BY r.name, r.description
+         ORDER BY r.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []models.Role{}
+	for rows.Next() {
+		var role models.Role
+		if err := rows.Scan(&role.Name, &role.Description, &role.Permissions); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (r *roleRepo) GetRole(name string) (*models.Role, error) {
+	var role models.Role
+	err := r.q.QueryRow(context.Background(),
+		`SELECT r.name, r.description,
+                COALESCE(ARRAY_AGG(rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+         FROM roles r
+         LEFT JOIN role_permissions rp ON rp.role = r.name
+         WHERE r.name = $1
+         GROUP BY r.name, r.description`,
+		name).Scan(&role.Name, &role.Description, &role.Permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+func (r *roleRepo) CreateRole(role *models.Role) error {
+	// Begin transaction
+	tx, err := r.q.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(),
+		`INSERT INTO roles (name, description) VALUES ($1, $2)`,
+		role.Name, role.Description)
+	if err != nil {
+		return err
+	}
+	if err := insertRolePermissions(tx, role.Name, role.Permissions); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func (r *roleRepo) SetRolePermissions(name string, permissions []string) error {
+	// Begin transaction
+	tx, err := r.q.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	// Lock the role so concurrent edits apply one after the other
+	var exists bool
+	err = tx.QueryRow(context.Background(),
+		`SELECT true FROM roles WHERE name = $1 FOR UPDATE`, name).Scan(&exists)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &RoleNotFoundError{Role: name}
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(),
+		`DELETE FROM role_permissions WHERE role = $1`, name)
+	if err != nil {
+		return err
+	}
+	if err := insertRolePermissions(tx, name, permissions); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func insertRolePermissions(tx pgx.Tx, role string, permissions []string) error {
+	if len(permissions) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(context.Background(),
+		`INSERT INTO role_permissions (role, permission)
+         SELECT $1, unnest($2::text[])
+         ON CONFLICT DO NOTHING`,
+		role, permissions)
+	return err
+}
+
+// RoleNotFoundError is returned for unknown role names
+type RoleNotFoundError struct {
+	Role string
+}
+
+func (e *RoleNotFoundError) Error() string {
+	return "role not found"
+}
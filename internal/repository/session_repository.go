@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+type SessionRepository interface {
+	CreateSession(session *models.Session) error
+	GetSession(sessionID string) (*models.Session, error)
+	// TouchSession records a refresh made from the given client
+	TouchSession(sessionID string, lastUsedAt time.Time, userAgent, ipAddress string) error
+	// GetActiveSessions lists the sessions that still hold a usable refresh token
+	GetActiveSessions(userID int, now time.Time) ([]models.Session, error)
+	// DeleteOrphanedSessions removes sessions whose refresh tokens are all gone
+	DeleteOrphanedSessions() (int64, error)
+}
+
+type sessionRepo struct {
+	q db.Querier
+}
+
+func NewSessionRepository(q db.Querier) SessionRepository {
+	return &sessionRepo{q: q}
+}
+
+func (r *sessionRepo) CreateSession(session *models.Session) error {
+	_, err := r.q.Exec(context.Background(),
+		`INSERT INTO sessions (id, user_id, user_agent, ip_address, device_label, created_at, last_used_at)
+         VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		session.ID, session.UserID, session.UserAgent, session.IPAddress, session.DeviceLabel,
+		session.CreatedAt, session.LastUsedAt)
+	return err
+}
+
+func (r *sessionRepo) GetSession(sessionID string) (*models.Session, error) {
+	var s models.Session
+	err := r.q.QueryRow(context.Background(),
+		`SELECT id, user_id, user_agent, ip_address, device_label, created_at, last_used_at
+         FROM sessions WHERE id = $1`,
+		sessionID).Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IPAddress, &s.DeviceLabel,
+		&s.CreatedAt, &s.LastUsedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (r *sessionRepo) TouchSession(sessionID string, lastUsedAt time.Time, userAgent, ipAddress string) error {
+	_, err := r.q.Exec(context.Background(),
+		`UPDATE sessions SET last_used_at = $1, user_agent = $2, ip_address = $3 WHERE id = $4`,
+		lastUsedAt, userAgent, ipAddress, sessionID)
+	return err
+}
+
+func (r *sessionRepo) GetActiveSessions(userID int, now time.Time) ([]models.Session, error) {
+	// The unused, unrevoked token of a family is the head of its rotation chain
+	rows, err := r.q.Query(context.Background(),
+		`SELECT s.id, s.user_id, s.user_agent, s.ip_address, s.device_label, s.created_at, s.last_used_at,
+                rt.expires_at
+         FROM sessions s
+         JOIN refresh_tokens rt ON rt.family_id = s.id
+         WHERE s.user_id = $1 AND rt.used_at IS NULL AND rt.revoked_at IS NULL AND rt.expires_at > $2
+         ORDER BY s.last_used_at DESC`,
+		userID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		err := rows.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IPAddress, &s.DeviceLabel,
+			&s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (r *sessionRepo) DeleteOrphanedSessions() (int64, error) {
+	result, err := r.q.Exec(context.Background(),
+		`DELETE FROM sessions s
+         WHERE NOT EXISTS (SELECT 1 FROM refresh_tokens rt WHERE rt.family_id = s.id)`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
@@ -2,6 +2,8 @@ package repository
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/slmbngl/OrderAplication/internal/adapters/db"
@@ -13,42 +15,63 @@ type UserRepository interface {
 	GetByUsername(username string) (*models.User, error)
 	GetAllUsers() ([]models.User, error)
 	UpdateUserRole(userID int, role string) error
+	UpdatePasswordHash(userID int, passwordHash string) error
+	SetActive(userID int, active bool) error
+	// SearchUsers returns a page of the users matching filter, newest first,
+	// and how many match in total
+	SearchUsers(filter models.UserFilter) ([]models.User, int, error)
+	// SoftDelete marks a user deleted and inactive, keeping the row for the
+	// orders referencing it. Deleted users get a UserNotFoundError.
+	SoftDelete(userID int, deletedAt time.Time) error
 	GetByID(userID int) (*models.GetMeResponseReq, error) // Optional: Get user by ID
-	// Refresh token functions
-	SaveRefreshToken(userID int, token string, expiresAt time.Time) error
-	GetRefreshToken(token string) (*RefreshToken, error)
-	DeleteRefreshToken(token string) error
+	// Access tokens issued with an older token version are rejected
+	GetTokenVersion(userID int) (int, error)
+	IncrementTokenVersion(userID int) error
+	IncrementRoleTokenVersions(role string) error
+	// Refresh token functions, tokens are looked up by their hash
+	SaveRefreshToken(token *RefreshToken) error
+	GetRefreshToken(tokenHash string) (*RefreshToken, error)
+	MarkRefreshTokenUsed(tokenHash string, usedAt time.Time) error
+	RevokeRefreshTokenFamily(familyID string, revokedAt time.Time) error
 	DeleteUserRefreshTokens(userID int) error
+	DeleteExpiredRefreshTokens(before time.Time) (int64, error)
 }
 
-// Refresh Token modeli
+// Refresh Token modeli. Every refresh creates a new token in the same family,
+// so a family stands for one login.
 type RefreshToken struct {
-	ID        int       `json:"id"`
-	UserID    int       `json:"user_id"`
-	Token     string    `json:"token"`
-	ExpiresAt time.Time `json:"expires_at"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	TokenHash string     `json:"-"`
+	FamilyID  string     `json:"family_id"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
 }
 
-type userRepo struct{}
+type userRepo struct {
+	q db.Querier
+}
 
-func NewUserRepository() UserRepository {
-	return &userRepo{}
+func NewUserRepository(q db.Querier) UserRepository {
+	return &userRepo{q: q}
 }
 
 func (r *userRepo) Create(user *models.User) (*models.User, error) {
+	// Set the default role if not specified
+	if user.Role == "" {
+		user.Role = models.RoleCustomer
+	}
+
 	var userID int
-	err := db.Pool.QueryRow(context.Background(),
+	err := r.q.QueryRow(context.Background(),
 		`INSERT INTO users (username, password_hash, is_active, role) VALUES ($1, $2, $3, $4) RETURNING id`,
 		user.Username, user.PasswordHash, user.IsActive, user.Role).Scan(&userID)
 
 	if err != nil {
 		return nil, err
 	}
-	// Set the ID and default role if not specified
-	if user.Role == "" {
-		user.Role = "user" // Default role if not specified
-	}
 
 	user.ID = userID
 	return user, nil
@@ -56,9 +79,11 @@ func (r *userRepo) Create(user *models.User) (*models.User, error) {
 
 func (r *userRepo) GetByUsername(username string) (*models.User, error) {
 	var user models.User
-	err := db.Pool.QueryRow(context.Background(),
-		`SELECT id, username, password_hash, is_active, role, created_at FROM users WHERE username = $1`,
-		username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.IsActive, &user.Role, &user.CreatedAt)
+	err := r.q.QueryRow(context.Background(),
+		`SELECT id, username, password_hash, is_active, role, token_version, created_at, deleted_at
+         FROM users WHERE username = $1`,
+		username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.IsActive, &user.Role,
+		&user.TokenVersion, &user.CreatedAt, &user.DeletedAt)
 
 	if err != nil {
 		return nil, err
@@ -69,8 +94,8 @@ func (r *userRepo) GetByUsername(username string) (*models.User, error) {
 
 // GetAllUsers retrieves all users from the database
 func (r *userRepo) GetAllUsers() ([]models.User, error) {
-	rows, err := db.Pool.Query(context.Background(),
-		`SELECT id, username, is_active, role, created_at FROM users ORDER BY created_at DESC`)
+	rows, err := r.q.Query(context.Background(),
+		`SELECT id, username, is_active, role, created_at, deleted_at FROM users ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +104,7 @@ func (r *userRepo) GetAllUsers() ([]models.User, error) {
 	var users []models.User
 	for rows.Next() {
 		var user models.User
-		err := rows.Scan(&user.ID, &user.Username, &user.IsActive, &user.Role, &user.CreatedAt)
+		err := rows.Scan(&user.ID, &user.Username, &user.IsActive, &user.Role, &user.CreatedAt, &user.DeletedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -97,7 +122,7 @@ func (r *userRepo) GetAllUsers() ([]models.User, error) {
 
 // UpdateUserRole updates a user's role in the database
 func (r *userRepo) UpdateUserRole(userID int, role string) error {
-	result, err := db.Pool.Exec(context.Background(),
+	result, err := r.q.Exec(context.Background(),
 		`UPDATE users SET role = $1 WHERE id = $2`,
 		role, userID)
 	if err != nil {
@@ -112,10 +137,120 @@ func (r *userRepo) UpdateUserRole(userID int, role string) error {
 	return nil
 }
 
+// UpdatePasswordHash replaces a user's stored password hash
+func (r *userRepo) UpdatePasswordHash(userID int, passwordHash string) error {
+	result, err := r.q.Exec(context.Background(),
+		`UPDATE users SET password_hash = $1 WHERE id = $2`,
+		passwordHash, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return &UserNotFoundError{UserID: userID}
+	}
+
+	return nil
+}
+
+func (r *userRepo) SetActive(userID int, active bool) error {
+	result, err := r.q.Exec(context.Background(),
+		`UPDATE users SET is_active = $1 WHERE id = $2`,
+		active, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return &UserNotFoundError{UserID: userID}
+	}
+
+	return nil
+}
+
+func (r *userRepo) SearchUsers(filter models.UserFilter) ([]models.User, int, error) {
+	var conditions []string
+	var args []any
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Username != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(filter.Username)
+		where(`username ILIKE '%%' || $%d || '%%'`, escaped)
+	}
+	if filter.Role != "" {
+		where(`role = $%d`, filter.Role)
+	}
+	if filter.IsActive != nil {
+		where(`is_active = $%d`, *filter.IsActive)
+	}
+	if filter.CreatedFrom != nil {
+		where(`created_at >= $%d`, *filter.CreatedFrom)
+	}
+	if filter.CreatedTo != nil {
+		where(`created_at < $%d`, *filter.CreatedTo)
+	}
+	if !filter.IncludeDeleted {
+		conditions = append(conditions, `deleted_at IS NULL`)
+	}
+	clause := ""
+	if len(conditions) > 0 {
+		clause = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	err := r.q.QueryRow(context.Background(), `SELECT COUNT(*) FROM users`+clause, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	rows, err := r.q.Query(context.Background(),
+		`SELECT id, username, is_active, role, created_at, deleted_at FROM users`+clause+
+			fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d`, len(args)-1, len(args)),
+		args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		err := rows.Scan(&user.ID, &user.Username, &user.IsActive, &user.Role, &user.CreatedAt, &user.DeletedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+func (r *userRepo) SoftDelete(userID int, deletedAt time.Time) error {
+	result, err := r.q.Exec(context.Background(),
+		`UPDATE users SET deleted_at = $2, is_active = FALSE WHERE id = $1 AND deleted_at IS NULL`,
+		userID, deletedAt)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return &UserNotFoundError{UserID: userID}
+	}
+
+	return nil
+}
+
 // GetByID retrieves a user by their ID
 func (r *userRepo) GetByID(userID int) (*models.GetMeResponseReq, error) {
 	var user models.GetMeResponseReq
-	err := db.Pool.QueryRow(context.Background(),
+	err := r.q.QueryRow(context.Background(),
 		`SELECT id, username, is_active, created_at, role FROM users WHERE id = $1`,
 		userID).Scan(&user.ID, &user.Username, &user.IsActive, &user.CreatedAt, &user.Role)
 
@@ -126,6 +261,40 @@ func (r *userRepo) GetByID(userID int) (*models.GetMeResponseReq, error) {
 	return &user, nil
 }
 
+// GetTokenVersion returns the token version of a user
+func (r *userRepo) GetTokenVersion(userID int) (int, error) {
+	var version int
+	err := r.q.QueryRow(context.Background(),
+		`SELECT token_version FROM users WHERE id = $1`,
+		userID).Scan(&version)
+	return version, err
+}
+
+// IncrementTokenVersion invalidates every access token issued to a user so far
+func (r *userRepo) IncrementTokenVersion(userID int) error {
+	result, err := r.q.Exec(context.Background(),
+		`UPDATE users SET token_version = token_version + 1 WHERE id = $1`,
+		userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return &UserNotFoundError{UserID: userID}
+	}
+
+	return nil
+}
+
+// IncrementRoleTokenVersions invalidates the access tokens of every user with
+// the given role, e.g. after its permissions changed
+func (r *userRepo) IncrementRoleTokenVersions(role string) error {
+	_, err := r.q.Exec(context.Background(),
+		`UPDATE users SET token_version = token_version + 1 WHERE role = $1`,
+		role)
+	return err
+}
+
 // Custom error type for user not found
 type UserNotFoundError struct {
 	UserID int
@@ -136,19 +305,23 @@ func (e *UserNotFoundError) Error() string {
 }
 
 // SaveRefreshToken saves a refresh token for a user
-func (r *userRepo) SaveRefreshToken(userID int, token string, expiresAt time.Time) error {
-	_, err := db.Pool.Exec(context.Background(),
-		`INSERT INTO refresh_tokens (user_id, token, expires_at) VALUES ($1, $2, $3)`,
-		userID, token, expiresAt)
-	return err
+func (r *userRepo) SaveRefreshToken(token *RefreshToken) error {
+	return r.q.QueryRow(context.Background(),
+		`INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at)
+         VALUES ($1, $2, $3, $4)
+         RETURNING id, created_at`,
+		token.UserID, token.TokenHash, token.FamilyID, token.ExpiresAt).
+		Scan(&token.ID, &token.CreatedAt)
 }
 
 // Get a specific refresh token
-func (r *userRepo) GetRefreshToken(token string) (*RefreshToken, error) {
+func (r *userRepo) GetRefreshToken(tokenHash string) (*RefreshToken, error) {
 	var rt RefreshToken
-	err := db.Pool.QueryRow(context.Background(),
-		`SELECT id, user_id, token, expires_at, created_at FROM refresh_tokens WHERE token = $1`,
-		token).Scan(&rt.ID, &rt.UserID, &rt.Token, &rt.ExpiresAt, &rt.CreatedAt)
+	err := r.q.QueryRow(context.Background(),
+		`SELECT id, user_id, token_hash, family_id, expires_at, created_at, used_at, revoked_at
+         FROM refresh_tokens WHERE token_hash = $1`,
+		tokenHash).Scan(&rt.ID, &rt.UserID, &rt.TokenHash, &rt.FamilyID, &rt.ExpiresAt,
+		&rt.CreatedAt, &rt.UsedAt, &rt.RevokedAt)
 
 	if err != nil {
 		return nil, err
@@ -157,16 +330,53 @@ func (r *userRepo) GetRefreshToken(token string) (*RefreshToken, error) {
 	return &rt, nil
 }
 
-// Delete a specific refresh token
-func (r *userRepo) DeleteRefreshToken(token string) error {
-	_, err := db.Pool.Exec(context.Background(),
-		`DELETE FROM refresh_tokens WHERE token = $1`, token)
+// MarkRefreshTokenUsed consumes a token. Only one caller can consume a token;
+// everyone else gets a RefreshTokenUsedError.
+func (r *userRepo) MarkRefreshTokenUsed(tokenHash string, usedAt time.Time) error {
+	result, err := r.q.Exec(context.Background(),
+		`UPDATE refresh_tokens SET used_at = $1
+         WHERE token_hash = $2 AND used_at IS NULL AND revoked_at IS NULL`,
+		usedAt, tokenHash)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return &RefreshTokenUsedError{}
+	}
+
+	return nil
+}
+
+// RevokeRefreshTokenFamily invalidates every token of a login
+func (r *userRepo) RevokeRefreshTokenFamily(familyID string, revokedAt time.Time) error {
+	_, err := r.q.Exec(context.Background(),
+		`UPDATE refresh_tokens SET revoked_at = $1 WHERE family_id = $2 AND revoked_at IS NULL`,
+		revokedAt, familyID)
 	return err
 }
 
 // Delete user refresh tokens (logout all devices)
 func (r *userRepo) DeleteUserRefreshTokens(userID int) error {
-	_, err := db.Pool.Exec(context.Background(),
+	_, err := r.q.Exec(context.Background(),
 		`DELETE FROM refresh_tokens WHERE user_id = $1`, userID)
 	return err
 }
+
+// DeleteExpiredRefreshTokens purges tokens that expired before the given time
+func (r *userRepo) DeleteExpiredRefreshTokens(before time.Time) (int64, error) {
+	result, err := r.q.Exec(context.Background(),
+		`DELETE FROM refresh_tokens WHERE expires_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// RefreshTokenUsedError is returned when a refresh token was already used or
+// revoked
+type RefreshTokenUsedError struct{}
+
+func (e *RefreshTokenUsedError) Error() string {
+	return "refresh token already used"
+}
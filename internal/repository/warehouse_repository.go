@@ -2,9 +2,11 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/slmbngl/OrderAplication/internal/adapters/db"
 	"github.com/slmbngl/OrderAplication/internal/models"
 )
@@ -21,6 +23,8 @@ type WarehouseRepository interface {
 	GetWarehouseStocks(warehouseID int) ([]models.WarehouseStock, error)
 	GetProductStockInWarehouse(warehouseID, productID int) (*models.WarehouseStock, error)
 	GetAllStocks() ([]models.WarehouseStock, error)
+	// UpdateStock sets the stock of a product in a warehouse. Setting it
+	// below the reserved quantity returns an InsufficientWarehouseStockError.
 	UpdateStock(warehouseID, productID, quantity int) error
 	AddStock(warehouseID, productID, quantity int) error
 
@@ -30,33 +34,43 @@ type WarehouseRepository interface {
 	GetTransferByID(id int) (*models.StockTransfer, error)
 	UpdateTransferStatus(id int, status string) error
 	ProcessTransfer(id int) error
+
+	// Warehouse assignments
+	GetUserWarehouseIDs(userID int) ([]int, error)
+	// SetUserWarehouses replaces the warehouses a user is assigned to
+	SetUserWarehouses(userID int, warehouseIDs []int) error
 }
 
-type warehouseRepo struct{}
+type warehouseRepo struct {
+	q db.Querier
+}
 
-func NewWarehouseRepository() WarehouseRepository {
-	return &warehouseRepo{}
+func NewWarehouseRepository(q db.Querier) WarehouseRepository {
+	return &warehouseRepo{q: q}
 }
 
 // Warehouse management
 func (r *warehouseRepo) CreateWarehouse(req *models.CreateWarehouseRequest) (*models.Warehouse, error) {
 	var warehouse models.Warehouse
-	err := db.Pool.QueryRow(context.Background(),
-		`INSERT INTO warehouses (name, address) VALUES ($1, $2) 
-         RETURNING id, name, address, is_active, created_at`,
-		req.Name, req.Address).Scan(&warehouse.ID, &warehouse.Name, &warehouse.Address,
-		&warehouse.IsActive, &warehouse.CreatedAt)
+	var latitude, longitude *float64
+	lat, lon := coordinates(req.Location)
+	err := r.q.QueryRow(context.Background(),
+		`INSERT INTO warehouses (name, address, latitude, longitude) VALUES ($1, $2, $3, $4) 
+         RETURNING id, name, address, latitude, longitude, is_active, created_at`,
+		req.Name, req.Address, lat, lon).Scan(&warehouse.ID, &warehouse.Name, &warehouse.Address,
+		&latitude, &longitude, &warehouse.IsActive, &warehouse.CreatedAt)
 
 	if err != nil {
 		return nil, err
 	}
+	warehouse.Location = locationOf(latitude, longitude)
 
 	return &warehouse, nil
 }
 
 func (r *warehouseRepo) GetAllWarehouses() ([]models.Warehouse, error) {
-	rows, err := db.Pool.Query(context.Background(),
-		`SELECT id, name, address, is_active, created_at FROM warehouses ORDER BY name`)
+	rows, err := r.q.Query(context.Background(),
+		`SELECT id, name, address, latitude, longitude, is_active, created_at FROM warehouses ORDER BY name`)
 	if err != nil {
 		return nil, err
 	}
@@ -65,10 +79,12 @@ func (r *warehouseRepo) GetAllWarehouses() ([]models.Warehouse, error) {
 	var warehouses []models.Warehouse
 	for rows.Next() {
 		var w models.Warehouse
-		err := rows.Scan(&w.ID, &w.Name, &w.Address, &w.IsActive, &w.CreatedAt)
+		var latitude, longitude *float64
+		err := rows.Scan(&w.ID, &w.Name, &w.Address, &latitude, &longitude, &w.IsActive, &w.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
+		w.Location = locationOf(latitude, longitude)
 		warehouses = append(warehouses, w)
 	}
 
@@ -77,21 +93,26 @@ func (r *warehouseRepo) GetAllWarehouses() ([]models.Warehouse, error) {
 
 func (r *warehouseRepo) GetWarehouseByID(id int) (*models.Warehouse, error) {
 	var warehouse models.Warehouse
-	err := db.Pool.QueryRow(context.Background(),
-		`SELECT id, name, address, is_active, created_at FROM warehouses WHERE id = $1`,
-		id).Scan(&warehouse.ID, &warehouse.Name, &warehouse.Address, &warehouse.IsActive, &warehouse.CreatedAt)
+	var latitude, longitude *float64
+	err := r.q.QueryRow(context.Background(),
+		`SELECT id, name, address, latitude, longitude, is_active, created_at FROM warehouses WHERE id = $1`,
+		id).Scan(&warehouse.ID, &warehouse.Name, &warehouse.Address, &latitude, &longitude,
+		&warehouse.IsActive, &warehouse.CreatedAt)
 
 	if err != nil {
 		return nil, err
 	}
+	warehouse.Location = locationOf(latitude, longitude)
 
 	return &warehouse, nil
 }
 
 func (r *warehouseRepo) UpdateWarehouse(id int, req *models.UpdateWarehouseRequest) error {
-	result, err := db.Pool.Exec(context.Background(),
-		`UPDATE warehouses SET name = $1, address = $2, is_active = $3 WHERE id = $4`,
-		req.Name, req.Address, req.IsActive, id)
+	lat, lon := coordinates(req.Location)
+	result, err := r.q.Exec(context.Background(),
+		`UPDATE warehouses SET name = $1, address = $2, is_active = $3, latitude = $4, longitude = $5
+         WHERE id = $6`,
+		req.Name, req.Address, req.IsActive, lat, lon, id)
 
 	if err != nil {
 		return err
@@ -105,10 +126,27 @@ func (r *warehouseRepo) UpdateWarehouse(id int, req *models.UpdateWarehouseReque
 	return nil
 }
 
+// coordinates returns the latitude and longitude columns of a location
+func coordinates(l *models.Location) (latitude, longitude *float64) {
+	if l == nil {
+		return nil, nil
+	}
+	return &l.Latitude, &l.Longitude
+}
+
+// locationOf returns the location stored in the latitude and longitude
+// columns, if any
+func locationOf(latitude, longitude *float64) *models.Location {
+	if latitude == nil || longitude == nil {
+		return nil
+	}
+	return &models.Location{Latitude: *latitude, Longitude: *longitude}
+}
+
 func (r *warehouseRepo) DeleteWarehouse(id int) error {
 	// Check if warehouse has stock
 	var stockCount int
-	err := db.Pool.QueryRow(context.Background(),
+	err := r.q.QueryRow(context.Background(),
 		`SELECT COUNT(*) FROM warehouse_stocks WHERE warehouse_id = $1 AND quantity > 0`,
 		id).Scan(&stockCount)
 	if err != nil {
@@ -119,7 +157,7 @@ func (r *warehouseRepo) DeleteWarehouse(id int) error {
 		return &WarehouseHasStockError{WarehouseID: id}
 	}
 
-	result, err := db.Pool.Exec(context.Background(),
+	result, err := r.q.Exec(context.Background(),
 		`DELETE FROM warehouses WHERE id = $1`, id)
 
 	if err != nil {
@@ -136,7 +174,7 @@ func (r *warehouseRepo) DeleteWarehouse(id int) error {
 
 // Stock management
 func (r *warehouseRepo) GetWarehouseStocks(warehouseID int) ([]models.WarehouseStock, error) {
-	rows, err := db.Pool.Query(context.Background(),
+	rows, err := r.q.Query(context.Background(),
 		`SELECT ws.id, ws.warehouse_id, ws.product_id, ws.quantity, ws.reserved_quantity,
                 ws.created_at, ws.updated_at, w.name, p.name, p.price
          FROM warehouse_stocks ws
@@ -166,7 +204,7 @@ func (r *warehouseRepo) GetWarehouseStocks(warehouseID int) ([]models.WarehouseS
 }
 
 func (r *warehouseRepo) GetAllStocks() ([]models.WarehouseStock, error) {
-	rows, err := db.Pool.Query(context.Background(),
+	rows, err := r.q.Query(context.Background(),
 		`SELECT ws.id, ws.warehouse_id, ws.product_id, ws.quantity, ws.reserved_quantity,
                 ws.created_at, ws.updated_at, w.name, p.name, p.price
          FROM warehouse_stocks ws
@@ -196,7 +234,7 @@ func (r *warehouseRepo) GetAllStocks() ([]models.WarehouseStock, error) {
 
 func (r *warehouseRepo) GetProductStockInWarehouse(warehouseID, productID int) (*models.WarehouseStock, error) {
 	var stock models.WarehouseStock
-	err := db.Pool.QueryRow(context.Background(),
+	err := r.q.QueryRow(context.Background(),
 		`SELECT ws.id, ws.warehouse_id, ws.product_id, ws.quantity, ws.reserved_quantity,
                 ws.created_at, ws.updated_at, w.name, p.name, p.price
          FROM warehouse_stocks ws
@@ -217,7 +255,7 @@ func (r *warehouseRepo) GetProductStockInWarehouse(warehouseID, productID int) (
 
 func (r *warehouseRepo) UpdateStock(warehouseID, productID, quantity int) error {
 	// Begin transaction
-	tx, err := db.Pool.Begin(context.Background())
+	tx, err := r.q.Begin(context.Background())
 	if err != nil {
 		return err
 	}
@@ -233,11 +271,30 @@ func (r *warehouseRepo) UpdateStock(warehouseID, productID, quantity int) error
 	}
 
 	if exists {
-		// Update existing stock
-		_, err = tx.Exec(context.Background(),
+		// Update existing stock, never below what orders have reserved
+		var result pgconn.CommandTag
+		result, err = tx.Exec(context.Background(),
 			`UPDATE warehouse_stocks SET quantity = $1, updated_at = CURRENT_TIMESTAMP 
-             WHERE warehouse_id = $2 AND product_id = $3`,
+             WHERE warehouse_id = $2 AND product_id = $3 AND reserved_quantity <= $1`,
 			quantity, warehouseID, productID)
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			var current, reserved int
+			err = tx.QueryRow(context.Background(),
+				`SELECT quantity, reserved_quantity FROM warehouse_stocks WHERE warehouse_id = $1 AND product_id = $2`,
+				warehouseID, productID).Scan(&current, &reserved)
+			if err != nil {
+				return err
+			}
+			return &InsufficientWarehouseStockError{
+				ProductID:      productID,
+				WarehouseID:    warehouseID,
+				RequiredStock:  current - quantity,
+				AvailableStock: current - reserved,
+			}
+		}
 	} else {
 		// Insert new stock record
 		_, err = tx.Exec(context.Background(),
@@ -255,7 +312,7 @@ func (r *warehouseRepo) UpdateStock(warehouseID, productID, quantity int) error
 
 func (r *warehouseRepo) AddStock(warehouseID, productID, quantity int) error {
 	// Begin transaction
-	tx, err := db.Pool.Begin(context.Background())
+	tx, err := r.q.Begin(context.Background())
 	if err != nil {
 		return err
 	}
@@ -294,7 +351,7 @@ func (r *warehouseRepo) AddStock(warehouseID, productID, quantity int) error {
 // Transfer management
 func (r *warehouseRepo) CreateStockTransfer(req *models.StockTransferRequest, requestedBy int) (*models.StockTransfer, error) {
 	var transfer models.StockTransfer
-	err := db.Pool.QueryRow(context.Background(),
+	err := r.q.QueryRow(context.Background(),
 		`INSERT INTO stock_transfers (from_warehouse_id, to_warehouse_id, product_id, quantity, reason, requested_by)
          VALUES ($1, $2, $3, $4, $5, $6)
          RETURNING id, from_warehouse_id, to_warehouse_id, product_id, quantity, status, reason, requested_by, created_at, completed_at`,
@@ -311,7 +368,7 @@ func (r *warehouseRepo) CreateStockTransfer(req *models.StockTransferRequest, re
 }
 
 func (r *warehouseRepo) GetAllTransfers() ([]models.StockTransfer, error) {
-	rows, err := db.Pool.Query(context.Background(),
+	rows, err := r.q.Query(context.Background(),
 		`SELECT st.id, st.from_warehouse_id, st.to_warehouse_id, st.product_id, st.quantity,
                 st.status, st.reason, st.requested_by, st.created_at, st.completed_at,
                 COALESCE(wf.name, 'External') as from_warehouse_name,
@@ -347,7 +404,7 @@ func (r *warehouseRepo) GetAllTransfers() ([]models.StockTransfer, error) {
 
 func (r *warehouseRepo) GetTransferByID(id int) (*models.StockTransfer, error) {
 	var transfer models.StockTransfer
-	err := db.Pool.QueryRow(context.Background(),
+	err := r.q.QueryRow(context.Background(),
 		`SELECT st.id, st.from_warehouse_id, st.to_warehouse_id, st.product_id, st.quantity,
                 st.status, st.reason, st.requested_by, st.created_at, st.completed_at,
                 COALESCE(wf.name, 'External') as from_warehouse_name,
@@ -374,7 +431,7 @@ func (r *warehouseRepo) GetTransferByID(id int) (*models.StockTransfer, error) {
 
 func (r *warehouseRepo) UpdateTransferStatus(id int, status string) error {
 	// Begin transaction
-	tx, err := db.Pool.Begin(context.Background())
+	tx, err := r.q.Begin(context.Background())
 	if err != nil {
 		return err
 	}
@@ -435,7 +492,7 @@ func (r *warehouseRepo) UpdateTransferStatus(id int, status string) error {
                  WHERE warehouse_id = $1 AND product_id = $2 FOR UPDATE`,
 				*transfer.FromWarehouseID, transfer.ProductID).Scan(&currentStock)
 			if err != nil {
-				if err == pgx.ErrNoRows {
+				if errors.Is(err, pgx.ErrNoRows) {
 					return &InsufficientStockError{
 						WarehouseID: *transfer.FromWarehouseID,
 						ProductID:   transfer.ProductID,
@@ -516,7 +573,7 @@ func (r *warehouseRepo) UpdateTransferStatus(id int, status string) error {
 
 func (r *warehouseRepo) ProcessTransfer(id int) error {
 	// Begin transaction
-	tx, err := db.Pool.Begin(context.Background())
+	tx, err := r.q.Begin(context.Background())
 	if err != nil {
 		return err
 	}
@@ -540,13 +597,14 @@ func (r *warehouseRepo) ProcessTransfer(id int) error {
 
 	// Handle stock decrease from source warehouse
 	if transfer.FromWarehouseID != nil {
+		// Units reserved by orders cannot be moved
 		var currentStock int
 		err = tx.QueryRow(context.Background(),
-			`SELECT quantity FROM warehouse_stocks 
+			`SELECT quantity - reserved_quantity FROM warehouse_stocks 
              WHERE warehouse_id = $1 AND product_id = $2 FOR UPDATE`,
 			*transfer.FromWarehouseID, transfer.ProductID).Scan(&currentStock)
 		if err != nil {
-			if err == pgx.ErrNoRows {
+			if errors.Is(err, pgx.ErrNoRows) {
 				return &InsufficientStockError{
 					WarehouseID: *transfer.FromWarehouseID,
 					ProductID:   transfer.ProductID,
@@ -633,7 +691,82 @@ func (r *warehouseRepo) ProcessTransfer(id int) error {
 	return tx.Commit(context.Background())
 }
 
+// Warehouse assignments
+func (r *warehouseRepo) GetUserWarehouseIDs(userID int) ([]int, error) {
+	rows, err := r.q.Query(context.Background(),
+		`SELECT warehouse_id FROM user_warehouses WHERE user_id = $1 ORDER BY warehouse_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func (r *warehouseRepo) SetUserWarehouses(userID int, warehouseIDs []int) error {
+	tx, err := r.q.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	// Lock the user so concurrent updates apply one after the other
+	var id int
+	err = tx.QueryRow(context.Background(),
+		`SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &UserNotFoundError{UserID: userID}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, warehouseID := range warehouseIDs {
+		var exists bool
+		err := tx.QueryRow(context.Background(),
+			`SELECT EXISTS(SELECT 1 FROM warehouses WHERE id = $1)`, warehouseID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &WarehouseNotFoundError{WarehouseID: warehouseID}
+		}
+	}
+
+	_, err = tx.Exec(context.Background(),
+		`DELETE FROM user_warehouses WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(),
+		`INSERT INTO user_warehouses (user_id, warehouse_id)
+         SELECT $1, unnest($2::int[]) ON CONFLICT DO NOTHING`,
+		userID, warehouseIDs)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
 // Custom error types
+type WarehouseNotFoundError struct {
+	WarehouseID int
+}
+
+func (e *WarehouseNotFoundError) Error() string {
+	return "warehouse not found"
+}
+
 type WarehouseHasStockError struct {
 	WarehouseID int
 }
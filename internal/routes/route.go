@@ -5,93 +5,226 @@ import (
 	"github.com/gofiber/swagger"
 	"github.com/slmbngl/OrderAplication/internal/adapters/handler"
 	"github.com/slmbngl/OrderAplication/internal/adapters/middleware"
+	"github.com/slmbngl/OrderAplication/internal/app"
+	"github.com/slmbngl/OrderAplication/internal/models"
 )
 
-func SetupRoutes(app *fiber.App) {
+func SetupRoutes(router *fiber.App, application *app.Application) {
+	h := application.Handlers
+	requireJWT := middleware.JWTMiddleware(application.Tokens, application.Revocations)
+	// Integrations call the warehouse endpoints with an API key instead
+	requireJWTOrAPIKey := middleware.JWTOrAPIKey(requireJWT, middleware.APIKeyMiddleware(application.APIKeys))
+
 	// Swagger endpoint
-	app.Get("/swagger/*", swagger.HandlerDefault)
+	router.Get("/swagger/*", swagger.HandlerDefault)
+
+	// Public keys for verifying access tokens
+	router.Get("/.well-known/jwks.json", h.Auth.JWKS)
 
-	// API groups
-	api := app.Group("/api")
+	// API groups. Everything under /admin requires a JWT; the group checks it
+	// once per request, so admin routes must not add requireJWT again.
+	api := router.Group("/api")
+	admin := api.Group("/admin", requireJWT)
 	// Auth endpoints (JWT not required)
-	SetupAuthRoutes(api)
+	SetupAuthRoutes(api, h.Auth, requireJWT)
+
+	// Two-factor endpoints; enrollment also accepts the MFA challenge of a login
+	requireJWTOrChallenge := middleware.JWTOrMFAChallenge(application.Tokens, application.Revocations, application.MFA)
+	SetupMFARoutes(api, h.Auth, requireJWT, requireJWTOrChallenge)
+
+	// Password change and reset, account deactivation and admin (de)activation
+	SetupAccountRoutes(api, admin, h.Accounts, requireJWT)
+
+	// Invitation endpoints (users:manage permission required, except accepting)
+	SetupInvitationRoutes(api, admin, h.Invitations)
+
+	// Role endpoints (roles:manage permission required)
+	SetupRoleRoutes(admin, h.Roles)
+
+	// Session endpoints (JWT required)
+	SetupSessionRoutes(api, admin, h.Sessions, requireJWT)
 
 	// Product endpoints
-	SetupProductRoutes(api)
+	SetupProductRoutes(api, h.Products, requireJWT)
 
 	// Order endpoints (JWT required)
-	SetupOrderRoutes(api)
+	SetupOrderRoutes(api, h.Orders, requireJWT)
+
+	// Admin endpoints (users:* and orders:read_all permissions)
+	SetupAdminRoutes(admin, h.Auth, h.Orders)
 
-	// Admin endpoints (Admin role required)
-	SetupAdminRoutes(api)
+	// User search, detail, creation, deletion and impersonation (users:* permissions)
+	SetupUserRoutes(admin, h.Users)
 
-	// Warehouse management endpoints (Admin role required)
-	SetupWarehouseRoutes(api)
+	// Lockout, MFA reset and audit log endpoints (users:manage and audit:read permissions)
+	SetupSecurityRoutes(admin, h.Security)
+
+	// API key endpoints (api_keys:manage permission required)
+	SetupAPIKeyRoutes(admin, h.APIKeys)
+
+	// Warehouse management endpoints (warehouses:*, stock:* and transfers:* permissions,
+	// limited to the caller's warehouses unless warehouses:all is granted); also
+	// open to API keys
+	SetupWarehouseRoutes(api, admin, h.Warehouses, requireJWTOrAPIKey)
 }
 
-func SetupAuthRoutes(api fiber.Router) {
+func SetupAuthRoutes(api fiber.Router, h *handler.AuthHandler, requireJWT fiber.Handler) {
 	auth := api.Group("/auth")
-	auth.Post("/register", handler.Register)
-	auth.Post("/login", handler.Login)
-	auth.Get("/profile", middleware.JWTMiddleware(), handler.GetMe)
-	auth.Post("/refresh", handler.RefreshToken)
-	auth.Post("/logout", handler.Logout)
-	auth.Post("/logout-all", middleware.JWTMiddleware(), handler.LogoutAllDevices)
+	auth.Post("/register", h.Register)
+	auth.Post("/login", h.Login)
+	auth.Get("/profile", requireJWT, h.GetMe)
+	auth.Post("/refresh", h.RefreshToken)
+	auth.Post("/logout", h.Logout)
+	auth.Post("/logout-all", requireJWT, h.LogoutAllDevices)
+
+}
 
+func SetupMFARoutes(api fiber.Router, h *handler.AuthHandler, requireJWT, requireJWTOrChallenge fiber.Handler) {
+	mfa := api.Group("/auth/mfa")
+	mfa.Post("/verify", h.VerifyMFA)
+	// Impersonation tokens cannot change the user's second factor
+	notImpersonating := middleware.RejectImpersonation()
+	mfa.Post("/enroll", requireJWTOrChallenge, notImpersonating, h.EnrollMFA)
+	mfa.Post("/enroll/confirm", requireJWTOrChallenge, notImpersonating, h.ConfirmMFA)
+	mfa.Get("/", requireJWT, h.MFAStatus)
+	mfa.Post("/recovery-codes", requireJWT, notImpersonating, h.RegenerateRecoveryCodes)
+	mfa.Delete("/", requireJWT, notImpersonating, h.DisableMFA)
 }
 
-func SetupProductRoutes(api fiber.Router) {
+func SetupAccountRoutes(api, admin fiber.Router, h *handler.AccountHandler, requireJWT fiber.Handler) {
+	notImpersonating := middleware.RejectImpersonation()
+	api.Put("/auth/password", requireJWT, notImpersonating, h.ChangePassword)
+	api.Post("/auth/password/forgot", h.ForgotPassword)
+	api.Post("/auth/password/reset", h.ResetPassword)
+	api.Post("/auth/deactivate", requireJWT, notImpersonating, h.DeactivateAccount)
+	admin.Post("/users/:id/activate", middleware.RequirePermission(models.PermUsersManage), h.ActivateUser)
+	admin.Post("/users/:id/deactivate", middleware.RequirePermission(models.PermUsersManage), h.DeactivateUser)
+}
+
+func SetupProductRoutes(api fiber.Router, h *handler.ProductHandler, requireJWT fiber.Handler) {
 	products := api.Group("/products")
-	products.Get("/", handler.GetProducts)
-	products.Get("/:id", handler.GetProductByID)
+	products.Get("/", h.GetProducts)
+	products.Get("/:id", h.GetProductByID)
 
 	// Protected routes for product management
-	products.Post("/", middleware.JWTMiddleware(), middleware.AdminMiddleware(), handler.CreateProduct)
-	products.Put("/:id", middleware.JWTMiddleware(), middleware.AdminMiddleware(), handler.UpdateProduct)
-	products.Delete("/:id", middleware.JWTMiddleware(), middleware.AdminMiddleware(), handler.DeleteProduct)
+	canWrite := middleware.RequirePermission(models.PermProductsWrite)
+	products.Post("/", requireJWT, canWrite, h.CreateProduct)
+	products.Put("/:id", requireJWT, canWrite, h.UpdateProduct)
+	products.Delete("/:id", requireJWT, canWrite, h.DeleteProduct)
+}
+
+func SetupOrderRoutes(api fiber.Router, h *handler.OrderHandler, requireJWT fiber.Handler) {
+	orders := api.Group("/orders", requireJWT)
+	canRead := middleware.RequirePermission(models.PermOrdersRead)
+	canCreate := middleware.RequirePermission(models.PermOrdersCreate)
+	orders.Get("/", canRead, h.GetOrders)
+	orders.Get("/:id", canRead, h.GetOrderByID)
+	orders.Get("/:id/history", canRead, h.GetOrderHistory)
+	orders.Post("/", canCreate, h.CreateOrder)
+	// Who may make a status change depends on the transition and is
+	// checked by the order service
+	orders.Put("/:id/status", h.UpdateOrderStatus)
+	orders.Delete("/:id", canCreate, h.DeleteOrder)
+}
+
+func SetupSessionRoutes(api, admin fiber.Router, h *handler.SessionHandler, requireJWT fiber.Handler) {
+	sessions := api.Group("/auth/sessions", requireJWT)
+	sessions.Get("/", h.ListSessions)
+	sessions.Delete("/:id", h.RevokeSession)
+
+	userSessions := admin.Group("/users/:id/sessions")
+	userSessions.Get("/", middleware.RequirePermission(models.PermUsersRead), h.ListUserSessions)
+	userSessions.Delete("/:sessionId", middleware.RequirePermission(models.PermUsersManage), h.RevokeUserSession)
+}
+
+func SetupInvitationRoutes(api, admin fiber.Router, h *handler.InvitationHandler) {
+	api.Post("/auth/invitations/accept", h.AcceptInvitation)
+
+	invitations := admin.Group("/invitations", middleware.RequirePermission(models.PermUsersManage))
+	invitations.Post("/", h.CreateInvitation)
+	invitations.Get("/", h.ListInvitations)
+	invitations.Delete("/:id", h.RevokeInvitation)
+}
+
+func SetupRoleRoutes(admin fiber.Router, h *handler.RoleHandler) {
+	// Group middleware applies to the whole prefix, which /admin shares with
+	// routes guarded by other permissions
+	canManage := middleware.RequirePermission(models.PermRolesManage)
+	admin.Get("/permissions", canManage, h.ListPermissions)
+
+	roles := admin.Group("/roles", canManage)
+	roles.Get("/", h.ListRoles)
+	roles.Post("/", h.CreateRole)
+	roles.Put("/:name/permissions", h.UpdateRolePermissions)
+}
+
+func SetupAdminRoutes(admin fiber.Router, h *handler.AuthHandler, orders *handler.OrderHandler) {
+	admin.Put("/users/:id/role", middleware.RequirePermission(models.PermUsersManage), h.UpdateUserRole) // Update user role
+	admin.Get("/orders", middleware.RequirePermission(models.PermOrdersReadAll), orders.GetAllOrders)    // List all orders
+}
+
+func SetupUserRoutes(admin fiber.Router, h *handler.UserHandler) {
+	users := admin.Group("/users")
+	canRead := middleware.RequirePermission(models.PermUsersRead)
+	canManage := middleware.RequirePermission(models.PermUsersManage)
+	users.Get("/", canRead, h.ListUsers)
+	users.Post("/", canManage, h.CreateUser)
+	users.Get("/:id", canRead, middleware.RequirePermission(models.PermOrdersReadAll), h.GetUser)
+	users.Delete("/:id", canManage, h.DeleteUser)
+	// Impersonation tokens cannot be chained
+	users.Post("/:id/impersonate", middleware.RequirePermission(models.PermUsersImpersonate),
+		middleware.RejectImpersonation(), h.ImpersonateUser)
 }
 
-func SetupOrderRoutes(api fiber.Router) {
-	orders := api.Group("/orders", middleware.JWTMiddleware())
-	orders.Get("/", handler.GetOrders)
-	orders.Get("/:id", handler.GetOrderByID)
-	orders.Post("/", handler.CreateOrder)
-	orders.Put("/:id/status", handler.UpdateOrderStatus)
-	orders.Delete("/:id", handler.DeleteOrder)
+func SetupSecurityRoutes(admin fiber.Router, h *handler.SecurityHandler) {
+	admin.Post("/users/:id/unlock", middleware.RequirePermission(models.PermUsersManage), h.UnlockUser)
+	admin.Delete("/users/:id/mfa", middleware.RequirePermission(models.PermUsersManage), h.ResetUserMFA)
+	admin.Get("/audit-log", middleware.RequirePermission(models.PermAuditRead), h.ListAuditLog)
 }
 
-func SetupAdminRoutes(api fiber.Router) {
-	admin := api.Group("/admin", middleware.JWTMiddleware(), middleware.AdminMiddleware())
-	admin.Get("/users", handler.GetAllUsers)             // List all users
-	admin.Put("/users/:id/role", handler.UpdateUserRole) // Update user role
+func SetupAPIKeyRoutes(admin fiber.Router, h *handler.APIKeyHandler) {
+	keys := admin.Group("/api-keys", middleware.RequirePermission(models.PermAPIKeysManage))
+	keys.Post("/", h.CreateAPIKey)
+	keys.Get("/", h.ListAPIKeys)
+	keys.Delete("/:id", h.RevokeAPIKey)
 }
 
-func SetupWarehouseRoutes(api fiber.Router) {
-	// Warehouse management routes (JWT + Admin gerekli)
-	warehouses := api.Group("/warehouses", middleware.JWTMiddleware(), middleware.AdminMiddleware())
-	warehouses.Post("/", handler.CreateWarehouse)
-	warehouses.Get("/", handler.GetAllWarehouses)
-	warehouses.Get("/:id", handler.GetWarehouseByID)
-	warehouses.Put("/:id", handler.UpdateWarehouse)
-	warehouses.Delete("/:id", handler.DeleteWarehouse)
-
-	// Warehouse-specific stock routes (JWT + Admin gerekli)
-	warehouses.Get("/:id/stocks", handler.GetWarehouseStocks)
-	warehouses.Get("/:warehouseId/stocks/:productId", handler.GetProductStockInWarehouse)
-	warehouses.Put("/:warehouseId/stocks/:productId", handler.UpdateStock)
-	warehouses.Post("/:warehouseId/stocks/:productId/add", handler.AddStock)
-
-	// Global stock routes (Sadece JWT gerekli - görüntüleme için)
-	stocks := api.Group("/stocks", middleware.JWTMiddleware())
-	stocks.Get("/", handler.GetAllStocks)
-
-	// Transfer management routes (Sadece JWT gerekli)
-	transfers := api.Group("/transfers", middleware.JWTMiddleware())
-	transfers.Post("/", handler.CreateStockTransfer)
-	transfers.Get("/", handler.GetAllTransfers)
-	transfers.Get("/:id", handler.GetTransferByID)
-
-	// Admin only routes for transfer management (JWT + Admin gerekli)
-	transfers.Put("/:id/status", middleware.AdminMiddleware(), handler.UpdateTransferStatus)
-	transfers.Post("/:id/process", middleware.AdminMiddleware(), handler.ProcessTransfer)
+func SetupWarehouseRoutes(api, admin fiber.Router, h *handler.WarehouseHandler, requireJWTOrAPIKey fiber.Handler) {
+	// Warehouse management routes, for a JWT or API key with warehouses:*
+	warehouses := api.Group("/warehouses", requireJWTOrAPIKey)
+	canRead := middleware.RequirePermission(models.PermWarehousesRead)
+	canWrite := middleware.RequirePermission(models.PermWarehousesWrite)
+	warehouses.Post("/", canWrite, h.CreateWarehouse)
+	warehouses.Get("/", canRead, h.GetAllWarehouses)
+	warehouses.Get("/:id", canRead, h.GetWarehouseByID)
+	warehouses.Put("/:id", canWrite, h.UpdateWarehouse)
+	warehouses.Delete("/:id", canWrite, h.DeleteWarehouse)
+
+	// Stock of a single warehouse, for a JWT or API key with stock:*
+	canReadStock := middleware.RequirePermission(models.PermStockRead)
+	canAdjustStock := middleware.RequirePermission(models.PermStockAdjust)
+	warehouses.Get("/:id/stocks", canReadStock, h.GetWarehouseStocks)
+	warehouses.Get("/:warehouseId/stocks/:productId", canReadStock, h.GetProductStockInWarehouse)
+	warehouses.Put("/:warehouseId/stocks/:productId", canAdjustStock, h.UpdateStock)
+	warehouses.Post("/:warehouseId/stocks/:productId/add", canAdjustStock, h.AddStock)
+
+	// Stock across all warehouses, for a JWT or API key with stock:read
+	stocks := api.Group("/stocks", requireJWTOrAPIKey)
+	stocks.Get("/", canReadStock, h.GetAllStocks)
+
+	// Transfer management routes, for a JWT or API key with transfers:*
+	transfers := api.Group("/transfers", requireJWTOrAPIKey)
+	transfers.Post("/", middleware.RequirePermission(models.PermTransfersCreate), h.CreateStockTransfer)
+	transfers.Get("/", middleware.RequirePermission(models.PermTransfersRead), h.GetAllTransfers)
+	transfers.Get("/:id", middleware.RequirePermission(models.PermTransfersRead), h.GetTransferByID)
+
+	// Processing transfers requires transfers:process
+	canProcess := middleware.RequirePermission(models.PermTransfersProcess)
+	transfers.Put("/:id/status", canProcess, h.UpdateTransferStatus)
+	transfers.Post("/:id/process", canProcess, h.ProcessTransfer)
+
+	// Warehouse assignments of users, for a JWT with users:*
+	assignments := admin.Group("/users/:id/warehouses")
+	assignments.Get("/", middleware.RequirePermission(models.PermUsersRead), h.GetUserWarehouses)
+	assignments.Put("/", middleware.RequirePermission(models.PermUsersManage), h.SetUserWarehouses)
 }
@@ -0,0 +1,384 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/config"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+// MinPasswordLength applies to passwords set through change and reset
+const MinPasswordLength = 8
+
+var (
+	ErrUserNotFound      = errors.New("user not found")
+	ErrWrongPassword     = errors.New("wrong password")
+	ErrWeakPassword      = fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	ErrInvalidResetToken = errors.New("invalid, used or expired reset token")
+	ErrLastAdmin         = errors.New("the last active admin cannot be deactivated")
+	ErrUserDeleted       = errors.New("user is deleted")
+	ErrDeleteSelf        = errors.New("users cannot delete themselves")
+)
+
+// AccountService covers the account self-service: changing and resetting
+// passwords and (de)activating accounts. Whenever credentials change or an
+// account is deactivated, the affected sessions and access tokens are
+// revoked.
+type AccountService struct {
+	users         repository.UserRepository
+	resets        repository.PasswordResetRepository
+	audit         repository.AuditRepository
+	refreshTokens *RefreshTokenService
+	revocations   *RevocationService
+	lockout       *LockoutService
+	roles         *RoleService
+	passwords     PasswordHasher
+	notifier      Notifier
+	cfg           config.PasswordResetConfig
+}
+
+func NewAccountService(users repository.UserRepository, resets repository.PasswordResetRepository,
+	audit repository.AuditRepository, refreshTokens *RefreshTokenService, revocations *RevocationService,
+	lockout *LockoutService, roles *RoleService, passwords PasswordHasher, notifier Notifier,
+	cfg config.PasswordResetConfig) *AccountService {
+	return &AccountService{
+		users:         users,
+		resets:        resets,
+		audit:         audit,
+		refreshTokens: refreshTokens,
+		revocations:   revocations,
+		lockout:       lockout,
+		roles:         roles,
+		passwords:     passwords,
+		notifier:      notifier,
+		cfg:           cfg,
+	}
+}
+
+// ChangePassword sets a new password after checking the current one. Every
+// other session is ended and every access token revoked; the session the
+// change was made from stays and gets a new access token on refresh.
+func (s *AccountService) ChangePassword(userID int, sessionID, currentPassword, newPassword, ip string) error {
+	user, err := s.loadUser(userID)
+	if err != nil {
+		return err
+	}
+	if len(newPassword) < MinPasswordLength {
+		return ErrWeakPassword
+	}
+	if err := s.checkPassword(user, currentPassword, ip); err != nil {
+		return err
+	}
+
+	if err := s.setPassword(user.ID, newPassword); err != nil {
+		return err
+	}
+	if err := s.refreshTokens.RevokeOtherSessions(user.ID, sessionID); err != nil {
+		return err
+	}
+	if err := s.revocations.RevokeUser(user.ID); err != nil {
+		return err
+	}
+
+	return s.audit.RecordEvent(&models.AuditEvent{
+		Event:   models.AuditPasswordChanged,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+		IP:      ip,
+	})
+}
+
+// RequestReset sends a reset token to an active user. Unknown and inactive
+// users are ignored without an error, so the endpoint does not reveal which
+// accounts exist.
+func (s *AccountService) RequestReset(username string) error {
+	user, err := s.users.GetByUsername(username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !user.IsActive {
+		return nil
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	reset := &models.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(s.cfg.TokenTTL),
+	}
+	if err := s.resets.CreatePasswordReset(reset); err != nil {
+		return err
+	}
+
+	return s.notifier.Notify(Notification{
+		UserID:   user.ID,
+		Username: user.Username,
+		Subject:  "Password reset",
+		Body: fmt.Sprintf("Reset your password with this token before %s: %s",
+			reset.ExpiresAt.Format(time.RFC3339), token),
+		SentAt: now,
+	})
+}
+
+// ResetPassword sets a new password with a reset token. The token works
+// once; every session of the user is ended and a login lockout lifted.
+func (s *AccountService) ResetPassword(token, newPassword, ip string) error {
+	// Checked first so a weak password does not use the token up
+	if len(newPassword) < MinPasswordLength {
+		return ErrWeakPassword
+	}
+
+	reset, err := s.resets.ClaimPasswordReset(hashToken(token), time.Now().UTC())
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+	user, err := s.loadUser(reset.UserID)
+	if errors.Is(err, ErrUserNotFound) || (err == nil && !user.IsActive) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.setPassword(user.ID, newPassword); err != nil {
+		return err
+	}
+	if err := s.revokeEverything(user.ID); err != nil {
+		return err
+	}
+	if err := s.lockout.RecordSuccess(user.Username); err != nil {
+		return err
+	}
+
+	return s.audit.RecordEvent(&models.AuditEvent{
+		Event:  models.AuditPasswordReset,
+		UserID: &user.ID,
+		IP:     ip,
+	})
+}
+
+// Deactivate closes the account of the caller after checking their password
+func (s *AccountService) Deactivate(userID int, password, ip string) error {
+	user, err := s.loadUser(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkPassword(user, password, ip); err != nil {
+		return err
+	}
+	return s.setActive(user, false, user.ID, ip)
+}
+
+// SetActive activates or deactivates an account on behalf of an admin
+func (s *AccountService) SetActive(userID int, active bool, actorID int, ip string) error {
+	user, err := s.loadUser(userID)
+	if err != nil {
+		return err
+	}
+	return s.setActive(user, active, actorID, ip)
+}
+
+func (s *AccountService) setActive(user *models.User, active bool, actorID int, ip string) error {
+	if user.DeletedAt != nil {
+		return ErrUserDeleted
+	}
+	if !active && user.IsActive && user.Role == models.RoleAdmin {
+		if err := s.checkOtherAdmin(user.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := s.users.SetActive(user.ID, active); err != nil {
+		return err
+	}
+	event := models.AuditUserActivated
+	if !active {
+		event = models.AuditUserDeactivated
+		if err := s.revokeEverything(user.ID); err != nil {
+			return err
+		}
+	}
+
+	return s.audit.RecordEvent(&models.AuditEvent{
+		Event:   event,
+		ActorID: &actorID,
+		UserID:  &user.ID,
+		Subject: user.Username,
+		IP:      ip,
+	})
+}
+
+// ChangeRole gives a user another role on behalf of an actor holding
+// granted, and revokes the tokens issued with the old one. The actor must
+// hold every permission of the new role, and the last active admin keeps
+// the admin role.
+func (s *AccountService) ChangeRole(userID int, role string, granted []string) error {
+	user, err := s.loadUser(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.roles.CheckGrant(role, granted); err != nil {
+		return err
+	}
+	if user.IsActive && user.Role == models.RoleAdmin && role != models.RoleAdmin {
+		if err := s.checkOtherAdmin(user.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := s.users.UpdateUserRole(user.ID, role); err != nil {
+		return err
+	}
+	// Tokens issued with the old role must not outlive the change
+	return s.revocations.RevokeUser(user.ID)
+}
+
+// Delete soft-deletes a user on behalf of an admin. The user can no longer
+// log in and disappears from user lists, but their orders are kept.
+func (s *AccountService) Delete(userID, actorID int, ip string) error {
+	if userID == actorID {
+		return ErrDeleteSelf
+	}
+	user, err := s.loadUser(userID)
+	if err != nil {
+		return err
+	}
+	if user.DeletedAt != nil {
+		return ErrUserNotFound
+	}
+	if user.IsActive && user.Role == models.RoleAdmin {
+		if err := s.checkOtherAdmin(user.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := s.users.SoftDelete(user.ID, time.Now().UTC()); err != nil {
+		var notFound *repository.UserNotFoundError
+		if errors.As(err, &notFound) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	if err := s.revokeEverything(user.ID); err != nil {
+		return err
+	}
+	if err := s.resets.DeleteUserPasswordResets(user.ID); err != nil {
+		return err
+	}
+
+	return s.audit.RecordEvent(&models.AuditEvent{
+		Event:   models.AuditUserDeleted,
+		ActorID: &actorID,
+		UserID:  &user.ID,
+		Subject: user.Username,
+		IP:      ip,
+	})
+}
+
+// checkOtherAdmin returns ErrLastAdmin unless an active admin other than
+// userID remains
+func (s *AccountService) checkOtherAdmin(userID int) error {
+	users, err := s.users.GetAllUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.ID != userID && u.Role == models.RoleAdmin && u.IsActive {
+			return nil
+		}
+	}
+	return ErrLastAdmin
+}
+
+// checkPassword verifies the password of a signed-in user. Wrong passwords
+// count as failed logins, so a stolen access token cannot be used to guess
+// it; a locked user gets a *LoginLockedError.
+func (s *AccountService) checkPassword(user *models.User, password, ip string) error {
+	if err := s.lockout.Check(user.Username, ip); err != nil {
+		return err
+	}
+
+	ok, err := s.passwords.Verify(password, user.PasswordHash)
+	if err != nil || !ok {
+		if err := s.lockout.RecordFailure(user.Username, ip, &user.ID); err != nil {
+			return err
+		}
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+func (s *AccountService) setPassword(userID int, password string) error {
+	hash, err := s.passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	if err := s.users.UpdatePasswordHash(userID, hash); err != nil {
+		return err
+	}
+	// Outstanding reset tokens must not undo the new password
+	return s.resets.DeleteUserPasswordResets(userID)
+}
+
+// revokeEverything ends every session and revokes every access token of a user
+func (s *AccountService) revokeEverything(userID int) error {
+	if err := s.refreshTokens.RevokeAll(userID); err != nil {
+		return err
+	}
+	return s.revocations.RevokeUser(userID)
+}
+
+// loadUser returns the full user record, or ErrUserNotFound
+func (s *AccountService) loadUser(userID int) (*models.User, error) {
+	user, err := s.users.GetByID(userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.users.GetByUsername(user.Username)
+}
+
+// Sweep purges expired reset tokens
+func (s *AccountService) Sweep(now time.Time) (int64, error) {
+	return s.resets.DeleteExpiredPasswordResets(now.UTC())
+}
+
+// RunSweeper calls Sweep every interval until ctx is cancelled
+func (s *AccountService) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			deleted, err := s.Sweep(now)
+			if err != nil {
+				slog.Error("password reset sweep failed", "error", err)
+				continue
+			}
+			if deleted > 0 {
+				slog.Info("expired password reset tokens purged", "count", deleted)
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"crypto/subtle"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+const (
+	// DefaultAPIKeyTTL applies when a key is created without expiry
+	DefaultAPIKeyTTL = 90 * 24 * time.Hour
+	// MaxAPIKeyTTL caps how long a key stays usable
+	MaxAPIKeyTTL = 365 * 24 * time.Hour
+
+	// apiKeyPrefix starts every key, which makes leaked keys easy to spot
+	apiKeyPrefix = "oak_"
+	// apiKeyTouchInterval limits how often the last use of a key is written
+	apiKeyTouchInterval = time.Minute
+)
+
+var (
+	ErrInvalidAPIKey     = errors.New("invalid, revoked or expired api key")
+	ErrInvalidAPIKeyName = errors.New("api key name must be 1 to 100 characters")
+	ErrInvalidAPIKeyTTL  = errors.New("invalid api key expiry")
+	ErrNoScopes          = errors.New("an api key needs at least one scope")
+	ErrScopeNotGranted   = errors.New("scope not granted to the user's role")
+)
+
+// APIKeyPrincipal is who a request authenticated with an API key acts as
+type APIKeyPrincipal struct {
+	KeyID       int
+	UserID      int
+	Role        string
+	Permissions []string
+}
+
+// APIKeyService manages the API keys of integrations. A key acts as its
+// user with the permissions that are both among its scopes and granted by
+// the user's current role, so a role change narrows existing keys too.
+type APIKeyService struct {
+	keys  repository.APIKeyRepository
+	users repository.UserRepository
+	roles *RoleService
+	audit repository.AuditRepository
+}
+
+func NewAPIKeyService(keys repository.APIKeyRepository, users repository.UserRepository,
+	roles *RoleService, audit repository.AuditRepository) *APIKeyService {
+	return &APIKeyService{keys: keys, users: users, roles: roles, audit: audit}
+}
+
+// Create stores a new key for a user and returns it together with the key
+// itself, which is not stored and cannot be shown again
+func (s *APIKeyService) Create(userID int, name string, scopes []string, ttl time.Duration,
+	createdBy int, ip string) (*models.APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > 100 {
+		return nil, "", ErrInvalidAPIKeyName
+	}
+	if ttl == 0 {
+		ttl = DefaultAPIKeyTTL
+	}
+	if ttl < 0 || ttl > MaxAPIKeyTTL {
+		return nil, "", ErrInvalidAPIKeyTTL
+	}
+	scopes = normalizePermissions(scopes)
+	if len(scopes) == 0 {
+		return nil, "", ErrNoScopes
+	}
+	if err := checkPermissions(scopes); err != nil {
+		return nil, "", err
+	}
+
+	user, err := s.users.GetByID(userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, "", ErrUserNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	granted, err := s.roles.Permissions(user.Role)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			return nil, "", ErrScopeNotGranted
+		}
+	}
+
+	id, err := randomHex(4)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := apiKeyPrefix + id
+	key := prefix + "_" + secret
+
+	expiresAt := time.Now().UTC().Add(ttl)
+	apiKey := &models.APIKey{
+		UserID:    user.ID,
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   hashToken(key),
+		Scopes:    scopes,
+		ExpiresAt: &expiresAt,
+		CreatedBy: &createdBy,
+	}
+	if err := s.keys.CreateAPIKey(apiKey); err != nil {
+		return nil, "", err
+	}
+
+	if err := s.audit.RecordEvent(&models.AuditEvent{
+		Event:   models.AuditAPIKeyCreated,
+		ActorID: &createdBy,
+		UserID:  &user.ID,
+		Subject: prefix,
+		IP:      ip,
+		Details: name,
+	}); err != nil {
+		return nil, "", err
+	}
+
+	return apiKey, key, nil
+}
+
+// List returns every key, newest first
+func (s *APIKeyService) List() ([]models.APIKey, error) {
+	return s.keys.GetAPIKeys()
+}
+
+// Revoke stops a key from working. Revoked keys stay listed.
+func (s *APIKeyService) Revoke(id, actorID int, ip string) error {
+	apiKey, err := s.keys.GetAPIKey(id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &repository.APIKeyNotFoundError{ID: id}
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.keys.RevokeAPIKey(id, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	return s.audit.RecordEvent(&models.AuditEvent{
+		Event:   models.AuditAPIKeyRevoked,
+		ActorID: &actorID,
+		UserID:  &apiKey.UserID,
+		Subject: apiKey.Prefix,
+		IP:      ip,
+		Details: apiKey.Name,
+	})
+}
+
+// Authenticate checks a key and returns the principal it acts as. Unknown,
+// revoked and expired keys, and keys of inactive users, get ErrInvalidAPIKey.
+func (s *APIKeyService) Authenticate(key string) (*APIKeyPrincipal, error) {
+	// prefix "oak_" + 8 hex digits, "_", 32 hex digits
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(key) != len(apiKeyPrefix)+8+1+32 {
+		return nil, ErrInvalidAPIKey
+	}
+	prefix := key[:len(apiKeyPrefix)+8]
+
+	apiKey, err := s.keys.GetAPIKeyByPrefix(prefix)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(apiKey.KeyHash)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	now := time.Now().UTC()
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && !now.Before(*apiKey.ExpiresAt)) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	user, err := s.users.GetByID(apiKey.UserID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsActive {
+		return nil, ErrInvalidAPIKey
+	}
+	granted, err := s.roles.Permissions(user.Role)
+	if err != nil {
+		return nil, err
+	}
+	permissions := []string{}
+	for _, scope := range apiKey.Scopes {
+		if slices.Contains(granted, scope) {
+			permissions = append(permissions, scope)
+		}
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.keys.TouchAPIKey(apiKey.ID, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return &APIKeyPrincipal{
+		KeyID:       apiKey.ID,
+		UserID:      user.ID,
+		Role:        user.Role,
+		Permissions: permissions,
+	}, nil
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+const (
+	// DefaultInvitationTTL applies when an invitation is created without expiry
+	DefaultInvitationTTL = 72 * time.Hour
+	// MaxInvitationTTL caps how long an invite code stays usable
+	MaxInvitationTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidInvitation = errors.New("invalid, used or expired invitation")
+	ErrInvalidRole       = errors.New("invalid role")
+	ErrInvalidTTL        = errors.New("invalid invitation expiry")
+	ErrUsernameTaken     = errors.New("username already taken")
+	ErrAdminExists       = errors.New("an admin already exists")
+)
+
+// InvitationService issues single-use invite codes bound to a role. Public
+// registration only creates customers; every other role is handed out
+// through an invitation created by an admin.
+type InvitationService struct {
+	invitations repository.InvitationRepository
+	users       repository.UserRepository
+	roles       *RoleService
+	passwords   PasswordHasher
+}
+
+func NewInvitationService(invitations repository.InvitationRepository, users repository.UserRepository,
+	roles *RoleService, passwords PasswordHasher) *InvitationService {
+	return &InvitationService{invitations: invitations, users: users, roles: roles, passwords: passwords}
+}
+
+// Create stores a new invitation and returns it together with its code,
+// which is not stored and cannot be shown again. The inviter, holding
+// granted, must hold every permission of the invited role.
+func (s *InvitationService) Create(role string, createdBy int, granted []string, ttl time.Duration) (*models.Invitation, string, error) {
+	err := s.roles.CheckGrant(role, granted)
+	if errors.Is(err, ErrRoleNotFound) {
+		return nil, "", ErrInvalidRole
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if ttl == 0 {
+		ttl = DefaultInvitationTTL
+	}
+	if ttl < 0 || ttl > MaxInvitationTTL {
+		return nil, "", ErrInvalidTTL
+	}
+
+	code, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+
+	invitation := &models.Invitation{
+		CodeHash:  hashToken(code),
+		Role:      role,
+		CreatedBy: &createdBy,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	}
+	if err := s.invitations.CreateInvitation(invitation); err != nil {
+		return nil, "", err
+	}
+
+	return invitation, code, nil
+}
+
+// List returns every invitation, newest first
+func (s *InvitationService) List() ([]models.Invitation, error) {
+	return s.invitations.GetInvitations()
+}
+
+// Revoke deletes an invitation so its code can no longer be used
+func (s *InvitationService) Revoke(id int) error {
+	return s.invitations.DeleteInvitation(id)
+}
+
+// Accept creates an account with the role of the invitation and uses the
+// invitation up
+func (s *InvitationService) Accept(code, username, password string) (*models.User, error) {
+	now := time.Now().UTC()
+
+	invitation, err := s.invitations.GetInvitationByCodeHash(hashToken(code))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidInvitation
+	}
+	if err != nil {
+		return nil, err
+	}
+	if invitation.UsedAt != nil || !now.Before(invitation.ExpiresAt) {
+		return nil, ErrInvalidInvitation
+	}
+
+	if err := s.checkUsernameFree(username); err != nil {
+		return nil, err
+	}
+	passwordHash, err := s.passwords.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+
+	// Two sign-ups racing with the same code: only one may win
+	if err := s.invitations.ClaimInvitation(invitation.ID, username, now); err != nil {
+		var claimed *repository.InvitationClaimedError
+		if errors.As(err, &claimed) {
+			return nil, ErrInvalidInvitation
+		}
+		return nil, err
+	}
+
+	user, err := s.users.Create(&models.User{
+		Username:     username,
+		PasswordHash: passwordHash,
+		IsActive:     true,
+		Role:         invitation.Role,
+	})
+	if err != nil {
+		// Give the code back, the account was never created
+		if releaseErr := s.invitations.ReleaseInvitation(invitation.ID); releaseErr != nil {
+			slog.Warn("invitation could not be released", "invitation_id", invitation.ID, "error", releaseErr)
+		}
+		return nil, err
+	}
+
+	user.PasswordHash = ""
+	return user, nil
+}
+
+func (s *InvitationService) checkUsernameFree(username string) error {
+	_, err := s.users.GetByUsername(username)
+	if err == nil {
+		return ErrUsernameTaken
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	return nil
+}
+
+// BootstrapAdmin creates the first admin account. It refuses to run once any
+// admin exists; further admins are invited.
+func (s *InvitationService) BootstrapAdmin(username, password string) (*models.User, error) {
+	users, err := s.users.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.Role == models.RoleAdmin {
+			return nil, ErrAdminExists
+		}
+	}
+
+	if err := s.checkUsernameFree(username); err != nil {
+		return nil, err
+	}
+	passwordHash, err := s.passwords.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.users.Create(&models.User{
+		Username:     username,
+		PasswordHash: passwordHash,
+		IsActive:     true,
+		Role:         models.RoleAdmin,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user.PasswordHash = ""
+	return user, nil
+}
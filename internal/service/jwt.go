@@ -1,91 +1,233 @@
 package service
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/slmbngl/OrderAplication/internal/config"
 )
 
-var jwtKey = []byte("secret-key")
+// TokenService issues and validates JWT access tokens
+type TokenService struct {
+	keys           *Keyring
+	accessTokenTTL time.Duration
+}
 
-// define token durations
-const (
-	AccessTokenDuration  = 15 * time.Minute   // 15 dakika
-	RefreshTokenDuration = 7 * 24 * time.Hour // 7 gün
-)
+func NewTokenService(cfg config.JWTConfig) (*TokenService, error) {
+	keys, err := NewKeyring(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-// make Access Token (15 minutes)
-func GenerateAccessToken(userID int, role string) (string, error) {
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"role":    role,
-		"type":    "access", // Token type
-		"exp":     time.Now().Add(AccessTokenDuration).Unix(),
-		"iat":     time.Now().Unix(),
+	return &TokenService{
+		keys:           keys,
+		accessTokenTTL: cfg.AccessTokenTTL,
+	}, nil
+}
+
+// Keys returns the keyring used to sign and verify access tokens
+func (s *TokenService) Keys() *Keyring {
+	return s.keys
+}
+
+// AccessTokenDuration returns how long access tokens are valid
+func (s *TokenService) AccessTokenDuration() time.Duration {
+	return s.accessTokenTTL
+}
+
+// AccessClaims are the claims of a verified access token
+type AccessClaims struct {
+	UserID       int
+	Role         string
+	Permissions  []string // Permissions of the role when the token was issued
+	SessionID    string
+	TokenID      string // jti, used to revoke this token alone
+	TokenVersion int    // Token version of the user when the token was issued
+	// ImpersonatorID is the staff member acting as the user, 0 for tokens
+	// the user obtained themselves
+	ImpersonatorID int
+	// ImpersonatorTokenVersion is the impersonator's token version when the
+	// token was issued
+	ImpersonatorTokenVersion int
+	ExpiresAt                time.Time
+}
+
+// make Access Token
+func (s *TokenService) GenerateAccessToken(userID int, role string, permissions []string, tokenVersion int, sessionID string) (string, error) {
+	claims, err := s.accessClaims(userID, role, permissions, tokenVersion, sessionID)
+	if err != nil {
+		return "", err
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+	return s.sign(claims)
 }
 
-// make Refresh Token (7 days)
-func GenerateRefreshToken() (string, error) {
-	// create 32 random bytes
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
+// GenerateImpersonationToken creates an access token acting as a user on
+// behalf of impersonatorID. It belongs to no session and carries the
+// impersonator and their token version in the "imp" and "imp_ver" claims.
+func (s *TokenService) GenerateImpersonationToken(userID int, role string, permissions []string, tokenVersion,
+	impersonatorID, impersonatorTokenVersion int) (string, error) {
+	claims, err := s.accessClaims(userID, role, permissions, tokenVersion, "")
+	if err != nil {
 		return "", err
 	}
-	return hex.EncodeToString(bytes), nil
+	claims["imp"] = impersonatorID
+	claims["imp_ver"] = impersonatorTokenVersion // Outdated once the impersonator is demoted or deactivated
+	return s.sign(claims)
 }
 
-func GenerateJWT(userID int, role string) (string, error) {
-	return GenerateAccessToken(userID, role)
+func (s *TokenService) accessClaims(userID int, role string, permissions []string, tokenVersion int, sessionID string) (jwt.MapClaims, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.MapClaims{
+		"user_id": userID,
+		"role":    role,
+		"perms":   permissions,  // Permissions of the role, checked per route
+		"sid":     sessionID,    // Session the token was issued for
+		"jti":     jti,          // Token ID for the denylist
+		"ver":     tokenVersion, // Outdated once the user's token version is incremented
+		"type":    "access",     // Token type
+		"exp":     time.Now().Add(s.accessTokenTTL).Unix(),
+		"iat":     time.Now().Unix(),
+	}, nil
+}
+
+// sign signs claims with the current signing key
+func (s *TokenService) sign(claims jwt.MapClaims) (string, error) {
+	key := s.keys.Signer()
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signKey)
 }
 
 // parse JWT token
-func ParseJWT(tokenStr string) (*jwt.Token, error) {
+func (s *TokenService) ParseJWT(tokenStr string) (*jwt.Token, error) {
 	return jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := s.keys.Verifier(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key: %q", kid)
+		}
+		// The algorithm is bound to the key, never taken from the token alone
+		if token.Method.Alg() != key.Method.Alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return jwtKey, nil
-	})
+		return key.verifyKey, nil
+	}, jwt.WithValidMethods(s.keys.Methods()))
 }
 
-// Access token's validation
-func ValidateAccessToken(tokenString string) (int, string, error) {
-	token, err := ParseJWT(tokenString)
+// ParseAccessToken verifies an access token and extracts its claims. It does
+// not check revocation, see RevocationService.Check.
+func (s *TokenService) ParseAccessToken(tokenStr string) (*AccessClaims, error) {
+	token, err := s.ParseJWT(tokenStr)
 	if err != nil {
-		return 0, "", err
+		return nil, err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		// Check token type
-		if tokenType, exists := claims["type"]; !exists || tokenType != "access" {
-			return 0, "", errors.New("invalid token type")
-		}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if tokenType, _ := claims["type"].(string); tokenType != "access" {
+		return nil, errors.New("invalid token type")
+	}
 
-		userID := int(claims["user_id"].(float64))
-		role := claims["role"].(string)
-		return userID, role, nil
+	userID, okUser := claims["user_id"].(float64)
+	role, okRole := claims["role"].(string)
+	jti, okID := claims["jti"].(string)
+	version, okVersion := claims["ver"].(float64)
+	if !okUser || !okRole || !okID || jti == "" || !okVersion {
+		return nil, errors.New("missing access token claims")
+	}
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		return nil, errors.New("missing expiration time")
+	}
+	sessionID, _ := claims["sid"].(string)
+	impersonatorID, _ := claims["imp"].(float64)
+	impersonatorVersion, okImpersonatorVersion := claims["imp_ver"].(float64)
+	if impersonatorID != 0 && !okImpersonatorVersion {
+		return nil, errors.New("missing impersonator token version")
 	}
 
-	return 0, "", errors.New("invalid token")
+	var permissions []string
+	perms, _ := claims["perms"].([]interface{})
+	for _, p := range perms {
+		if name, ok := p.(string); ok {
+			permissions = append(permissions, name)
+		}
+	}
+
+	return &AccessClaims{
+		UserID:                   int(userID),
+		Role:                     role,
+		Permissions:              permissions,
+		SessionID:                sessionID,
+		TokenID:                  jti,
+		TokenVersion:             int(version),
+		ImpersonatorID:           int(impersonatorID),
+		ImpersonatorTokenVersion: int(impersonatorVersion),
+		ExpiresAt:                expiresAt.Time,
+	}, nil
 }
 
-func ValidateJWT(tokenString string) (uint, error) {
-	userID, _, err := ValidateAccessToken(tokenString)
-	if err != nil {
-		return 0, err
+// MFAClaims are the claims of a verified MFA challenge token. The token
+// proves a correct password and is exchanged for an access token once the
+// second factor is verified.
+type MFAClaims struct {
+	UserID       int
+	TokenVersion int
+	DeviceLabel  string // Device label sent with the login
+	ExpiresAt    time.Time
+}
+
+// GenerateMFAToken creates a short-lived MFA challenge token
+func (s *TokenService) GenerateMFAToken(userID, tokenVersion int, deviceLabel string, ttl time.Duration) (string, error) {
+	claims := jwt.MapClaims{
+		"user_id": userID,
+		"ver":     tokenVersion, // A password change in between voids the challenge
+		"dev":     deviceLabel,
+		"type":    "mfa", // Never accepted as an access token
+		"exp":     time.Now().Add(ttl).Unix(),
+		"iat":     time.Now().Unix(),
 	}
-	return uint(userID), nil
+	return s.sign(claims)
 }
 
-func HashPassword(password string) string {
-	hash := sha256.Sum256([]byte(password))
-	return hex.EncodeToString(hash[:])
+// ParseMFAToken verifies an MFA challenge token and extracts its claims
+func (s *TokenService) ParseMFAToken(tokenStr string) (*MFAClaims, error) {
+	token, err := s.ParseJWT(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if tokenType, _ := claims["type"].(string); tokenType != "mfa" {
+		return nil, errors.New("invalid token type")
+	}
+
+	userID, okUser := claims["user_id"].(float64)
+	version, okVersion := claims["ver"].(float64)
+	if !okUser || !okVersion {
+		return nil, errors.New("missing mfa token claims")
+	}
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		return nil, errors.New("missing expiration time")
+	}
+	deviceLabel, _ := claims["dev"].(string)
+
+	return &MFAClaims{
+		UserID:       int(userID),
+		TokenVersion: int(version),
+		DeviceLabel:  deviceLabel,
+		ExpiresAt:    expiresAt.Time,
+	}, nil
 }
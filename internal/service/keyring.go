@@ -0,0 +1,465 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/slmbngl/OrderAplication/internal/config"
+)
+
+// SigningKey is a single key of the keyring, identified by the token's kid
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	CreatedAt time.Time
+
+	signKey   any // *rsa.PrivateKey, ed25519.PrivateKey or []byte for HMAC
+	verifyKey any // *rsa.PublicKey, ed25519.PublicKey or []byte for HMAC
+}
+
+// Keyring holds the keys used to sign and verify access tokens. A new key is
+// published in the JWKS at once but only signs after the publish delay, so
+// peers and cached key sets know it before the first token arrives. From
+// then on it signs new tokens; older keys keep verifying until every token
+// they signed has expired, after which they are retired. With a key
+// directory the keys are stored as <kid>.pem files, so several instances
+// pointed at the same directory share one keyring, of which only the
+// rotator creates and retires keys.
+type Keyring struct {
+	mu               sync.RWMutex
+	keys             []*SigningKey // oldest first
+	method           jwt.SigningMethod
+	dir              string
+	rotationInterval time.Duration
+	publishDelay     time.Duration
+	rotator          bool
+	tokenTTL         time.Duration
+}
+
+// hmacKeyID is the kid of the single shared secret used in HS256 mode
+const hmacKeyID = "hs256"
+
+// NewKeyring builds the keyring described by cfg. HS256 uses the shared
+// secret and never rotates; RS256 and EdDSA load keys from cfg.KeysDir and
+// create a key when there is none, keeping it in memory only when no
+// directory is configured.
+func NewKeyring(cfg config.JWTConfig) (*Keyring, error) {
+	k := &Keyring{
+		dir:              cfg.KeysDir,
+		rotationInterval: cfg.RotationInterval,
+		publishDelay:     cfg.KeyPublishDelay,
+		// Without a shared directory every instance has its own keys
+		rotator:  cfg.KeyRotator || cfg.KeysDir == "",
+		tokenTTL: cfg.AccessTokenTTL,
+	}
+
+	switch cfg.Algorithm {
+	case "HS256":
+		k.method = jwt.SigningMethodHS256
+		k.keys = []*SigningKey{{
+			ID:        hmacKeyID,
+			Method:    jwt.SigningMethodHS256,
+			signKey:   []byte(cfg.Secret),
+			verifyKey: []byte(cfg.Secret),
+		}}
+		return k, nil
+	case "RS256":
+		k.method = jwt.SigningMethodRS256
+	case "EdDSA":
+		k.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", cfg.Algorithm)
+	}
+
+	if err := k.Refresh(time.Now()); err != nil {
+		return nil, err
+	}
+	if k.dir == "" {
+		slog.Warn("jwt.keys_dir is not set, signing keys are kept in memory and tokens become invalid on restart")
+	}
+
+	return k, nil
+}
+
+// Signer returns the key used for new tokens: the newest key of the
+// configured algorithm published for at least the publish delay, or the
+// oldest one while none has been published that long
+func (k *Keyring) Signer() *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if i := k.signer(time.Now()); i >= 0 {
+		return k.keys[i]
+	}
+	return nil
+}
+
+// signer returns the index of the signing key, -1 when there is none
+func (k *Keyring) signer(now time.Time) int {
+	oldest := -1
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if k.keys[i].Method != k.method {
+			continue
+		}
+		if now.Sub(k.keys[i].CreatedAt) >= k.publishDelay {
+			return i
+		}
+		oldest = i
+	}
+	return oldest
+}
+
+// Verifier returns the non-retired key with the given kid. An empty kid is
+// only accepted in HS256 mode, for tokens issued before keys had ids.
+func (k *Keyring) Verifier(kid string) (*SigningKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid == "" && k.method == jwt.SigningMethodHS256 {
+		kid = hmacKeyID
+	}
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// Methods lists the algorithms of the keys that may verify tokens
+func (k *Keyring) Methods() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	seen := map[string]bool{}
+	var methods []string
+	for _, key := range k.keys {
+		if alg := key.Method.Alg(); !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
+
+// Rotate publishes a new key, which starts signing once it has been
+// published for the publish delay. The previous signer keeps verifying
+// until the tokens it issued have expired.
+func (k *Keyring) Rotate(now time.Time) (*SigningKey, error) {
+	if k.method == jwt.SigningMethodHS256 {
+		return nil, errors.New("HS256 keys cannot be rotated")
+	}
+
+	key, err := k.generate(now)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	k.keys = append(k.keys, key)
+	k.mu.Unlock()
+
+	slog.Info("jwt signing key published", "kid", key.ID, "alg", key.Method.Alg(),
+		"signs_from", key.CreatedAt.Add(k.publishDelay))
+	return key, nil
+}
+
+// Refresh reloads the key directory. The rotator then publishes a key when
+// there is none or the newest one is due for rotation, and retires expired
+// keys; other instances only create a key when the directory is empty.
+func (k *Keyring) Refresh(now time.Time) error {
+	if k.method == jwt.SigningMethodHS256 {
+		return nil
+	}
+
+	if k.dir != "" {
+		keys, err := loadKeyDir(k.dir)
+		if err != nil {
+			return err
+		}
+		k.mu.Lock()
+		k.keys = keys
+		k.mu.Unlock()
+	}
+
+	newest := k.newest()
+	due := newest != nil && k.rotationInterval > 0 && now.Sub(newest.CreatedAt) >= k.rotationInterval
+	if newest == nil || (k.rotator && due) {
+		if _, err := k.Rotate(now); err != nil {
+			return err
+		}
+	}
+
+	if k.rotator {
+		k.retire(now)
+	}
+	return nil
+}
+
+// newest returns the most recently published key of the configured
+// algorithm, signing or not
+func (k *Keyring) newest() *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if k.keys[i].Method == k.method {
+			return k.keys[i]
+		}
+	}
+	return nil
+}
+
+// Run refreshes the keyring every config.KeyReloadInterval until ctx is
+// cancelled
+func (k *Keyring) Run(ctx context.Context) {
+	if k.method == jwt.SigningMethodHS256 {
+		return
+	}
+
+	ticker := time.NewTicker(config.KeyReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := k.Refresh(now); err != nil {
+				slog.Error("jwt keyring refresh failed", "error", err)
+			}
+		}
+	}
+}
+
+// retire drops every key whose successor has been signing for longer than
+// the token lifetime, so no valid token can still reference it
+func (k *Keyring) retire(now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	signer := k.signer(now)
+	var kept []*SigningKey
+	for i, key := range k.keys {
+		if i < signer && now.Sub(k.keys[i+1].CreatedAt) > k.publishDelay+k.tokenTTL {
+			if k.dir != "" {
+				if err := os.Remove(filepath.Join(k.dir, key.ID+".pem")); err != nil && !errors.Is(err, os.ErrNotExist) {
+					slog.Warn("could not remove retired jwt key", "kid", key.ID, "error", err)
+				}
+			}
+			slog.Info("jwt signing key retired", "kid", key.ID)
+			continue
+		}
+		kept = append(kept, key)
+	}
+	k.keys = kept
+}
+
+func (k *Keyring) generate(now time.Time) (*SigningKey, error) {
+	var private crypto.Signer
+	switch k.method {
+	case jwt.SigningMethodRS256:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		private = key
+	case jwt.SigningMethodEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		private = key
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	key, err := newSigningKey(hex.EncodeToString(id), private, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.dir != "" {
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(k.dir, 0o700); err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := writeKeyFile(filepath.Join(k.dir, key.ID+".pem"), data, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+// writeKeyFile writes a key file atomically: the data goes to a temporary
+// file in the same directory, which is synced and then renamed into place,
+// so other instances never read a partially written key
+func writeKeyFile(path string, data []byte, createdAt time.Time) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), keyTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), createdAt, createdAt); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func newSigningKey(id string, private crypto.Signer, createdAt time.Time) (*SigningKey, error) {
+	key := &SigningKey{ID: id, CreatedAt: createdAt, signKey: private}
+	switch p := private.(type) {
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+		key.verifyKey = &p.PublicKey
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.verifyKey = p.Public()
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+	return key, nil
+}
+
+// keyTempPrefix starts the names of key files that are still being written
+const keyTempPrefix = ".tmp-"
+
+// loadKeyDir reads every <kid>.pem file of dir, using the modification time
+// as the key's creation time. Temporary files of keys being written are
+// skipped.
+func loadKeyDir(dir string) ([]*SigningKey, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*SigningKey
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), keyTempPrefix) || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data", path)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		private, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported key type %T", path, parsed)
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		key, err := newSigningKey(strings.TrimSuffix(entry.Name(), ".pem"), private, info.ModTime())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every non-retired asymmetric key. HMAC
+// secrets are never published, so the set is empty in HS256 mode.
+func (k *Keyring) JWKS() JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range k.keys {
+		jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.Method.Alg()}
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/slmbngl/OrderAplication/internal/config"
+)
+
+const (
+	testPublishDelay = 5 * time.Minute
+	testTokenTTL     = 15 * time.Minute
+)
+
+func newTestKeyring(t *testing.T, algorithm, dir string, rotator bool) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(config.JWTConfig{
+		Algorithm:        algorithm,
+		Secret:           "secret",
+		KeysDir:          dir,
+		RotationInterval: 24 * time.Hour,
+		KeyPublishDelay:  testPublishDelay,
+		KeyRotator:       rotator,
+		AccessTokenTTL:   testTokenTTL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func jwksKeyIDs(k *Keyring) []string {
+	var ids []string
+	for _, key := range k.JWKS().Keys {
+		ids = append(ids, key.KeyID)
+	}
+	return ids
+}
+
+func TestKeyringPublishDelay(t *testing.T) {
+	k := newTestKeyring(t, "EdDSA", "", false)
+	first := k.Signer()
+	if first == nil {
+		t.Fatal("new keyring has no signer")
+	}
+
+	// A new key is published at once but signs only after the publish delay
+	published := first.CreatedAt.Add(time.Hour)
+	second, err := k.Rotate(published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := jwksKeyIDs(k); !slices.Equal(ids, []string{first.ID, second.ID}) {
+		t.Fatalf("JWKS kids = %v, want %s and %s", ids, first.ID, second.ID)
+	}
+
+	cases := []struct {
+		at   time.Time
+		want *SigningKey
+	}{
+		{published, first},
+		{published.Add(testPublishDelay - time.Second), first},
+		{published.Add(testPublishDelay), second},
+	}
+	for _, tc := range cases {
+		if got := k.keys[k.signer(tc.at)]; got != tc.want {
+			t.Errorf("signer %v after publishing = %s, want %s", tc.at.Sub(published), got.ID, tc.want.ID)
+		}
+	}
+
+	// Before any key has been published long enough, the oldest one signs
+	fresh := newTestKeyring(t, "EdDSA", "", false)
+	if signer := fresh.Signer(); signer == nil || time.Since(signer.CreatedAt) >= testPublishDelay {
+		t.Fatalf("fresh keyring signer = %+v, want its only key", signer)
+	}
+}
+
+func TestKeyringRetirement(t *testing.T) {
+	k := newTestKeyring(t, "EdDSA", "", false)
+	first := k.Signer()
+	published := first.CreatedAt.Add(time.Hour)
+	second, err := k.Rotate(published)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key verifies until every token it signed before the new key
+	// took over has expired
+	lastToken := published.Add(testPublishDelay)
+	k.retire(lastToken.Add(testTokenTTL))
+	if _, ok := k.Verifier(first.ID); !ok {
+		t.Fatal("old key retired while its tokens may still be valid")
+	}
+
+	k.retire(lastToken.Add(testTokenTTL + time.Second))
+	if _, ok := k.Verifier(first.ID); ok {
+		t.Fatal("old key still verifies after its tokens expired")
+	}
+	if _, ok := k.Verifier(second.ID); !ok {
+		t.Fatal("signing key retired")
+	}
+	if ids := jwksKeyIDs(k); !slices.Equal(ids, []string{second.ID}) {
+		t.Fatalf("JWKS kids = %v, want only %s", ids, second.ID)
+	}
+}
+
+func TestKeyringSharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	rotator := newTestKeyring(t, "EdDSA", dir, true)
+	follower := newTestKeyring(t, "EdDSA", dir, false)
+	first := rotator.Signer()
+	if signer := follower.Signer(); signer == nil || signer.ID != first.ID {
+		t.Fatalf("follower signs with %+v, want the rotator's key %s", signer, first.ID)
+	}
+
+	// Files of keys being written and anything else are ignored
+	for _, name := range []string{keyTempPrefix + "123", keyTempPrefix + "123.pem", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("partial"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	published := first.CreatedAt.Add(time.Hour)
+	second, err := rotator.Rotate(published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Refresh(published); err != nil {
+		t.Fatal(err)
+	}
+	if ids := jwksKeyIDs(follower); !slices.Equal(ids, []string{first.ID, second.ID}) {
+		t.Fatalf("follower JWKS kids = %v, want %s and %s", ids, first.ID, second.ID)
+	}
+
+	// Only the rotator retires keys, removing their files
+	expired := published.Add(testPublishDelay + testTokenTTL + time.Second)
+	if err := follower.Refresh(expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := follower.Verifier(first.ID); !ok {
+		t.Fatal("follower retired a key")
+	}
+	if err := rotator.Refresh(expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, first.ID+".pem")); !os.IsNotExist(err) {
+		t.Fatalf("retired key file still exists: %v", err)
+	}
+	if err := follower.Refresh(expired); err != nil {
+		t.Fatal(err)
+	}
+	if ids := jwksKeyIDs(follower); !slices.Equal(ids, []string{second.ID}) {
+		t.Fatalf("follower JWKS kids = %v, want only %s", ids, second.ID)
+	}
+}
+
+func TestKeyringJWKS(t *testing.T) {
+	rs := newTestKeyring(t, "RS256", "", false)
+	rsaKey := rs.JWKS().Keys[0]
+	public := rs.Signer().verifyKey.(*rsa.PublicKey)
+	n, _ := base64.RawURLEncoding.DecodeString(rsaKey.N)
+	e, _ := base64.RawURLEncoding.DecodeString(rsaKey.E)
+	if rsaKey.KeyType != "RSA" || rsaKey.Algorithm != "RS256" || rsaKey.Use != "sig" || rsaKey.KeyID != rs.Signer().ID ||
+		new(big.Int).SetBytes(n).Cmp(public.N) != 0 || new(big.Int).SetBytes(e).Int64() != int64(public.E) {
+		t.Fatalf("RSA JWK = %+v, want the signer's public key", rsaKey)
+	}
+
+	ed := newTestKeyring(t, "EdDSA", "", false)
+	edKey := ed.JWKS().Keys[0]
+	x, _ := base64.RawURLEncoding.DecodeString(edKey.X)
+	if edKey.KeyType != "OKP" || edKey.Curve != "Ed25519" || edKey.Algorithm != "EdDSA" || edKey.KeyID != ed.Signer().ID ||
+		!ed25519.PublicKey(x).Equal(ed.Signer().verifyKey) {
+		t.Fatalf("Ed25519 JWK = %+v, want the signer's public key", edKey)
+	}
+
+	// The shared HS256 secret is never published and never rotates
+	hs := newTestKeyring(t, "HS256", "", false)
+	if keys := hs.JWKS().Keys; keys == nil || len(keys) != 0 {
+		t.Fatalf("HS256 JWKS = %+v, want an empty set", keys)
+	}
+	if _, err := hs.Rotate(time.Now()); err == nil {
+		t.Fatal("HS256 keyring rotated")
+	}
+}
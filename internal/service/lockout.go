@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/config"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+// LoginLockedError is returned while an account or address is locked out
+type LoginLockedError struct {
+	Until time.Time
+}
+
+func (e *LoginLockedError) Error() string {
+	return "too many failed login attempts"
+}
+
+// LockoutService protects the login against brute force. Failed attempts
+// are counted per account and per source address; once a count reaches its
+// threshold the subject is locked for a delay that doubles with every
+// further failure. Lockouts and unlocks are written to the audit log.
+type LockoutService struct {
+	attempts repository.LoginAttemptRepository
+	audit    repository.AuditRepository
+	cfg      config.LockoutConfig
+}
+
+func NewLockoutService(attempts repository.LoginAttemptRepository, audit repository.AuditRepository,
+	cfg config.LockoutConfig) *LockoutService {
+	return &LockoutService{attempts: attempts, audit: audit, cfg: cfg}
+}
+
+// Check returns a *LoginLockedError when the account or the address is
+// locked out
+func (s *LockoutService) Check(username, ip string) error {
+	now := time.Now().UTC()
+
+	var until time.Time
+	for _, key := range s.keys(username, ip) {
+		attempt, err := s.attempts.GetLoginAttempt(key.scope, key.subject)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if attempt.LockedUntil != nil && attempt.LockedUntil.After(now) && attempt.LockedUntil.After(until) {
+			until = *attempt.LockedUntil
+		}
+	}
+
+	if !until.IsZero() {
+		return &LoginLockedError{Until: until}
+	}
+	return nil
+}
+
+// RecordFailure counts a failed login and locks the account or the address
+// once its threshold is reached. userID is nil for unknown usernames.
+func (s *LockoutService) RecordFailure(username, ip string, userID *int) error {
+	now := time.Now().UTC()
+
+	for _, key := range s.keys(username, ip) {
+		attempt, err := s.attempts.RecordLoginFailure(key.scope, key.subject, now, now.Add(-s.cfg.ResetAfter))
+		if err != nil {
+			return err
+		}
+		if attempt.Failures < key.threshold {
+			continue
+		}
+
+		delay := s.delay(attempt.Failures - key.threshold)
+		if err := s.attempts.LockLoginAttempt(key.scope, key.subject, now.Add(delay)); err != nil {
+			return err
+		}
+
+		event := &models.AuditEvent{
+			Event:   models.AuditAccountLocked,
+			Subject: key.subject,
+			IP:      ip,
+			Details: fmt.Sprintf("%d failed attempts, locked for %s", attempt.Failures, delay),
+		}
+		if key.scope == models.LoginScopeAccount {
+			event.UserID = userID
+		} else {
+			event.Event = models.AuditIPLocked
+		}
+		if err := s.audit.RecordEvent(event); err != nil {
+			return err
+		}
+		slog.Warn("login locked", "scope", key.scope, "subject", key.subject, "failures", attempt.Failures, "delay", delay)
+	}
+
+	return nil
+}
+
+// RecordSuccess forgets the failed attempts of an account. Failures from the
+// address are kept, so one valid account does not reset them.
+func (s *LockoutService) RecordSuccess(username string) error {
+	return s.attempts.ResetLoginAttempts(models.LoginScopeAccount, username)
+}
+
+// Unlock lifts the lockout of an account on behalf of an admin
+func (s *LockoutService) Unlock(userID int, username string, actorID int, ip string) error {
+	if err := s.attempts.ResetLoginAttempts(models.LoginScopeAccount, username); err != nil {
+		return err
+	}
+	return s.audit.RecordEvent(&models.AuditEvent{
+		Event:   models.AuditAccountUnlocked,
+		ActorID: &actorID,
+		UserID:  &userID,
+		Subject: username,
+		IP:      ip,
+	})
+}
+
+// Sweep purges failure counts that are no longer relevant
+func (s *LockoutService) Sweep(now time.Time) (int64, error) {
+	return s.attempts.DeleteStaleLoginAttempts(now.UTC().Add(-s.cfg.ResetAfter))
+}
+
+// RunSweeper calls Sweep every interval until ctx is cancelled
+func (s *LockoutService) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			deleted, err := s.Sweep(now)
+			if err != nil {
+				slog.Error("login attempt sweep failed", "error", err)
+				continue
+			}
+			if deleted > 0 {
+				slog.Info("stale login attempts purged", "count", deleted)
+			}
+		}
+	}
+}
+
+type lockoutKey struct {
+	scope     string
+	subject   string
+	threshold int
+}
+
+func (s *LockoutService) keys(username, ip string) []lockoutKey {
+	keys := []lockoutKey{{models.LoginScopeAccount, username, s.cfg.Threshold}}
+	if s.cfg.IPThreshold > 0 && ip != "" {
+		keys = append(keys, lockoutKey{models.LoginScopeIP, ip, s.cfg.IPThreshold})
+	}
+	return keys
+}
+
+// delay doubles the base delay for every failure beyond the threshold
+func (s *LockoutService) delay(excess int) time.Duration {
+	delay := s.cfg.BaseDelay
+	for i := 0; i < excess && delay < s.cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.cfg.MaxDelay {
+		delay = s.cfg.MaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,310 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/config"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+// recoveryCodeCount is how many recovery codes an enrollment hands out
+const recoveryCodeCount = 10
+
+var (
+	ErrMFANotEnabled       = errors.New("two-factor authentication is not enabled")
+	ErrMFAAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnrolling     = errors.New("no two-factor enrollment in progress")
+	ErrMFARequired         = errors.New("two-factor authentication is required for this role")
+	ErrInvalidMFACode      = errors.New("invalid two-factor code")
+	ErrInvalidMFAChallenge = errors.New("invalid or expired mfa challenge")
+)
+
+// MFAService manages TOTP two-factor authentication. A login of a user with
+// MFA enabled, or whose role requires it, returns a challenge token instead
+// of an access token; the challenge is completed with a code from the
+// authenticator app or a single-use recovery code.
+type MFAService struct {
+	mfa     repository.MFARepository
+	users   repository.UserRepository
+	audit   repository.AuditRepository
+	tokens  *TokenService
+	lockout *LockoutService
+	cfg     config.MFAConfig
+}
+
+func NewMFAService(mfa repository.MFARepository, users repository.UserRepository,
+	audit repository.AuditRepository, tokens *TokenService, lockout *LockoutService, cfg config.MFAConfig) *MFAService {
+	return &MFAService{mfa: mfa, users: users, audit: audit, tokens: tokens, lockout: lockout, cfg: cfg}
+}
+
+// Required reports whether users with role must use MFA
+func (s *MFAService) Required(role string) bool {
+	return slices.Contains(s.cfg.RequiredRoles, role)
+}
+
+// Enabled reports whether the user has a confirmed MFA enrollment
+func (s *MFAService) Enabled(userID int) (bool, error) {
+	m, err := s.mfa.GetMFA(userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return m.EnabledAt != nil, nil
+}
+
+// Status describes the MFA state of a user
+func (s *MFAService) Status(userID int, role string) (*models.MFAStatus, error) {
+	enabled, err := s.Enabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	left, err := s.mfa.CountRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &models.MFAStatus{Enabled: enabled, Required: s.Required(role), RecoveryCodesLeft: left}, nil
+}
+
+// ChallengeDuration returns how long challenge tokens are valid
+func (s *MFAService) ChallengeDuration() time.Duration {
+	return s.cfg.ChallengeTTL
+}
+
+// Challenge issues the token a login returns while the second factor is
+// outstanding
+func (s *MFAService) Challenge(user *models.User, deviceLabel string) (string, error) {
+	return s.tokens.GenerateMFAToken(user.ID, user.TokenVersion, deviceLabel, s.cfg.ChallengeTTL)
+}
+
+// ParseChallenge verifies a challenge token. Challenges issued before the
+// user's token version changed, e.g. by a password change, are rejected.
+func (s *MFAService) ParseChallenge(token string) (*MFAClaims, error) {
+	claims, err := s.tokens.ParseMFAToken(token)
+	if err != nil {
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	version, err := s.users.GetTokenVersion(claims.UserID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenVersion != version {
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	return claims, nil
+}
+
+// Enroll starts an enrollment with a new secret, replacing one that was
+// never confirmed
+func (s *MFAService) Enroll(userID int, username string) (*models.MFAEnrollment, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.mfa.StartMFAEnrollment(userID, secret); err != nil {
+		var enabled *repository.MFAAlreadyEnabledError
+		if errors.As(err, &enabled) {
+			return nil, ErrMFAAlreadyEnabled
+		}
+		return nil, err
+	}
+
+	return &models.MFAEnrollment{Secret: secret, OTPAuthURL: totpURL(s.cfg.Issuer, username, secret)}, nil
+}
+
+// ConfirmEnrollment enables MFA once the user proves the app produces
+// codes, and returns the recovery codes
+func (s *MFAService) ConfirmEnrollment(userID int, code, ip string) ([]string, error) {
+	m, err := s.mfa.GetMFA(userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMFANotEnrolling
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.EnabledAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	now := time.Now().UTC()
+	step, ok := matchTOTP(m.Secret, code, now)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mfa.EnableMFA(userID, step, now, hashes); err != nil {
+		var notFound *repository.MFANotFoundError
+		if errors.As(err, &notFound) {
+			return nil, ErrMFANotEnrolling
+		}
+		return nil, err
+	}
+
+	if err := s.audit.RecordEvent(&models.AuditEvent{
+		Event:   models.AuditMFAEnabled,
+		ActorID: &userID,
+		UserID:  &userID,
+		IP:      ip,
+	}); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Verify checks a code from the authenticator app or, if given, a recovery
+// code. Either works only once. Wrong codes count as failed logins of the
+// user, so codes cannot be guessed; a locked user gets a *LoginLockedError.
+func (s *MFAService) Verify(userID int, code, recoveryCode, ip string) error {
+	user, err := s.users.GetByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.lockout.Check(user.Username, ip); err != nil {
+		return err
+	}
+
+	err = s.verify(userID, code, recoveryCode)
+	if errors.Is(err, ErrInvalidMFACode) {
+		if recordErr := s.lockout.RecordFailure(user.Username, ip, &userID); recordErr != nil {
+			return recordErr
+		}
+	}
+	return err
+}
+
+func (s *MFAService) verify(userID int, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		err := s.mfa.UseRecoveryCode(userID, hashRecoveryCode(recoveryCode), time.Now().UTC())
+		var notFound *repository.RecoveryCodeNotFoundError
+		if errors.As(err, &notFound) {
+			return ErrInvalidMFACode
+		}
+		return err
+	}
+
+	m, err := s.mfa.GetMFA(userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrMFANotEnabled
+	}
+	if err != nil {
+		return err
+	}
+	if m.EnabledAt == nil {
+		return ErrMFANotEnabled
+	}
+
+	step, ok := matchTOTP(m.Secret, code, time.Now().UTC())
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	// A code seen once, e.g. by someone looking over the user's shoulder,
+	// cannot be replayed
+	if err := s.mfa.UseMFAStep(userID, step); err != nil {
+		var used *repository.MFACodeUsedError
+		if errors.As(err, &used) {
+			return ErrInvalidMFACode
+		}
+		return err
+	}
+
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces every recovery code of the user after
+// checking a code from the authenticator app
+func (s *MFAService) RegenerateRecoveryCodes(userID int, code, ip string) ([]string, error) {
+	if err := s.Verify(userID, code, "", ip); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mfa.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable turns MFA off after checking a code from the authenticator app.
+// Users whose role requires MFA cannot turn it off.
+func (s *MFAService) Disable(userID int, role, code, ip string) error {
+	if s.Required(role) {
+		return ErrMFARequired
+	}
+	if err := s.Verify(userID, code, "", ip); err != nil {
+		return err
+	}
+	if err := s.mfa.DeleteMFA(userID); err != nil {
+		return err
+	}
+
+	return s.audit.RecordEvent(&models.AuditEvent{
+		Event:   models.AuditMFADisabled,
+		ActorID: &userID,
+		UserID:  &userID,
+		IP:      ip,
+	})
+}
+
+// Reset removes the MFA enrollment of a user who lost their device, on
+// behalf of an admin. Users whose role requires MFA enroll again at their
+// next login.
+func (s *MFAService) Reset(userID int, username string, actorID int, ip string) error {
+	if err := s.mfa.DeleteMFA(userID); err != nil {
+		var notFound *repository.MFANotFoundError
+		if errors.As(err, &notFound) {
+			return ErrMFANotEnabled
+		}
+		return err
+	}
+
+	return s.audit.RecordEvent(&models.AuditEvent{
+		Event:   models.AuditMFAReset,
+		ActorID: &actorID,
+		UserID:  &userID,
+		Subject: username,
+		IP:      ip,
+	})
+}
+
+// newRecoveryCodes returns readable recovery codes and the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw, err := randomHex(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case, dashes and spaces, which users tend to
+// get wrong when typing a code
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashToken(code)
+}
@@ -0,0 +1,19 @@
+package service
+
+import "time"
+
+// Notification is a message for a user, such as a password reset link
+type Notification struct {
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	Subject  string    `json:"subject"`
+	Body     string    `json:"body"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+// Notifier delivers notifications to users. Users have no contact details
+// on file yet, so the implementations in adapters/notify write to the log or
+// a file for local use; a deployment plugs in its own delivery.
+type Notifier interface {
+	Notify(n Notification) error
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/allocation"
+	"github.com/slmbngl/OrderAplication/internal/config"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+var ErrTransitionNotPermitted = errors.New("not permitted to make this order status change")
+
+// IllegalTransitionError is returned for status changes the order state
+// machine does not allow
+type IllegalTransitionError struct {
+	From    string
+	To      string
+	Allowed []string
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("order cannot move from %s to %s", e.From, e.To)
+}
+
+// orderTransition is an edge of the order state machine. Owner transitions
+// may be made by the customer who placed the order; any transition may be
+// made by users holding its permission, on every order.
+type orderTransition struct {
+	to         string
+	owner      bool
+	permission string
+}
+
+// orderTransitions is the order state machine, keyed by the current status.
+// Cancelled and refunded orders are final.
+var orderTransitions = map[string][]orderTransition{
+	models.OrderPending: {
+		{to: models.OrderConfirmed, owner: true, permission: models.PermOrdersFulfil},
+		{to: models.OrderCancelled, owner: true, permission: models.PermOrdersFulfil},
+	},
+	models.OrderConfirmed: {
+		{to: models.OrderPicking, permission: models.PermOrdersFulfil},
+		{to: models.OrderCancelled, owner: true, permission: models.PermOrdersFulfil},
+	},
+	models.OrderPicking: {
+		{to: models.OrderPacked, permission: models.PermOrdersFulfil},
+		{to: models.OrderCancelled, permission: models.PermOrdersFulfil},
+	},
+	models.OrderPacked: {
+		{to: models.OrderShipped, permission: models.PermOrdersFulfil},
+		{to: models.OrderCancelled, permission: models.PermOrdersFulfil},
+	},
+	models.OrderShipped: {
+		{to: models.OrderDelivered, permission: models.PermOrdersFulfil},
+		{to: models.OrderRefunded, permission: models.PermOrdersRefund},
+	},
+	models.OrderDelivered: {
+		{to: models.OrderRefunded, permission: models.PermOrdersRefund},
+	},
+}
+
+// OrderActor is who changes an order, with the permissions of their token
+type OrderActor struct {
+	UserID      int
+	Permissions []string
+}
+
+func (a OrderActor) can(permission string) bool {
+	return slices.Contains(a.Permissions, permission)
+}
+
+// OrderService places orders, moves them through their state machine and
+// expires the stock reservations of orders left pending
+type OrderService struct {
+	orders repository.OrderRepository
+	cfg    config.OrdersConfig
+}
+
+func NewOrderService(orders repository.OrderRepository, cfg config.OrdersConfig) *OrderService {
+	return &OrderService{orders: orders, cfg: cfg}
+}
+
+// Place places an order for a user, taking its items from the warehouses
+// chosen by the configured allocation strategy
+func (s *OrderService) Place(userID int, req models.CreateOrderRequest) (*models.OrderWithItems, error) {
+	strategy, err := allocation.New(s.cfg.AllocationStrategy, req.ShipTo)
+	if err != nil {
+		return nil, err
+	}
+	return s.orders.CreateOrder(userID, req.Items, strategy)
+}
+
+// NextStatuses returns the statuses an order in status can move to
+func NextStatuses(status string) []string {
+	next := []string{}
+	for _, t := range orderTransitions[status] {
+		next = append(next, t.to)
+	}
+	return next
+}
+
+// Visible reports whether actor may see the order: customers see their own
+// orders, staff every order they could act on
+func (s *OrderService) Visible(order *models.Order, actor OrderActor) bool {
+	return order.UserID == actor.UserID || actor.can(models.PermOrdersReadAll) ||
+		actor.can(models.PermOrdersFulfil) || actor.can(models.PermOrdersRefund)
+}
+
+// ChangeStatus moves an order to status to on behalf of actor. Orders the
+// actor cannot see are reported as not found; setting the current status
+// again changes nothing.
+func (s *OrderService) ChangeStatus(orderID int, to string, actor OrderActor) error {
+	order, err := s.orders.GetOrder(orderID)
+	if err != nil {
+		return err
+	}
+	if !s.Visible(order, actor) {
+		return pgx.ErrNoRows
+	}
+	if order.Status == to {
+		return nil
+	}
+
+	i := slices.IndexFunc(orderTransitions[order.Status], func(t orderTransition) bool { return t.to == to })
+	if i < 0 {
+		return &IllegalTransitionError{From: order.Status, To: to, Allowed: NextStatuses(order.Status)}
+	}
+	transition := orderTransitions[order.Status][i]
+
+	owner := order.UserID == actor.UserID && actor.can(models.PermOrdersCreate)
+	if !(transition.owner && owner) && !actor.can(transition.permission) {
+		return ErrTransitionNotPermitted
+	}
+
+	err = s.orders.UpdateOrderStatus(orderID, order.Status, to, actor.UserID)
+	var changed *repository.OrderStatusChangedError
+	if errors.As(err, &changed) {
+		if changed.Status == to {
+			return nil
+		}
+		return &IllegalTransitionError{From: changed.Status, To: to, Allowed: NextStatuses(changed.Status)}
+	}
+	return err
+}
+
+// History returns the status changes of an order the actor can see
+func (s *OrderService) History(orderID int, actor OrderActor) ([]models.OrderStatusChange, error) {
+	order, err := s.orders.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !s.Visible(order, actor) {
+		return nil, pgx.ErrNoRows
+	}
+	return s.orders.GetOrderStatusHistory(orderID)
+}
+
+// ExpireReservations cancels the orders still pending ReservationTTL after
+// they were placed, releasing their reserved stock
+func (s *OrderService) ExpireReservations(now time.Time) (int64, error) {
+	return s.orders.ExpirePendingOrders(now.Add(-s.cfg.ReservationTTL))
+}
+
+// RunSweeper calls ExpireReservations every interval until ctx is cancelled
+func (s *OrderService) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired, err := s.ExpireReservations(now)
+			if err != nil {
+				slog.Error("order reservation sweep failed", "error", err)
+				continue
+			}
+			if expired > 0 {
+				slog.Info("pending orders with expired reservations cancelled", "count", expired)
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/slmbngl/OrderAplication/internal/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters, so the tests stay fast
+func testArgon2id() *Argon2idHasher {
+	return &Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+}
+
+func testPasswordConfig(algorithm string) config.PasswordConfig {
+	return config.PasswordConfig{
+		Algorithm:  algorithm,
+		Argon2:     config.Argon2Config{MemoryKiB: 64, Iterations: 1, Parallelism: 1},
+		BcryptCost: bcrypt.MinCost,
+	}
+}
+
+// phcArgon2id encodes a hash of password with the given parameters
+func phcArgon2id(password string, memory, iterations uint32, parallelism uint8, salt []byte, keyLength uint32) string {
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, keyLength)
+	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s", memory, iterations, parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestDecodeArgon2id(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	valid := phcArgon2id("secret", 128, 2, 3, salt, 24)
+
+	params, gotSalt, key, err := decodeArgon2id(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Memory != 128 || params.Iterations != 2 || params.Parallelism != 3 ||
+		string(gotSalt) != string(salt) || len(key) != 24 {
+		t.Fatalf("decodeArgon2id = %+v, salt %q, %d byte key", params, gotSalt, len(key))
+	}
+
+	parts := strings.Split(valid, "$")
+	invalid := map[string]string{
+		"empty":          "",
+		"missing key":    strings.Join(parts[:5], "$"),
+		"argon2i":        strings.Replace(valid, "$argon2id$", "$argon2i$", 1),
+		"old version":    strings.Replace(valid, "$v=19$", "$v=16$", 1),
+		"bad parameters": strings.Replace(valid, "m=128,t=2,p=3", "m=128,t=two,p=3", 1),
+		"bad salt":       strings.Replace(valid, parts[4], "!!", 1),
+		"bad key":        strings.Replace(valid, parts[5], "!!", 1),
+	}
+	for name, encoded := range invalid {
+		if _, _, _, err := decodeArgon2id(encoded); err == nil {
+			t.Errorf("%s: decodeArgon2id(%q) accepted", name, encoded)
+		}
+	}
+}
+
+func TestArgon2idHasher(t *testing.T) {
+	h := testArgon2id()
+	encoded, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("Hash = %q, want a PHC string with the hasher's parameters", encoded)
+	}
+	if ok, err := h.Verify("secret", encoded); !ok || err != nil {
+		t.Fatalf("Verify(right password) = %v, %v", ok, err)
+	}
+	if ok, err := h.Verify("wrong", encoded); ok || err != nil {
+		t.Fatalf("Verify(wrong password) = %v, %v", ok, err)
+	}
+	if other, _ := h.Hash("secret"); other == encoded {
+		t.Fatal("two hashes share a salt")
+	}
+
+	// Hashes keep verifying with the parameters they were created with
+	older := phcArgon2id("secret", 32, 2, 2, []byte("saltsalt"), 16)
+	if ok, err := h.Verify("secret", older); !ok || err != nil {
+		t.Fatalf("Verify(older parameters) = %v, %v", ok, err)
+	}
+	if _, err := h.Verify("secret", "$2a$04$invalid"); !errors.Is(err, ErrUnknownPasswordHash) {
+		t.Fatalf("Verify(bcrypt hash) error = %v, want ErrUnknownPasswordHash", err)
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	h := testArgon2id()
+	salt := make([]byte, 16)
+	cases := []struct {
+		name    string
+		encoded string
+		want    bool
+	}{
+		{"same parameters", phcArgon2id("secret", 64, 1, 1, salt, 32), false},
+		{"memory", phcArgon2id("secret", 128, 1, 1, salt, 32), true},
+		{"iterations", phcArgon2id("secret", 64, 2, 1, salt, 32), true},
+		{"parallelism", phcArgon2id("secret", 64, 1, 2, salt, 32), true},
+		{"salt length", phcArgon2id("secret", 64, 1, 1, salt[:8], 32), true},
+		{"key length", phcArgon2id("secret", 64, 1, 1, salt, 16), true},
+		{"bcrypt", "$2a$04$abcdefghijklmnopqrstuu5GSk8Eu3Mip4XyobeJRbF/8d.JZYE1a", true},
+		{"garbage", "garbage", true},
+	}
+	for _, tc := range cases {
+		if got := h.NeedsRehash(tc.encoded); got != tc.want {
+			t.Errorf("%s: NeedsRehash = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBcryptHasher(t *testing.T) {
+	h := &BcryptHasher{Cost: bcrypt.MinCost}
+	encoded, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isBcrypt(encoded) {
+		t.Fatalf("Hash = %q, want a bcrypt hash", encoded)
+	}
+	if ok, err := h.Verify("secret", encoded); !ok || err != nil {
+		t.Fatalf("Verify(right password) = %v, %v", ok, err)
+	}
+	if ok, err := h.Verify("wrong", encoded); ok || err != nil {
+		t.Fatalf("Verify(wrong password) = %v, %v", ok, err)
+	}
+	if _, err := h.Verify("secret", "garbage"); err == nil {
+		t.Fatal("Verify accepted garbage")
+	}
+
+	if h.NeedsRehash(encoded) {
+		t.Fatal("NeedsRehash for the current cost")
+	}
+	if !(&BcryptHasher{Cost: bcrypt.MinCost + 1}).NeedsRehash(encoded) {
+		t.Fatal("no NeedsRehash after the cost changed")
+	}
+	argonHash, err := testArgon2id().Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.NeedsRehash(argonHash) {
+		t.Fatal("no NeedsRehash for an argon2id hash")
+	}
+}
+
+func TestPasswordHasherUpgrades(t *testing.T) {
+	argon, err := NewPasswordHasher(testPasswordConfig("argon2id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHasher, err := NewPasswordHasher(testPasswordConfig("bcrypt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPasswordHasher(testPasswordConfig("md5")); err == nil {
+		t.Fatal("NewPasswordHasher accepted an unknown algorithm")
+	}
+
+	argonHash, _ := argon.Hash("secret")
+	bcryptHash, _ := bcryptHasher.Hash("secret")
+	sum := sha256.Sum256([]byte("secret"))
+	legacy := hex.EncodeToString(sum[:])
+
+	// Every hasher verifies every supported format
+	for _, h := range []PasswordHasher{argon, bcryptHasher} {
+		for _, encoded := range []string{argonHash, bcryptHash, legacy, strings.ToUpper(legacy)} {
+			if ok, err := h.Verify("secret", encoded); !ok || err != nil {
+				t.Errorf("Verify(%q) = %v, %v", encoded, ok, err)
+			}
+			if ok, _ := h.Verify("wrong", encoded); ok {
+				t.Errorf("Verify(%q) accepted a wrong password", encoded)
+			}
+		}
+		if _, err := h.Verify("secret", "$1$md5$hash"); !errors.Is(err, ErrUnknownPasswordHash) {
+			t.Errorf("Verify(md5) error = %v, want ErrUnknownPasswordHash", err)
+		}
+	}
+
+	// Only hashes in the preferred format with current parameters are kept
+	cases := []struct {
+		name    string
+		h       PasswordHasher
+		encoded string
+		want    bool
+	}{
+		{"argon2id kept", argon, argonHash, false},
+		{"bcrypt upgraded to argon2id", argon, bcryptHash, true},
+		{"legacy upgraded to argon2id", argon, legacy, true},
+		{"bcrypt kept", bcryptHasher, bcryptHash, false},
+		{"argon2id upgraded to bcrypt", bcryptHasher, argonHash, true},
+		{"legacy upgraded to bcrypt", bcryptHasher, legacy, true},
+	}
+	for _, tc := range cases {
+		if got := tc.h.NeedsRehash(tc.encoded); got != tc.want {
+			t.Errorf("%s: NeedsRehash = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/config"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+	// ErrRefreshTokenReused means an already used token was presented again,
+	// so it has probably been stolen; its whole family is revoked
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	// ErrSessionNotFound is returned for unknown sessions and for sessions of
+	// another user
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// RefreshTokenService issues one-time-use refresh tokens. Every refresh
+// consumes the presented token and issues a new one in the same family; only
+// SHA-256 hashes of the tokens are stored. A family is a session: one login
+// on one device, with the client it was last used from. Ending a session
+// also revokes the access tokens issued for it.
+type RefreshTokenService struct {
+	users       repository.UserRepository
+	sessions    repository.SessionRepository
+	revocations *RevocationService
+	ttl         time.Duration
+}
+
+func NewRefreshTokenService(users repository.UserRepository, sessions repository.SessionRepository,
+	revocations *RevocationService, cfg config.JWTConfig) *RefreshTokenService {
+	return &RefreshTokenService{users: users, sessions: sessions, revocations: revocations, ttl: cfg.RefreshTokenTTL}
+}
+
+// ClientInfo describes the device a token is issued to
+type ClientInfo struct {
+	UserAgent   string
+	IPAddress   string
+	DeviceLabel string // Derived from the user agent when empty
+}
+
+// RefreshGrant is a newly issued refresh token and the session it belongs to
+type RefreshGrant struct {
+	Token     string
+	UserID    int
+	SessionID string
+}
+
+// Duration returns how long refresh tokens are valid
+func (s *RefreshTokenService) Duration() time.Duration {
+	return s.ttl
+}
+
+// Issue starts a new session for a fresh login
+func (s *RefreshTokenService) Issue(userID int, client ClientInfo) (*RefreshGrant, error) {
+	now := time.Now().UTC()
+	sessionID, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	// The token goes in first so the sweeper never sees a session without one
+	token, err := s.issue(userID, sessionID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	label := client.DeviceLabel
+	if label == "" {
+		label = DeviceLabel(client.UserAgent)
+	}
+	if runes := []rune(label); len(runes) > 100 {
+		label = string(runes[:100])
+	}
+	err = s.sessions.CreateSession(&models.Session{
+		ID:          sessionID,
+		UserID:      userID,
+		UserAgent:   client.UserAgent,
+		IPAddress:   client.IPAddress,
+		DeviceLabel: label,
+		CreatedAt:   now,
+		LastUsedAt:  now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &RefreshGrant{Token: token, UserID: userID, SessionID: sessionID}, nil
+}
+
+// Rotate consumes token and returns its successor in the same session
+func (s *RefreshTokenService) Rotate(token string, client ClientInfo) (*RefreshGrant, error) {
+	now := time.Now().UTC()
+	tokenHash := hashToken(token)
+
+	stored, err := s.users.GetRefreshToken(tokenHash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if stored.RevokedAt != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	if stored.UsedAt != nil {
+		return nil, s.revokeReusedFamily(stored, now)
+	}
+	if now.After(stored.ExpiresAt) {
+		return nil, ErrRefreshTokenExpired
+	}
+
+	// Two requests racing with the same token: only one may win
+	if err := s.users.MarkRefreshTokenUsed(tokenHash, now); err != nil {
+		var used *repository.RefreshTokenUsedError
+		if errors.As(err, &used) {
+			return nil, s.revokeReusedFamily(stored, now)
+		}
+		return nil, err
+	}
+
+	next, err := s.issue(stored.UserID, stored.FamilyID, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.sessions.TouchSession(stored.FamilyID, now, client.UserAgent, client.IPAddress); err != nil {
+		return nil, err
+	}
+
+	return &RefreshGrant{Token: next, UserID: stored.UserID, SessionID: stored.FamilyID}, nil
+}
+
+// Revoke invalidates the family of token, logging that login out
+func (s *RefreshTokenService) Revoke(token string) error {
+	stored, err := s.users.GetRefreshToken(hashToken(token))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return err
+	}
+	return s.endSession(stored.FamilyID, time.Now().UTC())
+}
+
+// Sessions lists the active sessions of a user, most recently used first
+func (s *RefreshTokenService) Sessions(userID int) ([]models.Session, error) {
+	return s.sessions.GetActiveSessions(userID, time.Now().UTC())
+}
+
+// RevokeSession ends a session of the given user
+func (s *RefreshTokenService) RevokeSession(userID int, sessionID string) error {
+	session, err := s.sessions.GetSession(sessionID)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && session.UserID != userID) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return s.endSession(sessionID, time.Now().UTC())
+}
+
+// RevokeOtherSessions ends every session of a user except keepSessionID
+func (s *RefreshTokenService) RevokeOtherSessions(userID int, keepSessionID string) error {
+	sessions, err := s.Sessions(userID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, session := range sessions {
+		if session.ID == keepSessionID {
+			continue
+		}
+		if err := s.endSession(session.ID, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endSession revokes the refresh tokens of a session and the access tokens
+// issued for it
+func (s *RefreshTokenService) endSession(sessionID string, now time.Time) error {
+	if err := s.users.RevokeRefreshTokenFamily(sessionID, now); err != nil {
+		return err
+	}
+	return s.revocations.RevokeSession(sessionID)
+}
+
+// RevokeAll deletes every refresh token of a user
+func (s *RefreshTokenService) RevokeAll(userID int) error {
+	return s.users.DeleteUserRefreshTokens(userID)
+}
+
+// Sweep purges expired tokens and the sessions left without tokens. Used and
+// revoked tokens are kept until they expire so that reuse can still be
+// detected.
+func (s *RefreshTokenService) Sweep(now time.Time) (int64, error) {
+	deleted, err := s.users.DeleteExpiredRefreshTokens(now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.sessions.DeleteOrphanedSessions(); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// RunSweeper calls Sweep every interval until ctx is cancelled
+func (s *RefreshTokenService) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			deleted, err := s.Sweep(now)
+			if err != nil {
+				slog.Error("refresh token sweep failed", "error", err)
+				continue
+			}
+			if deleted > 0 {
+				slog.Info("expired refresh tokens purged", "count", deleted)
+			}
+		}
+	}
+}
+
+func (s *RefreshTokenService) issue(userID int, familyID string, now time.Time) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.users.SaveRefreshToken(&repository.RefreshToken{
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		FamilyID:  familyID,
+		ExpiresAt: now.Add(s.ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *RefreshTokenService) revokeReusedFamily(stored *repository.RefreshToken, now time.Time) error {
+	slog.Warn("refresh token reuse detected, revoking token family",
+		"user_id", stored.UserID, "family_id", stored.FamilyID)
+	if err := s.endSession(stored.FamilyID, now); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// hashToken derives the stored form of a refresh token or invite code. Both
+// carry at least 128 bits of randomness, so a fast unsalted hash is enough to
+// protect them at rest.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/config"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+// ErrAccessTokenRevoked is returned for access tokens that were revoked
+// before they expired
+var ErrAccessTokenRevoked = errors.New("access token revoked")
+
+// RevocationService revokes access tokens before they expire. Single tokens
+// go on a denylist until their expiry, and so do ended sessions until the
+// last access token issued for them expires; all tokens of a user are
+// revoked at once by incrementing the user's token version, which every
+// access token carries.
+type RevocationService struct {
+	denylist  repository.AccessTokenDenylist
+	users     repository.UserRepository
+	accessTTL time.Duration
+}
+
+func NewRevocationService(denylist repository.AccessTokenDenylist, users repository.UserRepository,
+	cfg config.JWTConfig) *RevocationService {
+	return &RevocationService{denylist: denylist, users: users, accessTTL: cfg.AccessTokenTTL}
+}
+
+// Check returns ErrAccessTokenRevoked when the token or its session is
+// denylisted, the token was issued before the user's current token version
+// or its user is gone. The same holds for the impersonator of an
+// impersonation token.
+func (s *RevocationService) Check(claims *AccessClaims) error {
+	ids := []string{claims.TokenID}
+	if claims.SessionID != "" {
+		ids = append(ids, claims.SessionID)
+	}
+	denied, err := s.denylist.IsDenied(ids, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if denied {
+		return ErrAccessTokenRevoked
+	}
+
+	if err := s.checkVersion(claims.UserID, claims.TokenVersion); err != nil {
+		return err
+	}
+	if claims.ImpersonatorID != 0 {
+		return s.checkVersion(claims.ImpersonatorID, claims.ImpersonatorTokenVersion)
+	}
+	return nil
+}
+
+// checkVersion returns ErrAccessTokenRevoked when tokenVersion is older than
+// the user's current token version or the user is gone
+func (s *RevocationService) checkVersion(userID, tokenVersion int) error {
+	version, err := s.users.GetTokenVersion(userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrAccessTokenRevoked
+	}
+	if err != nil {
+		return err
+	}
+	if tokenVersion < version {
+		return ErrAccessTokenRevoked
+	}
+	return nil
+}
+
+// Revoke denylists a single access token
+func (s *RevocationService) Revoke(claims *AccessClaims) error {
+	return s.denylist.Deny(claims.TokenID, claims.ExpiresAt.UTC())
+}
+
+// RevokeSession denylists every access token issued for a session so far,
+// so ending the session takes effect at once
+func (s *RevocationService) RevokeSession(sessionID string) error {
+	return s.denylist.Deny(sessionID, time.Now().UTC().Add(s.accessTTL))
+}
+
+// RevokeUser invalidates every access token issued to a user so far. Call it
+// whenever the role or the active state of a user changes.
+func (s *RevocationService) RevokeUser(userID int) error {
+	return s.users.IncrementTokenVersion(userID)
+}
+
+// Sweep purges denylist entries of tokens that have expired anyway
+func (s *RevocationService) Sweep(now time.Time) (int64, error) {
+	return s.denylist.DeleteExpired(now.UTC())
+}
+
+// RunSweeper calls Sweep every interval until ctx is cancelled
+func (s *RevocationService) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			deleted, err := s.Sweep(now)
+			if err != nil {
+				slog.Error("access token denylist sweep failed", "error", err)
+				continue
+			}
+			if deleted > 0 {
+				slog.Info("expired denylist entries purged", "count", deleted)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+var (
+	ErrRoleExists        = errors.New("role already exists")
+	ErrRoleNotFound      = errors.New("role not found")
+	ErrInvalidRoleName   = errors.New("invalid role name")
+	ErrUnknownPermission = errors.New("unknown permission")
+	ErrImmutableRole     = errors.New("the admin role cannot be changed")
+	ErrGrantBroader      = errors.New("cannot grant permissions one does not hold")
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,49}$`)
+
+// RoleService manages the roles and the permissions they grant. Access
+// tokens carry the permissions of their user's role, so every change
+// revokes the tokens of the users holding that role. Nobody grants a
+// permission they do not hold themselves: the methods handing out
+// permissions take those of the actor and fail with ErrGrantBroader.
+type RoleService struct {
+	roles repository.RoleRepository
+	users repository.UserRepository
+}
+
+func NewRoleService(roles repository.RoleRepository, users repository.UserRepository) *RoleService {
+	return &RoleService{roles: roles, users: users}
+}
+
+// Exists reports whether a role with the given name exists
+func (s *RoleService) Exists(name string) (bool, error) {
+	_, err := s.roles.GetRole(name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Permissions returns the permissions granted by a role
+func (s *RoleService) Permissions(name string) ([]string, error) {
+	role, err := s.roles.GetRole(name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return role.Permissions, nil
+}
+
+// CheckGrant returns ErrGrantBroader unless granted holds every permission
+// of the role called name
+func (s *RoleService) CheckGrant(name string, granted []string) error {
+	permissions, err := s.Permissions(name)
+	if err != nil {
+		return err
+	}
+	if !holdsAll(granted, permissions) {
+		return ErrGrantBroader
+	}
+	return nil
+}
+
+// List returns every role with its permissions
+func (s *RoleService) List() ([]models.Role, error) {
+	return s.roles.GetRoles()
+}
+
+// Catalogue returns every permission a role can grant
+func (s *RoleService) Catalogue() ([]models.Permission, error) {
+	return s.roles.GetPermissions()
+}
+
+// Create adds a role on behalf of an actor holding granted
+func (s *RoleService) Create(role models.Role, granted []string) (*models.Role, error) {
+	if !roleNamePattern.MatchString(role.Name) {
+		return nil, ErrInvalidRoleName
+	}
+	if err := checkPermissions(role.Permissions); err != nil {
+		return nil, err
+	}
+	if !holdsAll(granted, role.Permissions) {
+		return nil, ErrGrantBroader
+	}
+	exists, err := s.Exists(role.Name)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrRoleExists
+	}
+
+	role.Permissions = normalizePermissions(role.Permissions)
+	if err := s.roles.CreateRole(&role); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// SetPermissions replaces the permissions of a role and revokes the access
+// tokens of its users, so the change applies immediately. The actor must
+// hold every permission in granted.
+func (s *RoleService) SetPermissions(name string, permissions, granted []string) (*models.Role, error) {
+	if name == models.RoleAdmin {
+		return nil, ErrImmutableRole
+	}
+	if err := checkPermissions(permissions); err != nil {
+		return nil, err
+	}
+	if !holdsAll(granted, permissions) {
+		return nil, ErrGrantBroader
+	}
+
+	err := s.roles.SetRolePermissions(name, normalizePermissions(permissions))
+	var notFound *repository.RoleNotFoundError
+	if errors.As(err, &notFound) {
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.users.IncrementRoleTokenVersions(name); err != nil {
+		return nil, err
+	}
+
+	return s.roles.GetRole(name)
+}
+
+func checkPermissions(permissions []string) error {
+	for _, p := range permissions {
+		if !models.IsPermission(p) {
+			return ErrUnknownPermission
+		}
+	}
+	return nil
+}
+
+// holdsAll reports whether granted contains every permission
+func holdsAll(granted, permissions []string) bool {
+	for _, p := range permissions {
+		if !slices.Contains(granted, p) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizePermissions(permissions []string) []string {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, p := range permissions {
+		if !seen[p] {
+			seen[p] = true
+			result = append(result, p)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
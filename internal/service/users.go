@@ -0,0 +1,212 @@
+package service
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/slmbngl/OrderAplication/internal/models"
+	"github.com/slmbngl/OrderAplication/internal/repository"
+)
+
+var (
+	ErrInvalidUsername     = errors.New("username must be 1 to 50 characters")
+	ErrImpersonateSelf     = errors.New("users cannot impersonate themselves")
+	ErrImpersonateAdmin    = errors.New("admins cannot be impersonated")
+	ErrImpersonateInactive = errors.New("inactive users cannot be impersonated")
+	// ErrImpersonateBroader is returned when the user holds permissions the
+	// impersonator does not
+	ErrImpersonateBroader = errors.New("users with permissions beyond the impersonator's cannot be impersonated")
+)
+
+// UserService backs the admin user management: looking users up, creating
+// accounts on behalf of customers and impersonating users for support.
+type UserService struct {
+	users         repository.UserRepository
+	orders        repository.OrderRepository
+	audit         repository.AuditRepository
+	refreshTokens *RefreshTokenService
+	roles         *RoleService
+	tokens        *TokenService
+	accounts      *AccountService
+	passwords     PasswordHasher
+}
+
+func NewUserService(users repository.UserRepository, orders repository.OrderRepository,
+	audit repository.AuditRepository, refreshTokens *RefreshTokenService, roles *RoleService,
+	tokens *TokenService, accounts *AccountService, passwords PasswordHasher) *UserService {
+	return &UserService{
+		users:         users,
+		orders:        orders,
+		audit:         audit,
+		refreshTokens: refreshTokens,
+		roles:         roles,
+		tokens:        tokens,
+		accounts:      accounts,
+		passwords:     passwords,
+	}
+}
+
+// Search returns a page of the users matching filter and the total count
+func (s *UserService) Search(filter models.UserFilter) ([]models.User, int, error) {
+	return s.users.SearchUsers(filter)
+}
+
+// Detail returns a user, deleted ones included, with their orders and
+// active sessions
+func (s *UserService) Detail(userID int) (*models.UserDetail, error) {
+	user, err := s.accounts.loadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	user.PasswordHash = ""
+
+	orders, err := s.orders.GetOrdersByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if orders == nil {
+		orders = []models.OrderWithItems{}
+	}
+	sessions, err := s.refreshTokens.Sessions(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.UserDetail{User: *user, Orders: orders, Sessions: sessions}, nil
+}
+
+// Create opens an account on behalf of a customer. Without a password the
+// account gets a random one and the user a reset token to choose their own;
+// the second result reports whether one was sent. The actor, holding
+// granted, must hold every permission of the role.
+func (s *UserService) Create(username, password, role string, granted []string, actorID int, ip string) (*models.User, bool, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || len([]rune(username)) > 50 {
+		return nil, false, ErrInvalidUsername
+	}
+	if role == "" {
+		role = models.RoleCustomer
+	}
+	err := s.roles.CheckGrant(role, granted)
+	if errors.Is(err, ErrRoleNotFound) {
+		return nil, false, ErrInvalidRole
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	sendReset := password == ""
+	if sendReset {
+		if password, err = randomHex(16); err != nil {
+			return nil, false, err
+		}
+	} else if len(password) < MinPasswordLength {
+		return nil, false, ErrWeakPassword
+	}
+
+	_, err = s.users.GetByUsername(username)
+	if err == nil {
+		return nil, false, ErrUsernameTaken
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, err
+	}
+	passwordHash, err := s.passwords.Hash(password)
+	if err != nil {
+		return nil, false, err
+	}
+
+	user, err := s.users.Create(&models.User{
+		Username:     username,
+		PasswordHash: passwordHash,
+		IsActive:     true,
+		Role:         role,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	user.PasswordHash = ""
+
+	if err := s.audit.RecordEvent(&models.AuditEvent{
+		Event:   models.AuditUserCreated,
+		ActorID: &actorID,
+		UserID:  &user.ID,
+		Subject: user.Username,
+		IP:      ip,
+		Details: "role " + user.Role,
+	}); err != nil {
+		return nil, false, err
+	}
+
+	if sendReset {
+		if err := s.accounts.RequestReset(user.Username); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return user, sendReset, nil
+}
+
+// Impersonate issues an access token acting as a user on behalf of a staff
+// member. The token carries the user's permissions and the impersonator,
+// belongs to no session and cannot be refreshed. Only users whose
+// permissions are all held by the impersonator can be impersonated, so staff
+// never borrow rights they lack, and admins cannot be impersonated at all.
+// The token also carries the impersonator's token version and dies once the
+// impersonator is demoted, deactivated or logged out everywhere.
+func (s *UserService) Impersonate(userID, impersonatorID int, ip string) (*models.ImpersonationResponse, error) {
+	if userID == impersonatorID {
+		return nil, ErrImpersonateSelf
+	}
+	user, err := s.accounts.loadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Role == models.RoleAdmin {
+		return nil, ErrImpersonateAdmin
+	}
+	if !user.IsActive || user.DeletedAt != nil {
+		return nil, ErrImpersonateInactive
+	}
+	impersonator, err := s.accounts.loadUser(impersonatorID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := s.roles.Permissions(user.Role)
+	if err != nil {
+		return nil, err
+	}
+	own, err := s.roles.Permissions(impersonator.Role)
+	if err != nil {
+		return nil, err
+	}
+	if !holdsAll(own, permissions) {
+		return nil, ErrImpersonateBroader
+	}
+
+	token, err := s.tokens.GenerateImpersonationToken(user.ID, user.Role, permissions, user.TokenVersion,
+		impersonator.ID, impersonator.TokenVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.audit.RecordEvent(&models.AuditEvent{
+		Event:   models.AuditImpersonation,
+		ActorID: &impersonatorID,
+		UserID:  &user.ID,
+		Subject: user.Username,
+		IP:      ip,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &models.ImpersonationResponse{
+		AccessToken:    token,
+		TokenType:      "Bearer",
+		ExpiresIn:      int(s.tokens.AccessTokenDuration().Seconds()),
+		UserID:         user.ID,
+		ImpersonatorID: impersonatorID,
+	}, nil
+}
@@ -0,0 +1,163 @@
+// Package validation checks request bodies against their validate struct
+// tags with go-playground/validator. Besides the built-in rules it knows:
+//
+//	money         a positive amount with at most two decimals
+//	order_status  one of models.OrderStatuses
+//
+// and checks that stock transfers move stock between two different
+// warehouses. Field names in errors are the JSON names, e.g. items[0].quantity.
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/slmbngl/OrderAplication/internal/models"
+)
+
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+
+	v.RegisterValidation("money", isMoney)
+	v.RegisterValidation("order_status", func(fl validator.FieldLevel) bool {
+		return models.IsOrderStatus(fl.Field().String())
+	})
+	v.RegisterStructValidation(distinctWarehouses, models.StockTransferRequest{})
+
+	return v
+}
+
+// isMoney accepts positive amounts in whole cents
+func isMoney(fl validator.FieldLevel) bool {
+	amount := fl.Field().Float()
+	if amount <= 0 || math.IsInf(amount, 0) {
+		return false
+	}
+	cents := amount * 100
+	return math.Abs(cents-math.Round(cents)) < 1e-6
+}
+
+// distinctWarehouses rejects transfers whose source is their destination
+func distinctWarehouses(sl validator.StructLevel) {
+	req := sl.Current().Interface().(models.StockTransferRequest)
+	if req.FromWarehouseID != nil && req.ToWarehouseID != nil && *req.FromWarehouseID == *req.ToWarehouseID {
+		sl.ReportError(req.ToWarehouseID, "to_warehouse_id", "ToWarehouseID", "distinct_warehouses", "")
+	}
+}
+
+// FieldError describes one invalid field of a request
+type FieldError struct {
+	Field   string `json:"field" example:"items[0].quantity"`
+	Rule    string `json:"rule" example:"min"`
+	Message string `json:"message" example:"must be at least 1"`
+}
+
+// Errors lists every invalid field of a request
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	fields := make([]string, len(e))
+	for i, f := range e {
+		fields[i] = f.Field + " " + f.Message
+	}
+	return "invalid request: " + strings.Join(fields, "; ")
+}
+
+// Struct checks the validate tags of the struct v points to. Invalid fields
+// are returned as Errors.
+func Struct(v any) error {
+	err := validate.Struct(v)
+	var invalid validator.ValidationErrors
+	if !errors.As(err, &invalid) {
+		return err
+	}
+
+	fields := make(Errors, len(invalid))
+	for i, fe := range invalid {
+		fields[i] = FieldError{Field: fieldPath(fe), Rule: fe.Tag(), Message: message(fe)}
+	}
+	return fields
+}
+
+// fieldPath drops the struct name the namespace starts with
+func fieldPath(fe validator.FieldError) string {
+	_, path, found := strings.Cut(fe.Namespace(), ".")
+	if !found {
+		return fe.Field()
+	}
+	return path
+}
+
+func message(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "required_without":
+		return "is required unless " + jsonName(fe.Param()) + " is set"
+	case "min", "max", "gt", "gte", "lt", "lte":
+		return bound(fe)
+	case "oneof":
+		return "must be one of " + strings.Join(strings.Fields(fe.Param()), ", ")
+	case "money":
+		return "must be a positive amount with at most two decimals"
+	case "order_status":
+		return "must be one of " + strings.Join(models.OrderStatuses, ", ")
+	case "distinct_warehouses":
+		return "must differ from from_warehouse_id"
+	}
+	return fmt.Sprintf("failed the %s rule", fe.Tag())
+}
+
+// bound describes a failed size rule, which counts characters of strings,
+// items of slices and the value of numbers
+func bound(fe validator.FieldError) string {
+	comparisons := map[string]string{
+		"min": "at least", "gte": "at least", "gt": "more than",
+		"max": "at most", "lte": "at most", "lt": "less than",
+	}
+	comparison := comparisons[fe.Tag()]
+
+	switch fe.Kind() {
+	case reflect.String:
+		return fmt.Sprintf("must be %s %s characters long", comparison, fe.Param())
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return fmt.Sprintf("must contain %s %s items", comparison, fe.Param())
+	}
+	return fmt.Sprintf("must be %s %s", comparison, fe.Param())
+}
+
+// jsonName turns a Go field name from a rule parameter into its JSON name,
+// e.g. RecoveryCode into recovery_code
+func jsonName(field string) string {
+	var b strings.Builder
+	lower := false
+	for _, r := range field {
+		upper := r >= 'A' && r <= 'Z'
+		if upper && lower {
+			b.WriteByte('_')
+		}
+		if upper {
+			r += 'a' - 'A'
+		}
+		lower = !upper
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -7,33 +7,185 @@
 // @in header
 // @name Authorization
 // @description please enter your token with "Bearer " prefix for JWT token
+// @securityDefinitions.apikey APIKeyAuth
+// @in header
+// @name X-API-Key
+// @description API key of an integration, created by an admin
 
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	_ "github.com/slmbngl/OrderAplication/docs" // Swagger docs
 	"github.com/slmbngl/OrderAplication/internal/adapters/db"
+	"github.com/slmbngl/OrderAplication/internal/adapters/middleware"
+	"github.com/slmbngl/OrderAplication/internal/app"
+	"github.com/slmbngl/OrderAplication/internal/config"
 	"github.com/slmbngl/OrderAplication/internal/routes"
 )
 
 func main() {
+	// Configuration (fails fast listing every invalid field)
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal("ERROR: ", err)
+	}
+
+	logLevel, _ := cfg.Log.SlogLevel()
+	slog.SetLogLoggerLevel(logLevel)
+
+	// Subcommands
+	if len(args) > 0 && args[0] == "migrate" {
+		runMigrate(cfg, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "bootstrap-admin" {
+		runBootstrapAdmin(cfg, args[1:])
+		return
+	}
+
 	// Database connection
-	db.Connect()
+	pool, err := db.Connect(cfg.Database)
+	if err != nil {
+		log.Fatal("ERROR: ", err)
+	}
+	defer pool.Close()
+
+	// Wire repositories, services and handlers
+	application, err := app.New(cfg, pool)
+	if err != nil {
+		log.Fatal("ERROR: ", err)
+	}
+
+	// Background jobs stop when main returns
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	application.Start(ctx)
 
 	// Initialize Fiber app
-	app := fiber.New()
+	server := fiber.New(fiber.Config{
+		ErrorHandler: middleware.ErrorHandler(cfg.Server.Environment == "production"),
+	})
 
 	// Middlewares
-	app.Use(logger.New())
-	app.Use(cors.New())
+	if logLevel <= slog.LevelInfo {
+		server.Use(logger.New())
+	}
+	server.Use(cors.New(cors.Config{
+		AllowOrigins: strings.Join(cfg.CORS.AllowOrigins, ","),
+	}))
 
 	// Setup routes
-	routes.SetupRoutes(app)
+	routes.SetupRoutes(server, application)
 	// START SERVER
-	log.Fatal(app.Listen(":4504"))
+	log.Fatal(server.Listen(cfg.Server.ListenAddr))
+}
+
+// runBootstrapAdmin handles "bootstrap-admin <username>", which creates the
+// first admin account. The password is read from the first line of stdin; if
+// that is empty a random password is generated and printed once.
+func runBootstrapAdmin(cfg *config.Config, args []string) {
+	if len(args) != 1 || args[0] == "" {
+		log.Fatal("usage: bootstrap-admin <username>")
+	}
+
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Print("Password (leave empty to generate one): ")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Fatal("ERROR: ", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	generated := password == ""
+	if generated {
+		b := make([]byte, 18)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatal("ERROR: ", err)
+		}
+		password = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	pool, err := db.Connect(cfg.Database)
+	if err != nil {
+		log.Fatal("ERROR: ", err)
+	}
+	defer pool.Close()
+
+	application, err := app.New(cfg, pool)
+	if err != nil {
+		log.Fatal("ERROR: ", err)
+	}
+
+	user, err := application.Invitations.BootstrapAdmin(args[0], password)
+	if err != nil {
+		log.Fatal("ERROR: ", err)
+	}
+
+	fmt.Printf("Admin %q created with id %d\n", user.Username, user.ID)
+	if generated {
+		fmt.Printf("Password: %s\n", password)
+	}
+}
+
+// runMigrate handles "migrate up", "migrate down [steps]" and "migrate status".
+func runMigrate(cfg *config.Config, args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: migrate up | down [steps] | status")
+	}
+
+	pool, err := db.Open(cfg.Database)
+	if err != nil {
+		log.Fatal("ERROR: ", err)
+	}
+	defer pool.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		if err := db.MigrateUp(ctx, pool); err != nil {
+			log.Fatal("ERROR: ", err)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatal("ERROR: steps must be a positive number")
+			}
+			steps = n
+		}
+		if err := db.MigrateDown(ctx, pool, steps); err != nil {
+			log.Fatal("ERROR: ", err)
+		}
+	case "status":
+		statuses, err := db.MigrationStatuses(ctx, pool)
+		if err != nil {
+			log.Fatal("ERROR: ", err)
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, state)
+		}
+	default:
+		log.Fatal("usage: migrate up | down [steps] | status")
+	}
 }